@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -16,6 +17,8 @@ import (
 
 var (
 	signals = make(chan os.Signal, 1)
+	reloads = make(chan os.Signal, 1)
+	dumps   = make(chan os.Signal, 1)
 	done    = make(chan bool, 1)
 )
 
@@ -41,18 +44,66 @@ func parse(data []byte) error {
 func main() {
 	log.SetFlags(log.LstdFlags)
 
+	configPath := flag.String("config", "", "path to the YAML config file")
+	flag.Parse()
+
+	cfg := server.DefaultConfig()
+	if *configPath != "" {
+		var err error
+		cfg, err = server.LoadConfig(*configPath)
+		if err != nil {
+			logging.Error("failed to load config: %v", err)
+			os.Exit(1)
+		}
+	}
+
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(reloads, syscall.SIGHUP)
+	signal.Notify(dumps, syscall.SIGUSR1)
 
 	ctx, cancelFn := context.WithCancel(context.Background())
 	defer cancelFn()
 
 	server.InitTransactionsTable()
 
+	if err := server.InitUpstreams(&cfg.Upstream, cfg.UpstreamGroups, cfg.ForwardRules); err != nil {
+		logging.Error("failed to initialize upstreams: %v", err)
+		os.Exit(1)
+	}
+
+	if err := server.InitRecursor(&cfg.Recursion); err != nil {
+		logging.Error("failed to initialize recursion: %v", err)
+		os.Exit(1)
+	}
+
+	if err := server.InitValidator(&cfg.DNSSEC); err != nil {
+		logging.Error("failed to initialize DNSSEC validation: %v", err)
+		os.Exit(1)
+	}
+
+	if err := server.InitTSIGKeys(cfg.TSIGKeys); err != nil {
+		logging.Error("failed to load TSIG keys: %v", err)
+		os.Exit(1)
+	}
+
+	if err := server.InitZones(cfg.Zones); err != nil {
+		logging.Error("failed to load zones: %v", err)
+		os.Exit(1)
+	}
+
+	if err := server.InitReverse(&cfg.Reverse); err != nil {
+		logging.Error("failed to initialize reverse lookups: %v", err)
+		os.Exit(1)
+	}
+
+	server.StartSecondaries(ctx)
+	server.StartSigning(ctx)
+
 	srvErrChan := make(chan error, 1)
 	procErrChan := make(chan error, 10)
 
 	// Resolve the string address to a UDP address
-	srv, err := server.NewServer()
+	srv, err := server.NewServer(cfg)
 	if err != nil {
 		logging.Error("failed to create server: ", err)
 		os.Exit(1)
@@ -61,25 +112,44 @@ func main() {
 	srv.Start(ctx, srvErrChan, procErrChan)
 
 	go func() {
-		select {
-		case <-signals:
-			logging.Info("Terminating...")
-
-			// Cancel background operations (periodic refresh, etc.)
-			cancelFn()
-
-			// Create timeout context for graceful shutdown
-			stopCtx, stopCancel := context.WithTimeout(context.Background(), shutdownTimeout)
-			defer stopCancel()
-
-			srv.Stop(stopCtx)
-			done <- true
-
-		case err := <-srvErrChan:
-			logging.Error("server start failed: ", err)
-			done <- true
-		case err := <-procErrChan:
-			logging.Error(err.Error())
+		for {
+			select {
+			case <-signals:
+				logging.Info("Terminating...")
+
+				// Cancel background operations (periodic refresh, etc.)
+				cancelFn()
+
+				// Create timeout context for graceful shutdown
+				stopCtx, stopCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				defer stopCancel()
+
+				srv.Stop(stopCtx)
+				done <- true
+				return
+
+			case <-reloads:
+				logging.Info("Reloading...")
+				if err := srv.Reload(); err != nil {
+					logging.Error("reload failed: %v", err)
+				}
+				if err := server.ReloadZones(cfg.Zones); err != nil {
+					logging.Error("zone reload failed: %v", err)
+				}
+
+			case <-dumps:
+				logging.Info("infrastructure cache:\n%s", server.Infra.String())
+				logging.Info("rejected replies: %s", server.RejectedReplies.String())
+
+			case err := <-srvErrChan:
+				logging.Error("server start failed: ", err)
+				done <- true
+				return
+			case err := <-procErrChan:
+				// keep draining processing errors, otherwise
+				// the goroutines reporting them block forever
+				logging.Error(err.Error())
+			}
 		}
 	}()
 
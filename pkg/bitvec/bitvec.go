@@ -6,7 +6,9 @@ import (
 	"io"
 )
 
-const MaxLength = 512
+// messages over TCP, TLS and HTTPS are length-prefixed
+// with 2 bytes so this is the biggest one we can get
+const MaxLength = 65535
 
 type BitVec struct {
 	data       []byte
@@ -91,7 +93,7 @@ func (v *BitVec) ReadBytes(n int) ([]byte, error) {
 		return nil, fmt.Errorf("can't read %d bytes", n)
 	}
 
-	if v.byteOffset >= 512 {
+	if v.byteOffset >= MaxLength {
 		return nil, errors.New("reached the end of the packet")
 	}
 
@@ -0,0 +1,338 @@
+package dnsmessage
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// record types of DNSSEC (RFC 4034, RFC 5155, RFC 7344)
+const (
+	TypeDS         RRType = 43 // Delegation signer
+	TypeRRSIG      RRType = 46 // Signature over an RRset
+	TypeNSEC       RRType = 47 // Next secure record
+	TypeDNSKEY     RRType = 48 // Public key of a zone
+	TypeNSEC3      RRType = 50 // Hashed next secure record
+	TypeNSEC3PARAM RRType = 51 // NSEC3 parameters of a zone
+	TypeCDS        RRType = 59 // Child copy of DS
+	TypeCDNSKEY    RRType = 60 // Child copy of DNSKEY
+)
+
+// base32 with the extended hex alphabet used for the hashed owner names of NSEC3
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// DS is the RDATA of a delegation signer record (RFC 4034, section 5),
+// CDS records have the same format.
+type DS struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+func UnpackDS(rdata []byte) (*DS, error) {
+	if len(rdata) < 5 {
+		return nil, errors.New("DS RDATA is too short")
+	}
+	return &DS{
+		KeyTag:     binary.BigEndian.Uint16(rdata),
+		Algorithm:  rdata[2],
+		DigestType: rdata[3],
+		Digest:     slices.Clone(rdata[4:]),
+	}, nil
+}
+
+func (d *DS) Pack() []byte {
+	b := binary.BigEndian.AppendUint16(nil, d.KeyTag)
+	b = append(b, d.Algorithm, d.DigestType)
+	return append(b, d.Digest...)
+}
+
+func (d *DS) String() string {
+	return fmt.Sprintf("%d %d %d %s", d.KeyTag, d.Algorithm, d.DigestType, strings.ToUpper(hex.EncodeToString(d.Digest)))
+}
+
+// DNSKEY is the RDATA of a public key record (RFC 4034, section 2),
+// CDNSKEY records have the same format.
+type DNSKEY struct {
+	Flags     uint16
+	Protocol  uint8 // always 3
+	Algorithm uint8
+	PublicKey []byte
+}
+
+const (
+	DNSKEYFlagZone = 0x0100 // the key signs zone data
+	DNSKEYFlagSEP  = 0x0001 // secure entry point, usually set on key signing keys
+)
+
+func UnpackDNSKEY(rdata []byte) (*DNSKEY, error) {
+	if len(rdata) < 5 {
+		return nil, errors.New("DNSKEY RDATA is too short")
+	}
+	return &DNSKEY{
+		Flags:     binary.BigEndian.Uint16(rdata),
+		Protocol:  rdata[2],
+		Algorithm: rdata[3],
+		PublicKey: slices.Clone(rdata[4:]),
+	}, nil
+}
+
+func (k *DNSKEY) Pack() []byte {
+	b := binary.BigEndian.AppendUint16(nil, k.Flags)
+	b = append(b, k.Protocol, k.Algorithm)
+	return append(b, k.PublicKey...)
+}
+
+func (k *DNSKEY) String() string {
+	return fmt.Sprintf("%d %d %d %s", k.Flags, k.Protocol, k.Algorithm, base64.StdEncoding.EncodeToString(k.PublicKey))
+}
+
+// RRSIG is the RDATA of a signature record (RFC 4034, section 3).
+type RRSIG struct {
+	TypeCovered RRType
+	Algorithm   uint8
+	Labels      uint8 // labels of the owner name without the root and a wildcard
+	OriginalTTL uint32
+	Expiration  uint32 // seconds since the epoch in serial number arithmetic
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  DomainName
+	Signature   []byte
+}
+
+func UnpackRRSIG(rdata []byte) (*RRSIG, error) {
+	if len(rdata) < 18 {
+		return nil, errors.New("RRSIG RDATA is too short")
+	}
+	signer, n, err := UnpackDomainName(rdata[18:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signer name: %w", err)
+	}
+	return &RRSIG{
+		TypeCovered: RRType(binary.BigEndian.Uint16(rdata)),
+		Algorithm:   rdata[2],
+		Labels:      rdata[3],
+		OriginalTTL: binary.BigEndian.Uint32(rdata[4:]),
+		Expiration:  binary.BigEndian.Uint32(rdata[8:]),
+		Inception:   binary.BigEndian.Uint32(rdata[12:]),
+		KeyTag:      binary.BigEndian.Uint16(rdata[16:]),
+		SignerName:  signer,
+		Signature:   slices.Clone(rdata[18+n:]),
+	}, nil
+}
+
+func (s *RRSIG) Pack() []byte {
+	return append(s.PackHeader(), s.Signature...)
+}
+
+// PackHeader returns the RDATA without the signature which
+// is the part of it covered by the signature itself.
+func (s *RRSIG) PackHeader() []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(s.TypeCovered))
+	b = append(b, s.Algorithm, s.Labels)
+	b = binary.BigEndian.AppendUint32(b, s.OriginalTTL)
+	b = binary.BigEndian.AppendUint32(b, s.Expiration)
+	b = binary.BigEndian.AppendUint32(b, s.Inception)
+	b = binary.BigEndian.AppendUint16(b, s.KeyTag)
+	return append(b, PackDomainName(s.SignerName)...)
+}
+
+func (s *RRSIG) String() string {
+	return fmt.Sprintf("%s %d %d %d %s %s %d %s. %s", s.TypeCovered, s.Algorithm, s.Labels, s.OriginalTTL,
+		formatSigTime(s.Expiration), formatSigTime(s.Inception), s.KeyTag,
+		DomainNameToString(s.SignerName), base64.StdEncoding.EncodeToString(s.Signature))
+}
+
+// formatSigTime formats a signature timestamp as YYYYMMDDHHmmSS in UTC.
+func formatSigTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format("20060102150405")
+}
+
+// NSEC is the RDATA of a next secure record (RFC 4034, section 4).
+type NSEC struct {
+	NextDomain DomainName
+	Types      []RRType // sorted
+}
+
+func UnpackNSEC(rdata []byte) (*NSEC, error) {
+	next, n, err := UnpackDomainName(rdata)
+	if err != nil {
+		return nil, fmt.Errorf("invalid next domain name: %w", err)
+	}
+	types, err := unpackTypeBitmap(rdata[n:])
+	if err != nil {
+		return nil, err
+	}
+	return &NSEC{NextDomain: next, Types: types}, nil
+}
+
+func (n *NSEC) Pack() []byte {
+	return append(PackDomainName(n.NextDomain), packTypeBitmap(n.Types)...)
+}
+
+func (n *NSEC) String() string {
+	return strings.TrimSpace(DomainNameToString(n.NextDomain) + ". " + typesString(n.Types))
+}
+
+// NSEC3 is the RDATA of a hashed next secure record (RFC 5155, section 3).
+type NSEC3 struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+	NextHashed    []byte // hash of the next owner name, unencoded
+	Types         []RRType
+}
+
+const NSEC3FlagOptOut = 0x01
+
+func UnpackNSEC3(rdata []byte) (*NSEC3, error) {
+	param, n, err := unpackNSEC3PARAM(rdata)
+	if err != nil {
+		return nil, err
+	}
+	if n >= len(rdata) || n+1+int(rdata[n]) > len(rdata) {
+		return nil, errors.New("NSEC3 next hashed owner name exceeds the data")
+	}
+	hashLength := int(rdata[n])
+	next := slices.Clone(rdata[n+1 : n+1+hashLength])
+	types, err := unpackTypeBitmap(rdata[n+1+hashLength:])
+	if err != nil {
+		return nil, err
+	}
+	return &NSEC3{
+		HashAlgorithm: param.HashAlgorithm,
+		Flags:         param.Flags,
+		Iterations:    param.Iterations,
+		Salt:          param.Salt,
+		NextHashed:    next,
+		Types:         types,
+	}, nil
+}
+
+func (n *NSEC3) Pack() []byte {
+	param := NSEC3PARAM{HashAlgorithm: n.HashAlgorithm, Flags: n.Flags, Iterations: n.Iterations, Salt: n.Salt}
+	b := append(param.Pack(), byte(len(n.NextHashed)))
+	b = append(b, n.NextHashed...)
+	return append(b, packTypeBitmap(n.Types)...)
+}
+
+func (n *NSEC3) String() string {
+	param := NSEC3PARAM{HashAlgorithm: n.HashAlgorithm, Flags: n.Flags, Iterations: n.Iterations, Salt: n.Salt}
+	return strings.TrimSpace(fmt.Sprintf("%s %s %s", param.String(), base32Hex.EncodeToString(n.NextHashed), typesString(n.Types)))
+}
+
+// NSEC3PARAM is the RDATA of the record announcing the NSEC3
+// parameters of a zone (RFC 5155, section 4).
+type NSEC3PARAM struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+}
+
+func UnpackNSEC3PARAM(rdata []byte) (*NSEC3PARAM, error) {
+	param, n, err := unpackNSEC3PARAM(rdata)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(rdata) {
+		return nil, errors.New("NSEC3PARAM RDATA has the wrong length")
+	}
+	return param, nil
+}
+
+// unpackNSEC3PARAM reads the fields NSEC3 and NSEC3PARAM have in common
+// and returns the number of bytes read.
+func unpackNSEC3PARAM(rdata []byte) (*NSEC3PARAM, int, error) {
+	if len(rdata) < 5 || 5+int(rdata[4]) > len(rdata) {
+		return nil, 0, errors.New("NSEC3 salt exceeds the data")
+	}
+	saltLength := int(rdata[4])
+	return &NSEC3PARAM{
+		HashAlgorithm: rdata[0],
+		Flags:         rdata[1],
+		Iterations:    binary.BigEndian.Uint16(rdata[2:]),
+		Salt:          slices.Clone(rdata[5 : 5+saltLength]),
+	}, 5 + saltLength, nil
+}
+
+func (p *NSEC3PARAM) Pack() []byte {
+	b := []byte{p.HashAlgorithm, p.Flags}
+	b = binary.BigEndian.AppendUint16(b, p.Iterations)
+	b = append(b, byte(len(p.Salt)))
+	return append(b, p.Salt...)
+}
+
+func (p *NSEC3PARAM) String() string {
+	salt := "-"
+	if len(p.Salt) > 0 {
+		salt = strings.ToUpper(hex.EncodeToString(p.Salt))
+	}
+	return fmt.Sprintf("%d %d %d %s", p.HashAlgorithm, p.Flags, p.Iterations, salt)
+}
+
+// packTypeBitmap encodes the types as window blocks of up to 256 types
+// each, leaving out empty blocks and trailing zero bytes (RFC 4034, section 4.1.2).
+func packTypeBitmap(types []RRType) []byte {
+	sorted := slices.Clone(types)
+	slices.Sort(sorted)
+	sorted = slices.Compact(sorted)
+
+	b := []byte{}
+	for i := 0; i < len(sorted); {
+		window := byte(sorted[i] >> 8)
+		bitmap := make([]byte, 32)
+		length := 0
+		for ; i < len(sorted) && byte(sorted[i]>>8) == window; i++ {
+			bit := sorted[i] & 0xFF
+			bitmap[bit/8] |= 0x80 >> (bit % 8)
+			length = int(bit/8) + 1
+		}
+		b = append(b, window, byte(length))
+		b = append(b, bitmap[:length]...)
+	}
+	return b
+}
+
+func unpackTypeBitmap(b []byte) ([]RRType, error) {
+	types := []RRType{}
+	last := -1
+	for offset := 0; offset < len(b); {
+		if offset+2 > len(b) {
+			return nil, errors.New("type bitmap window is truncated")
+		}
+		window, length := int(b[offset]), int(b[offset+1])
+		if window <= last {
+			return nil, errors.New("type bitmap windows are out of order")
+		}
+		if length == 0 || length > 32 || offset+2+length > len(b) {
+			return nil, fmt.Errorf("type bitmap window %d has an invalid length of %d", window, length)
+		}
+		for i, octet := range b[offset+2 : offset+2+length] {
+			for bit := range 8 {
+				if octet&(0x80>>bit) != 0 {
+					types = append(types, RRType(window<<8|i*8+bit))
+				}
+			}
+		}
+		last = window
+		offset += 2 + length
+	}
+	return types, nil
+}
+
+func typesString(types []RRType) string {
+	strs := make([]string, len(types))
+	for i, t := range types {
+		strs[i] = t.String()
+	}
+	return strings.Join(strs, " ")
+}
@@ -0,0 +1,97 @@
+package dnsmessage
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypeBitmap(t *testing.T) {
+	// example from RFC 4034, section 4.3
+	types := []RRType{TypeA, TypeMX, TypeRRSIG, TypeNSEC, 1234}
+	exp := append([]byte{0x00, 0x06, 0x40, 0x01, 0x00, 0x00, 0x00, 0x03, 0x04, 0x1b}, make([]byte, 26)...)
+	exp = append(exp, 0x20)
+
+	b := packTypeBitmap([]RRType{1234, TypeNSEC, TypeA, TypeMX, TypeRRSIG, TypeA})
+	assert.Equal(t, exp, b)
+
+	unpacked, err := unpackTypeBitmap(b)
+	assert.NoError(t, err)
+	assert.Equal(t, types, unpacked)
+
+	_, err = unpackTypeBitmap([]byte{0x00, 0x00})
+	assert.Error(t, err)
+	_, err = unpackTypeBitmap([]byte{0x01, 0x01, 0x80, 0x00, 0x01, 0x80})
+	assert.Error(t, err)
+	_, err = unpackTypeBitmap([]byte{0x00, 0x02, 0x40})
+	assert.Error(t, err)
+}
+
+func TestDNSSECRData(t *testing.T) {
+	digest, _ := hex.DecodeString("2bb183af5f22588179a53b0a98631fad1a292118")
+
+	tests := []struct {
+		rr  ResourceRecord
+		exp string
+	}{
+		{
+			rr:  ResourceRecord{Type: TypeDS, RData: (&DS{KeyTag: 60485, Algorithm: 5, DigestType: 1, Digest: digest}).Pack()},
+			exp: "60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118",
+		},
+		{
+			rr:  ResourceRecord{Type: TypeCDNSKEY, RData: (&DNSKEY{Flags: 257, Protocol: 3, Algorithm: 15, PublicKey: []byte{1, 2, 3}}).Pack()},
+			exp: "257 3 15 AQID",
+		},
+		{
+			rr: ResourceRecord{Type: TypeRRSIG, RData: (&RRSIG{
+				TypeCovered: TypeA, Algorithm: 5, Labels: 3, OriginalTTL: 86400,
+				Expiration: 1048354263, Inception: 1045762263, KeyTag: 2642,
+				SignerName: Domain("example", "com"), Signature: []byte{1, 2, 3},
+			}).Pack()},
+			exp: "A 5 3 86400 20030322173103 20030220173103 2642 example.com. AQID",
+		},
+		{
+			rr:  ResourceRecord{Type: TypeNSEC, RData: (&NSEC{NextDomain: Domain("host", "example", "com"), Types: []RRType{TypeA, TypeMX, TypeRRSIG, TypeNSEC}}).Pack()},
+			exp: "host.example.com. A MX RRSIG NSEC",
+		},
+		{
+			rr: ResourceRecord{Type: TypeNSEC3, RData: (&NSEC3{
+				HashAlgorithm: 1, Flags: NSEC3FlagOptOut, Iterations: 12, Salt: []byte{0xaa, 0xbb, 0xcc, 0xdd},
+				NextHashed: []byte{0x0d, 0xbb, 0x2c}, Types: []RRType{TypeNS, TypeDS, TypeRRSIG},
+			}).Pack()},
+			exp: "1 1 12 AABBCCDD 1MTIO NS DS RRSIG",
+		},
+		{
+			rr:  ResourceRecord{Type: TypeNSEC3PARAM, RData: (&NSEC3PARAM{HashAlgorithm: 1, Iterations: 0}).Pack()},
+			exp: "1 0 0 -",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rr.Type.String(), func(t *testing.T) {
+			assert.Equal(t, tt.exp, tt.rr.RDataString())
+		})
+	}
+}
+
+func TestUnpackDNSSECRoundTrip(t *testing.T) {
+	sig := RRSIG{
+		TypeCovered: TypeDNSKEY, Algorithm: 13, Labels: 0, OriginalTTL: 172800,
+		Expiration: 1, Inception: 2, KeyTag: 20326, SignerName: DomainName{}, Signature: []byte{9, 9},
+	}
+	parsedSig, err := UnpackRRSIG(sig.Pack())
+	assert.NoError(t, err)
+	assert.Equal(t, sig, *parsedSig)
+
+	nsec3 := NSEC3{HashAlgorithm: 1, Iterations: 1, Salt: []byte{}, NextHashed: []byte{1, 2}, Types: []RRType{}}
+	parsedNSEC3, err := UnpackNSEC3(nsec3.Pack())
+	assert.NoError(t, err)
+	assert.Equal(t, nsec3, *parsedNSEC3)
+
+	_, err = UnpackNSEC3([]byte{1, 0, 0, 1, 4, 0xaa})
+	assert.Error(t, err)
+	_, err = UnpackNSEC3PARAM(append((&NSEC3PARAM{HashAlgorithm: 1}).Pack(), 0))
+	assert.Error(t, err)
+	_, err = UnpackRRSIG(make([]byte, 17))
+	assert.Error(t, err)
+}
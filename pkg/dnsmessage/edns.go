@@ -0,0 +1,49 @@
+package dnsmessage
+
+// TypeOPT is the pseudo record carrying EDNS (RFC 6891). Its class holds
+// the UDP payload size of the sender and its TTL the extended flags.
+const TypeOPT RRType = 41
+
+const (
+	// bits of the Z field in the header (RFC 4035, section 3.2)
+	ZAuthenticData    = 0b010
+	ZCheckingDisabled = 0b001
+
+	ednsDO = 0x8000 // DNSSEC OK, the first of the extended flags
+)
+
+// NewOPT returns an OPT record advertising the UDP payload size,
+// with the DO bit set if the sender wants DNSSEC records.
+func NewOPT(udpSize uint16, do bool) *ResourceRecord {
+	opt := &ResourceRecord{Name: DomainName{}, Type: TypeOPT, Class: RRClass(udpSize)}
+	if do {
+		opt.TTL = ednsDO
+	}
+	return opt
+}
+
+// OPT returns the OPT record of the message or nil if it has none.
+func (m *DNSMessage) OPT() *ResourceRecord {
+	for _, rr := range m.AdditonalRecords {
+		if rr.Type == TypeOPT {
+			return rr
+		}
+	}
+	return nil
+}
+
+// DO reports whether the sender of the message asked for DNSSEC records.
+func (m *DNSMessage) DO() bool {
+	opt := m.OPT()
+	return opt != nil && opt.TTL&ednsDO != 0
+}
+
+// AD reports whether the authentic data bit is set.
+func (h *Header) AD() bool {
+	return h.Z&ZAuthenticData != 0
+}
+
+// CD reports whether the checking disabled bit is set.
+func (h *Header) CD() bool {
+	return h.Z&ZCheckingDisabled != 0
+}
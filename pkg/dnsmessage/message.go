@@ -1,7 +1,11 @@
 package dnsmessage
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"net/netip"
+	"strconv"
 	"strings"
 
 	"server/pkg/log"
@@ -38,12 +42,41 @@ const (
 	TypeTXT   RRType = 16 // Text strings
 
 	TypeAAAA RRType = 28 // IPv6
+
+	// types only found in questions
+	TypeIXFR RRType = 251 // Incremental zone transfer (RFC 1995)
+	TypeAXFR RRType = 252 // Full zone transfer (RFC 5936)
+	TypeANY  RRType = 255 // All records
+)
+
+const (
+	RCodeNoError        RCode = 0
+	RCodeFormatError    RCode = 1
+	RCodeServerFailure  RCode = 2
+	RCodeNameError      RCode = 3
+	RCodeNotImplemented RCode = 4
+	RCodeRefused        RCode = 5
+	// response codes of dynamic updates (RFC 2136, section 2.2)
+	RCodeYXDomain RCode = 6
+	RCodeYXRRSet  RCode = 7
+	RCodeNXRRSet  RCode = 8
+	RCodeNotAuth  RCode = 9
+	RCodeNotZone  RCode = 10
+)
+
+const (
+	OpCodeQuery  = 0
+	OpCodeNotify = 4 // Zone change notification (RFC 1996)
+	OpCodeUpdate = 5 // Dynamic update (RFC 2136)
 )
 
 const (
 	ClassIN RRClass = 1
 	ClassCH RRClass = 3
 	ClassHS RRClass = 4
+	// classes of prerequisites and updates (RFC 2136, section 2.4 and 2.5)
+	ClassNONE RRClass = 254
+	ClassANY  RRClass = 255
 )
 
 type Header struct {
@@ -167,6 +200,33 @@ func (c RCode) String() string {
 		return "4 - not implemented"
 	case 5:
 		return "5 - refused"
+	case 6:
+		// A name exists that ought not to.
+		return "6 - name exists"
+	case 7:
+		// An RRset exists that ought not to.
+		return "7 - RRset exists"
+	case 8:
+		// An RRset that ought to exist does not.
+		return "8 - RRset does not exist"
+	case 9:
+		// The server is not authoritative for the zone.
+		return "9 - not authoritative"
+	case 10:
+		// A name is not within the zone of the update.
+		return "10 - not in zone"
+	case 16:
+		// The MAC of the TSIG record doesn't match.
+		return "16 - bad signature"
+	case 17:
+		// The key of the TSIG record is not known.
+		return "17 - bad key"
+	case 18:
+		// The TSIG record was signed outside of the time allowed.
+		return "18 - bad time"
+	case 22:
+		// The MAC of the TSIG record was truncated too much.
+		return "22 - bad truncation"
 	default:
 		return fmt.Sprintf("UNKNOWN(%d)", int(c))
 	}
@@ -185,31 +245,114 @@ func (rr *ResourceRecord) String() string {
 		return ""
 	}
 
-	var rdata string
+	rdata := rr.RDataString()
+
+	return fmt.Sprintf(`
+Resource Record:
+  Name: %s
+  Type: %s
+  Class: %s
+  TTL: %d sec
+  RData Length: %d
+  RData: `, DomainNameToString(rr.Name), rr.Type, rr.Class, rr.TTL, rr.RdLength) + rdata
+}
 
+// RDataString returns the RDATA in presentation format.
+func (rr *ResourceRecord) RDataString() string {
 	switch rr.Type {
-	case TypeA, TypeAAAA:
+	case TypeA:
+		var rdata string
 		for i, b := range rr.RData {
 			rdata += fmt.Sprintf("%d", b)
 			if i < len(rr.RData)-1 {
 				rdata += "."
 			}
 		}
-	case TypeCNAME, TypeNS:
-		for _, b := range rr.RData {
-			rdata += string(b)
+		return rdata
+	case TypeAAAA:
+		if addr, ok := netip.AddrFromSlice(rr.RData); ok {
+			return addr.String()
+		}
+	case TypeNS, TypeMD, TypeMF, TypeCNAME, TypeMB, TypeMG, TypeMR, TypePTR:
+		if name, _, err := UnpackDomainName(rr.RData); err == nil {
+			return DomainNameToString(name) + "."
+		}
+	case TypeMINFO:
+		if names, ok := unpackNames(rr.RData, 2); ok {
+			return names[0] + " " + names[1]
+		}
+	case TypeMX:
+		if len(rr.RData) > 2 {
+			if name, _, err := UnpackDomainName(rr.RData[2:]); err == nil {
+				return fmt.Sprintf("%d %s.", binary.BigEndian.Uint16(rr.RData), DomainNameToString(name))
+			}
+		}
+	case TypeSOA:
+		if soa, err := UnpackSOA(rr.RData); err == nil {
+			return soa.String()
+		}
+	case TypeTXT, TypeHINFO:
+		if strs, err := unpackCharacterStrings(rr.RData); err == nil {
+			quoted := make([]string, len(strs))
+			for i, str := range strs {
+				quoted[i] = strconv.Quote(str)
+			}
+			return strings.Join(quoted, " ")
+		}
+	case TypeDS, TypeCDS:
+		if ds, err := UnpackDS(rr.RData); err == nil {
+			return ds.String()
+		}
+	case TypeDNSKEY, TypeCDNSKEY:
+		if key, err := UnpackDNSKEY(rr.RData); err == nil {
+			return key.String()
+		}
+	case TypeRRSIG:
+		if sig, err := UnpackRRSIG(rr.RData); err == nil {
+			return sig.String()
+		}
+	case TypeNSEC:
+		if nsec, err := UnpackNSEC(rr.RData); err == nil {
+			return nsec.String()
+		}
+	case TypeNSEC3:
+		if nsec3, err := UnpackNSEC3(rr.RData); err == nil {
+			return nsec3.String()
+		}
+	case TypeNSEC3PARAM:
+		if param, err := UnpackNSEC3PARAM(rr.RData); err == nil {
+			return param.String()
 		}
-		// TODO: implement the rest
 	}
+	// generic format from RFC 3597, section 5
+	return fmt.Sprintf("\\# %d %x", len(rr.RData), rr.RData)
+}
 
-	return fmt.Sprintf(`
-Resource Record:
-  Name: %s
-  Type: %s
-  Class: %s
-  TTL: %d sec
-  RData Length: %d
-  RData: `, DomainNameToString(rr.Name), rr.Type, rr.Class, rr.TTL, rr.RdLength) + rdata
+func unpackNames(b []byte, n int) ([]string, bool) {
+	names := make([]string, 0, n)
+	offset := 0
+	for range n {
+		name, read, err := UnpackDomainName(b[offset:])
+		if err != nil {
+			return nil, false
+		}
+		names = append(names, DomainNameToString(name)+".")
+		offset += read
+	}
+	return names, true
+}
+
+func unpackCharacterStrings(b []byte) ([]string, error) {
+	strs := []string{}
+	for offset := 0; offset < len(b); {
+		length := int(b[offset])
+		if offset+1+length > len(b) {
+			return nil, errors.New("character string exceeds the data")
+		}
+		strs = append(strs, string(b[offset+1:offset+1+length]))
+		offset += 1 + length
+	}
+	return strs, nil
 }
 
 func DomainNameToString(name DomainName) string {
@@ -246,6 +389,10 @@ func OpCodeToString(c uint64) string {
 		return "inverse query"
 	case 2:
 		return "server status request"
+	case 4:
+		return "notify"
+	case 5:
+		return "update"
 	default:
 		return fmt.Sprintf("UNKNOWN(%d)", int(c))
 	}
@@ -259,6 +406,10 @@ func (c RRClass) String() string {
 		return "CH"
 	case ClassHS:
 		return "HS"
+	case ClassNONE:
+		return "NONE"
+	case ClassANY:
+		return "ANY"
 	default:
 		return fmt.Sprintf("UNKNOWN(%d)", c)
 	}
@@ -300,11 +451,77 @@ func (t RRType) String() string {
 		return "TXT"
 	case TypeAAAA:
 		return "AAAA"
+	case TypeOPT:
+		return "OPT"
+	case TypeDS:
+		return "DS"
+	case TypeRRSIG:
+		return "RRSIG"
+	case TypeNSEC:
+		return "NSEC"
+	case TypeDNSKEY:
+		return "DNSKEY"
+	case TypeNSEC3:
+		return "NSEC3"
+	case TypeNSEC3PARAM:
+		return "NSEC3PARAM"
+	case TypeCDS:
+		return "CDS"
+	case TypeCDNSKEY:
+		return "CDNSKEY"
+	case TypeTSIG:
+		return "TSIG"
+	case TypeIXFR:
+		return "IXFR"
+	case TypeAXFR:
+		return "AXFR"
+	case TypeANY:
+		return "ANY"
 	default:
 		return fmt.Sprintf("UNKNOWN(%d)", t)
 	}
 }
 
+// types known by their mnemonic
+var knownTypes = []RRType{
+	TypeA, TypeNS, TypeMD, TypeMF, TypeCNAME, TypeSOA, TypeMB, TypeMG, TypeMR, TypeNULL, TypeWKS,
+	TypePTR, TypeHINFO, TypeMINFO, TypeMX, TypeTXT, TypeAAAA, TypeOPT,
+	TypeDS, TypeRRSIG, TypeNSEC, TypeDNSKEY, TypeNSEC3, TypeNSEC3PARAM, TypeCDS, TypeCDNSKEY,
+}
+
+// ParseRRType returns the type with the mnemonic or written as TYPEnnn
+// (RFC 3597, section 5), case-insensitively.
+func ParseRRType(s string) (RRType, bool) {
+	s = strings.ToUpper(s)
+	for _, t := range knownTypes {
+		if t.String() == s {
+			return t, true
+		}
+	}
+	if n, ok := strings.CutPrefix(s, "TYPE"); ok {
+		if v, err := strconv.ParseUint(n, 10, 16); err == nil {
+			return RRType(v), true
+		}
+	}
+	return 0, false
+}
+
+// ParseRRClass returns the class with the mnemonic or written as CLASSnnn.
+func ParseRRClass(s string) (RRClass, bool) {
+	s = strings.ToUpper(s)
+	for _, c := range []RRClass{ClassIN, ClassCH, ClassHS} {
+		if c.String() == s {
+			return c, true
+		}
+	}
+	if n, ok := strings.CutPrefix(s, "CLASS"); ok {
+		if v, err := strconv.ParseUint(n, 10, 16); err == nil {
+			return RRClass(v), true
+		}
+	}
+	return 0, false
+}
+
 func Domain(labels ...string) DomainName {
 	dn := make(DomainName, len(labels))
 	for i, l := range labels {
@@ -0,0 +1,36 @@
+package dnsmessage
+
+import (
+	"bytes"
+	"strings"
+)
+
+// ParseDomainName converts a domain name in presentation format
+// like "www.example.com." into labels. The root is "." or "".
+func ParseDomainName(s string) DomainName {
+	s = strings.TrimSuffix(strings.TrimSpace(s), ".")
+	if s == "" {
+		return DomainName{}
+	}
+	return Domain(strings.Split(s, ".")...)
+}
+
+// IsSubdomain reports whether name is equal to or below parent.
+// Labels are compared case-insensitively.
+func IsSubdomain(name, parent DomainName) bool {
+	if len(parent) > len(name) {
+		return false
+	}
+	offset := len(name) - len(parent)
+	for i, label := range parent {
+		if !bytes.EqualFold(name[offset+i], label) {
+			return false
+		}
+	}
+	return true
+}
+
+// EqualNames compares two domain names case-insensitively.
+func EqualNames(a, b DomainName) bool {
+	return len(a) == len(b) && IsSubdomain(a, b)
+}
@@ -0,0 +1,172 @@
+package dnsmessage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	HeaderLength     = 12 // in bytes
+	MaxMessageLength = 65535
+	maxLabelLength   = 63
+	maxPointer       = 0x3FFF // biggest offset a compression pointer can hold
+)
+
+// Pack serializes the header into its 12 byte wire format.
+func (h *Header) Pack() []byte {
+	b := make([]byte, HeaderLength)
+	binary.BigEndian.PutUint16(b[0:], uint16(h.ID))
+
+	flags := uint16(h.QR&1)<<15 |
+		uint16(h.OpCode&0xF)<<11 |
+		uint16(h.AA&1)<<10 |
+		uint16(h.TC&1)<<9 |
+		uint16(h.RD&1)<<8 |
+		uint16(h.RA&1)<<7 |
+		uint16(h.Z&0x7)<<4 |
+		uint16(h.RCode&0xF)
+	binary.BigEndian.PutUint16(b[2:], flags)
+
+	binary.BigEndian.PutUint16(b[4:], uint16(h.QdCount))
+	binary.BigEndian.PutUint16(b[6:], uint16(h.AnCount))
+	binary.BigEndian.PutUint16(b[8:], uint16(h.NSCount))
+	binary.BigEndian.PutUint16(b[10:], uint16(h.ARCount))
+	return b
+}
+
+// Pack serializes the question into its wire format without compression.
+func (q *Question) Pack() []byte {
+	b := PackDomainName(q.QName)
+	b = binary.BigEndian.AppendUint16(b, uint16(q.QType))
+	b = binary.BigEndian.AppendUint16(b, uint16(q.QClass))
+	return b
+}
+
+// PackDomainName serializes a domain name as a sequence of
+// length-prefixed labels terminated by the root label.
+func PackDomainName(name DomainName) []byte {
+	b := make([]byte, 0, len(name)*8+1)
+	for _, label := range name {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// NewErrorResponse builds a response to the query m carrying no
+// records but the question and the given response code.
+func NewErrorResponse(m *DNSMessage, rcode RCode) []byte {
+	h := *m.Header
+	h.QR = 1
+	h.AA = 0
+	h.TC = 0
+	h.RA = 1
+	h.Z = 0
+	h.RCode = rcode
+	h.AnCount = 0
+	h.NSCount = 0
+	h.ARCount = 0
+
+	if m.Question == nil {
+		h.QdCount = 0
+		return h.Pack()
+	}
+	h.QdCount = 1
+	return append(h.Pack(), m.Question.Pack()...)
+}
+
+// Pack serializes the message into its wire format. The section counts are
+// taken from the slices, not the header. Owner names and the question name
+// are compressed (RFC 1035, section 4.1.4), RDATA is written as it is.
+func (m *DNSMessage) Pack() ([]byte, error) {
+	h := *m.Header
+	h.QdCount = 0
+	if m.Question != nil {
+		h.QdCount = 1
+	}
+	h.AnCount = uint32(len(m.Answers))
+	h.NSCount = uint32(len(m.AuthorityRecords))
+	h.ARCount = uint32(len(m.AdditonalRecords))
+
+	p := packer{buf: h.Pack(), names: make(map[string]int)}
+	if m.Question != nil {
+		p.name(m.Question.QName)
+		p.buf = binary.BigEndian.AppendUint16(p.buf, uint16(m.Question.QType))
+		p.buf = binary.BigEndian.AppendUint16(p.buf, uint16(m.Question.QClass))
+	}
+
+	for _, section := range []ResourceRecords{m.Answers, m.AuthorityRecords, m.AdditonalRecords} {
+		for _, rr := range section {
+			if err := p.rr(rr); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(p.buf) > MaxMessageLength {
+		return nil, fmt.Errorf("packed message of %d bytes exceeds %d bytes", len(p.buf), MaxMessageLength)
+	}
+	return p.buf, nil
+}
+
+type packer struct {
+	buf []byte
+	// offsets of the names written so far keyed by their lower case form
+	names map[string]int
+}
+
+func (p *packer) name(name DomainName) {
+	for i := range name {
+		key := strings.ToLower(DomainNameToString(name[i:]))
+		if offset, ok := p.names[key]; ok {
+			p.buf = binary.BigEndian.AppendUint16(p.buf, 0xC000|uint16(offset))
+			return
+		}
+		if len(p.buf) <= maxPointer {
+			p.names[key] = len(p.buf)
+		}
+		p.buf = append(p.buf, byte(len(name[i])))
+		p.buf = append(p.buf, name[i]...)
+	}
+	p.buf = append(p.buf, 0)
+}
+
+func (p *packer) rr(rr *ResourceRecord) error {
+	if len(rr.RData) > 0xFFFF {
+		return fmt.Errorf("RDATA of %d bytes is too long", len(rr.RData))
+	}
+	p.name(rr.Name)
+	p.buf = binary.BigEndian.AppendUint16(p.buf, uint16(rr.Type))
+	p.buf = binary.BigEndian.AppendUint16(p.buf, uint16(rr.Class))
+	p.buf = binary.BigEndian.AppendUint32(p.buf, rr.TTL)
+	p.buf = binary.BigEndian.AppendUint16(p.buf, uint16(len(rr.RData)))
+	p.buf = append(p.buf, rr.RData...)
+	return nil
+}
+
+// UnpackDomainName reads an uncompressed domain name from the start of b
+// as it is stored in RDATA. It returns the name and the number of bytes read.
+func UnpackDomainName(b []byte) (DomainName, int, error) {
+	name := DomainName{}
+	offset := 0
+	for {
+		if offset >= len(b) {
+			return nil, 0, errors.New("domain name is not terminated")
+		}
+		length := int(b[offset])
+		offset++
+		if length == 0 {
+			return name, offset, nil
+		}
+		if length > maxLabelLength {
+			return nil, 0, fmt.Errorf("label of %d bytes is too long", length)
+		}
+		if offset+length > len(b) {
+			return nil, 0, errors.New("label exceeds the data")
+		}
+		name = append(name, b[offset:offset+length])
+		offset += length
+	}
+}
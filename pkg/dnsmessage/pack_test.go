@@ -0,0 +1,45 @@
+package dnsmessage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPackHeader(t *testing.T) {
+	h := Header{ID: 0xdeb1, QR: 1, OpCode: 0, RD: 1, RA: 1, RCode: RCodeNameError, QdCount: 1, AnCount: 2}
+	assert.Equal(t, []byte{0xde, 0xb1, 0x81, 0x83, 0, 1, 0, 2, 0, 0, 0, 0}, h.Pack())
+}
+
+func TestPackCompressesNames(t *testing.T) {
+	m := DNSMessage{
+		Header:   &Header{ID: 1},
+		Question: &Question{QName: Domain("www", "Pianykh", "xyz"), QType: TypeA, QClass: ClassIN},
+		Answers: ResourceRecords{
+			{Name: Domain("www", "pianykh", "xyz"), Type: TypeA, Class: ClassIN, TTL: 60, RData: []byte{1, 2, 3, 4}},
+			{Name: Domain("mail", "pianykh", "xyz"), Type: TypeA, Class: ClassIN, TTL: 60, RData: []byte{1, 2, 3, 5}},
+		},
+	}
+	data, err := m.Pack()
+	assert.NoError(t, err)
+
+	question := []byte("\x03www\x07Pianykh\x03xyz\x00\x00\x01\x00\x01")
+	assert.Equal(t, question, data[HeaderLength:HeaderLength+len(question)])
+
+	answers := data[HeaderLength+len(question):]
+	// the whole name points to the question
+	assert.Equal(t, []byte{0xC0, 12}, answers[:2])
+	// "mail" followed by a pointer to "pianykh.xyz"
+	second := answers[2+10+4:]
+	assert.Equal(t, []byte("\x04mail\xC0\x10"), second[:7])
+}
+
+func TestUnpackDomainName(t *testing.T) {
+	name, n, err := UnpackDomainName([]byte("\x07pianykh\x03xyz\x00rest"))
+	assert.NoError(t, err)
+	assert.Equal(t, 13, n)
+	assert.Equal(t, Domain("pianykh", "xyz"), name)
+
+	_, _, err = UnpackDomainName([]byte("\x07pianykh\x03xy"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,57 @@
+package dnsmessage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// SOA is the RDATA of a start of authority record (RFC 1035, section 3.3.13).
+type SOA struct {
+	MName   DomainName // primary name server of the zone
+	RName   DomainName // mailbox of the person responsible for the zone
+	Serial  uint32
+	Refresh uint32 // seconds
+	Retry   uint32 // seconds
+	Expire  uint32 // seconds
+	Minimum uint32 // seconds, TTL for negative answers (RFC 2308)
+}
+
+func UnpackSOA(rdata []byte) (*SOA, error) {
+	mname, n, err := UnpackDomainName(rdata)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MNAME: %w", err)
+	}
+	rname, m, err := UnpackDomainName(rdata[n:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid RNAME: %w", err)
+	}
+	rest := rdata[n+m:]
+	if len(rest) != 20 {
+		return nil, errors.New("SOA RDATA has the wrong length")
+	}
+
+	return &SOA{
+		MName:   mname,
+		RName:   rname,
+		Serial:  binary.BigEndian.Uint32(rest[0:]),
+		Refresh: binary.BigEndian.Uint32(rest[4:]),
+		Retry:   binary.BigEndian.Uint32(rest[8:]),
+		Expire:  binary.BigEndian.Uint32(rest[12:]),
+		Minimum: binary.BigEndian.Uint32(rest[16:]),
+	}, nil
+}
+
+func (s *SOA) Pack() []byte {
+	b := PackDomainName(s.MName)
+	b = append(b, PackDomainName(s.RName)...)
+	for _, v := range []uint32{s.Serial, s.Refresh, s.Retry, s.Expire, s.Minimum} {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+func (s *SOA) String() string {
+	return fmt.Sprintf("%s. %s. %d %d %d %d %d", DomainNameToString(s.MName), DomainNameToString(s.RName),
+		s.Serial, s.Refresh, s.Retry, s.Expire, s.Minimum)
+}
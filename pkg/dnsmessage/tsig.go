@@ -0,0 +1,75 @@
+package dnsmessage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// TypeTSIG is the type of transaction signatures, only found
+// at the end of the additional section (RFC 8945).
+const TypeTSIG RRType = 250
+
+// extended response codes, only found in the error field of TSIG records
+// (RFC 8945, section 3)
+const (
+	RCodeBadSig   RCode = 16
+	RCodeBadKey   RCode = 17
+	RCodeBadTime  RCode = 18
+	RCodeBadTrunc RCode = 22
+)
+
+// TSIG is the RDATA of a transaction signature (RFC 8945, section 4.2).
+type TSIG struct {
+	Algorithm  DomainName
+	TimeSigned uint64 // seconds since the epoch, 48 bits
+	Fudge      uint16 // seconds the time may be off
+	MAC        []byte
+	OriginalID uint16
+	Error      RCode
+	OtherData  []byte
+}
+
+func UnpackTSIG(rdata []byte) (*TSIG, error) {
+	alg, n, err := UnpackDomainName(rdata)
+	if err != nil {
+		return nil, fmt.Errorf("invalid algorithm name: %w", err)
+	}
+	rest := rdata[n:]
+	if len(rest) < 10 {
+		return nil, errors.New("TSIG RDATA is too short")
+	}
+	t := &TSIG{
+		Algorithm:  alg,
+		TimeSigned: uint64(binary.BigEndian.Uint16(rest))<<32 | uint64(binary.BigEndian.Uint32(rest[2:])),
+		Fudge:      binary.BigEndian.Uint16(rest[6:]),
+	}
+	macSize := int(binary.BigEndian.Uint16(rest[8:]))
+	rest = rest[10:]
+	if len(rest) < macSize+6 {
+		return nil, errors.New("TSIG RDATA is too short")
+	}
+	t.MAC = rest[:macSize]
+	rest = rest[macSize:]
+	t.OriginalID = binary.BigEndian.Uint16(rest)
+	t.Error = RCode(binary.BigEndian.Uint16(rest[2:]))
+	otherLen := int(binary.BigEndian.Uint16(rest[4:]))
+	if len(rest[6:]) != otherLen {
+		return nil, errors.New("TSIG RDATA has the wrong length")
+	}
+	t.OtherData = rest[6:]
+	return t, nil
+}
+
+func (t *TSIG) Pack() []byte {
+	b := PackDomainName(t.Algorithm)
+	b = binary.BigEndian.AppendUint16(b, uint16(t.TimeSigned>>32))
+	b = binary.BigEndian.AppendUint32(b, uint32(t.TimeSigned))
+	b = binary.BigEndian.AppendUint16(b, t.Fudge)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(t.MAC)))
+	b = append(b, t.MAC...)
+	b = binary.BigEndian.AppendUint16(b, t.OriginalID)
+	b = binary.BigEndian.AppendUint16(b, uint16(t.Error))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(t.OtherData)))
+	return append(b, t.OtherData...)
+}
@@ -0,0 +1,127 @@
+package dnssec
+
+import (
+	"time"
+
+	"server/pkg/dnsmessage"
+)
+
+// proofs of nonexistence kept for synthesizing answers
+const maxNegativeEntries = 256
+
+// negativeEntry is the validated authority section of a negative response.
+// Its NSEC or NSEC3 records may prove other names not to exist as well, so
+// that they can be answered without asking upstream (RFC 8198).
+type negativeEntry struct {
+	zone    dnsmessage.DomainName
+	records dnsmessage.ResourceRecords // SOA, NSEC and NSEC3 records with their signatures
+	nsecs   []nsecRecord
+	nsec3s  []nsec3Record
+	stored  time.Time
+	expires time.Time
+}
+
+// remember keeps the proof of a secure negative response. It is used for
+// as long as the negative answer itself may be cached (RFC 8198, section 5.4).
+// Only the records of the zone of the response are kept along with the
+// signatures that verified, other records in the response prove nothing.
+func (v *Validator) remember(p *proof, now time.Time) {
+	if !v.aggressive || p.zone == nil {
+		return
+	}
+
+	e := negativeEntry{zone: p.zone, records: p.records, nsecs: p.nsecs, nsec3s: p.nsec3s, stored: now}
+	ttl := maxCacheTTL
+	hasSOA := false
+	for _, rr := range p.records {
+		if rr.Type == dnsmessage.TypeSOA {
+			soa, err := dnsmessage.UnpackSOA(rr.RData)
+			if err != nil {
+				return
+			}
+			hasSOA = true
+			ttl = min(ttl, time.Duration(soa.Minimum)*time.Second)
+		}
+		ttl = min(ttl, time.Duration(rr.TTL)*time.Second)
+	}
+	if !hasSOA || ttl <= 0 {
+		// the SOA is needed for the synthesized answers
+		return
+	}
+	e.expires = now.Add(ttl)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	// a new slice, Synthesize may still be reading the old one
+	kept := make([]negativeEntry, 0, len(v.negative)+1)
+	for _, old := range v.negative {
+		if now.Before(old.expires) {
+			kept = append(kept, old)
+		}
+	}
+	if len(kept) >= maxNegativeEntries {
+		kept = kept[1:]
+	}
+	v.negative = append(kept, e)
+}
+
+// Synthesize answers the question with NXDOMAIN or NODATA if a cached
+// proof of nonexistence covers it. It returns nil if none does.
+func (v *Validator) Synthesize(q *dnsmessage.Question) *dnsmessage.DNSMessage {
+	if !v.aggressive || q.QClass != dnsmessage.ClassIN {
+		return nil
+	}
+
+	now := time.Now()
+	v.mu.Lock()
+	entries := v.negative
+	v.mu.Unlock()
+
+	// the newest proofs are the most likely to be still accurate
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if !now.Before(e.expires) || !dnsmessage.IsSubdomain(q.QName, e.zone) {
+			continue
+		}
+		rcode, ok := e.proves(q)
+		if !ok {
+			continue
+		}
+
+		// the records age while they are cached
+		remaining := uint32(e.expires.Sub(now) / time.Second)
+		authority := make(dnsmessage.ResourceRecords, 0, len(e.records))
+		for _, rr := range e.records {
+			aged := *rr
+			aged.TTL = min(rr.TTL, remaining)
+			authority = append(authority, &aged)
+		}
+		return &dnsmessage.DNSMessage{
+			Header:           &dnsmessage.Header{QR: 1, RA: 1, RCode: rcode},
+			Question:         q,
+			AuthorityRecords: authority,
+		}
+	}
+	return nil
+}
+
+func (e *negativeEntry) proves(q *dnsmessage.Question) (dnsmessage.RCode, bool) {
+	if len(e.nsecs) > 0 {
+		switch {
+		case nsecNXDomain(e.nsecs, q.QName):
+			return dnsmessage.RCodeNameError, true
+		case nsecNoData(e.nsecs, q.QName, q.QType):
+			return dnsmessage.RCodeNoError, true
+		}
+		return 0, false
+	}
+
+	// opt-out spans only prove that there is no signed delegation
+	switch {
+	case nsec3NXDomain(e.nsec3s, q.QName) == Secure:
+		return dnsmessage.RCodeNameError, true
+	case nsec3NoData(e.nsec3s, q.QName, q.QType) == Secure:
+		return dnsmessage.RCodeNoError, true
+	}
+	return 0, false
+}
@@ -0,0 +1,112 @@
+package dnssec
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"server/pkg/dnsmessage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSynthesize(t *testing.T) {
+	w, v := newTestWorld(t)
+	v.aggressive = true
+
+	question := func(name string, qtype dnsmessage.RRType) *dnsmessage.Question {
+		return &dnsmessage.Question{QName: dnsmessage.ParseDomainName(name), QType: qtype, QClass: dnsmessage.ClassIN}
+	}
+	assert.Nil(t, v.Synthesize(question("nx.test", dnsmessage.TypeA)))
+
+	for _, q := range []*dnsmessage.Question{question("nx.test", dnsmessage.TypeA), question("nx.secure.test", dnsmessage.TypeA)} {
+		status, err := v.Validate(context.Background(), w.lookup, w.answer(q.QName, q.QType))
+		require.Equal(t, Secure, status, "error: %v", err)
+	}
+
+	tests := []struct {
+		q     *dnsmessage.Question
+		rcode dnsmessage.RCode
+		nil   bool
+	}{
+		{q: question("nx.test", dnsmessage.TypeA), rcode: dnsmessage.RCodeNameError},
+		{q: question("other.test", dnsmessage.TypeMX), rcode: dnsmessage.RCodeNameError},
+		{q: question("x.www.test", dnsmessage.TypeA), rcode: dnsmessage.RCodeNameError},
+		{q: question("www.test", dnsmessage.TypeAAAA), rcode: dnsmessage.RCodeNoError},
+		{q: question("b.test", dnsmessage.TypeA), rcode: dnsmessage.RCodeNoError},
+		{q: question("other.secure.test", dnsmessage.TypeA), rcode: dnsmessage.RCodeNameError},
+		{q: question("www.secure.test", dnsmessage.TypeTXT), rcode: dnsmessage.RCodeNoError},
+		{q: question("www.test", dnsmessage.TypeA), nil: true},
+		{q: question("x.wild.test", dnsmessage.TypeA), nil: true},
+		// below a delegation the parent's NSEC records prove nothing
+		{q: question("www.insecure.test", dnsmessage.TypeA), nil: true},
+		{q: question("insecure.test", dnsmessage.TypeA), nil: true},
+		{q: question("nx.rsa.test", dnsmessage.TypeA), nil: true},
+		{q: &dnsmessage.Question{QName: dnsmessage.ParseDomainName("nx.test"), QType: dnsmessage.TypeA, QClass: dnsmessage.ClassCH}, nil: true},
+	}
+	for _, tt := range tests {
+		t.Run(dnsmessage.DomainNameToString(tt.q.QName)+" "+tt.q.QType.String(), func(t *testing.T) {
+			resp := v.Synthesize(tt.q)
+			if tt.nil {
+				assert.Nil(t, resp)
+				return
+			}
+			require.NotNil(t, resp)
+			assert.Equal(t, tt.rcode, resp.Header.RCode)
+			assert.Empty(t, resp.Answers)
+
+			// the synthesized answer validates like the one from upstream
+			status, err := v.Validate(context.Background(), w.lookup, resp)
+			assert.Equal(t, Secure, status, "error: %v", err)
+		})
+	}
+}
+
+func TestSynthesizeDisabled(t *testing.T) {
+	w, v := newTestWorld(t)
+
+	resp := w.answer(dnsmessage.ParseDomainName("nx.test"), dnsmessage.TypeA)
+	status, _ := v.Validate(context.Background(), w.lookup, resp)
+	assert.Equal(t, Secure, status)
+	assert.Nil(t, v.Synthesize(resp.Question))
+}
+
+func TestSynthesizeOnlyFromTheZone(t *testing.T) {
+	w, v := newTestWorld(t)
+	v.aggressive = true
+
+	// records of another zone and a signature claiming another signer ride along
+	resp := w.answer(dnsmessage.ParseDomainName("nx.test"), dnsmessage.TypeA)
+	rsa := w.zoneFor(dnsmessage.ParseDomainName("rsa.test"), dnsmessage.TypeA)
+	var forged dnsmessage.ResourceRecords
+	for _, rr := range resp.AuthorityRecords {
+		if rr.Type != dnsmessage.TypeRRSIG {
+			continue
+		}
+		sig, err := dnsmessage.UnpackRRSIG(rr.RData)
+		require.NoError(t, err)
+		sig.SignerName = rsa.name
+		f := *rr
+		f.RData = sig.Pack()
+		forged = append(forged, &f)
+	}
+	// the apex NSEC of rsa.test would join the delegation NSEC of test
+	foreign := slices.DeleteFunc(rsa.denial(t), func(rr *dnsmessage.ResourceRecord) bool { return dnsmessage.EqualNames(rr.Name, rsa.name) })
+	require.NotEmpty(t, foreign)
+	resp.AuthorityRecords = append(append(forged, resp.AuthorityRecords...), foreign...)
+	status, err := v.Validate(context.Background(), w.lookup, resp)
+	require.Equal(t, Secure, status, "error: %v", err)
+
+	synthesized := v.Synthesize(&dnsmessage.Question{QName: dnsmessage.ParseDomainName("other.test"), QType: dnsmessage.TypeA, QClass: dnsmessage.ClassIN})
+	require.NotNil(t, synthesized)
+	for _, rr := range synthesized.AuthorityRecords {
+		assert.False(t, dnsmessage.IsSubdomain(rr.Name, rsa.name) && !dnsmessage.EqualNames(rr.Name, rsa.name), "record of %s", dnsmessage.DomainNameToString(rr.Name))
+		if rr.Type == dnsmessage.TypeRRSIG {
+			sig, err := dnsmessage.UnpackRRSIG(rr.RData)
+			require.NoError(t, err)
+			assert.Equal(t, "test", dnsmessage.DomainNameToString(sig.SignerName))
+		}
+	}
+	assert.Nil(t, v.Synthesize(&dnsmessage.Question{QName: dnsmessage.ParseDomainName("z.rsa.test"), QType: dnsmessage.TypeA, QClass: dnsmessage.ClassIN}))
+}
@@ -0,0 +1,62 @@
+package dnssec
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"server/pkg/dnsmessage"
+)
+
+// DefaultTrustAnchors are the DS records of the root key signing keys
+// published by IANA, KSK-2017 and KSK-2024.
+var DefaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// ParseDS parses a DS record in presentation format like
+// "example.com. 3600 IN DS 12345 13 2 ABCD...". The TTL and the class
+// are optional, the digest may be split by white space.
+func ParseDS(s string) (dnsmessage.DomainName, *dnsmessage.DS, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return nil, nil, fmt.Errorf("invalid DS record %q", s)
+	}
+	owner := dnsmessage.ParseDomainName(fields[0])
+
+	rest := fields[1:]
+	for len(rest) > 0 && !strings.EqualFold(rest[0], "DS") {
+		if _, err := strconv.ParseUint(rest[0], 10, 32); err != nil && !strings.EqualFold(rest[0], "IN") {
+			return nil, nil, fmt.Errorf("invalid DS record %q: unexpected %q", s, rest[0])
+		}
+		rest = rest[1:]
+	}
+	if len(rest) < 5 {
+		return nil, nil, fmt.Errorf("invalid DS record %q", s)
+	}
+
+	var fieldErr error
+	parse := func(s string, bits int) uint64 {
+		v, err := strconv.ParseUint(s, 10, bits)
+		if err != nil && fieldErr == nil {
+			fieldErr = err
+		}
+		return v
+	}
+	ds := &dnsmessage.DS{
+		KeyTag:     uint16(parse(rest[1], 16)),
+		Algorithm:  uint8(parse(rest[2], 8)),
+		DigestType: uint8(parse(rest[3], 8)),
+	}
+	if fieldErr != nil {
+		return nil, nil, fmt.Errorf("invalid DS record %q: %w", s, fieldErr)
+	}
+	digest, err := hex.DecodeString(strings.Join(rest[4:], ""))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid DS digest in %q: %w", s, err)
+	}
+	ds.Digest = digest
+	return owner, ds, nil
+}
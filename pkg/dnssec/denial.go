@@ -0,0 +1,260 @@
+package dnssec
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha1"
+	"slices"
+
+	"server/pkg/dnsmessage"
+)
+
+// NSEC3 records with more iterations are treated as insecure (RFC 9276)
+const maxIterations = 150
+
+// NSEC3 hash algorithm
+const hashSHA1 = 1
+
+type nsecRecord struct {
+	owner dnsmessage.DomainName
+	zone  dnsmessage.DomainName // the verified signer of the record
+	*dnsmessage.NSEC
+}
+
+type nsec3Record struct {
+	hash []byte                // decoded first label of the owner
+	zone dnsmessage.DomainName // the verified signer, the owner without the hash
+	*dnsmessage.NSEC3
+}
+
+// CompareNames orders names canonically (RFC 4034, section 6.1): label by
+// label from the root, each compared as lowercase bytes.
+func CompareNames(a, b dnsmessage.DomainName) int {
+	for i := 1; i <= min(len(a), len(b)); i++ {
+		la := bytes.Clone(a[len(a)-i])
+		lb := bytes.Clone(b[len(b)-i])
+		lowerASCII(la)
+		lowerASCII(lb)
+		if c := bytes.Compare(la, lb); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+// between reports whether x lies strictly between owner and next in an
+// NSEC or NSEC3 chain. The last record of a chain points back to the first.
+func between[T any](owner, next, x T, compare func(a, b T) int) bool {
+	if compare(owner, next) < 0 {
+		return compare(owner, x) < 0 && compare(x, next) < 0
+	}
+	return compare(owner, x) < 0 || compare(x, next) < 0
+}
+
+func (n nsecRecord) covers(name dnsmessage.DomainName) bool {
+	if n.delegation(name) {
+		return false
+	}
+	return dnsmessage.IsSubdomain(name, n.zone) && between(n.owner, n.NextDomain, name, CompareNames)
+}
+
+// delegation reports whether the record belongs to a zone cut above the
+// name, the parent can't deny anything below it (RFC 4035, section 5.4).
+func (n nsecRecord) delegation(name dnsmessage.DomainName) bool {
+	return len(n.owner) < len(name) && dnsmessage.IsSubdomain(name, n.owner) &&
+		hasType(n.Types, dnsmessage.TypeNS) && !hasType(n.Types, dnsmessage.TypeSOA)
+}
+
+func commonAncestor(a, b dnsmessage.DomainName) dnsmessage.DomainName {
+	i := 0
+	for i < min(len(a), len(b)) && bytes.EqualFold(a[len(a)-1-i], b[len(b)-1-i]) {
+		i++
+	}
+	return a[len(a)-i:]
+}
+
+func hasType(types []dnsmessage.RRType, t dnsmessage.RRType) bool {
+	return slices.Contains(types, t)
+}
+
+// nsecNoData reports whether the NSEC records prove that the name exists
+// but has no records of the type (RFC 4035, section 5.4).
+func nsecNoData(nsecs []nsecRecord, name dnsmessage.DomainName, qtype dnsmessage.RRType) bool {
+	for _, n := range nsecs {
+		if dnsmessage.EqualNames(n.owner, name) {
+			// the NSEC of the parent at a delegation can't deny anything but DS
+			if hasType(n.Types, dnsmessage.TypeNS) && !hasType(n.Types, dnsmessage.TypeSOA) && qtype != dnsmessage.TypeDS {
+				return false
+			}
+			return !hasType(n.Types, qtype) && !hasType(n.Types, dnsmessage.TypeCNAME)
+		}
+		// an empty non-terminal has no NSEC of its own but one pointing below it
+		if n.covers(name) && dnsmessage.IsSubdomain(n.NextDomain, name) {
+			return true
+		}
+	}
+
+	// a wildcard that doesn't have the type either
+	ce, ok := nsecClosestEncloser(nsecs, name)
+	if !ok {
+		return false
+	}
+	wildcard := append(dnsmessage.Domain("*"), ce...)
+	for _, n := range nsecs {
+		if dnsmessage.EqualNames(n.owner, wildcard) {
+			return !hasType(n.Types, qtype) && !hasType(n.Types, dnsmessage.TypeCNAME)
+		}
+	}
+	return false
+}
+
+// nsecNXDomain reports whether the NSEC records prove that neither the
+// name nor a wildcard that could have been expanded to it exist.
+func nsecNXDomain(nsecs []nsecRecord, name dnsmessage.DomainName) bool {
+	ce, ok := nsecClosestEncloser(nsecs, name)
+	if !ok {
+		return false
+	}
+	wildcard := append(dnsmessage.Domain("*"), ce...)
+	return slices.ContainsFunc(nsecs, func(n nsecRecord) bool { return n.covers(wildcard) })
+}
+
+// nsecClosestEncloser finds the NSEC record covering the name and derives
+// the closest encloser of the name from it (RFC 6840, section 4.1).
+func nsecClosestEncloser(nsecs []nsecRecord, name dnsmessage.DomainName) (dnsmessage.DomainName, bool) {
+	for _, n := range nsecs {
+		if !n.covers(name) {
+			continue
+		}
+		if dnsmessage.IsSubdomain(n.NextDomain, name) {
+			// an empty non-terminal, the name exists
+			return nil, false
+		}
+		ce := commonAncestor(name, n.owner)
+		if other := commonAncestor(name, n.NextDomain); len(other) > len(ce) {
+			ce = other
+		}
+		return ce, true
+	}
+	return nil, false
+}
+
+// HashName computes the NSEC3 hash of the name (RFC 5155, section 5).
+func HashName(name dnsmessage.DomainName, salt []byte, iterations uint16) []byte {
+	data := canonicalName(name)
+	for range int(iterations) + 1 {
+		h := sha1.New()
+		h.Write(data)
+		h.Write(salt)
+		data = h.Sum(nil)
+	}
+	return data
+}
+
+func (n nsec3Record) hashOf(name dnsmessage.DomainName) []byte {
+	return HashName(name, n.Salt, n.Iterations)
+}
+
+func (n nsec3Record) matches(name dnsmessage.DomainName) bool {
+	return dnsmessage.IsSubdomain(name, n.zone) && bytes.Equal(n.hash, n.hashOf(name))
+}
+
+func (n nsec3Record) covers(name dnsmessage.DomainName) bool {
+	return dnsmessage.IsSubdomain(name, n.zone) && between(n.hash, n.NextHashed, n.hashOf(name), bytes.Compare)
+}
+
+func (n nsec3Record) optOut() bool {
+	return n.Flags&dnsmessage.NSEC3FlagOptOut != 0
+}
+
+func findNSEC3(nsec3s []nsec3Record, f func(nsec3Record) bool) (nsec3Record, bool) {
+	i := slices.IndexFunc(nsec3s, f)
+	if i < 0 {
+		return nsec3Record{}, false
+	}
+	return nsec3s[i], true
+}
+
+// nsec3ClosestEncloser finds the closest provable encloser of the name and
+// the record covering the next closer name (RFC 5155, section 8.3).
+func nsec3ClosestEncloser(nsec3s []nsec3Record, name dnsmessage.DomainName) (dnsmessage.DomainName, nsec3Record, bool) {
+	for i := 1; i <= len(name); i++ {
+		ce := name[i:]
+		n, ok := findNSEC3(nsec3s, func(n nsec3Record) bool { return n.matches(ce) })
+		if !ok {
+			continue
+		}
+		if hasType(n.Types, dnsmessage.TypeNS) && !hasType(n.Types, dnsmessage.TypeSOA) {
+			// a zone cut can't be the closest encloser
+			return nil, nsec3Record{}, false
+		}
+		nextCloser := name[i-1:]
+		nc, ok := findNSEC3(nsec3s, func(n nsec3Record) bool { return n.covers(nextCloser) })
+		return ce, nc, ok
+	}
+	return nil, nsec3Record{}, false
+}
+
+// nsec3NoData proves that the name has no records of the type (RFC 5155,
+// section 8.5 to 8.7). Opt-out makes the denial of DS insecure.
+func nsec3NoData(nsec3s []nsec3Record, name dnsmessage.DomainName, qtype dnsmessage.RRType) Status {
+	if n, ok := findNSEC3(nsec3s, func(n nsec3Record) bool { return n.matches(name) }); ok {
+		if hasType(n.Types, dnsmessage.TypeNS) && !hasType(n.Types, dnsmessage.TypeSOA) && qtype != dnsmessage.TypeDS {
+			return Bogus
+		}
+		if hasType(n.Types, qtype) || hasType(n.Types, dnsmessage.TypeCNAME) {
+			return Bogus
+		}
+		return Secure
+	}
+
+	ce, nc, ok := nsec3ClosestEncloser(nsec3s, name)
+	if !ok {
+		return Bogus
+	}
+	if qtype == dnsmessage.TypeDS && nc.optOut() {
+		return Insecure
+	}
+	wildcard := append(dnsmessage.Domain("*"), ce...)
+	if n, ok := findNSEC3(nsec3s, func(n nsec3Record) bool { return n.matches(wildcard) }); ok &&
+		!hasType(n.Types, qtype) && !hasType(n.Types, dnsmessage.TypeCNAME) {
+		return Secure
+	}
+	return Bogus
+}
+
+// nsec3NXDomain proves that neither the name nor a wildcard that could
+// have been expanded to it exist (RFC 5155, section 8.4).
+func nsec3NXDomain(nsec3s []nsec3Record, name dnsmessage.DomainName) Status {
+	ce, nc, ok := nsec3ClosestEncloser(nsec3s, name)
+	if !ok {
+		return Bogus
+	}
+	wildcard := append(dnsmessage.Domain("*"), ce...)
+	if _, ok := findNSEC3(nsec3s, func(n nsec3Record) bool { return n.covers(wildcard) }); !ok {
+		return Bogus
+	}
+	if nc.optOut() {
+		return Insecure
+	}
+	return Secure
+}
+
+// insecureDelegation reports whether the records prove that the name is a
+// delegation without DS records, so that the zone below it is unsigned.
+func insecureDelegation(nsecs []nsecRecord, nsec3s []nsec3Record, name dnsmessage.DomainName) bool {
+	isInsecureCut := func(types []dnsmessage.RRType) bool {
+		return hasType(types, dnsmessage.TypeNS) && !hasType(types, dnsmessage.TypeDS) && !hasType(types, dnsmessage.TypeSOA)
+	}
+	for _, n := range nsecs {
+		if dnsmessage.EqualNames(n.owner, name) {
+			return isInsecureCut(n.Types)
+		}
+	}
+	if n, ok := findNSEC3(nsec3s, func(n nsec3Record) bool { return n.matches(name) }); ok {
+		return isInsecureCut(n.Types)
+	}
+	// an opt-out span may hide an unsigned delegation
+	_, nc, ok := nsec3ClosestEncloser(nsec3s, name)
+	return ok && nc.optOut()
+}
@@ -0,0 +1,638 @@
+package dnssec
+
+import (
+	"context"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"server/pkg/dnsmessage"
+)
+
+// Status is the outcome of validating a response (RFC 4035, section 4.3).
+type Status int
+
+const (
+	// no trust anchor covers the data or it is below an insecure delegation
+	Insecure Status = iota
+	// the data is signed by a chain of trust starting at a trust anchor
+	Secure
+	// the data should be signed but the signatures or the proofs are missing or don't verify
+	Bogus
+)
+
+const (
+	// upper bound for how long validated keys and insecure delegations are kept
+	maxCacheTTL = time.Hour
+	// DS and DNSKEY lookups allowed for validating a single response
+	maxLookups = 32
+	// CNAMEs followed in an answer
+	maxCNAMEs = 8
+)
+
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+	// DS records in presentation format, the root key signing keys by default
+	TrustAnchors []string `yaml:"trust_anchors"`
+	// answer from validated NSEC and NSEC3 records without asking upstream
+	AggressiveNSEC bool `yaml:"aggressive_nsec"`
+}
+
+// Lookup queries for the records of the name with the DO bit set.
+type Lookup func(ctx context.Context, name dnsmessage.DomainName, qtype dnsmessage.RRType) (*dnsmessage.DNSMessage, error)
+
+// Validator checks the signatures of responses by building the chain of
+// trust from the trust anchors down to the zone of the answer. Validated
+// keys and insecure delegations are cached.
+type Validator struct {
+	anchors    map[string]anchor
+	aggressive bool
+
+	mu       sync.Mutex
+	zones    map[string]zoneEntry
+	negative []negativeEntry // the newest last
+}
+
+type anchor struct {
+	name dnsmessage.DomainName
+	ds   []*dnsmessage.DS
+}
+
+type zoneEntry struct {
+	status  Status // Secure with the keys of the zone or Insecure
+	keys    []*dnsmessage.DNSKEY
+	expires time.Time
+}
+
+func NewValidator(cfg *Config) (*Validator, error) {
+	trustAnchors := cfg.TrustAnchors
+	if len(trustAnchors) == 0 {
+		trustAnchors = DefaultTrustAnchors
+	}
+
+	v := &Validator{anchors: make(map[string]anchor), aggressive: cfg.AggressiveNSEC, zones: make(map[string]zoneEntry)}
+	for _, s := range trustAnchors {
+		owner, ds, err := ParseDS(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor: %w", err)
+		}
+		a := v.anchors[nameKey(owner)]
+		a.name = owner
+		a.ds = append(a.ds, ds)
+		v.anchors[nameKey(owner)] = a
+	}
+	return v, nil
+}
+
+func nameKey(name dnsmessage.DomainName) string {
+	return strings.ToLower(dnsmessage.DomainNameToString(name))
+}
+
+// anchorFor returns the closest trust anchor at or above the name.
+func (v *Validator) anchorFor(name dnsmessage.DomainName) (anchor, bool) {
+	for i := range len(name) + 1 {
+		if a, ok := v.anchors[nameKey(name[i:])]; ok {
+			return a, true
+		}
+	}
+	return anchor{}, false
+}
+
+func (v *Validator) cached(zone dnsmessage.DomainName, now time.Time) (zoneEntry, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	e, ok := v.zones[nameKey(zone)]
+	if !ok || now.After(e.expires) {
+		return zoneEntry{}, false
+	}
+	return e, true
+}
+
+func (v *Validator) cache(zone dnsmessage.DomainName, e zoneEntry) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.zones[nameKey(zone)] = e
+}
+
+// Validate checks the answer and the proofs of nonexistence in the
+// response. Records are fetched with lookup as needed. A Bogus status
+// comes with an error telling why.
+func (v *Validator) Validate(ctx context.Context, lookup Lookup, resp *dnsmessage.DNSMessage) (Status, error) {
+	if resp.Question == nil {
+		return Bogus, errors.New("response without a question")
+	}
+	if _, ok := v.anchorFor(resp.Question.QName); !ok {
+		return Insecure, nil
+	}
+	c := &validation{v: v, lookup: lookup, now: time.Now()}
+	return c.response(ctx, resp)
+}
+
+// validation holds the state of validating a single response.
+type validation struct {
+	v       *Validator
+	lookup  Lookup
+	now     time.Time
+	lookups int
+}
+
+// rrset is a set of records with the same owner, type and class
+// together with the signatures covering it.
+type rrset struct {
+	name       dnsmessage.DomainName
+	typ        dnsmessage.RRType
+	records    dnsmessage.ResourceRecords
+	sigs       []*dnsmessage.RRSIG
+	sigRecords dnsmessage.ResourceRecords // the RRSIG records of sigs
+}
+
+func groupRRsets(records dnsmessage.ResourceRecords) []*rrset {
+	sets := []*rrset{}
+	find := func(name dnsmessage.DomainName, typ dnsmessage.RRType) *rrset {
+		for _, set := range sets {
+			if set.typ == typ && dnsmessage.EqualNames(set.name, name) {
+				return set
+			}
+		}
+		return nil
+	}
+
+	for _, rr := range records {
+		if rr.Type == dnsmessage.TypeRRSIG || rr.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		if set := find(rr.Name, rr.Type); set != nil {
+			set.records = append(set.records, rr)
+			continue
+		}
+		sets = append(sets, &rrset{name: rr.Name, typ: rr.Type, records: dnsmessage.ResourceRecords{rr}})
+	}
+	for _, rr := range records {
+		if rr.Type != dnsmessage.TypeRRSIG {
+			continue
+		}
+		sig, err := dnsmessage.UnpackRRSIG(rr.RData)
+		if err != nil {
+			continue
+		}
+		if set := find(rr.Name, sig.TypeCovered); set != nil {
+			set.sigs = append(set.sigs, sig)
+			set.sigRecords = append(set.sigRecords, rr)
+		}
+	}
+	return sets
+}
+
+func findRRset(sets []*rrset, name dnsmessage.DomainName, typ dnsmessage.RRType) *rrset {
+	for _, set := range sets {
+		if set.typ == typ && dnsmessage.EqualNames(set.name, name) {
+			return set
+		}
+	}
+	return nil
+}
+
+func minTTL(sets ...*rrset) time.Duration {
+	ttl := maxCacheTTL
+	for _, set := range sets {
+		for _, rr := range set.records {
+			ttl = min(ttl, time.Duration(rr.TTL)*time.Second)
+		}
+	}
+	return ttl
+}
+
+// expansion is an answer synthesized from a wildcard. The name itself
+// has to be proven not to exist.
+type expansion struct {
+	name   dnsmessage.DomainName
+	labels int                   // labels of the wildcard without the asterisk
+	zone   dnsmessage.DomainName // signer of the answer
+}
+
+// proof holds the validated NSEC or NSEC3 records of a response,
+// all of them signed by the zone the response is from.
+type proof struct {
+	zone   dnsmessage.DomainName // nil if the response doesn't tell
+	nsecs  []nsecRecord
+	nsec3s []nsec3Record
+	// the SOA, NSEC and NSEC3 records of the zone with the signatures that verified
+	records dnsmessage.ResourceRecords
+}
+
+func (p *proof) empty() bool {
+	return len(p.nsecs) == 0 && len(p.nsec3s) == 0
+}
+
+func (c *validation) response(ctx context.Context, resp *dnsmessage.DNSMessage) (Status, error) {
+	q := resp.Question
+	status := Secure
+	var expansions []expansion
+
+	answers := groupRRsets(resp.Answers)
+	for _, set := range answers {
+		s, sig, err := c.rrset(ctx, set)
+		if s == Bogus {
+			return Bogus, err
+		}
+		status = min(status, s)
+		if sig != nil && int(sig.Labels) < labelCount(set.name) {
+			expansions = append(expansions, expansion{name: set.name, labels: int(sig.Labels), zone: sig.SignerName})
+		}
+	}
+
+	// follow the CNAMEs to the name the answer is about
+	name := q.QName
+	for range maxCNAMEs {
+		set := findRRset(answers, name, dnsmessage.TypeCNAME)
+		if set == nil || q.QType == dnsmessage.TypeCNAME {
+			break
+		}
+		target, _, err := dnsmessage.UnpackDomainName(set.records[0].RData)
+		if err != nil {
+			return Bogus, fmt.Errorf("invalid CNAME: %w", err)
+		}
+		name = target
+	}
+	answered := findRRset(answers, name, q.QType) != nil
+	if answered && len(expansions) == 0 {
+		return status, nil
+	}
+
+	// without an SOA the proofs of a wildcard answer come from its zone
+	var expanded dnsmessage.DomainName
+	if len(expansions) > 0 {
+		expanded = expansions[len(expansions)-1].zone
+	}
+	p, s, err := c.denial(ctx, groupRRsets(resp.AuthorityRecords), expanded)
+	if s == Bogus {
+		return Bogus, err
+	}
+	if s == Insecure {
+		return Insecure, nil
+	}
+	nsecs, nsec3s := p.nsecs, p.nsec3s
+	if p.empty() {
+		// fine if the zone isn't signed at all
+		if s, err := c.provenInsecure(ctx, name); s != Insecure {
+			return Bogus, fmt.Errorf("no proof of nonexistence for %s: %w", dnsmessage.DomainNameToString(name), err)
+		}
+		return Insecure, nil
+	}
+
+	for _, exp := range expansions {
+		if s := provenExpansion(nsecs, nsec3s, exp); s != Secure {
+			return min(status, s), errors.New("no proof that the wildcard answer was needed")
+		}
+	}
+	if answered {
+		return status, nil
+	}
+
+	var proof Status
+	switch {
+	case resp.Header.RCode == dnsmessage.RCodeNameError && len(nsecs) > 0:
+		proof = statusOf(nsecNXDomain(nsecs, name))
+	case resp.Header.RCode == dnsmessage.RCodeNameError:
+		proof = nsec3NXDomain(nsec3s, name)
+	case resp.Header.RCode == dnsmessage.RCodeNoError && len(nsecs) > 0:
+		proof = statusOf(nsecNoData(nsecs, name, q.QType))
+	case resp.Header.RCode == dnsmessage.RCodeNoError:
+		proof = nsec3NoData(nsec3s, name, q.QType)
+	default:
+		// other errors can't be proven
+		return Insecure, nil
+	}
+	if proof == Bogus {
+		return Bogus, fmt.Errorf("the records don't prove that %s %s doesn't exist", dnsmessage.DomainNameToString(name), q.QType)
+	}
+	if status == Secure && proof == Secure {
+		c.v.remember(p, c.now)
+	}
+	return min(status, proof), nil
+}
+
+func statusOf(proven bool) Status {
+	if proven {
+		return Secure
+	}
+	return Bogus
+}
+
+// provenExpansion checks that the name a wildcard was expanded to doesn't
+// exist itself, covering the next closer name is enough (RFC 5155, section 8.8).
+func provenExpansion(nsecs []nsecRecord, nsec3s []nsec3Record, exp expansion) Status {
+	for _, n := range nsecs {
+		if n.covers(exp.name) {
+			return Secure
+		}
+	}
+	nextCloser := exp.name[len(exp.name)-exp.labels-1:]
+	if n, ok := findNSEC3(nsec3s, func(n nsec3Record) bool { return n.covers(nextCloser) }); ok {
+		if n.optOut() {
+			return Insecure
+		}
+		return Secure
+	}
+	return Bogus
+}
+
+// rrset verifies the signatures of the RRset and returns the one that
+// verified. Only its signer can be trusted, the other signatures may be
+// forged. An unsigned RRset is only fine below an insecure delegation.
+func (c *validation) rrset(ctx context.Context, set *rrset) (Status, *dnsmessage.RRSIG, error) {
+	if len(set.sigs) == 0 {
+		if s, err := c.provenInsecure(ctx, set.name); s != Insecure {
+			return Bogus, nil, fmt.Errorf("%s %s is not signed: %w", dnsmessage.DomainNameToString(set.name), set.typ, err)
+		}
+		return Insecure, nil, nil
+	}
+
+	err := fmt.Errorf("no valid signature for %s %s", dnsmessage.DomainNameToString(set.name), set.typ)
+	for _, sig := range set.sigs {
+		if !dnsmessage.IsSubdomain(set.name, sig.SignerName) {
+			continue
+		}
+		// DS records are signed by the parent, not the zone they belong to
+		if set.typ == dnsmessage.TypeDS && len(sig.SignerName) >= len(set.name) {
+			continue
+		}
+
+		s, keys, zoneErr := c.zoneKeys(ctx, sig.SignerName)
+		if s == Insecure {
+			return Insecure, nil, nil
+		}
+		if s == Bogus {
+			err = zoneErr
+			continue
+		}
+		for _, key := range keys {
+			if verifyErr := Verify(set.records, sig, key, c.now); verifyErr != nil {
+				err = fmt.Errorf("%s %s: %w", dnsmessage.DomainNameToString(set.name), set.typ, verifyErr)
+				continue
+			}
+			return Secure, sig, nil
+		}
+	}
+	return Bogus, nil, err
+}
+
+// denial validates the NSEC, NSEC3 and SOA records of the authority section
+// and returns the NSEC and NSEC3 records for checking proofs with. Only
+// records signed by the zone of the response count: the signer of its SOA
+// or, if there is none, the zone of the expanded wildcard answer. Records
+// of other zones would deny names that zone knows nothing about.
+func (c *validation) denial(ctx context.Context, sets []*rrset, expanded dnsmessage.DomainName) (*proof, Status, error) {
+	p := &proof{zone: expanded}
+	status := Secure
+
+	type signedSet struct {
+		set *rrset
+		sig *dnsmessage.RRSIG
+	}
+	var signed []signedSet
+	for _, set := range sets {
+		switch set.typ {
+		case dnsmessage.TypeSOA, dnsmessage.TypeNSEC, dnsmessage.TypeNSEC3:
+		default:
+			continue
+		}
+		s, sig, err := c.rrset(ctx, set)
+		if s == Bogus {
+			return nil, Bogus, err
+		}
+		if s == Insecure {
+			status = Insecure
+			continue
+		}
+		if set.typ == dnsmessage.TypeSOA {
+			if !dnsmessage.EqualNames(set.name, sig.SignerName) {
+				return nil, Bogus, fmt.Errorf("SOA of %s is signed by %s", dnsmessage.DomainNameToString(set.name), dnsmessage.DomainNameToString(sig.SignerName))
+			}
+			p.zone = set.name
+		}
+		signed = append(signed, signedSet{set: set, sig: sig})
+	}
+
+	for _, ss := range signed {
+		if p.zone == nil || !dnsmessage.EqualNames(ss.sig.SignerName, p.zone) {
+			continue
+		}
+		p.records = append(p.records, ss.set.records...)
+		p.records = append(p.records, ss.set.sigRecords[slices.Index(ss.set.sigs, ss.sig)])
+		for _, rr := range ss.set.records {
+			switch rr.Type {
+			case dnsmessage.TypeNSEC:
+				if n, err := dnsmessage.UnpackNSEC(rr.RData); err == nil {
+					p.nsecs = append(p.nsecs, nsecRecord{owner: rr.Name, zone: p.zone, NSEC: n})
+				}
+			case dnsmessage.TypeNSEC3:
+				// the owner is the hash right below the apex
+				if len(rr.Name) != len(p.zone)+1 {
+					continue
+				}
+				n, err := dnsmessage.UnpackNSEC3(rr.RData)
+				if err != nil || n.HashAlgorithm != hashSHA1 {
+					continue
+				}
+				if n.Iterations > maxIterations {
+					status = Insecure
+					continue
+				}
+				hash, err := base32.HexEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(string(rr.Name[0])))
+				if err != nil {
+					continue
+				}
+				p.nsec3s = append(p.nsec3s, nsec3Record{hash: hash, zone: p.zone, NSEC3: n})
+			}
+		}
+	}
+	return p, status, nil
+}
+
+func (c *validation) query(ctx context.Context, name dnsmessage.DomainName, qtype dnsmessage.RRType) (*dnsmessage.DNSMessage, error) {
+	if c.lookups >= maxLookups {
+		return nil, errors.New("too many lookups")
+	}
+	c.lookups++
+
+	resp, err := c.lookup(ctx, name, qtype)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %s %s: %w", dnsmessage.DomainNameToString(name), qtype, err)
+	}
+	if rcode := resp.Header.RCode; rcode != dnsmessage.RCodeNoError && rcode != dnsmessage.RCodeNameError {
+		return nil, fmt.Errorf("failed to look up %s %s: %s", dnsmessage.DomainNameToString(name), qtype, rcode)
+	}
+	return resp, nil
+}
+
+// zoneKeys returns the validated keys of the zone. The DS records of the
+// zone come from a trust anchor or are validated with the keys of the
+// parent, which leads up to a trust anchor.
+func (c *validation) zoneKeys(ctx context.Context, zone dnsmessage.DomainName) (Status, []*dnsmessage.DNSKEY, error) {
+	if e, ok := c.v.cached(zone, c.now); ok {
+		return e.status, e.keys, nil
+	}
+	a, ok := c.v.anchorFor(zone)
+	if !ok {
+		return Insecure, nil, nil
+	}
+
+	dsSet := a.ds
+	if !dnsmessage.EqualNames(a.name, zone) {
+		resp, err := c.query(ctx, zone, dnsmessage.TypeDS)
+		if err != nil {
+			return Bogus, nil, err
+		}
+
+		set := findRRset(groupRRsets(resp.Answers), zone, dnsmessage.TypeDS)
+		if set == nil {
+			s, err := c.noDS(ctx, resp, zone)
+			if s == Insecure {
+				c.v.cache(zone, zoneEntry{status: Insecure, expires: c.now.Add(minTTL(groupRRsets(resp.AuthorityRecords)...))})
+			}
+			return s, nil, err
+		}
+
+		s, _, err := c.rrset(ctx, set)
+		if s != Secure {
+			return s, nil, err
+		}
+		dsSet = nil
+		for _, rr := range set.records {
+			if ds, err := dnsmessage.UnpackDS(rr.RData); err == nil {
+				dsSet = append(dsSet, ds)
+			}
+		}
+	}
+
+	resp, err := c.query(ctx, zone, dnsmessage.TypeDNSKEY)
+	if err != nil {
+		return Bogus, nil, err
+	}
+	set := findRRset(groupRRsets(resp.Answers), zone, dnsmessage.TypeDNSKEY)
+	if set == nil {
+		return Bogus, nil, fmt.Errorf("no DNSKEY records for %s", dnsmessage.DomainNameToString(zone))
+	}
+	keys := []*dnsmessage.DNSKEY{}
+	for _, rr := range set.records {
+		if k, err := dnsmessage.UnpackDNSKEY(rr.RData); err == nil {
+			keys = append(keys, k)
+		}
+	}
+
+	// the DNSKEY RRset has to be signed by a key a DS record points to
+	supported := false
+	for _, ds := range dsSet {
+		if !SupportedAlgorithm(ds.Algorithm) || ds.DigestType == DigestSHA1 && len(dsSet) > 1 {
+			continue
+		}
+		supported = true
+		for _, k := range keys {
+			if !matchesDS(zone, k, ds) {
+				continue
+			}
+			for _, sig := range set.sigs {
+				if dnsmessage.EqualNames(sig.SignerName, zone) && Verify(set.records, sig, k, c.now) == nil {
+					c.v.cache(zone, zoneEntry{status: Secure, keys: keys, expires: c.now.Add(minTTL(set))})
+					return Secure, keys, nil
+				}
+			}
+		}
+	}
+	if !supported {
+		// zones signed only with algorithms we don't know are treated as unsigned (RFC 4035, section 5.2)
+		return Insecure, nil, nil
+	}
+	return Bogus, nil, fmt.Errorf("no DNSKEY of %s matching its DS records signs the DNSKEY RRset", dnsmessage.DomainNameToString(zone))
+}
+
+// noDS checks that a response without DS records for the zone proves
+// that it is an insecure delegation.
+func (c *validation) noDS(ctx context.Context, resp *dnsmessage.DNSMessage, zone dnsmessage.DomainName) (Status, error) {
+	p, s, err := c.denial(ctx, groupRRsets(resp.AuthorityRecords), nil)
+	if s != Secure {
+		return s, err
+	}
+	if p.empty() {
+		return c.provenInsecure(ctx, zone)
+	}
+	if !insecureDelegation(p.nsecs, p.nsec3s, zone) {
+		return Bogus, fmt.Errorf("no proof that %s is an unsigned delegation", dnsmessage.DomainNameToString(zone))
+	}
+	return Insecure, nil
+}
+
+// provenInsecure checks that unsigned data for the name is expected
+// because the name is at or below an insecure delegation. DS records are
+// asked for from the name upwards: responses from unsigned zones are
+// unsigned too, the first signed one has to prove the delegation.
+func (c *validation) provenInsecure(ctx context.Context, name dnsmessage.DomainName) (Status, error) {
+	a, ok := c.v.anchorFor(name)
+	if !ok {
+		return Insecure, nil
+	}
+
+	for n := name; len(n) > len(a.name); n = n[1:] {
+		if e, ok := c.v.cached(n, c.now); ok && e.status == Insecure {
+			return Insecure, nil
+		}
+	}
+
+	for n := name; ; n = n[1:] {
+		if dnsmessage.EqualNames(n, a.name) {
+			return Bogus, fmt.Errorf("unsigned data in %s", dnsmessage.DomainNameToString(n))
+		}
+
+		resp, err := c.query(ctx, n, dnsmessage.TypeDS)
+		if err != nil {
+			return Bogus, err
+		}
+
+		if set := findRRset(groupRRsets(resp.Answers), n, dnsmessage.TypeDS); set != nil {
+			if len(set.sigs) == 0 {
+				continue
+			}
+			if s, _, err := c.rrset(ctx, set); s != Secure {
+				return s, err
+			}
+			return Bogus, fmt.Errorf("%s is a signed zone", dnsmessage.DomainNameToString(n))
+		}
+
+		authority := groupRRsets(resp.AuthorityRecords)
+		signed := false
+		for _, set := range authority {
+			signed = signed || len(set.sigs) > 0
+		}
+		if !signed {
+			continue
+		}
+
+		p, s, err := c.denial(ctx, authority, nil)
+		if s != Secure {
+			return s, err
+		}
+		if !insecureDelegation(p.nsecs, p.nsec3s, n) {
+			return Bogus, fmt.Errorf("%s is in a signed zone", dnsmessage.DomainNameToString(n))
+		}
+		c.v.cache(n, zoneEntry{status: Insecure, expires: c.now.Add(minTTL(authority...))})
+		return Insecure, nil
+	}
+}
+
+func (s Status) String() string {
+	switch s {
+	case Insecure:
+		return "insecure"
+	case Secure:
+		return "secure"
+	case Bogus:
+		return "bogus"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", int(s))
+	}
+}
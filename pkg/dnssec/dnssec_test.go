@@ -0,0 +1,464 @@
+package dnssec
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"server/pkg/dnsmessage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testZone is a zone signed on the fly when it is asked for records.
+type testZone struct {
+	name    dnsmessage.DomainName
+	key     *dnsmessage.DNSKEY // nil for an unsigned zone
+	priv    crypto.Signer
+	records dnsmessage.ResourceRecords
+	nsec3   bool
+	expired bool
+}
+
+// testWorld answers queries from a hierarchy of zones like a resolver would.
+type testWorld struct {
+	t       *testing.T
+	zones   []*testZone
+	lookups int
+}
+
+func newTestKey(t *testing.T, alg int) (*dnsmessage.DNSKEY, crypto.Signer) {
+	var priv crypto.Signer
+	var err error
+	switch alg {
+	case AlgRSASHA256:
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgECDSAP256SHA256:
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgECDSAP384SHA384:
+		priv, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case AlgED25519:
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	}
+	require.NoError(t, err)
+	key, err := NewDNSKEY(dnsmessage.DNSKEYFlagZone|dnsmessage.DNSKEYFlagSEP, priv.Public())
+	require.NoError(t, err)
+	return key, priv
+}
+
+func testRR(name string, typ dnsmessage.RRType, rdata []byte) *dnsmessage.ResourceRecord {
+	return &dnsmessage.ResourceRecord{Name: dnsmessage.ParseDomainName(name), Type: typ, Class: dnsmessage.ClassIN, TTL: 300, RData: rdata}
+}
+
+func (w *testWorld) addZone(name string, alg int, records ...*dnsmessage.ResourceRecord) *testZone {
+	z := &testZone{name: dnsmessage.ParseDomainName(name)}
+	soa := &dnsmessage.SOA{MName: dnsmessage.ParseDomainName("ns.test"), RName: dnsmessage.ParseDomainName("admin.test"), Serial: 1, Minimum: 300}
+	z.records = append(dnsmessage.ResourceRecords{
+		testRR(name, dnsmessage.TypeSOA, soa.Pack()),
+		testRR(name, dnsmessage.TypeNS, dnsmessage.PackDomainName(dnsmessage.ParseDomainName("ns.test"))),
+	}, records...)
+	if alg != 0 {
+		z.key, z.priv = newTestKey(w.t, alg)
+		z.records = append(z.records, testRR(name, dnsmessage.TypeDNSKEY, z.key.Pack()))
+	}
+
+	if parent := w.zoneFor(z.name, dnsmessage.TypeDS); parent != nil {
+		parent.records = append(parent.records, testRR(name, dnsmessage.TypeNS, dnsmessage.PackDomainName(dnsmessage.ParseDomainName("ns.test"))))
+		if z.key != nil {
+			ds, err := NewDS(z.name, z.key, DigestSHA256)
+			require.NoError(w.t, err)
+			parent.records = append(parent.records, testRR(name, dnsmessage.TypeDS, ds.Pack()))
+		}
+	}
+	w.zones = append(w.zones, z)
+	return z
+}
+
+func (w *testWorld) anchor(z *testZone) string {
+	ds, err := NewDS(z.name, z.key, DigestSHA256)
+	require.NoError(w.t, err)
+	return fmt.Sprintf("%s. IN DS %s", dnsmessage.DomainNameToString(z.name), ds.String())
+}
+
+// zoneFor returns the zone answering for the name, DS records come from the parent.
+func (w *testWorld) zoneFor(name dnsmessage.DomainName, qtype dnsmessage.RRType) *testZone {
+	var best *testZone
+	for _, z := range w.zones {
+		if !dnsmessage.IsSubdomain(name, z.name) || qtype == dnsmessage.TypeDS && dnsmessage.EqualNames(name, z.name) {
+			continue
+		}
+		if best == nil || len(z.name) > len(best.name) {
+			best = z
+		}
+	}
+	return best
+}
+
+func (z *testZone) find(name dnsmessage.DomainName, typ dnsmessage.RRType) dnsmessage.ResourceRecords {
+	var rrs dnsmessage.ResourceRecords
+	for _, rr := range z.records {
+		if rr.Type == typ && dnsmessage.EqualNames(rr.Name, name) {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+func (z *testZone) exists(name dnsmessage.DomainName) bool {
+	return slices.ContainsFunc(z.records, func(rr *dnsmessage.ResourceRecord) bool { return dnsmessage.IsSubdomain(rr.Name, name) })
+}
+
+// signed returns the RRset followed by its signature.
+func (z *testZone) signed(t *testing.T, rrset dnsmessage.ResourceRecords) dnsmessage.ResourceRecords {
+	if z.key == nil || len(rrset) == 0 {
+		return rrset
+	}
+	inception, expiration := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	if z.expired {
+		inception, expiration = time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour)
+	}
+	sig, err := Sign(rrset, z.name, z.key, z.priv, inception, expiration)
+	require.NoError(t, err)
+	return append(slices.Clone(rrset), &dnsmessage.ResourceRecord{
+		Name: rrset[0].Name, Type: dnsmessage.TypeRRSIG, Class: dnsmessage.ClassIN, TTL: rrset[0].TTL, RData: sig.Pack(),
+	})
+}
+
+// denial returns the signed NSEC or NSEC3 chain of the whole zone.
+func (z *testZone) denial(t *testing.T) dnsmessage.ResourceRecords {
+	if z.key == nil {
+		return nil
+	}
+	types := map[string][]dnsmessage.RRType{}
+	names := []dnsmessage.DomainName{}
+	add := func(name dnsmessage.DomainName, typ dnsmessage.RRType) {
+		key := nameKey(name)
+		if _, ok := types[key]; !ok {
+			names = append(names, name)
+			types[key] = []dnsmessage.RRType{}
+		}
+		if typ != 0 && !slices.Contains(types[key], typ) {
+			types[key] = append(types[key], typ)
+		}
+	}
+	for _, rr := range z.records {
+		add(rr.Name, rr.Type)
+		add(rr.Name, dnsmessage.TypeRRSIG)
+		if z.nsec3 {
+			// empty non-terminals get an NSEC3 record too
+			for i := 1; i < len(rr.Name)-len(z.name); i++ {
+				add(rr.Name[i:], 0)
+			}
+		}
+	}
+
+	var rrs dnsmessage.ResourceRecords
+	if !z.nsec3 {
+		slices.SortFunc(names, CompareNames)
+		for i, name := range names {
+			next := names[(i+1)%len(names)]
+			nsec := &dnsmessage.NSEC{NextDomain: next, Types: append(types[nameKey(name)], dnsmessage.TypeNSEC)}
+			rrs = append(rrs, z.signed(t, dnsmessage.ResourceRecords{{Name: name, Type: dnsmessage.TypeNSEC, Class: dnsmessage.ClassIN, TTL: 300, RData: nsec.Pack()}})...)
+		}
+		return rrs
+	}
+
+	salt := []byte{0xab, 0xcd}
+	hashes := make([][]byte, len(names))
+	byHash := map[string][]dnsmessage.RRType{}
+	for i, name := range names {
+		hashes[i] = HashName(name, salt, 1)
+		byHash[string(hashes[i])] = types[nameKey(name)]
+	}
+	slices.SortFunc(hashes, bytes.Compare)
+	for i, hash := range hashes {
+		nsec3 := &dnsmessage.NSEC3{HashAlgorithm: hashSHA1, Iterations: 1, Salt: salt, NextHashed: hashes[(i+1)%len(hashes)], Types: byHash[string(hash)]}
+		owner := append(dnsmessage.Domain(base32.HexEncoding.WithPadding(base32.NoPadding).EncodeToString(hash)), z.name...)
+		rrs = append(rrs, z.signed(t, dnsmessage.ResourceRecords{{Name: owner, Type: dnsmessage.TypeNSEC3, Class: dnsmessage.ClassIN, TTL: 300, RData: nsec3.Pack()}})...)
+	}
+	return rrs
+}
+
+func (w *testWorld) answer(name dnsmessage.DomainName, qtype dnsmessage.RRType) *dnsmessage.DNSMessage {
+	resp := &dnsmessage.DNSMessage{
+		Header:   &dnsmessage.Header{QR: 1, RCode: dnsmessage.RCodeNoError},
+		Question: &dnsmessage.Question{QName: name, QType: qtype, QClass: dnsmessage.ClassIN},
+	}
+	for range maxCNAMEs {
+		z := w.zoneFor(name, qtype)
+		if z == nil {
+			resp.Header.RCode = dnsmessage.RCodeServerFailure
+			return resp
+		}
+		if rrs := z.find(name, qtype); len(rrs) > 0 {
+			resp.Answers = append(resp.Answers, z.signed(w.t, rrs)...)
+			return resp
+		}
+		if rrs := z.find(name, dnsmessage.TypeCNAME); len(rrs) > 0 {
+			resp.Answers = append(resp.Answers, z.signed(w.t, rrs)...)
+			name, _, _ = dnsmessage.UnpackDomainName(rrs[0].RData)
+			continue
+		}
+
+		if !z.exists(name) {
+			// expand the wildcard at the closest encloser
+			ce := name
+			for !z.exists(ce) {
+				ce = ce[1:]
+			}
+			if rrs := z.find(append(dnsmessage.Domain("*"), ce...), qtype); len(rrs) > 0 {
+				signed := z.signed(w.t, rrs)
+				for _, rr := range signed {
+					expanded := *rr
+					expanded.Name = name
+					resp.Answers = append(resp.Answers, &expanded)
+				}
+				resp.AuthorityRecords = z.denial(w.t)
+				return resp
+			}
+			resp.Header.RCode = dnsmessage.RCodeNameError
+		}
+		resp.AuthorityRecords = append(z.signed(w.t, z.find(z.name, dnsmessage.TypeSOA)), z.denial(w.t)...)
+		return resp
+	}
+	return resp
+}
+
+func (w *testWorld) lookup(_ context.Context, name dnsmessage.DomainName, qtype dnsmessage.RRType) (*dnsmessage.DNSMessage, error) {
+	w.lookups++
+	return w.answer(name, qtype), nil
+}
+
+// newTestWorld builds a signed hierarchy below test. using all supported
+// algorithms, NSEC and NSEC3, a wildcard and an unsigned delegation.
+func newTestWorld(t *testing.T) (*testWorld, *Validator) {
+	w := &testWorld{t: t}
+	a := func(ip byte) []byte { return []byte{192, 0, 2, ip} }
+
+	root := w.addZone("test", AlgED25519,
+		testRR("www.test", dnsmessage.TypeA, a(1)),
+		testRR("alias.test", dnsmessage.TypeCNAME, dnsmessage.PackDomainName(dnsmessage.ParseDomainName("www.secure.test"))),
+		testRR("*.wild.test", dnsmessage.TypeA, a(2)),
+		testRR("a.b.test", dnsmessage.TypeA, a(3)),
+	)
+	w.addZone("secure.test", AlgECDSAP256SHA256, testRR("www.secure.test", dnsmessage.TypeA, a(4))).nsec3 = true
+	w.addZone("rsa.test", AlgRSASHA256, testRR("www.rsa.test", dnsmessage.TypeA, a(5)))
+	w.addZone("p384.test", AlgECDSAP384SHA384, testRR("www.p384.test", dnsmessage.TypeA, a(6)))
+	w.addZone("insecure.test", 0, testRR("www.insecure.test", dnsmessage.TypeA, a(7)))
+	w.addZone("expired.test", AlgED25519, testRR("www.expired.test", dnsmessage.TypeA, a(8))).expired = true
+
+	v, err := NewValidator(&Config{Enabled: true, TrustAnchors: []string{w.anchor(root)}})
+	require.NoError(t, err)
+	return w, v
+}
+
+func TestValidate(t *testing.T) {
+	w, v := newTestWorld(t)
+
+	tests := []struct {
+		name  string
+		qtype dnsmessage.RRType
+		exp   Status
+		rcode dnsmessage.RCode
+	}{
+		{name: "www.test", qtype: dnsmessage.TypeA, exp: Secure},
+		{name: "www.secure.test", qtype: dnsmessage.TypeA, exp: Secure},
+		{name: "www.rsa.test", qtype: dnsmessage.TypeA, exp: Secure},
+		{name: "www.p384.test", qtype: dnsmessage.TypeA, exp: Secure},
+		{name: "alias.test", qtype: dnsmessage.TypeA, exp: Secure},
+		{name: "x.wild.test", qtype: dnsmessage.TypeA, exp: Secure},
+		{name: "nx.test", qtype: dnsmessage.TypeA, exp: Secure, rcode: dnsmessage.RCodeNameError},
+		{name: "www.test", qtype: dnsmessage.TypeAAAA, exp: Secure},
+		{name: "b.test", qtype: dnsmessage.TypeA, exp: Secure},
+		{name: "nx.secure.test", qtype: dnsmessage.TypeA, exp: Secure, rcode: dnsmessage.RCodeNameError},
+		{name: "www.secure.test", qtype: dnsmessage.TypeAAAA, exp: Secure},
+		{name: "www.insecure.test", qtype: dnsmessage.TypeA, exp: Insecure},
+		{name: "nx.insecure.test", qtype: dnsmessage.TypeA, exp: Insecure, rcode: dnsmessage.RCodeNameError},
+		{name: "example.org", qtype: dnsmessage.TypeA, exp: Insecure, rcode: dnsmessage.RCodeServerFailure},
+		{name: "www.expired.test", qtype: dnsmessage.TypeA, exp: Bogus},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s", tt.name, tt.qtype), func(t *testing.T) {
+			resp := w.answer(dnsmessage.ParseDomainName(tt.name), tt.qtype)
+			assert.Equal(t, tt.rcode, resp.Header.RCode)
+
+			status, err := v.Validate(context.Background(), w.lookup, resp)
+			assert.Equal(t, tt.exp, status, "error: %v", err)
+			if tt.exp == Bogus {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateBogus(t *testing.T) {
+	w, v := newTestWorld(t)
+
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  dnsmessage.RRType
+		tamper func(resp *dnsmessage.DNSMessage)
+	}{
+		{
+			name:  "changed address",
+			qname: "www.secure.test", qtype: dnsmessage.TypeA,
+			tamper: func(resp *dnsmessage.DNSMessage) { resp.Answers[0].RData = []byte{203, 0, 113, 1} },
+		},
+		{
+			name:  "stripped signature",
+			qname: "www.rsa.test", qtype: dnsmessage.TypeA,
+			tamper: func(resp *dnsmessage.DNSMessage) { resp.Answers = resp.Answers[:1] },
+		},
+		{
+			name:  "forged name error",
+			qname: "www.test", qtype: dnsmessage.TypeA,
+			tamper: func(resp *dnsmessage.DNSMessage) {
+				resp.Header.RCode = dnsmessage.RCodeNameError
+				resp.Answers = nil
+				resp.AuthorityRecords = w.answer(dnsmessage.ParseDomainName("nx.test"), dnsmessage.TypeA).AuthorityRecords
+			},
+		},
+		{
+			name:  "forged no data",
+			qname: "www.secure.test", qtype: dnsmessage.TypeA,
+			tamper: func(resp *dnsmessage.DNSMessage) {
+				resp.Answers = nil
+				resp.AuthorityRecords = w.answer(dnsmessage.ParseDomainName("www.secure.test"), dnsmessage.TypeAAAA).AuthorityRecords
+			},
+		},
+		{
+			name:  "name error for an empty non-terminal",
+			qname: "b.test", qtype: dnsmessage.TypeA,
+			tamper: func(resp *dnsmessage.DNSMessage) { resp.Header.RCode = dnsmessage.RCodeNameError },
+		},
+		{
+			// only the signer of the signature that verifies tells the zone of a record
+			name:  "name error from another zone with a forged signer first",
+			qname: "www.test", qtype: dnsmessage.TypeA,
+			tamper: func(resp *dnsmessage.DNSMessage) {
+				rsa := w.zoneFor(dnsmessage.ParseDomainName("rsa.test"), dnsmessage.TypeA)
+				proof := rsa.denial(t)
+				var forged dnsmessage.ResourceRecords
+				for _, rr := range proof {
+					if rr.Type != dnsmessage.TypeRRSIG {
+						continue
+					}
+					sig, err := dnsmessage.UnpackRRSIG(rr.RData)
+					require.NoError(t, err)
+					sig.SignerName = dnsmessage.ParseDomainName("test")
+					f := *rr
+					f.RData = sig.Pack()
+					forged = append(forged, &f)
+				}
+				root := w.zoneFor(dnsmessage.ParseDomainName("test"), dnsmessage.TypeSOA)
+				resp.Header.RCode = dnsmessage.RCodeNameError
+				resp.Answers = nil
+				resp.AuthorityRecords = append(append(forged, root.signed(t, root.find(root.name, dnsmessage.TypeSOA))...), proof...)
+			},
+		},
+		{
+			name:  "name error without proof",
+			qname: "nx.test", qtype: dnsmessage.TypeA,
+			tamper: func(resp *dnsmessage.DNSMessage) { resp.AuthorityRecords = resp.AuthorityRecords[:2] },
+		},
+		{
+			name:  "wildcard without proof",
+			qname: "x.wild.test", qtype: dnsmessage.TypeA,
+			tamper: func(resp *dnsmessage.DNSMessage) { resp.AuthorityRecords = nil },
+		},
+		{
+			name:  "answer moved to another name",
+			qname: "www.test", qtype: dnsmessage.TypeA,
+			tamper: func(resp *dnsmessage.DNSMessage) {
+				for _, rr := range resp.Answers {
+					rr.Name = dnsmessage.ParseDomainName("mail.test")
+				}
+				resp.Question.QName = dnsmessage.ParseDomainName("mail.test")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := w.answer(dnsmessage.ParseDomainName(tt.qname), tt.qtype)
+			status, err := v.Validate(context.Background(), w.lookup, resp)
+			require.Equal(t, Secure, status, "error: %v", err)
+
+			tt.tamper(resp)
+			status, err = v.Validate(context.Background(), w.lookup, resp)
+			assert.Equal(t, Bogus, status)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestValidateCachesKeys(t *testing.T) {
+	w, v := newTestWorld(t)
+
+	resp := w.answer(dnsmessage.ParseDomainName("www.secure.test"), dnsmessage.TypeA)
+	status, _ := v.Validate(context.Background(), w.lookup, resp)
+	assert.Equal(t, Secure, status)
+	assert.Equal(t, 3, w.lookups) // DNSKEY of test., DS and DNSKEY of secure.test.
+
+	status, _ = v.Validate(context.Background(), w.lookup, resp)
+	assert.Equal(t, Secure, status)
+	assert.Equal(t, 3, w.lookups)
+
+	resp = w.answer(dnsmessage.ParseDomainName("www.insecure.test"), dnsmessage.TypeA)
+	status, _ = v.Validate(context.Background(), w.lookup, resp)
+	assert.Equal(t, Insecure, status)
+	lookups := w.lookups
+	status, _ = v.Validate(context.Background(), w.lookup, resp)
+	assert.Equal(t, Insecure, status)
+	assert.Equal(t, lookups, w.lookups)
+}
+
+func TestVerify(t *testing.T) {
+	for _, alg := range []int{AlgRSASHA256, AlgECDSAP256SHA256, AlgECDSAP384SHA384, AlgED25519} {
+		t.Run(fmt.Sprint(alg), func(t *testing.T) {
+			key, priv := newTestKey(t, alg)
+			zone := dnsmessage.ParseDomainName("example.com")
+			rrset := dnsmessage.ResourceRecords{
+				testRR("WWW.example.com", dnsmessage.TypeA, []byte{192, 0, 2, 2}),
+				testRR("www.example.com", dnsmessage.TypeA, []byte{192, 0, 2, 1}),
+			}
+			now := time.Now()
+			sig, err := Sign(rrset, zone, key, priv, now.Add(-time.Minute), now.Add(time.Minute))
+			require.NoError(t, err)
+
+			// the order and the case of the owner don't matter
+			reversed := slices.Clone(rrset)
+			slices.Reverse(reversed)
+			assert.NoError(t, Verify(reversed, sig, key, now))
+			assert.Error(t, Verify(rrset[:1], sig, key, now))
+			assert.ErrorContains(t, Verify(rrset, sig, key, now.Add(time.Hour)), "expired")
+			assert.ErrorContains(t, Verify(rrset, sig, key, now.Add(-time.Hour)), "not valid yet")
+
+			other, _ := newTestKey(t, alg)
+			assert.Error(t, Verify(rrset, sig, other, now))
+		})
+	}
+}
+
+func TestKeyTag(t *testing.T) {
+	// the root KSK-2017 and its DS record
+	pub, _ := base64.StdEncoding.DecodeString("AwEAAaz/tAm8yTn4Mfeh5eyI96WSVexTBAvkMgJzkKTOiW1vkIbzxeF3+/4RgWOq7HrxRixHlFlExOLAJr5emLvN7SWXgnLh4+B5xQlNVz8Og8kvArMtNROxVQuCaSnIDdD5LKyWbRd2n9WGe2R8PzgCmr3EgVLrjyBxWezF0jLHwVN8efS3rCj/EWgvIWgb9tarpVUDK/b58Da+sqqls3eNbuv7pr+eoZG+SrDK6nWeL3c6H5Apxz7LjVc1uTIdsIXxuOLYA4/ilBmSVIzuDWfdRUfhHdY6+cn8HFRm+2hM8AnXGXws9555KrUB5qihylGa8subX2Nn6UwNR1AkUTV74bU=")
+	key := &dnsmessage.DNSKEY{Flags: 257, Protocol: 3, Algorithm: AlgRSASHA256, PublicKey: pub}
+	assert.Equal(t, uint16(20326), KeyTag(key))
+
+	owner, ds, err := ParseDS(DefaultTrustAnchors[0])
+	require.NoError(t, err)
+	assert.True(t, matchesDS(owner, key, ds))
+}
@@ -0,0 +1,106 @@
+package dnssec
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"server/pkg/dnsmessage"
+)
+
+// NewDNSKEY returns the DNSKEY record holding the public key.
+func NewDNSKEY(flags uint16, pub crypto.PublicKey) (*dnsmessage.DNSKEY, error) {
+	k := &dnsmessage.DNSKEY{Flags: flags, Protocol: 3}
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		k.Algorithm = AlgRSASHA256
+		e := big.NewInt(int64(pub.E)).Bytes()
+		k.PublicKey = append(append([]byte{byte(len(e))}, e...), pub.N.Bytes()...)
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			k.Algorithm = AlgECDSAP256SHA256
+		case elliptic.P384():
+			k.Algorithm = AlgECDSAP384SHA384
+		default:
+			return nil, errors.New("unsupported ECDSA curve")
+		}
+		b, err := pub.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		k.PublicKey = b[1:] // without the prefix of the uncompressed form
+	case ed25519.PublicKey:
+		k.Algorithm = AlgED25519
+		k.PublicKey = pub
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+	}
+	return k, nil
+}
+
+// Sign signs the RRset with the private key belonging to the DNSKEY of
+// the zone. The signature is valid from inception until expiration.
+func Sign(rrset dnsmessage.ResourceRecords, zone dnsmessage.DomainName, key *dnsmessage.DNSKEY, priv crypto.Signer, inception, expiration time.Time) (*dnsmessage.RRSIG, error) {
+	if len(rrset) == 0 {
+		return nil, errors.New("empty RRset")
+	}
+	sig := &dnsmessage.RRSIG{
+		TypeCovered: rrset[0].Type,
+		Algorithm:   key.Algorithm,
+		Labels:      uint8(labelCount(rrset[0].Name)),
+		OriginalTTL: rrset[0].TTL,
+		Expiration:  uint32(expiration.Unix()),
+		Inception:   uint32(inception.Unix()),
+		KeyTag:      KeyTag(key),
+		SignerName:  zone,
+	}
+
+	data := signedData(rrset, sig)
+	var err error
+	switch key.Algorithm {
+	case AlgRSASHA256:
+		sum := sha256.Sum256(data)
+		sig.Signature, err = priv.Sign(rand.Reader, sum[:], crypto.SHA256)
+	case AlgECDSAP256SHA256:
+		sum := sha256.Sum256(data)
+		sig.Signature, err = signECDSA(priv, sum[:], 32)
+	case AlgECDSAP384SHA384:
+		sum := sha512.Sum384(data)
+		sig.Signature, err = signECDSA(priv, sum[:], 48)
+	case AlgED25519:
+		sig.Signature, err = priv.Sign(rand.Reader, data, crypto.Hash(0))
+	default:
+		err = fmt.Errorf("unsupported algorithm %d", key.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// signECDSA returns r and s padded to the size of the curve
+// instead of the ASN.1 form crypto.Signer produces.
+func signECDSA(priv crypto.Signer, hash []byte, size int) ([]byte, error) {
+	key, ok := priv.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an ECDSA key, got %T", priv)
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash)
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 2*size)
+	r.FillBytes(sig[:size])
+	s.FillBytes(sig[size:])
+	return sig, nil
+}
@@ -0,0 +1,282 @@
+package dnssec
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+
+	"server/pkg/dnsmessage"
+)
+
+// signature algorithms (RFC 8624)
+const (
+	AlgRSASHA256       = 8
+	AlgECDSAP256SHA256 = 13
+	AlgECDSAP384SHA384 = 14
+	AlgED25519         = 15
+)
+
+// DS digest types
+const (
+	DigestSHA1   = 1
+	DigestSHA256 = 2
+	DigestSHA384 = 4
+)
+
+// SupportedAlgorithm reports whether signatures of the algorithm can be verified.
+func SupportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case AlgRSASHA256, AlgECDSAP256SHA256, AlgECDSAP384SHA384, AlgED25519:
+		return true
+	}
+	return false
+}
+
+// KeyTag computes the tag of the key that DS and RRSIG records refer
+// to it by (RFC 4034, appendix B).
+func KeyTag(k *dnsmessage.DNSKEY) uint16 {
+	var ac uint32
+	for i, b := range k.Pack() {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xFFFF
+	return uint16(ac)
+}
+
+// NewDS returns the DS record for the key of the zone.
+func NewDS(zone dnsmessage.DomainName, k *dnsmessage.DNSKEY, digestType uint8) (*dnsmessage.DS, error) {
+	data := append(canonicalName(zone), k.Pack()...)
+	var digest []byte
+	switch digestType {
+	case DigestSHA1:
+		sum := sha1.Sum(data)
+		digest = sum[:]
+	case DigestSHA256:
+		sum := sha256.Sum256(data)
+		digest = sum[:]
+	case DigestSHA384:
+		sum := sha512.Sum384(data)
+		digest = sum[:]
+	default:
+		return nil, fmt.Errorf("unsupported digest type %d", digestType)
+	}
+	return &dnsmessage.DS{KeyTag: KeyTag(k), Algorithm: k.Algorithm, DigestType: digestType, Digest: digest}, nil
+}
+
+// matchesDS reports whether the DS record refers to the key of the zone.
+func matchesDS(zone dnsmessage.DomainName, k *dnsmessage.DNSKEY, ds *dnsmessage.DS) bool {
+	if ds.KeyTag != KeyTag(k) || ds.Algorithm != k.Algorithm {
+		return false
+	}
+	d, err := NewDS(zone, k, ds.DigestType)
+	return err == nil && bytes.Equal(d.Digest, ds.Digest)
+}
+
+// Verify checks that the signature covers the RRset and was made with the
+// key. All records of the RRset have the same owner, type and class.
+func Verify(rrset dnsmessage.ResourceRecords, sig *dnsmessage.RRSIG, key *dnsmessage.DNSKEY, now time.Time) error {
+	if len(rrset) == 0 {
+		return errors.New("empty RRset")
+	}
+	if key.Flags&dnsmessage.DNSKEYFlagZone == 0 || key.Protocol != 3 {
+		return errors.New("not a zone key")
+	}
+	if sig.KeyTag != KeyTag(key) || sig.Algorithm != key.Algorithm {
+		return errors.New("signature was made with another key")
+	}
+	if sig.TypeCovered != rrset[0].Type {
+		return fmt.Errorf("signature covers %s, not %s", sig.TypeCovered, rrset[0].Type)
+	}
+	if int(sig.Labels) > labelCount(rrset[0].Name) {
+		return errors.New("signature has more labels than the owner name")
+	}
+
+	// timestamps are compared in serial number arithmetic (RFC 1982)
+	t := uint32(now.Unix())
+	if int32(t-sig.Inception) < 0 {
+		return errors.New("signature is not valid yet")
+	}
+	if int32(sig.Expiration-t) < 0 {
+		return errors.New("signature has expired")
+	}
+
+	data := signedData(rrset, sig)
+	switch sig.Algorithm {
+	case AlgRSASHA256:
+		pub, err := rsaPublicKey(key.PublicKey)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig.Signature)
+
+	case AlgECDSAP256SHA256:
+		sum := sha256.Sum256(data)
+		return verifyECDSA(elliptic.P256(), key.PublicKey, sum[:], sig.Signature)
+
+	case AlgECDSAP384SHA384:
+		sum := sha512.Sum384(data)
+		return verifyECDSA(elliptic.P384(), key.PublicKey, sum[:], sig.Signature)
+
+	case AlgED25519:
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return errors.New("invalid Ed25519 key")
+		}
+		if !ed25519.Verify(key.PublicKey, data, sig.Signature) {
+			return errors.New("invalid Ed25519 signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %d", sig.Algorithm)
+}
+
+// rsaPublicKey decodes a key in the format of RFC 3110, section 2.
+func rsaPublicKey(b []byte) (*rsa.PublicKey, error) {
+	if len(b) < 3 {
+		return nil, errors.New("invalid RSA key")
+	}
+	expLength, offset := int(b[0]), 1
+	if expLength == 0 {
+		expLength, offset = int(binary.BigEndian.Uint16(b[1:])), 3
+	}
+	if expLength == 0 || expLength > 4 || offset+expLength >= len(b) {
+		return nil, errors.New("invalid RSA key exponent")
+	}
+
+	e := 0
+	for _, c := range b[offset : offset+expLength] {
+		e = e<<8 | int(c)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(b[offset+expLength:]), E: e}, nil
+}
+
+// verifyECDSA checks a signature made of r and s of the size of the
+// curve against a key made of the coordinates x and y (RFC 6605).
+func verifyECDSA(curve elliptic.Curve, key, hash, sig []byte) error {
+	size := (curve.Params().BitSize + 7) / 8
+	if len(key) != 2*size || len(sig) != 2*size {
+		return errors.New("invalid ECDSA key or signature size")
+	}
+	pub, err := ecdsa.ParseUncompressedPublicKey(curve, append([]byte{4}, key...))
+	if err != nil {
+		return err
+	}
+	r := new(big.Int).SetBytes(sig[:size])
+	s := new(big.Int).SetBytes(sig[size:])
+	if !ecdsa.Verify(pub, hash, r, s) {
+		return errors.New("invalid ECDSA signature")
+	}
+	return nil
+}
+
+// signedData builds the data covered by the signature: the RRSIG RDATA
+// without the signature followed by the records in canonical form and
+// order (RFC 4034, section 3.1.8.1).
+func signedData(rrset dnsmessage.ResourceRecords, sig *dnsmessage.RRSIG) []byte {
+	s := *sig
+	s.SignerName = lowerName(sig.SignerName)
+	data := s.PackHeader()
+
+	// a record synthesized from a wildcard is signed with the wildcard as owner
+	owner := rrset[0].Name
+	if labels := int(sig.Labels); labels < labelCount(owner) {
+		owner = append(dnsmessage.Domain("*"), owner[len(owner)-labels:]...)
+	}
+	name := canonicalName(owner)
+
+	rdatas := make([][]byte, 0, len(rrset))
+	for _, rr := range rrset {
+		rdatas = append(rdatas, canonicalRData(rr))
+	}
+	slices.SortFunc(rdatas, bytes.Compare)
+	rdatas = slices.CompactFunc(rdatas, bytes.Equal)
+
+	for _, rdata := range rdatas {
+		data = append(data, name...)
+		data = binary.BigEndian.AppendUint16(data, uint16(rrset[0].Type))
+		data = binary.BigEndian.AppendUint16(data, uint16(rrset[0].Class))
+		data = binary.BigEndian.AppendUint32(data, sig.OriginalTTL)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(rdata)))
+		data = append(data, rdata...)
+	}
+	return data
+}
+
+// labelCount returns the number of labels an RRSIG counts for the
+// name, a leading wildcard label isn't one of them.
+func labelCount(name dnsmessage.DomainName) int {
+	if len(name) > 0 && string(name[0]) == "*" {
+		return len(name) - 1
+	}
+	return len(name)
+}
+
+func lowerName(name dnsmessage.DomainName) dnsmessage.DomainName {
+	lower := make(dnsmessage.DomainName, len(name))
+	for i, label := range name {
+		lower[i] = slices.Clone(label)
+		lowerASCII(lower[i])
+	}
+	return lower
+}
+
+func canonicalName(name dnsmessage.DomainName) []byte {
+	return dnsmessage.PackDomainName(lowerName(name))
+}
+
+// canonicalRData lowercases the names in the RDATA of the types
+// listed in RFC 4034, section 6.2 as updated by RFC 6840, section 5.1.
+func canonicalRData(rr *dnsmessage.ResourceRecord) []byte {
+	rdata := slices.Clone(rr.RData)
+	switch rr.Type {
+	case dnsmessage.TypeNS, dnsmessage.TypeMD, dnsmessage.TypeMF, dnsmessage.TypeCNAME,
+		dnsmessage.TypeMB, dnsmessage.TypeMG, dnsmessage.TypeMR, dnsmessage.TypePTR:
+		lowerNames(rdata, 1)
+	case dnsmessage.TypeSOA, dnsmessage.TypeMINFO:
+		lowerNames(rdata, 2)
+	case dnsmessage.TypeMX:
+		if len(rdata) > 2 {
+			lowerNames(rdata[2:], 1)
+		}
+	}
+	return rdata
+}
+
+// lowerNames lowercases n consecutive uncompressed names at the start of b.
+func lowerNames(b []byte, n int) {
+	offset := 0
+	for range n {
+		for offset < len(b) && b[offset] != 0 {
+			end := min(offset+1+int(b[offset]), len(b))
+			lowerASCII(b[offset+1 : end])
+			offset = end
+		}
+		offset++
+	}
+}
+
+// lowerASCII lowercases the letters of b in place, DNS leaves
+// everything outside of ASCII as it is (RFC 4343).
+func lowerASCII(b []byte) {
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package infra
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ceiling of the smoothed RTT of failing servers, well above any query timeout
+	maxSRTT = 10 * time.Second
+	// RTT charged to a server failing before it ever answered, unless
+	// the policy has a query timeout
+	defaultFailureRTT = time.Second
+	// servers not contacted for this long are forgotten unless backed off
+	maxIdle = time.Hour
+	// how often the table looks for idle servers
+	sweepInterval = time.Minute
+	// case mismatches before a server that never preserved the case gets plain names
+	maxCaseMismatches = 2
+)
+
+// Policy decides when a failing server is backed off and for how long.
+type Policy struct {
+	MaxFails   int           // consecutive failures before the server is backed off
+	Backoff    time.Duration // first backoff, doubled with every further failure
+	MaxBackoff time.Duration
+	Timeout    time.Duration // of a query, charged to servers that never answered
+}
+
+// Table keeps the smoothed round trip time and the failure history of the
+// servers we send queries to, like the infrastructure cache of BIND or
+// Unbound. It is keyed by the address of the server.
+type Table struct {
+	mu        sync.Mutex
+	servers   map[string]*entry
+	lastSweep time.Time
+}
+
+type entry struct {
+	srtt      time.Duration
+	successes uint64
+	failures  uint64
+	// consecutive failures and the backoff they caused
+	fails     int
+	backoff   time.Duration
+	downUntil time.Time
+	// 0x20 case randomization
+	casePreserved  bool
+	caseMismatches int
+	noCase         bool
+
+	lastUsed time.Time
+}
+
+// Stats is a snapshot of what is known about a server.
+type Stats struct {
+	Addr        string
+	SRTT        time.Duration // 0 if the server was never contacted
+	Successes   uint64
+	Failures    uint64
+	Consecutive int // failures since the last success
+	DownUntil   time.Time
+}
+
+func NewTable() *Table {
+	return &Table{servers: make(map[string]*entry)}
+}
+
+func (t *Table) get(addr string) *entry {
+	now := time.Now()
+	e, ok := t.servers[addr]
+	if !ok {
+		t.sweep(now)
+		e = &entry{}
+		t.servers[addr] = e
+	}
+	e.lastUsed = now
+	return e
+}
+
+// sweep drops the servers that have been idle for maxIdle and are not
+// backed off, so that the table doesn't grow with every server ever
+// contacted during recursion.
+func (t *Table) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < sweepInterval {
+		return
+	}
+	t.lastSweep = now
+	for addr, e := range t.servers {
+		if now.Sub(e.lastUsed) > maxIdle && !now.Before(e.downUntil) {
+			delete(t.servers, addr)
+		}
+	}
+}
+
+// Success resets the failures of the server and folds the measured
+// round trip time into the smoothed value.
+func (t *Table) Success(addr string, rtt time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.get(addr)
+	e.successes++
+	e.fails = 0
+	e.backoff = 0
+	e.downUntil = time.Time{}
+	if e.srtt == 0 {
+		e.srtt = rtt
+		return
+	}
+	// same weights as the TCP SRTT estimator (RFC 6298)
+	e.srtt = (7*e.srtt + rtt) / 8
+}
+
+// Failure counts a timeout or an error reply. After MaxFails consecutive
+// failures the server is backed off, every further failure doubles the
+// backoff up to MaxBackoff. The smoothed RTT is doubled as well, up to
+// maxSRTT, so that the server is tried later even before it is backed off.
+// A server that never answered starts out with the query timeout.
+func (t *Table) Failure(addr string, p Policy) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.get(addr)
+	e.failures++
+	e.fails++
+	if e.srtt == 0 {
+		e.srtt = defaultFailureRTT
+		if p.Timeout > 0 {
+			e.srtt = p.Timeout
+		}
+	}
+	e.srtt = min(2*e.srtt, maxSRTT)
+	if e.fails < p.MaxFails {
+		return
+	}
+
+	if e.backoff == 0 {
+		e.backoff = p.Backoff
+	} else {
+		e.backoff *= 2
+	}
+	e.backoff = min(e.backoff, max(p.MaxBackoff, p.Backoff))
+	e.downUntil = time.Now().Add(e.backoff)
+}
+
+// Healthy reports whether the server is not backed off at the given time.
+func (t *Table) Healthy(addr string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.servers[addr]
+	return !ok || !now.Before(e.downUntil)
+}
+
+// RTT returns the smoothed round trip time of the server
+// or 0 if it was never contacted.
+func (t *Table) RTT(addr string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e, ok := t.servers[addr]; ok {
+		return e.srtt
+	}
+	return 0
+}
+
+// RandomizeCase reports whether the case of the question name in queries
+// to the server may be randomized (draft-vixie-dnsext-dns0x20).
+func (t *Table) RandomizeCase(addr string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.servers[addr]
+	return !ok || !e.noCase
+}
+
+// CasePreserved records a reply that echoed the randomized question name
+// exactly. Once a server did, it is never assumed to change the case again.
+func (t *Table) CasePreserved(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.get(addr)
+	e.casePreserved = true
+	e.caseMismatches = 0
+}
+
+// CaseMismatch records a reply whose question name differed only in case
+// and reports whether randomization was turned off for the server because
+// of it. Servers that rewrite the name don't get randomized names anymore.
+func (t *Table) CaseMismatch(addr string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.get(addr)
+	e.caseMismatches++
+	if e.noCase || e.casePreserved || e.caseMismatches < maxCaseMismatches {
+		return false
+	}
+	e.noCase = true
+	return true
+}
+
+func (t *Table) Stats(addr string) Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := Stats{Addr: addr}
+	if e, ok := t.servers[addr]; ok {
+		s.SRTT = e.srtt
+		s.Successes = e.successes
+		s.Failures = e.failures
+		s.Consecutive = e.fails
+		s.DownUntil = e.downUntil
+	}
+	return s
+}
+
+// Snapshot returns the stats of all servers sorted by address.
+func (t *Table) Snapshot() []Stats {
+	t.mu.Lock()
+	addrs := make([]string, 0, len(t.servers))
+	for addr := range t.servers {
+		addrs = append(addrs, addr)
+	}
+	t.mu.Unlock()
+
+	slices.Sort(addrs)
+	stats := make([]Stats, 0, len(addrs))
+	for _, addr := range addrs {
+		stats = append(stats, t.Stats(addr))
+	}
+	return stats
+}
+
+// String formats the table for debugging, one server per line.
+func (t *Table) String() string {
+	now := time.Now()
+	var sb strings.Builder
+	for _, s := range t.Snapshot() {
+		sb.WriteString(fmt.Sprintf("%s srtt: %s successes: %d failures: %d",
+			s.Addr, s.SRTT.Round(time.Microsecond), s.Successes, s.Failures))
+		if now.Before(s.DownUntil) {
+			sb.WriteString(fmt.Sprintf(" down for: %s", s.DownUntil.Sub(now).Round(time.Second)))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
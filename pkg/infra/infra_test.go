@@ -0,0 +1,133 @@
+package infra
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSuccessSmoothsRTT(t *testing.T) {
+	table := NewTable()
+	assert.Equal(t, time.Duration(0), table.RTT("192.0.2.1:53"))
+
+	table.Success("192.0.2.1:53", 80*time.Millisecond)
+	assert.Equal(t, 80*time.Millisecond, table.RTT("192.0.2.1:53"))
+
+	table.Success("192.0.2.1:53", 0)
+	assert.Equal(t, 70*time.Millisecond, table.RTT("192.0.2.1:53"))
+}
+
+func TestFailureBacksOff(t *testing.T) {
+	table := NewTable()
+	policy := Policy{MaxFails: 2, Backoff: time.Second, MaxBackoff: 3 * time.Second}
+	addr := "192.0.2.1:53"
+	table.Success(addr, 10*time.Millisecond)
+
+	table.Failure(addr, policy)
+	assert.True(t, table.Healthy(addr, time.Now()))
+	assert.Equal(t, 20*time.Millisecond, table.RTT(addr))
+
+	// the backoff doubles with every failure until it reaches the maximum
+	for _, exp := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		table.Failure(addr, policy)
+		now := time.Now()
+		assert.False(t, table.Healthy(addr, now.Add(exp-100*time.Millisecond)), exp)
+		assert.True(t, table.Healthy(addr, now.Add(exp+100*time.Millisecond)), exp)
+	}
+
+	s := table.Stats(addr)
+	assert.Equal(t, uint64(1), s.Successes)
+	assert.Equal(t, uint64(5), s.Failures)
+	assert.Equal(t, 5, s.Consecutive)
+
+	// a success ends the backoff
+	table.Success(addr, 10*time.Millisecond)
+	assert.True(t, table.Healthy(addr, time.Now()))
+	table.Failure(addr, policy)
+	table.Failure(addr, policy)
+	assert.True(t, table.Healthy(addr, time.Now().Add(time.Second+100*time.Millisecond)))
+}
+
+func TestFailureLimitsRTT(t *testing.T) {
+	table := NewTable()
+	addr := "192.0.2.1:53"
+	table.Success(addr, 30*time.Millisecond)
+
+	for range 100 {
+		table.Failure(addr, Policy{MaxFails: 3, Backoff: time.Second})
+	}
+	assert.Equal(t, maxSRTT, table.RTT(addr))
+}
+
+func TestFailureWithoutAnswer(t *testing.T) {
+	table := NewTable()
+	policy := Policy{MaxFails: 3, Backoff: time.Second, Timeout: 2 * time.Second}
+	dead, alive := "192.0.2.1:53", "192.0.2.2:53"
+
+	table.Success(alive, 50*time.Millisecond)
+	table.Failure(dead, policy)
+	// not backed off yet, but slower than any server that answers
+	assert.True(t, table.Healthy(dead, time.Now()))
+	assert.Equal(t, 4*time.Second, table.RTT(dead))
+	assert.Greater(t, table.RTT(dead), table.RTT(alive))
+
+	table.Failure("192.0.2.3:53", Policy{MaxFails: 3})
+	assert.Equal(t, 2*defaultFailureRTT, table.RTT("192.0.2.3:53"))
+}
+
+func TestSweepIdleServers(t *testing.T) {
+	table := NewTable()
+	policy := Policy{MaxFails: 1, Backoff: 2 * maxIdle}
+	table.Success("192.0.2.1:53", time.Millisecond)
+	table.Success("192.0.2.2:53", time.Millisecond)
+	table.Failure("192.0.2.3:53", policy)
+
+	// pretend the first and the backed off server haven't been used for a while
+	table.mu.Lock()
+	for _, addr := range []string{"192.0.2.1:53", "192.0.2.3:53"} {
+		table.servers[addr].lastUsed = time.Now().Add(-maxIdle - time.Minute)
+	}
+	table.lastSweep = time.Time{}
+	table.mu.Unlock()
+
+	// sweeping happens when a new server shows up
+	table.Success("192.0.2.4:53", time.Millisecond)
+	var addrs []string
+	for _, s := range table.Snapshot() {
+		addrs = append(addrs, s.Addr)
+	}
+	assert.Equal(t, []string{"192.0.2.2:53", "192.0.2.3:53", "192.0.2.4:53"}, addrs)
+}
+
+func TestSnapshot(t *testing.T) {
+	table := NewTable()
+	table.Success("192.0.2.2:53", 5*time.Millisecond)
+	table.Failure("192.0.2.1:53", Policy{MaxFails: 1, Backoff: time.Minute})
+
+	stats := table.Snapshot()
+	assert.Len(t, stats, 2)
+	assert.Equal(t, "192.0.2.1:53", stats[0].Addr)
+	assert.Equal(t, "192.0.2.2:53", stats[1].Addr)
+	assert.Equal(t, 5*time.Millisecond, stats[1].SRTT)
+
+	assert.Equal(t, "192.0.2.1:53 srtt: 2s successes: 0 failures: 1 down for: 1m0s\n"+
+		"192.0.2.2:53 srtt: 5ms successes: 1 failures: 0\n", table.String())
+}
+
+func TestCaseMismatch(t *testing.T) {
+	table := NewTable()
+	assert.True(t, table.RandomizeCase("192.0.2.1:53"))
+
+	assert.False(t, table.CaseMismatch("192.0.2.1:53"))
+	assert.True(t, table.CaseMismatch("192.0.2.1:53"))
+	assert.False(t, table.RandomizeCase("192.0.2.1:53"))
+	assert.False(t, table.CaseMismatch("192.0.2.1:53"))
+
+	// a server that preserved the case once is never given up on
+	table.CasePreserved("192.0.2.2:53")
+	for range 5 {
+		assert.False(t, table.CaseMismatch("192.0.2.2:53"))
+	}
+	assert.True(t, table.RandomizeCase("192.0.2.2:53"))
+}
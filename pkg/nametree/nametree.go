@@ -0,0 +1,133 @@
+// Package nametree maps domain names to values. Besides exact lookups it
+// finds the value of the longest suffix of a name, like the zone a name is
+// in or the forwarding rule it falls under.
+package nametree
+
+import (
+	"encoding/binary"
+
+	"server/pkg/dnsmessage"
+)
+
+// Tree maps domain names to values, the names are compared
+// case-insensitively. Lookups may run concurrently, changes may not.
+//
+// The names form a tree of labels starting at the root. All edges of the
+// tree are kept in a single map keyed on the parent and the label in lower
+// case, so a million names don't need a map for every node.
+type Tree[V any] struct {
+	edges map[string]uint32
+	nodes []entry[V] // the root first
+	len   int
+}
+
+type entry[V any] struct {
+	value V
+	ok    bool
+}
+
+func New[V any]() *Tree[V] {
+	return &Tree[V]{edges: make(map[string]uint32), nodes: make([]entry[V], 1)}
+}
+
+// Len returns the number of names in the tree.
+func (t *Tree[V]) Len() int {
+	return t.len
+}
+
+// Insert sets the value of the name, replacing the previous one.
+func (t *Tree[V]) Insert(name dnsmessage.DomainName, value V) {
+	var buf [4 + 63]byte
+	node := uint32(0)
+	for i := len(name) - 1; i >= 0; i-- {
+		key := edgeKey(buf[:0], node, name[i])
+		child, ok := t.edges[string(key)]
+		if !ok {
+			child = uint32(len(t.nodes))
+			t.nodes = append(t.nodes, entry[V]{})
+			t.edges[string(key)] = child
+		}
+		node = child
+	}
+	if !t.nodes[node].ok {
+		t.len++
+	}
+	t.nodes[node] = entry[V]{value: value, ok: true}
+}
+
+// Delete removes the name and reports whether it was in the tree.
+// The labels stay in the tree for names that are inserted again.
+func (t *Tree[V]) Delete(name dnsmessage.DomainName) bool {
+	node, matched := t.walk(name, nil)
+	if matched < len(name) || !t.nodes[node].ok {
+		return false
+	}
+	t.nodes[node] = entry[V]{}
+	t.len--
+	return true
+}
+
+// Get returns the value of the name.
+func (t *Tree[V]) Get(name dnsmessage.DomainName) (V, bool) {
+	node, matched := t.walk(name, nil)
+	if matched < len(name) {
+		var zero V
+		return zero, false
+	}
+	return t.nodes[node].value, t.nodes[node].ok
+}
+
+// Match returns the value of the longest name in the tree
+// that is equal to or a parent of the name.
+func (t *Tree[V]) Match(name dnsmessage.DomainName) (V, bool) {
+	best := t.nodes[0]
+	t.walk(name, func(node uint32) {
+		if t.nodes[node].ok {
+			best = t.nodes[node]
+		}
+	})
+	return best.value, best.ok
+}
+
+// Values returns the values of all names in the order
+// the names were first inserted.
+func (t *Tree[V]) Values() []V {
+	values := make([]V, 0, t.len)
+	for _, e := range t.nodes {
+		if e.ok {
+			values = append(values, e.value)
+		}
+	}
+	return values
+}
+
+// walk follows the labels of the name from the root as far as the tree
+// goes and calls f for every node below the root on the way. It returns
+// the last node and the number of labels that lead to it.
+func (t *Tree[V]) walk(name dnsmessage.DomainName, f func(node uint32)) (uint32, int) {
+	var buf [4 + 63]byte
+	node := uint32(0)
+	for i := len(name) - 1; i >= 0; i-- {
+		child, ok := t.edges[string(edgeKey(buf[:0], node, name[i]))]
+		if !ok {
+			return node, len(name) - 1 - i
+		}
+		node = child
+		if f != nil {
+			f(node)
+		}
+	}
+	return node, len(name)
+}
+
+// edgeKey appends the parent and the label in lower case to b.
+func edgeKey(b []byte, parent uint32, label []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, parent)
+	for _, c := range label {
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		b = append(b, c)
+	}
+	return b
+}
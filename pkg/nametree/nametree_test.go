@@ -0,0 +1,145 @@
+package nametree
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+
+	"server/pkg/dnsmessage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTree(t *testing.T) {
+	tree := New[string]()
+	for _, name := range []string{"example", "www.example", "Lab.Corp.Internal", "a.b.c.example"} {
+		tree.Insert(dnsmessage.ParseDomainName(name), name)
+	}
+	assert.Equal(t, 4, tree.Len())
+	assert.Equal(t, []string{"example", "www.example", "Lab.Corp.Internal", "a.b.c.example"}, tree.Values())
+
+	tests := []struct {
+		name  string
+		get   string
+		match string
+	}{
+		{name: "example", get: "example", match: "example"},
+		{name: "WWW.example", get: "www.example", match: "www.example"},
+		{name: "mail.www.example", match: "www.example"},
+		{name: "lab.corp.internal", get: "Lab.Corp.Internal", match: "Lab.Corp.Internal"},
+		{name: "printer.LAB.corp.internal", match: "Lab.Corp.Internal"},
+		{name: "corp.internal"},
+		// labels without a value on the way
+		{name: "b.c.example", match: "example"},
+		{name: "x.a.b.c.example", match: "a.b.c.example"},
+		{name: "other"},
+		{name: "."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := dnsmessage.ParseDomainName(tt.name)
+			v, ok := tree.Get(name)
+			assert.Equal(t, tt.get != "", ok)
+			assert.Equal(t, tt.get, v)
+			v, ok = tree.Match(name)
+			assert.Equal(t, tt.match != "", ok)
+			assert.Equal(t, tt.match, v)
+		})
+	}
+}
+
+func TestTreeChanges(t *testing.T) {
+	tree := New[int]()
+	www := dnsmessage.ParseDomainName("www.example")
+	tree.Insert(www, 1)
+	tree.Insert(dnsmessage.ParseDomainName("WWW.EXAMPLE"), 2)
+	assert.Equal(t, 1, tree.Len())
+	v, _ := tree.Get(www)
+	assert.Equal(t, 2, v)
+
+	// the root matches every name
+	tree.Insert(dnsmessage.DomainName{}, 0)
+	v, ok := tree.Match(dnsmessage.ParseDomainName("other"))
+	assert.True(t, ok)
+	assert.Equal(t, 0, v)
+
+	assert.False(t, tree.Delete(dnsmessage.ParseDomainName("example")))
+	assert.False(t, tree.Delete(dnsmessage.ParseDomainName("a.www.example")))
+	assert.True(t, tree.Delete(www))
+	assert.False(t, tree.Delete(www))
+	assert.Equal(t, 1, tree.Len())
+	_, ok = tree.Get(www)
+	assert.False(t, ok)
+	assert.Equal(t, []int{0}, tree.Values())
+	v, _ = tree.Match(www)
+	assert.Equal(t, 0, v)
+}
+
+// benchNames returns a million names like a big blocklist.
+func benchNames() []dnsmessage.DomainName {
+	names := make([]dnsmessage.DomainName, 1<<20)
+	for i := range names {
+		names[i] = dnsmessage.ParseDomainName(fmt.Sprintf("ads%d.tracker%d.com", i, i%4096))
+	}
+	return names
+}
+
+func benchTree(names []dnsmessage.DomainName) *Tree[int] {
+	tree := New[int]()
+	for i, name := range names {
+		tree.Insert(name, i)
+	}
+	return tree
+}
+
+func BenchmarkInsert(b *testing.B) {
+	names := benchNames()
+	perName := heapPerName(names)
+	for b.Loop() {
+		benchTree(names)
+	}
+	b.ReportMetric(perName, "heap-B/name")
+}
+
+// heapPerName returns the bytes on the heap a tree of the names takes per name.
+func heapPerName(names []dnsmessage.DomainName) float64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	tree := benchTree(names)
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(tree)
+	return float64(int64(after.HeapAlloc)-int64(before.HeapAlloc)) / float64(len(names))
+}
+
+func BenchmarkGet(b *testing.B) {
+	names := benchNames()
+	tree := benchTree(names)
+	name := names[len(names)/2]
+	for b.Loop() {
+		if _, ok := tree.Get(name); !ok {
+			b.Fatal("name not found")
+		}
+	}
+}
+
+func BenchmarkMatch(b *testing.B) {
+	tree := benchTree(benchNames())
+	name := dnsmessage.ParseDomainName("cdn.img.ads12345.tracker57.com")
+	for b.Loop() {
+		if _, ok := tree.Match(name); !ok {
+			b.Fatal("no match")
+		}
+	}
+}
+
+func BenchmarkMatchMiss(b *testing.B) {
+	tree := benchTree(benchNames())
+	name := dnsmessage.ParseDomainName("www.example.org")
+	for b.Loop() {
+		if _, ok := tree.Match(name); ok {
+			b.Fatal("unexpected match")
+		}
+	}
+}
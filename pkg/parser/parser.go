@@ -3,6 +3,7 @@ package parser
 import (
 	"errors"
 	"fmt"
+	"slices"
 
 	"server/pkg/bitvec"
 	"server/pkg/dnsmessage"
@@ -243,9 +244,13 @@ func (p *Parser) parseRR() (*dnsmessage.ResourceRecord, error) {
 		return nil, fmt.Errorf("failed to parse length of additional data for resource record: %w", err)
 	}
 	rr.RdLength = rdLength
+	if rdLength == 0 && (rr.Class == dnsmessage.ClassANY || rr.Class == dnsmessage.ClassNONE) {
+		// prerequisites and deletions of dynamic updates
+		// without RDATA (RFC 2136, section 2.4 and 2.5)
+		return &rr, nil
+	}
 
-	// TODO: parse RData [page 12]
-	rData, err := p.parseRData(rr.Type)
+	rData, err := p.parseRData(rr.Type, int(rdLength))
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse RDATA: %w", err)
 	}
@@ -253,7 +258,9 @@ func (p *Parser) parseRR() (*dnsmessage.ResourceRecord, error) {
 	return &rr, nil
 }
 
-func (p *Parser) parseRData(rType dnsmessage.RRType) ([]byte, error) {
+// parseRData returns the RDATA in its wire format with
+// compressed domain names expanded
+func (p *Parser) parseRData(rType dnsmessage.RRType, rdLength int) ([]byte, error) {
 	switch t := int(rType); t {
 	// A
 	case 1:
@@ -264,70 +271,71 @@ func (p *Parser) parseRData(rType dnsmessage.RRType) ([]byte, error) {
 		}
 		return v, nil
 
-	// NS
-	case 2:
-		// this should never reach our server
-		log.Debug("parsing NS RDATA")
-		v, err := p.ParseLabels(false, -1)
+	// NS (2) - authoritative name server
+	// MD (3) - mail destination - obsolete
+	// MF (4) - mail forwarder - obsolete
+	// CNAME (5) - canonical name
+	// MB (7) - mailbox domain name - experimental
+	// MG (8) - mail group member - experimental
+	// MR (9) - mail rename domain name - experimental
+	// PTR (12) - domain name pointer
+	case 2, 3, 4, 5, 7, 8, 9, 12:
+		log.Debug("parsing %s RDATA", rType)
+		v, err := p.parseNames(1)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse domain name in NS RDATA: %w", err)
+			return nil, fmt.Errorf("failed to parse domain name in %s RDATA: %w", rType, err)
 		}
-		flattened := []byte{}
-		for _, label := range v {
-			flattened = append(flattened, label...)
-		}
-		return flattened, nil
+		return v, nil
 
-	// MD (3) - mail destination - obsolete
-	// MF (4) - mail forwarder - obsolete
-	// SOA (6) - marks the start of a zone of authority (not sure if we need this now)
-	// MB (7) - mailbox domain name - experimental (we choose to reject)
-	// MG (8) - main group member - experimental (we choose to reject)
-	// MR (9) - main rename domain name - experimental (we choose to reject)
-	// MINFO (14) - mailbox or mail list info - experimental (we choose to reject)
-	// MX (15) - mail exchange (we choose to reject for now)
-	case 3, 4, 6, 7, 8, 9, 14, 15:
-		// TODO: unimplemented
-		return nil, fmt.Errorf("unimplemented %d type", t)
-
-	// CNAME
-	case 5:
-		log.Debug("parsing CNAME RDATA")
-		v, err := p.ParseLabels(false, -1)
+	// SOA - marks the start of a zone of authority
+	case 6:
+		log.Debug("parsing SOA RDATA")
+		names, err := p.parseNames(2)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse domain name in CNAME RDATA: %w", err)
+			return nil, fmt.Errorf("failed to parse domain names in SOA RDATA: %w", err)
 		}
-		flattened := []byte{}
-		for _, label := range v {
-			flattened = append(flattened, label...)
+		// serial, refresh, retry, expire, minimum
+		v, err := p.vec.ReadBytes(20)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SOA RDATA: %w", err)
 		}
-		return flattened, nil
+		return append(names, v...), nil
 
-	// NULL RDATA - ignore
-	case 10:
-		return []byte{}, nil
-
-	// WKS - a well known service description
-	case 11:
-		// TODO
-		return nil, fmt.Errorf("unimplemented %d type", t)
+	// MINFO - mailbox or mail list info
+	case 14:
+		log.Debug("parsing MINFO RDATA")
+		v, err := p.parseNames(2)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse domain names in MINFO RDATA: %w", err)
+		}
+		return v, nil
 
-	// PTR
-	case 12:
-		log.Debug("parsing PTR RDATA")
-		v, err := p.ParseLabels(false, -1)
+	// MX - mail exchange
+	case 15:
+		log.Debug("parsing MX RDATA")
+		preference, err := p.vec.ReadBytes(2)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse domain name in PTR RDATA: %w", err)
+			return nil, fmt.Errorf("failed to parse preference in MX RDATA: %w", err)
 		}
-		flattened := []byte{}
-		for _, label := range v {
-			flattened = append(flattened, label...)
+		v, err := p.parseNames(1)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse domain name in MX RDATA: %w", err)
+		}
+		return append(slices.Clone(preference), v...), nil
+
+	// NULL (10) - anything at all
+	// WKS (11) - a well known service description
+	// HINFO (13) - host info
+	// TXT (16) - text strings
+	// none of them contains domain names so they are taken as they are
+	case 10, 11, 13, 16:
+		log.Debug("parsing %s RDATA", rType)
+		v, err := p.vec.ReadBytes(rdLength)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s RDATA: %w", rType, err)
 		}
-		return flattened, nil
+		return v, nil
 
-	// HINFO - host info
-	case 13:
-		return nil, fmt.Errorf("unknown RR TYPE: %d", t)
 	case 28:
 		log.Debug("parsing type AAAA RDATA")
 		v, err := p.vec.ReadBytes(16)
@@ -335,12 +343,83 @@ func (p *Parser) parseRData(rType dnsmessage.RRType) ([]byte, error) {
 			return nil, fmt.Errorf("failed to parse type AAAA RDATA: %w", err)
 		}
 		return v, nil
+
+	// OPT - EDNS options, taken as they are
+	case 41:
+		log.Debug("parsing OPT RDATA")
+		v, err := p.vec.ReadBytes(rdLength)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse OPT RDATA: %w", err)
+		}
+		return v, nil
+
+	// DS (43), RRSIG (46), NSEC (47), DNSKEY (48), NSEC3 (50),
+	// NSEC3PARAM (51), CDS (59), CDNSKEY (60) - DNSSEC
+	// names in them are never compressed (RFC 4034, section 6.2)
+	// so the RDATA is taken as it is once it is known to be well-formed
+	case 43, 46, 47, 48, 50, 51, 59, 60:
+		log.Debug("parsing %s RDATA", rType)
+		v, err := p.vec.ReadBytes(rdLength)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s RDATA: %w", rType, err)
+		}
+		if err := checkDNSSECRData(rType, v); err != nil {
+			return nil, fmt.Errorf("invalid %s RDATA: %w", rType, err)
+		}
+		return v, nil
+
+	// TSIG - transaction signature, the algorithm name
+	// is never compressed (RFC 8945, section 4.2)
+	case 250:
+		log.Debug("parsing TSIG RDATA")
+		v, err := p.vec.ReadBytes(rdLength)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse TSIG RDATA: %w", err)
+		}
+		if _, err := dnsmessage.UnpackTSIG(v); err != nil {
+			return nil, fmt.Errorf("invalid TSIG RDATA: %w", err)
+		}
+		return v, nil
+
 		// reject
 	default:
 		return nil, fmt.Errorf("UNKNOWN(%d)", t)
 	}
 }
 
+func checkDNSSECRData(rType dnsmessage.RRType, rdata []byte) error {
+	var err error
+	switch rType {
+	case dnsmessage.TypeDS, dnsmessage.TypeCDS:
+		_, err = dnsmessage.UnpackDS(rdata)
+	case dnsmessage.TypeDNSKEY, dnsmessage.TypeCDNSKEY:
+		_, err = dnsmessage.UnpackDNSKEY(rdata)
+	case dnsmessage.TypeRRSIG:
+		_, err = dnsmessage.UnpackRRSIG(rdata)
+	case dnsmessage.TypeNSEC:
+		_, err = dnsmessage.UnpackNSEC(rdata)
+	case dnsmessage.TypeNSEC3:
+		_, err = dnsmessage.UnpackNSEC3(rdata)
+	case dnsmessage.TypeNSEC3PARAM:
+		_, err = dnsmessage.UnpackNSEC3PARAM(rdata)
+	}
+	return err
+}
+
+// parseNames reads n consecutive, possibly compressed domain names
+// and returns them in the uncompressed wire format
+func (p *Parser) parseNames(n int) ([]byte, error) {
+	v := []byte{}
+	for range n {
+		name, err := p.ParseLabels(false, -1)
+		if err != nil {
+			return nil, err
+		}
+		v = append(v, dnsmessage.PackDomainName(name)...)
+	}
+	return v, nil
+}
+
 func (p *Parser) ParseHeader() error {
 	header := dnsmessage.Header{}
 
@@ -180,7 +180,7 @@ func TestParseAnswer(t *testing.T) {
 			Class:    dnsmessage.RRClass(1),
 			TTL:      uint32(1589),
 			RdLength: uint32(28),
-			RData:    []byte("kristina-pianykhgithubio"),
+			RData:    []byte("\x10kristina-pianykh\x06github\x02io\x00"),
 		},
 		{
 			Name:     dnsmessage.Domain("kristina-pianykh", "github", "io"),
@@ -259,3 +259,160 @@ func TestParseMessage(t *testing.T) {
 	assert.Len(t, p.Message.AuthorityRecords, 4)
 	assert.Len(t, p.Message.AdditonalRecords, 8)
 }
+
+func TestPackRoundTrip(t *testing.T) {
+	messages := []string{
+		"deb1818000010001000000000377777706676f6f676c6503636f6d0000010001c00c000100010000001300048efabaa4",
+		"948181800001000500000000086b72697374696e61077069616e796b680378797a0000010001c00c0005000100000635001c106b72697374696e612d7069616e796b680667697468756202696f00c0320001000100000c9b0004b9c76f99c0320001000100000c9b0004b9c76d99c0320001000100000c9b0004b9c76c99c0320001000100000c9b0004b9c76e99",
+		"04068000000100000004000806676f6f676c6503636f6d0000020001c00c000200010002a3000006036e7332c00cc00c000200010002a3000006036e7331c00cc00c000200010002a3000006036e7333c00cc00c000200010002a3000006036e7334c00cc028001c00010002a30000102001486048020034000000000000000ac028000100010002a3000004d8ef220ac03a001c00010002a30000102001486048020032000000000000000ac03a000100010002a3000004d8ef200ac04c001c00010002a30000102001486048020036000000000000000ac04c000100010002a3000004d8ef240ac05e001c00010002a30000102001486048020038000000000000000ac05e000100010002a3000004d8ef260a",
+	}
+	for _, message := range messages {
+		input, err := hex.DecodeString(message)
+		assert.NoError(t, err)
+
+		p, err := NewParser(input)
+		assert.NoError(t, err)
+		assert.NoError(t, p.ParseMessage())
+
+		packed, err := p.Message.Pack()
+		assert.NoError(t, err)
+
+		repacked, err := NewParser(packed)
+		assert.NoError(t, err)
+		assert.NoError(t, repacked.ParseMessage())
+
+		assert.Equal(t, p.Message.Header.Pack(), repacked.Message.Header.Pack())
+		assert.Equal(t, p.Message.Question, repacked.Message.Question)
+		assert.Equal(t, len(p.Message.Answers), len(repacked.Message.Answers))
+		for i, rr := range p.Message.Answers {
+			assert.Equal(t, rr.RData, repacked.Message.Answers[i].RData)
+			assert.Equal(t, rr.RDataString(), repacked.Message.Answers[i].RDataString())
+		}
+		assert.Equal(t, len(p.Message.AuthorityRecords), len(repacked.Message.AuthorityRecords))
+		assert.Equal(t, len(p.Message.AdditonalRecords), len(repacked.Message.AdditonalRecords))
+	}
+}
+
+func TestParseSOAAndMX(t *testing.T) {
+	// NXDOMAIN for nonexistent.pianykh.xyz with the SOA in the authority section
+	// and an MX record in the additional one
+	soa := dnsmessage.SOA{
+		MName:   dnsmessage.Domain("ns1", "pianykh", "xyz"),
+		RName:   dnsmessage.Domain("hostmaster", "pianykh", "xyz"),
+		Serial:  2024010101,
+		Refresh: 7200,
+		Retry:   3600,
+		Expire:  1209600,
+		Minimum: 300,
+	}
+	mx := append([]byte{0, 10}, dnsmessage.PackDomainName(dnsmessage.Domain("mail", "pianykh", "xyz"))...)
+
+	m := dnsmessage.DNSMessage{
+		Header: &dnsmessage.Header{ID: 1, QR: 1, RCode: dnsmessage.RCodeNameError},
+		Question: &dnsmessage.Question{
+			QName:  dnsmessage.Domain("nonexistent", "pianykh", "xyz"),
+			QType:  dnsmessage.TypeA,
+			QClass: dnsmessage.ClassIN,
+		},
+		AuthorityRecords: dnsmessage.ResourceRecords{{
+			Name: dnsmessage.Domain("pianykh", "xyz"), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassIN, TTL: 300, RData: soa.Pack(),
+		}},
+		AdditonalRecords: dnsmessage.ResourceRecords{{
+			Name: dnsmessage.Domain("pianykh", "xyz"), Type: dnsmessage.TypeMX, Class: dnsmessage.ClassIN, TTL: 300, RData: mx,
+		}},
+	}
+	data, err := m.Pack()
+	assert.NoError(t, err)
+
+	p, err := NewParser(data)
+	assert.NoError(t, err)
+	assert.NoError(t, p.ParseMessage())
+
+	assert.Equal(t, dnsmessage.RCodeNameError, p.Message.Header.RCode)
+	assert.Len(t, p.Message.AuthorityRecords, 1)
+	parsed, err := dnsmessage.UnpackSOA(p.Message.AuthorityRecords[0].RData)
+	assert.NoError(t, err)
+	assert.Equal(t, soa, *parsed)
+	assert.Equal(t, "ns1.pianykh.xyz. hostmaster.pianykh.xyz. 2024010101 7200 3600 1209600 300", p.Message.AuthorityRecords[0].RDataString())
+	assert.Equal(t, "10 mail.pianykh.xyz.", p.Message.AdditonalRecords[0].RDataString())
+}
+
+func TestParseDNSSEC(t *testing.T) {
+	zone := dnsmessage.Domain("example", "com")
+	sig := dnsmessage.RRSIG{
+		TypeCovered: dnsmessage.TypeA, Algorithm: 13, Labels: 3, OriginalTTL: 300,
+		Expiration: 1700000000, Inception: 1690000000, KeyTag: 12345,
+		SignerName: zone, Signature: []byte{1, 2, 3, 4},
+	}
+	nsec := dnsmessage.NSEC{NextDomain: dnsmessage.Domain("www", "example", "com"), Types: []dnsmessage.RRType{dnsmessage.TypeA, dnsmessage.TypeRRSIG, dnsmessage.TypeNSEC}}
+	key := dnsmessage.DNSKEY{Flags: 257, Protocol: 3, Algorithm: 13, PublicKey: []byte{5, 6, 7, 8}}
+	ds := dnsmessage.DS{KeyTag: 12345, Algorithm: 13, DigestType: 2, Digest: []byte{0xab, 0xcd}}
+
+	name := dnsmessage.Domain("mail", "example", "com")
+	m := dnsmessage.DNSMessage{
+		Header:   &dnsmessage.Header{ID: 1, QR: 1},
+		Question: &dnsmessage.Question{QName: name, QType: dnsmessage.TypeA, QClass: dnsmessage.ClassIN},
+		Answers: dnsmessage.ResourceRecords{
+			{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassIN, TTL: 300, RData: []byte{192, 0, 2, 1}},
+			{Name: name, Type: dnsmessage.TypeRRSIG, Class: dnsmessage.ClassIN, TTL: 300, RData: sig.Pack()},
+		},
+		AuthorityRecords: dnsmessage.ResourceRecords{
+			{Name: name, Type: dnsmessage.TypeNSEC, Class: dnsmessage.ClassIN, TTL: 300, RData: nsec.Pack()},
+			{Name: zone, Type: dnsmessage.TypeDNSKEY, Class: dnsmessage.ClassIN, TTL: 300, RData: key.Pack()},
+			{Name: zone, Type: dnsmessage.TypeCDS, Class: dnsmessage.ClassIN, TTL: 300, RData: ds.Pack()},
+		},
+	}
+	data, err := m.Pack()
+	assert.NoError(t, err)
+
+	p, err := NewParser(data)
+	assert.NoError(t, err)
+	assert.NoError(t, p.ParseMessage())
+
+	assert.Len(t, p.Message.Answers, 2)
+	parsedSig, err := dnsmessage.UnpackRRSIG(p.Message.Answers[1].RData)
+	assert.NoError(t, err)
+	assert.Equal(t, sig, *parsedSig)
+	assert.Equal(t, "A 13 3 300 20231114221320 20230722042640 12345 example.com. AQIDBA==", p.Message.Answers[1].RDataString())
+
+	assert.Len(t, p.Message.AuthorityRecords, 3)
+	assert.Equal(t, "www.example.com. A RRSIG NSEC", p.Message.AuthorityRecords[0].RDataString())
+	assert.Equal(t, "257 3 13 BQYHCA==", p.Message.AuthorityRecords[1].RDataString())
+	assert.Equal(t, "12345 13 2 ABCD", p.Message.AuthorityRecords[2].RDataString())
+
+	// a broken type bitmap makes the message invalid
+	m.AuthorityRecords[0].RData = append(dnsmessage.PackDomainName(nsec.NextDomain), 0, 0)
+	data, err = m.Pack()
+	assert.NoError(t, err)
+	p, err = NewParser(data)
+	assert.NoError(t, err)
+	assert.Error(t, p.ParseMessage())
+}
+
+func TestParseUpdate(t *testing.T) {
+	name := dnsmessage.ParseDomainName("host.example")
+	m := dnsmessage.DNSMessage{
+		Header:   &dnsmessage.Header{ID: 7, OpCode: dnsmessage.OpCodeUpdate},
+		Question: &dnsmessage.Question{QName: dnsmessage.ParseDomainName("example"), QType: dnsmessage.TypeSOA, QClass: dnsmessage.ClassIN},
+		// the name has an A record
+		Answers: dnsmessage.ResourceRecords{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassANY}},
+		AuthorityRecords: dnsmessage.ResourceRecords{
+			{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassANY},
+			{Name: name, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassNONE, RData: make([]byte, 16)},
+			{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassIN, TTL: 60, RData: []byte{192, 0, 2, 1}},
+		},
+	}
+	data, err := m.Pack()
+	assert.NoError(t, err)
+
+	p, err := NewParser(data)
+	assert.NoError(t, err)
+	assert.NoError(t, p.ParseMessage())
+	assert.Equal(t, uint64(dnsmessage.OpCodeUpdate), p.Message.Header.OpCode)
+	assert.Len(t, p.Message.Answers, 1)
+	assert.Empty(t, p.Message.Answers[0].RData)
+	assert.Len(t, p.Message.AuthorityRecords, 3)
+	assert.Empty(t, p.Message.AuthorityRecords[0].RData)
+	assert.Equal(t, make([]byte, 16), p.Message.AuthorityRecords[1].RData)
+	assert.Equal(t, []byte{192, 0, 2, 1}, p.Message.AuthorityRecords[2].RData)
+}
@@ -0,0 +1,104 @@
+package resolver
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"server/pkg/dnsmessage"
+)
+
+// infraCache remembers the name servers of the zones we have been
+// referred to and the addresses of those name servers, so that later
+// lookups can start at the closest known delegation instead of the root.
+type infraCache struct {
+	mu    sync.Mutex
+	zones map[string]delegation
+	hosts map[string]hostEntry
+}
+
+type delegation struct {
+	servers []dnsmessage.DomainName
+	expires time.Time
+}
+
+type hostEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+func newInfraCache() *infraCache {
+	return &infraCache{
+		zones: make(map[string]delegation),
+		hosts: make(map[string]hostEntry),
+	}
+}
+
+func cacheKey(name dnsmessage.DomainName) string {
+	return strings.ToLower(dnsmessage.DomainNameToString(name))
+}
+
+func (c *infraCache) addDelegation(zone dnsmessage.DomainName, servers []dnsmessage.DomainName, ttl uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.zones[cacheKey(zone)] = delegation{
+		servers: servers,
+		expires: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// addHost adds addresses of a name server to the ones already known.
+func (c *infraCache) addHost(name dnsmessage.DomainName, addrs []netip.Addr, ttl uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	key := cacheKey(name)
+	entry, ok := c.hosts[key]
+	if !ok || now.After(entry.expires) {
+		entry = hostEntry{expires: now.Add(time.Duration(ttl) * time.Second)}
+	}
+	for _, addr := range addrs {
+		if !slices.Contains(entry.addrs, addr) {
+			entry.addrs = append(entry.addrs, addr)
+		}
+	}
+	c.hosts[key] = entry
+}
+
+func (c *infraCache) host(name dnsmessage.DomainName) []netip.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.hosts[cacheKey(name)]
+	if !ok || time.Now().After(entry.expires) {
+		return nil
+	}
+	return slices.Clone(entry.addrs)
+}
+
+// closest returns the deepest zone enclosing name whose name servers have
+// known addresses. ok is false if nothing is known and we have to start at the root.
+func (c *infraCache) closest(name dnsmessage.DomainName) (dnsmessage.DomainName, []netip.Addr, bool) {
+	for i := range len(name) {
+		zone := name[i:]
+
+		c.mu.Lock()
+		d, ok := c.zones[cacheKey(zone)]
+		c.mu.Unlock()
+		if !ok || time.Now().After(d.expires) {
+			continue
+		}
+
+		addrs := []netip.Addr{}
+		for _, server := range d.servers {
+			addrs = append(addrs, c.host(server)...)
+		}
+		if len(addrs) > 0 {
+			return zone, addrs, true
+		}
+	}
+	return nil, nil, false
+}
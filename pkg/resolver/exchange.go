@@ -0,0 +1,108 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/log"
+	"server/pkg/parser"
+	"server/pkg/transport"
+)
+
+// exchange sends a single non-recursive query to a name server. A truncated
+// reply over UDP makes us ask again over TCP (RFC 7766, section 5).
+func (r *Resolver) exchange(ctx context.Context, server netip.AddrPort, q *dnsmessage.Question) (*dnsmessage.DNSMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	h := dnsmessage.Header{ID: uint32(rand.IntN(1 << 16)), QdCount: 1}
+	query := append(h.Pack(), q.Pack()...)
+
+	resp, err := exchangeUDP(ctx, server, query, h.ID, q)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.TC == 1 {
+		log.Debug("reply from %s for %s is truncated, retrying over TCP", server, q.String())
+		return exchangeTCP(ctx, server, query, h.ID, q)
+	}
+	return resp, nil
+}
+
+func exchangeUDP(ctx context.Context, server netip.AddrPort, query []byte, id uint32, q *dnsmessage.Question) (*dnsmessage.DNSMessage, error) {
+	// a connected socket only receives datagrams from the server
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", server.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, dnsmessage.MaxMessageLength)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		m, err := parseReply(buf[:n], id, q)
+		if err != nil {
+			// keep waiting, the reply to our query might still come
+			log.Debug("ignoring reply from %s: %v", server, err)
+			continue
+		}
+		return m, nil
+	}
+}
+
+func exchangeTCP(ctx context.Context, server netip.AddrPort, query []byte, id uint32, q *dnsmessage.Question) (*dnsmessage.DNSMessage, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", server.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if err := transport.WriteMessage(conn, query); err != nil {
+		return nil, err
+	}
+	data, err := transport.ReadMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	return parseReply(data, id, q)
+}
+
+func parseReply(data []byte, id uint32, q *dnsmessage.Question) (*dnsmessage.DNSMessage, error) {
+	p, err := parser.NewParser(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.ParseMessage(); err != nil {
+		return nil, fmt.Errorf("failed to parse reply: %w", err)
+	}
+
+	m := p.Message
+	switch {
+	case m.Header.ID != id:
+		return nil, fmt.Errorf("reply has ID %d instead of %d", m.Header.ID, id)
+	case m.IsQuery():
+		return nil, errors.New("got a query instead of a reply")
+	case m.Question == nil || !dnsmessage.EqualNames(m.Question.QName, q.QName) ||
+		m.Question.QType != q.QType || m.Question.QClass != q.QClass:
+		return nil, errors.New("reply is for a different question")
+	}
+	return m, nil
+}
@@ -0,0 +1,411 @@
+package resolver
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/infra"
+	"server/pkg/log"
+)
+
+const (
+	DefaultPort    = 53
+	DefaultTimeout = 2 * time.Second
+)
+
+const (
+	maxReferrals = 16
+	maxCNAMEs    = 8
+	// how deep lookups of name server addresses for glueless delegations may nest
+	maxDepth = 4
+	// back off name servers that fail twice in a row
+	maxFails   = 2
+	backoff    = 5 * time.Second
+	maxBackoff = 5 * time.Minute
+	// limits of QNAME minimisation (RFC 9156, section 2.3)
+	maxMinimiseCount = 10
+	minimiseOneLab   = 4
+)
+
+type Config struct {
+	Enabled   bool          `yaml:"enabled"`
+	RootHints []string      `yaml:"root_hints"` // addresses of the root servers, the built-in hints if empty
+	Port      int           `yaml:"port"`       // port the name servers listen on
+	Timeout   time.Duration `yaml:"timeout"`    // for a single query to a name server
+	// only send name servers the labels they need to know (RFC 9156)
+	QNameMinimisation bool `yaml:"qname_minimisation"`
+}
+
+// Resolver resolves names iteratively starting at the root servers
+// (RFC 1034, section 5.3.3). The delegations it learns on the way
+// are cached so that the root isn't asked every time.
+type Resolver struct {
+	roots    []netip.Addr
+	port     uint16
+	timeout  time.Duration
+	minimise bool
+	cache    *infraCache
+	// round trip times and failures of the name servers
+	infra *infra.Table
+}
+
+// NewResolver creates a resolver that keeps the health of the name servers
+// in table which may be shared with the upstreams, nil means a table of its own.
+func NewResolver(cfg *Config, table *infra.Table) (*Resolver, error) {
+	hints := cfg.RootHints
+	if len(hints) == 0 {
+		hints = rootHints
+	}
+
+	roots := make([]netip.Addr, 0, len(hints))
+	for _, h := range hints {
+		addr, err := netip.ParseAddr(h)
+		if err != nil {
+			return nil, fmt.Errorf("invalid root hint %q: %w", h, err)
+		}
+		roots = append(roots, addr)
+	}
+
+	r := Resolver{
+		roots:    roots,
+		port:     DefaultPort,
+		timeout:  DefaultTimeout,
+		minimise: cfg.QNameMinimisation,
+		cache:    newInfraCache(),
+		infra:    table,
+	}
+	if r.infra == nil {
+		r.infra = infra.NewTable()
+	}
+	if cfg.Port != 0 {
+		r.port = uint16(cfg.Port)
+	}
+	if cfg.Timeout > 0 {
+		r.timeout = cfg.Timeout
+	}
+	return &r, nil
+}
+
+// Resolve answers the question. The returned message carries the response
+// code and the authority section of the final reply, its answers are
+// preceded by the CNAME records that led there.
+func (r *Resolver) Resolve(ctx context.Context, q *dnsmessage.Question) (*dnsmessage.DNSMessage, error) {
+	return r.resolve(ctx, q, 0)
+}
+
+func (r *Resolver) resolve(ctx context.Context, q *dnsmessage.Question, depth int) (*dnsmessage.DNSMessage, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("giving up on %s: too many nested lookups", q.String())
+	}
+
+	name := q.QName
+	chain := dnsmessage.ResourceRecords{}
+	for range maxCNAMEs {
+		resp, zone, err := r.iterate(ctx, &dnsmessage.Question{QName: name, QType: q.QType, QClass: q.QClass}, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		records, next := answerFor(resp.Answers, zone, name, q.QType)
+		chain = append(chain, records...)
+		if next == nil {
+			resp.Answers = chain
+			resp.AdditonalRecords = nil
+			return resp, nil
+		}
+		log.Debug("following CNAME chain of %s to %s", dnsmessage.DomainNameToString(q.QName), dnsmessage.DomainNameToString(next))
+		name = next
+	}
+	return nil, fmt.Errorf("CNAME chain of %s is too long", q.String())
+}
+
+// iterate follows referrals from the closest known delegation until a
+// server answers the question. It returns the reply together with the
+// zone of the server that sent it. With QNAME minimisation each server
+// is only asked for one more label than the zone it serves and the
+// full name is sent once we are in the zone it belongs to.
+func (r *Resolver) iterate(ctx context.Context, q *dnsmessage.Question, depth int) (*dnsmessage.DNSMessage, dnsmessage.DomainName, error) {
+	zone, servers, ok := r.cache.closest(q.QName)
+	if !ok {
+		zone, servers = dnsmessage.DomainName{}, r.roots
+	}
+
+	minimise := r.minimise
+	labels, steps := len(zone), 0
+	for referrals := 0; referrals < maxReferrals; {
+		asked := q
+		if minimise {
+			labels = nextLabels(labels, len(q.QName), steps)
+			if labels < len(q.QName) {
+				asked = &dnsmessage.Question{QName: q.QName[len(q.QName)-labels:], QType: dnsmessage.TypeA, QClass: q.QClass}
+				steps++
+			}
+		}
+
+		resp, err := r.query(ctx, servers, asked)
+		if asked != q && (err != nil || resp.Header.RCode == dnsmessage.RCodeNameError) {
+			// some servers get empty non-terminals wrong, so we can't
+			// trust this and ask for the full name instead
+			log.Debug("minimised query %s failed, asking for the full name", asked.String())
+			minimise = false
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if asked == q && (resp.Header.AA == 1 || len(resp.Answers) > 0 || resp.Header.RCode == dnsmessage.RCodeNameError) {
+			return resp, zone, nil
+		}
+
+		child, nsNames, ttl := referral(resp, zone, q.QName)
+		if child == nil {
+			if asked != q {
+				// the name is in the same zone, ask for more labels
+				continue
+			}
+			// neither an answer nor a referral, there is no data
+			return resp, zone, nil
+		}
+		log.Debug("referral from %q to %q for %s", dnsmessage.DomainNameToString(zone), dnsmessage.DomainNameToString(child), q.String())
+
+		r.cache.addDelegation(child, nsNames, ttl)
+		r.cacheGlue(resp, zone, nsNames)
+
+		servers, err = r.serverAddrs(ctx, nsNames, depth)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to find name servers of %q: %w", dnsmessage.DomainNameToString(child), err)
+		}
+		zone, labels = child, len(child)
+		referrals++
+	}
+	return nil, nil, fmt.Errorf("too many referrals resolving %s", q.String())
+}
+
+// nextLabels returns how many labels of a name with total labels to ask for
+// after current labels. The first queries add one label at a time, later
+// ones several so that long names don't take too many queries.
+func nextLabels(current, total, steps int) int {
+	if steps >= maxMinimiseCount {
+		return total
+	}
+	add := 1
+	if steps >= minimiseOneLab {
+		add = max(1, (total-current)/(maxMinimiseCount-steps))
+	}
+	return min(current+add, total)
+}
+
+// query asks the servers one after another until one of them replies
+// with NOERROR or NXDOMAIN.
+func (r *Resolver) query(ctx context.Context, servers []netip.Addr, q *dnsmessage.Question) (*dnsmessage.DNSMessage, error) {
+	policy := infra.Policy{MaxFails: maxFails, Backoff: backoff, MaxBackoff: maxBackoff, Timeout: r.timeout}
+
+	errs := []error{}
+	for _, addr := range r.order(servers) {
+		server := netip.AddrPortFrom(addr, r.port)
+		sentAt := time.Now()
+		resp, err := r.exchange(ctx, server, q)
+		if err == nil && resp.Header.RCode != dnsmessage.RCodeNoError && resp.Header.RCode != dnsmessage.RCodeNameError {
+			err = fmt.Errorf("%s answered with %s", addr, resp.Header.RCode)
+		}
+		if err == nil {
+			r.infra.Success(server.String(), time.Since(sentAt))
+			return resp, nil
+		}
+
+		log.Debug("name server %s failed for %s: %v", addr, q.String(), err)
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+		r.infra.Failure(server.String(), policy)
+	}
+	return nil, fmt.Errorf("no name server answered %s: %w", q.String(), errors.Join(errs...))
+}
+
+// order sorts the servers by their smoothed RTT, servers that never
+// answered come first so that they get probed. IPv4 is tried before IPv6
+// since we might not have IPv6 connectivity at all and servers that are
+// backed off are only tried as a last resort.
+func (r *Resolver) order(servers []netip.Addr) []netip.Addr {
+	servers = slices.Clone(servers)
+	rand.Shuffle(len(servers), func(i, j int) {
+		servers[i], servers[j] = servers[j], servers[i]
+	})
+
+	now := time.Now()
+	key := func(addr netip.Addr) (bool, bool, time.Duration) {
+		server := netip.AddrPortFrom(addr, r.port).String()
+		return !r.infra.Healthy(server, now), !addr.Is4(), r.infra.RTT(server)
+	}
+	slices.SortStableFunc(servers, func(a, b netip.Addr) int {
+		aDown, a6, aRTT := key(a)
+		bDown, b6, bRTT := key(b)
+		return cmp.Or(compareBool(aDown, bDown), compareBool(a6, b6), cmp.Compare(aRTT, bRTT))
+	})
+	return servers
+}
+
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
+
+// referral returns the zone and its name servers if the reply delegates
+// name to a zone below the one of the server we asked.
+func referral(resp *dnsmessage.DNSMessage, zone, name dnsmessage.DomainName) (dnsmessage.DomainName, []dnsmessage.DomainName, uint32) {
+	var (
+		child   dnsmessage.DomainName
+		servers []dnsmessage.DomainName
+		ttl     uint32 = math.MaxUint32
+	)
+	for _, rr := range resp.AuthorityRecords {
+		if rr.Type != dnsmessage.TypeNS || len(rr.Name) <= len(zone) ||
+			!dnsmessage.IsSubdomain(name, rr.Name) || !dnsmessage.IsSubdomain(rr.Name, zone) {
+			continue
+		}
+		if child != nil && !dnsmessage.EqualNames(child, rr.Name) {
+			continue
+		}
+
+		ns, _, err := dnsmessage.UnpackDomainName(rr.RData)
+		if err != nil {
+			continue
+		}
+		child = rr.Name
+		servers = append(servers, ns)
+		ttl = min(ttl, rr.TTL)
+	}
+	return child, servers, ttl
+}
+
+// cacheGlue stores the addresses of the name servers found in the additional
+// section. Only addresses of names within the zone of the server that sent
+// them are trusted.
+func (r *Resolver) cacheGlue(resp *dnsmessage.DNSMessage, zone dnsmessage.DomainName, servers []dnsmessage.DomainName) {
+	for _, rr := range resp.AdditonalRecords {
+		if !dnsmessage.IsSubdomain(rr.Name, zone) || !slices.ContainsFunc(servers, func(ns dnsmessage.DomainName) bool {
+			return dnsmessage.EqualNames(ns, rr.Name)
+		}) {
+			continue
+		}
+		if addr, ok := addrFromRR(rr); ok {
+			r.cache.addHost(rr.Name, []netip.Addr{addr}, rr.TTL)
+		}
+	}
+}
+
+// serverAddrs returns the known addresses of the name servers. A delegation
+// without glue makes us look the addresses up first.
+func (r *Resolver) serverAddrs(ctx context.Context, servers []dnsmessage.DomainName, depth int) ([]netip.Addr, error) {
+	addrs := []netip.Addr{}
+	for _, ns := range servers {
+		addrs = append(addrs, r.cache.host(ns)...)
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	errs := []error{}
+	for _, ns := range servers {
+		addrs, err := r.lookupHost(ctx, ns, depth+1)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("name servers have no addresses")
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (r *Resolver) lookupHost(ctx context.Context, name dnsmessage.DomainName, depth int) ([]netip.Addr, error) {
+	log.Debug("looking up the address of name server %s", dnsmessage.DomainNameToString(name))
+	resp, err := r.resolve(ctx, &dnsmessage.Question{QName: name, QType: dnsmessage.TypeA, QClass: dnsmessage.ClassIN}, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := []netip.Addr{}
+	var ttl uint32 = math.MaxUint32
+	for _, rr := range resp.Answers {
+		if addr, ok := addrFromRR(rr); ok {
+			addrs = append(addrs, addr)
+			ttl = min(ttl, rr.TTL)
+		}
+	}
+	if len(addrs) > 0 {
+		r.cache.addHost(name, addrs, ttl)
+	}
+	return addrs, nil
+}
+
+// answerFor picks the records answering name from the answer section, following
+// CNAMEs. Records outside the zone of the server that sent them are not trusted.
+// next is set if the chain leaves the reply and has to be resolved further.
+func answerFor(answers dnsmessage.ResourceRecords, zone, name dnsmessage.DomainName, qtype dnsmessage.RRType) (records dnsmessage.ResourceRecords, next dnsmessage.DomainName) {
+	for range maxCNAMEs {
+		if !dnsmessage.IsSubdomain(name, zone) {
+			return records, name
+		}
+
+		var cname *dnsmessage.ResourceRecord
+		found := false
+		for _, rr := range answers {
+			if !dnsmessage.EqualNames(rr.Name, name) {
+				continue
+			}
+			if rr.Type == qtype {
+				records = append(records, rr)
+				found = true
+			} else if rr.Type == dnsmessage.TypeCNAME {
+				cname = rr
+			}
+		}
+
+		switch {
+		case found:
+			return records, nil
+		case cname == nil && len(records) > 0:
+			return records, name
+		case cname == nil:
+			return records, nil
+		}
+
+		target, _, err := dnsmessage.UnpackDomainName(cname.RData)
+		if err != nil {
+			return records, nil
+		}
+		records = append(records, cname)
+		name = target
+	}
+	return records, nil
+}
+
+func addrFromRR(rr *dnsmessage.ResourceRecord) (netip.Addr, bool) {
+	switch {
+	case rr.Type == dnsmessage.TypeA && len(rr.RData) == 4,
+		rr.Type == dnsmessage.TypeAAAA && len(rr.RData) == 16:
+		return netip.AddrFromSlice(rr.RData)
+	default:
+		return netip.Addr{}, false
+	}
+}
@@ -0,0 +1,503 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/infra"
+	"server/pkg/parser"
+	"server/pkg/transport"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testZone holds the records of a zone including the NS records of
+// its delegations and their glue.
+type testZone struct {
+	origin  dnsmessage.DomainName
+	records dnsmessage.ResourceRecords
+}
+
+// newTestZone reads records given as "owner TYPE value". An SOA is added.
+func newTestZone(t *testing.T, origin string, lines ...string) *testZone {
+	z := &testZone{origin: dnsmessage.ParseDomainName(origin)}
+	soa := dnsmessage.SOA{
+		MName:   dnsmessage.ParseDomainName("ns." + origin),
+		RName:   dnsmessage.ParseDomainName("hostmaster." + origin),
+		Serial:  1,
+		Minimum: 300,
+	}
+	z.records = append(z.records, &dnsmessage.ResourceRecord{
+		Name: z.origin, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassIN, TTL: 3600, RData: soa.Pack(),
+	})
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		assert.Len(t, fields, 3, line)
+
+		rr := &dnsmessage.ResourceRecord{Name: dnsmessage.ParseDomainName(fields[0]), Class: dnsmessage.ClassIN, TTL: 3600}
+		switch fields[1] {
+		case "A":
+			rr.Type = dnsmessage.TypeA
+			addr := netip.MustParseAddr(fields[2]).As4()
+			rr.RData = addr[:]
+		case "NS":
+			rr.Type = dnsmessage.TypeNS
+			rr.RData = dnsmessage.PackDomainName(dnsmessage.ParseDomainName(fields[2]))
+		case "CNAME":
+			rr.Type = dnsmessage.TypeCNAME
+			rr.RData = dnsmessage.PackDomainName(dnsmessage.ParseDomainName(fields[2]))
+		default:
+			t.Fatalf("unsupported type in %q", line)
+		}
+		z.records = append(z.records, rr)
+	}
+	return z
+}
+
+func (z *testZone) find(name dnsmessage.DomainName, types ...dnsmessage.RRType) dnsmessage.ResourceRecords {
+	records := dnsmessage.ResourceRecords{}
+	for _, rr := range z.records {
+		if dnsmessage.EqualNames(rr.Name, name) && (len(types) == 0 || slices.Contains(types, rr.Type)) {
+			records = append(records, rr)
+		}
+	}
+	return records
+}
+
+// exists reports whether there are records at or below name.
+func (z *testZone) exists(name dnsmessage.DomainName) bool {
+	return slices.ContainsFunc(z.records, func(rr *dnsmessage.ResourceRecord) bool {
+		return dnsmessage.IsSubdomain(rr.Name, name)
+	})
+}
+
+// answer builds the reply of an authoritative server of the zone.
+// Broken servers deny the existence of empty non-terminals.
+func (z *testZone) answer(resp *dnsmessage.DNSMessage, broken bool) {
+	q := resp.Question
+
+	// referrals to the delegations below the zone
+	for i := len(q.QName) - len(z.origin) - 1; i >= 0; i-- {
+		cut := q.QName[i:]
+		if ns := z.find(cut, dnsmessage.TypeNS); len(ns) > 0 {
+			resp.AuthorityRecords = ns
+			for _, rr := range ns {
+				target, _, _ := dnsmessage.UnpackDomainName(rr.RData)
+				resp.AdditonalRecords = append(resp.AdditonalRecords, z.find(target, dnsmessage.TypeA)...)
+			}
+			return
+		}
+	}
+
+	resp.Header.AA = 1
+	name := q.QName
+	for range maxCNAMEs {
+		if records := z.find(name, q.QType); len(records) > 0 {
+			resp.Answers = append(resp.Answers, records...)
+			return
+		}
+		cname := z.find(name, dnsmessage.TypeCNAME)
+		if len(cname) == 0 {
+			break
+		}
+		resp.Answers = append(resp.Answers, cname...)
+		name, _, _ = dnsmessage.UnpackDomainName(cname[0].RData)
+		if !dnsmessage.IsSubdomain(name, z.origin) {
+			return
+		}
+	}
+
+	if len(resp.Answers) == 0 && (broken && len(z.find(name)) == 0 || !z.exists(name)) {
+		resp.Header.RCode = dnsmessage.RCodeNameError
+	}
+	resp.AuthorityRecords = z.find(z.origin, dnsmessage.TypeSOA)
+}
+
+// testServer is an authoritative name server on a loopback address
+// serving its zones over UDP and TCP.
+type testServer struct {
+	addr    netip.Addr
+	zones   []*testZone
+	queries atomic.Int32
+	// names answered with only the TC bit over UDP
+	truncate []string
+	// answer NXDOMAIN for empty non-terminals
+	brokenENT atomic.Bool
+
+	mu    sync.Mutex
+	asked []string
+}
+
+func (s *testServer) askedNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.asked)
+}
+
+func (s *testServer) handle(query []byte, udp bool) []byte {
+	s.queries.Add(1)
+
+	p, err := parser.NewParser(query)
+	if err != nil || p.ParseMessage() != nil {
+		return nil
+	}
+	m := p.Message
+	s.mu.Lock()
+	s.asked = append(s.asked, dnsmessage.DomainNameToString(m.Question.QName))
+	s.mu.Unlock()
+
+	resp := &dnsmessage.DNSMessage{Header: &dnsmessage.Header{ID: m.Header.ID, QR: 1}, Question: m.Question}
+
+	var zone *testZone
+	for _, z := range s.zones {
+		if dnsmessage.IsSubdomain(m.Question.QName, z.origin) && (zone == nil || len(z.origin) > len(zone.origin)) {
+			zone = z
+		}
+	}
+
+	switch {
+	case zone == nil:
+		resp.Header.RCode = dnsmessage.RCodeRefused
+	case udp && slices.Contains(s.truncate, dnsmessage.DomainNameToString(m.Question.QName)):
+		resp.Header.TC = 1
+	default:
+		zone.answer(resp, s.brokenENT.Load())
+	}
+
+	data, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func (s *testServer) serve(t *testing.T, udp *net.UDPConn, tcp net.Listener) {
+	t.Cleanup(func() {
+		_ = udp.Close()
+		_ = tcp.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := udp.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if resp := s.handle(slices.Clone(buf[:n]), true); resp != nil {
+				_, _ = udp.WriteToUDP(resp, addr)
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				query, err := transport.ReadMessage(conn)
+				if err != nil {
+					return
+				}
+				if resp := s.handle(query, false); resp != nil {
+					_ = transport.WriteMessage(conn, resp)
+				}
+			}()
+		}
+	}()
+}
+
+// startTestServers starts the servers on their addresses all sharing one port.
+func startTestServers(t *testing.T, servers ...*testServer) int {
+	for range 20 {
+		port, err := listenAll(t, servers)
+		if err == nil {
+			return port
+		}
+	}
+	t.Fatal("failed to find a port free on all addresses")
+	return 0
+}
+
+func listenAll(t *testing.T, servers []*testServer) (int, error) {
+	port := 0
+	closers := []func() error{}
+	type listeners struct {
+		udp *net.UDPConn
+		tcp net.Listener
+	}
+	ls := []listeners{}
+
+	for _, s := range servers {
+		udp, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(s.addr, uint16(port))))
+		if err != nil {
+			for _, c := range closers {
+				_ = c()
+			}
+			return 0, err
+		}
+		closers = append(closers, udp.Close)
+		port = udp.LocalAddr().(*net.UDPAddr).Port
+
+		tcp, err := net.Listen("tcp", net.JoinHostPort(s.addr.String(), strconv.Itoa(port)))
+		if err != nil {
+			for _, c := range closers {
+				_ = c()
+			}
+			return 0, err
+		}
+		closers = append(closers, tcp.Close)
+		ls = append(ls, listeners{udp, tcp})
+	}
+
+	for i, s := range servers {
+		s.serve(t, ls[i].udp, ls[i].tcp)
+	}
+	return port, nil
+}
+
+type testHierarchy struct {
+	root, com, example, net, exampleNet, glueless, refusing *testServer
+	port                                                    int
+	resolver                                                *Resolver
+}
+
+func newTestHierarchy(t *testing.T) *testHierarchy {
+	h := &testHierarchy{
+		root: &testServer{addr: netip.MustParseAddr("127.0.0.2"), zones: []*testZone{newTestZone(t, ".",
+			"com NS ns.com",
+			"ns.com A 127.0.0.3",
+			"net NS ns.net",
+			"ns.net A 127.0.0.5",
+		)}},
+		com: &testServer{addr: netip.MustParseAddr("127.0.0.3"), zones: []*testZone{newTestZone(t, "com",
+			"example.com NS ns1.example.com",
+			"ns1.example.com A 127.0.0.4",
+			// glueless, the name server is in another TLD
+			"glueless.com NS ns.example.net",
+			// the first server refuses to answer
+			"lame.com NS ns1.lame.com",
+			"lame.com NS ns2.lame.com",
+			"ns1.lame.com A 127.0.0.8",
+			"ns2.lame.com A 127.0.0.4",
+		)}},
+		example: &testServer{addr: netip.MustParseAddr("127.0.0.4"), zones: []*testZone{
+			newTestZone(t, "example.com",
+				"example.com NS ns1.example.com",
+				"ns1.example.com A 127.0.0.4",
+				"www.example.com A 192.0.2.1",
+				"mail.example.com A 192.0.2.2",
+				"big.example.com A 192.0.2.3",
+				"alias.example.com CNAME www.example.com",
+				"ext.example.com CNAME host.glueless.com",
+				"deep.example.com CNAME alias.example.com",
+				// b.c.example.com and c.example.com are empty non-terminals
+				"a.b.c.example.com A 192.0.2.9",
+			),
+			newTestZone(t, "lame.com",
+				"www.lame.com A 192.0.2.8",
+			),
+		}, truncate: []string{"big.example.com"}},
+		net: &testServer{addr: netip.MustParseAddr("127.0.0.5"), zones: []*testZone{newTestZone(t, "net",
+			"example.net NS ns.example.net",
+			"ns.example.net A 127.0.0.6",
+		)}},
+		exampleNet: &testServer{addr: netip.MustParseAddr("127.0.0.6"), zones: []*testZone{newTestZone(t, "example.net",
+			"ns.example.net A 127.0.0.7",
+		)}},
+		glueless: &testServer{addr: netip.MustParseAddr("127.0.0.7"), zones: []*testZone{newTestZone(t, "glueless.com",
+			"host.glueless.com A 192.0.2.7",
+		)}},
+		refusing: &testServer{addr: netip.MustParseAddr("127.0.0.8")},
+	}
+
+	h.port = startTestServers(t, h.root, h.com, h.example, h.net, h.exampleNet, h.glueless, h.refusing)
+
+	r, err := NewResolver(&Config{RootHints: []string{"127.0.0.2"}, Port: h.port, Timeout: time.Second, QNameMinimisation: true}, nil)
+	assert.NoError(t, err)
+	h.resolver = r
+	return h
+}
+
+func resolve(t *testing.T, r *Resolver, name string, qtype dnsmessage.RRType) *dnsmessage.DNSMessage {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := r.Resolve(ctx, &dnsmessage.Question{QName: dnsmessage.ParseDomainName(name), QType: qtype, QClass: dnsmessage.ClassIN})
+	assert.NoError(t, err)
+	if resp == nil {
+		t.FailNow()
+	}
+	return resp
+}
+
+func answerStrings(m *dnsmessage.DNSMessage) []string {
+	s := []string{}
+	for _, rr := range m.Answers {
+		s = append(s, dnsmessage.DomainNameToString(rr.Name)+" "+rr.Type.String()+" "+rr.RDataString())
+	}
+	return s
+}
+
+func TestResolve(t *testing.T) {
+	h := newTestHierarchy(t)
+
+	m := resolve(t, h.resolver, "www.example.com", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeNoError, m.Header.RCode)
+	assert.Equal(t, []string{"www.example.com A 192.0.2.1"}, answerStrings(m))
+	assert.Equal(t, int32(1), h.root.queries.Load())
+	assert.Equal(t, int32(1), h.com.queries.Load())
+	assert.Equal(t, int32(1), h.example.queries.Load())
+
+	// the delegation of example.com is cached
+	m = resolve(t, h.resolver, "MAIL.example.com", dnsmessage.TypeA)
+	assert.Equal(t, []string{"MAIL.example.com A 192.0.2.2"}, answerStrings(m))
+	assert.Equal(t, int32(1), h.root.queries.Load())
+	assert.Equal(t, int32(1), h.com.queries.Load())
+	assert.Equal(t, int32(2), h.example.queries.Load())
+}
+
+func TestQNameMinimisation(t *testing.T) {
+	h := newTestHierarchy(t)
+
+	m := resolve(t, h.resolver, "a.b.c.example.com", dnsmessage.TypeA)
+	assert.Equal(t, []string{"a.b.c.example.com A 192.0.2.9"}, answerStrings(m))
+	assert.Equal(t, []string{"com"}, h.root.askedNames())
+	assert.Equal(t, []string{"example.com"}, h.com.askedNames())
+	assert.Equal(t, []string{"c.example.com", "b.c.example.com", "a.b.c.example.com"}, h.example.askedNames())
+
+	// without minimisation everybody sees the full name
+	r, err := NewResolver(&Config{RootHints: []string{"127.0.0.2"}, Port: h.port, Timeout: time.Second}, nil)
+	assert.NoError(t, err)
+	m = resolve(t, r, "a.b.c.example.com", dnsmessage.TypeA)
+	assert.Len(t, m.Answers, 1)
+	assert.Equal(t, []string{"com", "a.b.c.example.com"}, h.root.askedNames())
+}
+
+func TestQNameMinimisationFallback(t *testing.T) {
+	h := newTestHierarchy(t)
+	h.example.brokenENT.Store(true)
+
+	m := resolve(t, h.resolver, "a.b.c.example.com", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeNoError, m.Header.RCode)
+	assert.Equal(t, []string{"a.b.c.example.com A 192.0.2.9"}, answerStrings(m))
+	assert.Equal(t, []string{"c.example.com", "a.b.c.example.com"}, h.example.askedNames())
+
+	// names that really don't exist are still NXDOMAIN
+	m = resolve(t, h.resolver, "x.y.example.com", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeNameError, m.Header.RCode)
+}
+
+func TestNextLabels(t *testing.T) {
+	// one label at a time first, then the rest in bigger steps
+	labels, steps, asked := 0, 0, []int{}
+	for labels < 20 {
+		labels = nextLabels(labels, 20, steps)
+		asked = append(asked, labels)
+		steps++
+	}
+	assert.Equal(t, []int{1, 2, 3, 4, 6, 8, 11, 14, 17, 20}, asked)
+	assert.Equal(t, 3, nextLabels(2, 3, 0))
+}
+
+func TestResolveCNAME(t *testing.T) {
+	h := newTestHierarchy(t)
+
+	m := resolve(t, h.resolver, "deep.example.com", dnsmessage.TypeA)
+	assert.Equal(t, []string{
+		"deep.example.com CNAME alias.example.com.",
+		"alias.example.com CNAME www.example.com.",
+		"www.example.com A 192.0.2.1",
+	}, answerStrings(m))
+
+	// the target is in a zone with a glueless delegation
+	m = resolve(t, h.resolver, "ext.example.com", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeNoError, m.Header.RCode)
+	assert.Equal(t, []string{
+		"ext.example.com CNAME host.glueless.com.",
+		"host.glueless.com A 192.0.2.7",
+	}, answerStrings(m))
+	assert.Equal(t, int32(1), h.exampleNet.queries.Load())
+	assert.Equal(t, int32(1), h.glueless.queries.Load())
+}
+
+func TestResolveNegative(t *testing.T) {
+	h := newTestHierarchy(t)
+
+	m := resolve(t, h.resolver, "nx.example.com", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeNameError, m.Header.RCode)
+	assert.Empty(t, m.Answers)
+	assert.Len(t, m.AuthorityRecords, 1)
+	assert.Equal(t, dnsmessage.TypeSOA, m.AuthorityRecords[0].Type)
+
+	m = resolve(t, h.resolver, "www.example.com", dnsmessage.TypeAAAA)
+	assert.Equal(t, dnsmessage.RCodeNoError, m.Header.RCode)
+	assert.Empty(t, m.Answers)
+	assert.Len(t, m.AuthorityRecords, 1)
+
+	m = resolve(t, h.resolver, "nx.org", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeNameError, m.Header.RCode)
+}
+
+func TestResolveFallbacks(t *testing.T) {
+	h := newTestHierarchy(t)
+
+	// the reply over UDP is truncated
+	m := resolve(t, h.resolver, "big.example.com", dnsmessage.TypeA)
+	assert.Equal(t, []string{"big.example.com A 192.0.2.3"}, answerStrings(m))
+
+	// one of the two name servers refuses
+	for range 3 {
+		m = resolve(t, h.resolver, "www.lame.com", dnsmessage.TypeA)
+		assert.Equal(t, []string{"www.lame.com A 192.0.2.8"}, answerStrings(m))
+	}
+}
+
+func TestServerSelection(t *testing.T) {
+	h := newTestHierarchy(t)
+
+	// once the refusing server failed, the one answering goes first
+	for range 5 {
+		m := resolve(t, h.resolver, "www.lame.com", dnsmessage.TypeA)
+		assert.Equal(t, []string{"www.lame.com A 192.0.2.8"}, answerStrings(m))
+	}
+	assert.LessOrEqual(t, h.refusing.queries.Load(), int32(1))
+
+	table := infra.NewTable()
+	r, err := NewResolver(&Config{Port: 53}, table)
+	assert.NoError(t, err)
+	fast, slow, unknown, down, v6 := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("192.0.2.3"), netip.MustParseAddr("192.0.2.4"), netip.MustParseAddr("2001:db8::1")
+	table.Success("192.0.2.1:53", 10*time.Millisecond)
+	table.Success("192.0.2.2:53", 50*time.Millisecond)
+	table.Failure("192.0.2.4:53", infra.Policy{MaxFails: 1, Backoff: time.Minute})
+
+	assert.Equal(t, []netip.Addr{unknown, fast, slow, v6, down}, r.order([]netip.Addr{down, v6, slow, fast, unknown}))
+}
+
+func TestResolveFailure(t *testing.T) {
+	h := newTestHierarchy(t)
+
+	r, err := NewResolver(&Config{RootHints: []string{"127.0.0.8"}, Port: h.port, Timeout: time.Second}, nil)
+	assert.NoError(t, err)
+	_, err = r.Resolve(context.Background(), &dnsmessage.Question{
+		QName: dnsmessage.ParseDomainName("www.example.com"), QType: dnsmessage.TypeA, QClass: dnsmessage.ClassIN,
+	})
+	assert.ErrorContains(t, err, "refused")
+
+	_, err = NewResolver(&Config{RootHints: []string{"a.root-servers.net"}}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/log"
+	"server/pkg/zone"
+)
+
+// Zones holds the zones the server is authoritative for.
+// It is nil unless zones are configured.
+var Zones *zone.Store
+
+// zonesMu serializes the changes of zones by reloads and updates.
+var zonesMu sync.Mutex
+
+func InitZones(cfgs []zone.Config) error {
+	Zones = nil
+	secondaries = nil
+	signedZones = nil
+	if len(cfgs) == 0 {
+		return nil
+	}
+
+	store := zone.NewStore()
+	var secs []*secondary
+	var signed []dnsmessage.DomainName
+	for i := range cfgs {
+		if err := checkKeys(&cfgs[i]); err != nil {
+			return fmt.Errorf("invalid zone %s: %w", cfgs[i].Origin, err)
+		}
+		if len(cfgs[i].Primaries) > 0 {
+			s, err := newSecondary(cfgs[i], store)
+			if err != nil {
+				return fmt.Errorf("invalid secondary zone %s: %w", cfgs[i].Origin, err)
+			}
+			secs = append(secs, s)
+			continue
+		}
+
+		z, err := zone.Load(&cfgs[i])
+		if err != nil {
+			return fmt.Errorf("failed to load zone %s: %w", cfgs[i].Origin, err)
+		}
+		log.Info("loaded zone %s with %d records", cfgs[i].Origin, len(z.Records()))
+		store.Add(z)
+		if cfgs[i].DNSSEC != nil {
+			signed = append(signed, z.Origin)
+		}
+	}
+	Zones = store
+	secondaries = secs
+	signedZones = signed
+	return nil
+}
+
+// ReloadZones reads the zone files again. Zones that fail to load are
+// served as they were, zones with an unchanged serial are left alone
+// so that their changes stay available for incremental transfers.
+// Dynamic updates are kept in the journals of the zones and read back.
+func ReloadZones(cfgs []zone.Config) error {
+	if Zones == nil {
+		return nil
+	}
+	zonesMu.Lock()
+	defer zonesMu.Unlock()
+
+	var errs []error
+	var signed []dnsmessage.DomainName
+	for i := range cfgs {
+		if len(cfgs[i].Primaries) > 0 {
+			// kept up to date by its secondary
+			continue
+		}
+		if cfgs[i].DNSSEC != nil {
+			signed = append(signed, dnsmessage.ParseDomainName(cfgs[i].Origin))
+		}
+		if err := checkKeys(&cfgs[i]); err != nil {
+			errs = append(errs, fmt.Errorf("failed to reload zone %s: %w", cfgs[i].Origin, err))
+			continue
+		}
+		z, err := zone.Load(&cfgs[i])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to reload zone %s: %w", cfgs[i].Origin, err))
+			continue
+		}
+		if old := Zones.Get(z.Origin); old != nil && old.Serial() == z.Serial() {
+			log.Debug("serial of zone %s is still %d, not reloading it", cfgs[i].Origin, z.Serial())
+			continue
+		}
+		Zones.Add(z)
+		log.Info("reloaded zone %s with serial %d", cfgs[i].Origin, z.Serial())
+		notifySecondaries(z)
+	}
+	signedZones = signed
+	return errors.Join(errs...)
+}
+
+// authoritative reports whether the query is answered from our zones:
+// queries for names in them and queries that don't ask for recursion,
+// which are refused if the name is outside of all zones.
+func authoritative(m *dnsmessage.DNSMessage) bool {
+	return Zones != nil && m.Header.OpCode == 0 && (m.Header.RD == 0 || Zones.Find(m.Question.QName) != nil)
+}
+
+// answerAuthoritative answers the query from our zones.
+func answerAuthoritative(m *dnsmessage.DNSMessage) ([]byte, error) {
+	return authoritativeResponse(m, Zones.Answer(m.Question, m.DO()))
+}
+
+// authoritativeResponse packs the answer to the query from our own data.
+func authoritativeResponse(m *dnsmessage.DNSMessage, a *zone.Answer) ([]byte, error) {
+	h := *m.Header
+	h.QR = 1
+	h.AA = 0
+	if a.Authoritative {
+		h.AA = 1
+	}
+	h.TC = 0
+	h.RA = 0
+	h.Z = 0
+	h.RCode = a.RCode
+
+	resp := dnsmessage.DNSMessage{
+		Header:           &h,
+		Question:         m.Question,
+		Answers:          a.Answers,
+		AuthorityRecords: a.Authority,
+		AdditonalRecords: a.Additional,
+	}
+	if m.OPT() != nil {
+		resp.AdditonalRecords = append(resp.AdditonalRecords, dnsmessage.NewOPT(ednsUDPSize, m.DO()))
+	}
+	return resp.Pack()
+}
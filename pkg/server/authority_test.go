@@ -0,0 +1,97 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/parser"
+	"server/pkg/upstream"
+	"server/pkg/zone"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testZoneFile = `$ORIGIN example.
+$TTL 3600
+@	SOA	ns1 hostmaster 1 7200 1800 1209600 300
+	NS	ns1
+ns1	A	192.0.2.53
+www	A	192.0.2.80
+`
+
+func initTestZones(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "example.zone")
+	require.NoError(t, os.WriteFile(path, []byte(testZoneFile), 0o644))
+	require.NoError(t, InitZones([]zone.Config{{Origin: "example.", File: path}}))
+	t.Cleanup(func() { Zones = nil })
+}
+
+func sendAuthoritativeQuery(t *testing.T, srv *UDPServer, name string, rd uint64) *dnsmessage.DNSMessage {
+	client, err := NewUDPClient(srv.Conn.LocalAddr().String(), time.Second*5)
+	require.NoError(t, err)
+	defer client.Close()
+
+	query := &dnsmessage.DNSMessage{
+		Header:   &dnsmessage.Header{ID: 0x4321, RD: rd},
+		Question: &dnsmessage.Question{QName: dnsmessage.ParseDomainName(name), QType: dnsmessage.TypeA, QClass: dnsmessage.ClassIN},
+	}
+	data, err := query.Pack()
+	require.NoError(t, err)
+
+	resp, err := client.SendAndReceive(data, ednsUDPSize)
+	require.NoError(t, err)
+	p, err := parser.NewParser(resp)
+	require.NoError(t, err)
+	require.NoError(t, p.ParseMessage())
+	return p.Message
+}
+
+func TestAnswerAuthoritative(t *testing.T) {
+	up := newFakeUpstream(t, respond(dnsmessage.RCodeNoError))
+	initTestZones(t)
+	srv, errCh := startTestServer(t, &upstream.Config{Addrs: []string{up.Addr()}})
+
+	tests := []struct {
+		name      string
+		qname     string
+		rd        uint64
+		rcode     dnsmessage.RCode
+		aa        uint64
+		answers   int
+		authority int
+		forwarded bool
+	}{
+		{name: "answer", qname: "www.example", rd: 1, aa: 1, answers: 1},
+		{name: "name error", qname: "missing.example", rd: 1, rcode: dnsmessage.RCodeNameError, aa: 1, authority: 1},
+		{name: "outside without recursion", qname: "www.other", rcode: dnsmessage.RCodeRefused},
+		{name: "outside with recursion", qname: "www.other", rd: 1, forwarded: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := up.queries.Load()
+			resp := sendAuthoritativeQuery(t, srv, tt.qname, tt.rd)
+			assert.Equal(t, uint32(0x4321), resp.Header.ID)
+			assert.Equal(t, tt.rcode, resp.Header.RCode)
+			assert.Equal(t, tt.aa, resp.Header.AA)
+			assert.Len(t, resp.Answers, tt.answers)
+			assert.Len(t, resp.AuthorityRecords, tt.authority)
+			assert.Equal(t, tt.forwarded, up.queries.Load() > before)
+		})
+	}
+
+	select {
+	case err := <-errCh:
+		t.Fatalf("unexpected error: %v", err)
+	default:
+	}
+}
+
+func TestInitZonesError(t *testing.T) {
+	err := InitZones([]zone.Config{{Origin: "example.", File: filepath.Join(t.TempDir(), "missing.zone")}})
+	assert.ErrorContains(t, err, "example.")
+	assert.Nil(t, Zones)
+}
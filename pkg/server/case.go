@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand/v2"
+	"slices"
+
+	"server/pkg/dnsmessage"
+)
+
+// questionName returns the question name of the message in wire format.
+// It is the first name in the message so it is never compressed.
+func questionName(msg []byte) ([]byte, bool) {
+	if len(msg) < dnsmessage.HeaderLength || binary.BigEndian.Uint16(msg[4:]) == 0 {
+		return nil, false
+	}
+	for i := dnsmessage.HeaderLength; i < len(msg); i += 1 + int(msg[i]) {
+		if msg[i] == 0 {
+			return msg[dnsmessage.HeaderLength : i+1], true
+		}
+		if msg[i]&0xC0 != 0 {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// randomizeCase returns a copy of the query with the case of every letter
+// in the question name flipped at random (draft-vixie-dnsext-dns0x20).
+// Upstreams echo the name as it was sent, which adds a bit per letter that
+// a spoofed reply has to guess on top of the ID and the port.
+func randomizeCase(query []byte) []byte {
+	msg := slices.Clone(query)
+	name, ok := questionName(msg)
+	if !ok {
+		return msg
+	}
+
+	bits := rand.Uint64()
+	for i := 0; name[i] != 0; i += 1 + int(name[i]) {
+		for j := i + 1; j <= i+int(name[i]); j++ {
+			c := name[j] | 0x20
+			if c < 'a' || c > 'z' {
+				continue
+			}
+			if bits == 0 {
+				bits = rand.Uint64()
+			}
+			if bits&1 == 1 {
+				name[j] ^= 0x20
+			}
+			bits >>= 1
+		}
+	}
+	return msg
+}
+
+// matchQuestion reports whether the reply asks the same question as the
+// query, with the name compared exactly and ignoring case. The type and
+// class always have to be the same. Both have to ask a single question.
+func matchQuestion(reply, query []byte) (exact, fold bool) {
+	r, ok := questionName(reply)
+	if !ok || binary.BigEndian.Uint16(reply[4:]) != 1 {
+		return false, false
+	}
+	q, ok := questionName(query)
+	if !ok || binary.BigEndian.Uint16(query[4:]) != 1 {
+		return false, false
+	}
+
+	end := dnsmessage.HeaderLength + len(q) + 4
+	if len(reply) < end || len(query) < end ||
+		!bytes.Equal(reply[end-4:end], query[end-4:end]) {
+		return false, false
+	}
+	return bytes.Equal(r, q), equalFold(r, q)
+}
+
+// equalFold compares names in wire format ignoring the case of ASCII
+// letters only, as DNS does (RFC 4343).
+func equalFold(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if lower(a[i]) != lower(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func lower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// clientReply returns a copy of the reply with the ID and the case of the
+// question name as the client sent them in query. Names in the reply that
+// are compressed to point at the question follow the client's case too.
+func clientReply(reply, query []byte) []byte {
+	msg := withID(reply, binary.BigEndian.Uint16(query))
+	if r, ok := questionName(msg); ok {
+		if q, ok := questionName(query); ok && equalFold(r, q) {
+			copy(r, q)
+		}
+	}
+	return msg
+}
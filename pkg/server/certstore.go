@@ -0,0 +1,43 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync/atomic"
+
+	"server/pkg/log"
+)
+
+// CertStore holds the certificate presented by the TLS listeners. It
+// can be reloaded from disk while the server is running, e.g. after
+// the certificate got renewed. New connections pick up the new one.
+type CertStore struct {
+	CertFile string
+	KeyFile  string
+
+	cert atomic.Pointer[tls.Certificate]
+}
+
+func NewCertStore(certFile, keyFile string) (*CertStore, error) {
+	c := CertStore{CertFile: certFile, KeyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Reload reads the certificate and key files. The current
+// certificate is kept if they can't be loaded.
+func (c *CertStore) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate %s: %w", c.CertFile, err)
+	}
+	c.cert.Store(&cert)
+	log.Info("loaded certificate from %s", c.CertFile)
+	return nil
+}
+
+func (c *CertStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
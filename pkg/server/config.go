@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"server/pkg/dnssec"
+	"server/pkg/resolver"
+	"server/pkg/upstream"
+)
+
+func DefaultConfig() *ServerConfig {
+	return &ServerConfig{
+		UDPCfg: UDPConfig{
+			Addr:          "",
+			Port:          8085,
+			MaxBufferSize: ednsUDPSize,
+			Timeout:       defaultTimeout,
+		},
+		TCPCfg: TCPConfig{
+			Addr:    "",
+			Port:    8085,
+			Timeout: defaultIdleTimeout,
+		},
+		TLSCfg: TLSConfig{
+			TCPConfig: TCPConfig{
+				Addr:    "",
+				Port:    853,
+				Timeout: defaultIdleTimeout,
+			},
+		},
+		HTTPSCfg: HTTPSConfig{
+			Addr:    "",
+			Port:    443,
+			Path:    defaultDoHPath,
+			Timeout: defaultIdleTimeout,
+		},
+		Timeout: defaultTimeout,
+		Upstream: upstream.Config{
+			Addrs:    []string{"1.1.1.1:53"},
+			Strategy: upstream.StrategySequential,
+			Timeout:  upstream.DefaultTimeout,
+		},
+		Recursion: resolver.Config{
+			Port:              resolver.DefaultPort,
+			Timeout:           resolver.DefaultTimeout,
+			QNameMinimisation: true,
+		},
+		DNSSEC: dnssec.Config{
+			AggressiveNSEC: true,
+		},
+	}
+}
+
+// LoadConfig reads a YAML config file. Settings missing
+// from the file keep their default values.
+func LoadConfig(path string) (*ServerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	cfg := DefaultConfig()
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/infra"
+	"server/pkg/log"
+	"server/pkg/parser"
+	"server/pkg/upstream"
+)
+
+var Upstreams *upstream.Router
+
+// Infra tracks the round trip times and failures of the upstreams
+// and of the name servers asked during recursion.
+var Infra = infra.NewTable()
+
+// RejectedReplies counts the replies dropped as suspicious, spoofing
+// attempts would show up here.
+var RejectedReplies ReplyStats
+
+var errNoUpstreamReply = errors.New("no usable reply from any upstream")
+
+// ReplyStats counts rejected replies by the reason they were rejected for.
+type ReplyStats struct {
+	UnknownID     atomic.Uint64 // no outstanding query with the ID
+	WrongSource   atomic.Uint64 // not from an upstream the query was sent to
+	WrongHeader   atomic.Uint64 // QR bit not set or a different opcode
+	WrongQuestion atomic.Uint64 // a different question section
+	WrongCase     atomic.Uint64 // the randomized case of the name not echoed
+}
+
+func (s *ReplyStats) String() string {
+	return fmt.Sprintf("unknown id: %d wrong source: %d wrong header: %d wrong question: %d wrong case: %d",
+		s.UnknownID.Load(), s.WrongSource.Load(), s.WrongHeader.Load(), s.WrongQuestion.Load(), s.WrongCase.Load())
+}
+
+// Reply is a response from an upstream handed over to the
+// goroutine that forwarded the query.
+type Reply struct {
+	Msg  *dnsmessage.DNSMessage
+	Data []byte
+	From string // address of the upstream
+	Err  error  // set if the exchange with the upstream failed
+}
+
+func InitUpstreams(cfg *upstream.Config, groups map[string]upstream.Config, rules []upstream.Rule) error {
+	router, err := upstream.NewRouter(cfg, groups, rules, Infra)
+	if err != nil {
+		return err
+	}
+	Upstreams = router
+	return nil
+}
+
+// forward sends the query to the upstreams in the order given by the pool's
+// plan and returns the first usable reply. An upstream that times out or
+// answers with SERVFAIL counts as failed and the next attempt is made.
+func forward(ctx context.Context, pool *upstream.Pool, conn *net.UDPConn, client net.Addr, m *dnsmessage.DNSMessage, data []byte) ([]byte, error) {
+	replies := make(chan Reply, len(pool.Upstreams))
+	id := reserveTransaction(client, replies)
+	defer TransactionTable.Delete(id)
+
+	// the ID is rewritten so that queries from different clients
+	// which happen to use the same ID don't collide in the table
+	query := withID(data, uint16(id))
+	mixedCase := randomizeCase(query)
+
+	// upstreams asked in earlier attempts may still answer late
+	asked := make(map[string]bool)
+
+	var lastReply []byte
+	for _, attempt := range pool.Plan() {
+		pending := make(map[string]*upstream.Upstream, len(attempt))
+		caseRandomized := make(map[string]bool, len(attempt))
+		sentAt := time.Now()
+
+		for _, u := range attempt {
+			if u.Client != nil {
+				go exchange(ctx, u, query, pool.Timeout, replies)
+				pending[u.Addr] = u
+				asked[u.Addr] = true
+				continue
+			}
+
+			query := query
+			if u.RandomizeCase() {
+				query = mixedCase
+				caseRandomized[u.Addr] = true
+			}
+
+			w, err := NewResponseWriter(conn, u.Addr)
+			if err != nil {
+				log.Warn("failed to create a response writer for upstream %s: %v", u.Addr, err)
+				continue
+			}
+			if _, err := w.Write(query); err != nil {
+				log.Warn("failed to forward query to upstream %s: %v", u.Addr, err)
+				u.ReportFailure()
+				continue
+			}
+			log.Debug("forwarded query %d to upstream %s as %d", m.Header.ID, u.Addr, id)
+			pending[u.Addr] = u
+			asked[u.Addr] = true
+		}
+
+		timer := time.NewTimer(pool.Timeout)
+	wait:
+		for len(pending) > 0 {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+
+			case <-timer.C:
+				for _, u := range pending {
+					log.Warn("upstream %s timed out", u.Addr)
+					u.ReportFailure()
+				}
+				break wait
+
+			case r := <-replies:
+				u, ok := pending[r.From]
+				if !ok {
+					if asked[r.From] {
+						log.Debug("ignoring late reply from %s for transaction ID %d", r.From, id)
+					} else {
+						log.Warn("ignoring reply from %s for transaction ID %d: the query wasn't sent there", r.From, id)
+						RejectedReplies.WrongSource.Add(1)
+					}
+					continue
+				}
+				if r.Err == nil {
+					sent := query
+					if caseRandomized[u.Addr] {
+						sent = mixedCase
+					}
+					if !checkReply(u, r, m, sent, caseRandomized[u.Addr]) {
+						// keep waiting, the genuine reply may still arrive
+						continue
+					}
+				}
+				delete(pending, u.Addr)
+
+				if r.Err != nil {
+					log.Warn("exchange with upstream %s failed: %v", u.Addr, r.Err)
+					u.ReportFailure()
+					continue
+				}
+
+				if r.Msg.Header.RCode == dnsmessage.RCodeServerFailure {
+					log.Warn("upstream %s answered with SERVFAIL", u.Addr)
+					u.ReportFailure()
+					lastReply = r.Data
+					continue
+				}
+
+				u.ReportSuccess(time.Since(sentAt))
+				timer.Stop()
+				return clientReply(r.Data, data), nil
+			}
+		}
+		timer.Stop()
+	}
+
+	// every upstream failed, pass on the last SERVFAIL if there was one
+	if lastReply != nil {
+		return clientReply(lastReply, data), nil
+	}
+	return nil, errNoUpstreamReply
+}
+
+// checkReply reports whether the reply answers the query that was sent to
+// the upstream: the QR bit has to be set, the opcode and the question have
+// to be the same. If the case of the name was randomized, the reply has to
+// echo it exactly.
+func checkReply(u *upstream.Upstream, r Reply, m *dnsmessage.DNSMessage, sent []byte, randomized bool) bool {
+	if r.Msg.Header.QR != 1 || r.Msg.Header.OpCode != m.Header.OpCode {
+		log.Warn("ignoring reply from upstream %s with QR %d and opcode %d", u.Addr, r.Msg.Header.QR, r.Msg.Header.OpCode)
+		RejectedReplies.WrongHeader.Add(1)
+		return false
+	}
+
+	exact, fold := matchQuestion(r.Data, sent)
+	switch {
+	case !fold:
+		log.Warn("ignoring reply from upstream %s for a different question", u.Addr)
+		RejectedReplies.WrongQuestion.Add(1)
+		return false
+	case randomized && !exact:
+		log.Warn("ignoring reply from upstream %s with the case of the question name changed", u.Addr)
+		RejectedReplies.WrongCase.Add(1)
+		u.ReportCase(false)
+		return false
+	case randomized:
+		u.ReportCase(true)
+	}
+	return true
+}
+
+// exchange sends the query over the upstream's own connection and
+// hands the reply over the same way as replies to the listener socket.
+func exchange(ctx context.Context, u *upstream.Upstream, query []byte, timeout time.Duration, replies chan Reply) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	r := Reply{From: u.Addr}
+	data, err := u.Client.Exchange(ctx, query)
+	if err != nil {
+		r.Err = err
+	} else if p, err := parser.NewParser(data); err != nil {
+		r.Err = err
+	} else if err := p.ParseMessage(); err != nil {
+		r.Err = fmt.Errorf("failed to parse reply: %w", err)
+	} else {
+		r.Msg = p.Message
+		r.Data = data
+	}
+
+	select {
+	case replies <- r:
+	default:
+		log.Debug("dropping reply from %s: nobody is waiting for it", u.Addr)
+	}
+}
+
+// reserveTransaction stores a new entry under a random unused ID.
+func reserveTransaction(client net.Addr, replies chan Reply) int {
+	for {
+		id := rand.IntN(1 << 16)
+		_, loaded := TransactionTable.LoadOrStore(id, Addr{
+			Addr:      client.String(),
+			Timestamp: time.Now(),
+			Reply:     replies,
+		})
+		if !loaded {
+			return id
+		}
+	}
+}
+
+// withID returns a copy of the message with the ID replaced.
+func withID(data []byte, id uint16) []byte {
+	msg := slices.Clone(data)
+	binary.BigEndian.PutUint16(msg, id)
+	return msg
+}
@@ -0,0 +1,372 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/parser"
+	"server/pkg/upstream"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeUpstream is a resolver on loopback answering every query with
+// whatever the handler returns. A nil answer means staying silent.
+type fakeUpstream struct {
+	conn    *net.UDPConn
+	handler func(query []byte) []byte
+	queries atomic.Int32
+}
+
+func newFakeUpstream(t *testing.T, handler func(query []byte) []byte) *fakeUpstream {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.NoError(t, err)
+
+	f := &fakeUpstream{conn: conn, handler: handler}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			f.queries.Add(1)
+			if resp := f.handler(slices.Clone(buf[:n])); resp != nil {
+				_, _ = conn.WriteToUDP(resp, addr)
+			}
+		}
+	}()
+	return f
+}
+
+func (f *fakeUpstream) Addr() string {
+	return f.conn.LocalAddr().String()
+}
+
+// respond turns the query into an empty response with the given code.
+func respond(rcode dnsmessage.RCode) func([]byte) []byte {
+	return func(query []byte) []byte {
+		query[2] |= 0x80 // QR
+		query[3] = 0x80 | byte(rcode)
+		return query
+	}
+}
+
+func silent(query []byte) []byte {
+	return nil
+}
+
+func startTestServer(t *testing.T, cfg *upstream.Config) (*UDPServer, chan error) {
+	InitTransactionsTable()
+	assert.NoError(t, InitUpstreams(cfg, nil, nil))
+	return serveUDP(t)
+}
+
+// serveUDP starts a UDP server with the upstreams that are configured at the time.
+func serveUDP(t *testing.T) (*UDPServer, chan error) {
+	udpSrv, err := NewUDPServer(&TestUDPCfg)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 16)
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		assert.NoError(t, udpSrv.Start(ctx, errCh))
+	})
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	return udpSrv, errCh
+}
+
+func sendQuery(t *testing.T, srv *UDPServer) *dnsmessage.DNSMessage {
+	client, err := NewUDPClient(srv.Conn.LocalAddr().String(), time.Second*5)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	query, err := hex.DecodeString("45dc010000010000000000000377777707796f757475626503636f6d0000010001")
+	assert.NoError(t, err)
+
+	resp, err := client.SendAndReceive(query, 512)
+	assert.NoError(t, err)
+
+	p, err := parser.NewParser(resp)
+	assert.NoError(t, err)
+	assert.NoError(t, p.ParseMessage())
+	return p.Message
+}
+
+func TestForwardFailoverOnTimeout(t *testing.T) {
+	dead := newFakeUpstream(t, silent)
+	alive := newFakeUpstream(t, respond(dnsmessage.RCodeNoError))
+
+	srv, errCh := startTestServer(t, &upstream.Config{
+		Addrs:   []string{dead.Addr(), alive.Addr()},
+		Timeout: 200 * time.Millisecond,
+	})
+
+	m := sendQuery(t, srv)
+	assert.Equal(t, uint32(0x45dc), m.Header.ID)
+	assert.Equal(t, uint64(1), m.Header.QR)
+	assert.Equal(t, dnsmessage.RCodeNoError, m.Header.RCode)
+
+	assert.Equal(t, int32(1), dead.queries.Load())
+	assert.Equal(t, int32(1), alive.queries.Load())
+	assert.Empty(t, errCh)
+}
+
+func TestForwardFailoverOnServfail(t *testing.T) {
+	broken := newFakeUpstream(t, respond(dnsmessage.RCodeServerFailure))
+	alive := newFakeUpstream(t, respond(dnsmessage.RCodeNoError))
+
+	srv, errCh := startTestServer(t, &upstream.Config{
+		Addrs: []string{broken.Addr(), alive.Addr()},
+	})
+
+	m := sendQuery(t, srv)
+	assert.Equal(t, dnsmessage.RCodeNoError, m.Header.RCode)
+	assert.Equal(t, int32(1), broken.queries.Load())
+	assert.Equal(t, int32(1), alive.queries.Load())
+	assert.Empty(t, errCh)
+}
+
+func TestForwardAllUpstreamsFail(t *testing.T) {
+	first := newFakeUpstream(t, silent)
+	second := newFakeUpstream(t, silent)
+
+	srv, errCh := startTestServer(t, &upstream.Config{
+		Addrs:   []string{first.Addr(), second.Addr()},
+		Timeout: 100 * time.Millisecond,
+	})
+
+	m := sendQuery(t, srv)
+	assert.Equal(t, uint32(0x45dc), m.Header.ID)
+	assert.Equal(t, dnsmessage.RCodeServerFailure, m.Header.RCode)
+	assert.Equal(t, []byte("youtube"), m.Question.QName[1])
+	assert.Len(t, errCh, 1)
+}
+
+func TestForwardParallelTakesFirstReply(t *testing.T) {
+	slow := newFakeUpstream(t, func(query []byte) []byte {
+		time.Sleep(time.Second)
+		return respond(dnsmessage.RCodeNoError)(query)
+	})
+	fast := newFakeUpstream(t, respond(dnsmessage.RCodeNoError))
+
+	srv, errCh := startTestServer(t, &upstream.Config{
+		Addrs:    []string{slow.Addr(), fast.Addr()},
+		Strategy: upstream.StrategyParallel,
+	})
+
+	start := time.Now()
+	m := sendQuery(t, srv)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, dnsmessage.RCodeNoError, m.Header.RCode)
+	assert.Equal(t, int32(1), slow.queries.Load())
+	assert.Equal(t, int32(1), fast.queries.Load())
+	assert.Empty(t, errCh)
+}
+
+func TestForwardByRule(t *testing.T) {
+	public := newFakeUpstream(t, respond(dnsmessage.RCodeNoError))
+	youtube := newFakeUpstream(t, respond(dnsmessage.RCodeNoError))
+
+	InitTransactionsTable()
+	assert.NoError(t, InitUpstreams(
+		&upstream.Config{Addrs: []string{public.Addr()}},
+		map[string]upstream.Config{"video": {Addrs: []string{youtube.Addr()}}},
+		[]upstream.Rule{{Suffix: "youtube.com", Group: "video"}},
+	))
+	srv, errCh := serveUDP(t)
+
+	m := sendQuery(t, srv)
+	assert.Equal(t, dnsmessage.RCodeNoError, m.Header.RCode)
+	assert.Equal(t, int32(0), public.queries.Load())
+	assert.Equal(t, int32(1), youtube.queries.Load())
+	assert.Empty(t, errCh)
+}
+
+// fakeExchanger stands in for an upstream with its own connection.
+type fakeExchanger struct {
+	handler func(query []byte) []byte
+}
+
+func (f fakeExchanger) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if resp := f.handler(slices.Clone(query)); resp != nil {
+		return resp, nil
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestForwardOverExchanger(t *testing.T) {
+	fallback := newFakeUpstream(t, respond(dnsmessage.RCodeNoError))
+
+	InitTransactionsTable()
+	assert.NoError(t, InitUpstreams(&upstream.Config{
+		Addrs:   []string{"tls://127.0.0.1:1", "tls://127.0.0.1:2", fallback.Addr()},
+		Timeout: 200 * time.Millisecond,
+	}, nil, nil))
+	upstreams := Upstreams.Default.Upstreams
+	upstreams[0].Client = fakeExchanger{handler: silent}
+	upstreams[1].Client = fakeExchanger{handler: respond(dnsmessage.RCodeNoError)}
+	srv, errCh := serveUDP(t)
+
+	m := sendQuery(t, srv)
+	assert.Equal(t, uint32(0x45dc), m.Header.ID)
+	assert.Equal(t, dnsmessage.RCodeNoError, m.Header.RCode)
+	assert.Equal(t, int32(0), fallback.queries.Load())
+	// the silent upstream is charged the timeout
+	assert.True(t, upstreams[1].RTT() > 0)
+	assert.Greater(t, upstreams[0].RTT(), upstreams[1].RTT())
+	assert.Empty(t, errCh)
+}
+
+// swapCase answers like respond but with the case of every letter in the
+// question name swapped, like an upstream that doesn't preserve it.
+func swapCase(query []byte) []byte {
+	name, _ := questionName(query)
+	for i, c := range name {
+		// label lengths are below 64 and never look like letters
+		if c |= 0x20; c >= 'a' && c <= 'z' {
+			name[i] ^= 0x20
+		}
+	}
+	return respond(dnsmessage.RCodeNoError)(query)
+}
+
+func TestForwardRandomizesCase(t *testing.T) {
+	var mu sync.Mutex
+	var names []string
+	upstreamSrv := newFakeUpstream(t, func(query []byte) []byte {
+		name, _ := questionName(query)
+		mu.Lock()
+		names = append(names, string(name))
+		mu.Unlock()
+		return respond(dnsmessage.RCodeNoError)(query)
+	})
+
+	srv, errCh := startTestServer(t, &upstream.Config{Addrs: []string{upstreamSrv.Addr()}})
+
+	for range 3 {
+		m := sendQuery(t, srv)
+		assert.Equal(t, dnsmessage.RCodeNoError, m.Header.RCode)
+		// the client gets the name back as it sent it
+		assert.Equal(t, []byte("youtube"), m.Question.QName[1])
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, names, 3)
+	mixed := false
+	for _, name := range names {
+		assert.True(t, equalFold([]byte(name), []byte("\x03www\x07youtube\x03com\x00")), name)
+		mixed = mixed || name != "\x03www\x07youtube\x03com\x00"
+	}
+	assert.True(t, mixed)
+	assert.Empty(t, errCh)
+}
+
+func TestForwardCaseFallback(t *testing.T) {
+	upstreamSrv := newFakeUpstream(t, swapCase)
+
+	srv, errCh := startTestServer(t, &upstream.Config{
+		Addrs:   []string{upstreamSrv.Addr()},
+		Timeout: 100 * time.Millisecond,
+	})
+
+	// replies that change the case are taken for spoofed until the
+	// upstream has done it often enough to be considered broken
+	for range 2 {
+		m := sendQuery(t, srv)
+		assert.Equal(t, dnsmessage.RCodeServerFailure, m.Header.RCode)
+	}
+	assert.Len(t, errCh, 2)
+	assert.False(t, Upstreams.Default.Upstreams[0].RandomizeCase())
+
+	m := sendQuery(t, srv)
+	assert.Equal(t, dnsmessage.RCodeNoError, m.Header.RCode)
+	assert.Equal(t, []byte("youtube"), m.Question.QName[1])
+}
+
+func TestForwardRejectsMismatchedReplies(t *testing.T) {
+	// replies from the spoofer reach the server from another address
+	spoofer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = spoofer.Close() })
+	var target atomic.Pointer[net.UDPAddr]
+
+	tests := []struct {
+		name    string
+		handler func(query []byte) []byte
+		counter *atomic.Uint64
+	}{
+		{
+			name: "wrong source",
+			handler: func(query []byte) []byte {
+				_, _ = spoofer.WriteToUDP(respond(dnsmessage.RCodeNoError)(query), target.Load())
+				return nil
+			},
+			counter: &RejectedReplies.WrongSource,
+		},
+		{
+			name: "wrong opcode",
+			handler: func(query []byte) []byte {
+				query[2] |= 2 << 3 // STATUS
+				return respond(dnsmessage.RCodeNoError)(query)
+			},
+			counter: &RejectedReplies.WrongHeader,
+		},
+		{
+			name: "wrong name",
+			handler: func(query []byte) []byte {
+				query[dnsmessage.HeaderLength+1] = 'x'
+				return respond(dnsmessage.RCodeNoError)(query)
+			},
+			counter: &RejectedReplies.WrongQuestion,
+		},
+		{
+			name: "wrong type",
+			handler: func(query []byte) []byte {
+				query[len(query)-3] = byte(dnsmessage.TypeAAAA)
+				return respond(dnsmessage.RCodeNoError)(query)
+			},
+			counter: &RejectedReplies.WrongQuestion,
+		},
+		{
+			name: "wrong class",
+			handler: func(query []byte) []byte {
+				query[len(query)-1] = 3 // CHAOS
+				return respond(dnsmessage.RCodeNoError)(query)
+			},
+			counter: &RejectedReplies.WrongQuestion,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamSrv := newFakeUpstream(t, tt.handler)
+			srv, errCh := startTestServer(t, &upstream.Config{
+				Addrs:   []string{upstreamSrv.Addr()},
+				Timeout: 100 * time.Millisecond,
+			})
+			target.Store(srv.Conn.LocalAddr().(*net.UDPAddr))
+
+			before := tt.counter.Load()
+			m := sendQuery(t, srv)
+			assert.Equal(t, dnsmessage.RCodeServerFailure, m.Header.RCode)
+			assert.Equal(t, before+1, tt.counter.Load())
+			assert.Len(t, errCh, 1)
+		})
+	}
+}
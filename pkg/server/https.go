@@ -0,0 +1,273 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/log"
+	"server/pkg/parser"
+	"server/pkg/transport"
+)
+
+const defaultDoHPath = "/dns-query"
+
+// HTTPServer serves DNS over HTTPS (RFC 8484). Without a certificate it
+// speaks plain HTTP which is meant for running behind a reverse proxy.
+type HTTPServer struct {
+	Config   *HTTPSConfig
+	Listener net.Listener
+	Net      string
+	// queries to UDP upstreams go out over the socket of the UDP listener
+	UDPConn *net.UDPConn
+	Certs   *CertStore // only set for HTTPS
+
+	srv            *http.Server
+	trustedProxies []netip.Prefix
+	errChan        chan error
+}
+
+func NewHTTPServer(cfg *HTTPSConfig, udpConn *net.UDPConn) (*HTTPServer, error) {
+	proxies := make([]netip.Prefix, 0, len(cfg.TrustedProxies))
+	for _, p := range cfg.TrustedProxies {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(p)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", p, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+
+	s := HTTPServer{
+		Config:         cfg,
+		Net:            "http",
+		UDPConn:        udpConn,
+		trustedProxies: proxies,
+	}
+
+	path := cfg.Path
+	if path == "" {
+		path = defaultDoHPath
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, s.serveDNS)
+	s.srv = &http.Server{Handler: mux, IdleTimeout: cfg.Timeout}
+
+	if cfg.CertFile != "" {
+		certs, err := NewCertStore(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.Certs = certs
+		s.Net = "https"
+		s.srv.TLSConfig = &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort(cfg.Addr, strconv.Itoa(cfg.Port)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s listener: %w", s.Net, err)
+	}
+	s.Listener = l
+
+	return &s, nil
+}
+
+func (s *HTTPServer) GetNet() string {
+	return s.Net
+}
+
+// Reload reads the certificate and key files again.
+func (s *HTTPServer) Reload() error {
+	if s.Certs == nil {
+		return nil
+	}
+	return s.Certs.Reload()
+}
+
+func (s *HTTPServer) Start(ctx context.Context, errChan chan error) error {
+	log.Info("starting %s server on %s...", s.Net, s.Listener.Addr().String())
+	s.errChan = errChan
+	s.srv.BaseContext = func(net.Listener) context.Context { return ctx }
+
+	go func() {
+		<-ctx.Done()
+		log.Debug("context done, closing %s server...", s.Net)
+		_ = s.srv.Close()
+	}()
+
+	var err error
+	if s.Certs != nil {
+		// the certificate comes from TLSConfig.GetCertificate
+		err = s.srv.ServeTLS(s.Listener, "", "")
+	} else {
+		err = s.srv.Serve(s.Listener)
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		log.Info("%s server shutting down", s.Net)
+		return nil
+	}
+	return err
+}
+
+func (s *HTTPServer) Shutdown(ctx context.Context) error {
+	log.Info("shutting down %s server...", s.Net)
+	if err := s.srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to shut down %s server: %w", s.Net, err)
+	}
+	return nil
+}
+
+func (s *HTTPServer) serveDNS(w http.ResponseWriter, r *http.Request) {
+	var (
+		data []byte
+		err  error
+	)
+
+	switch r.Method {
+	case http.MethodGet:
+		// the padding is omitted but tolerate it anyway (RFC 8484, section 6)
+		data, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(r.URL.Query().Get("dns"), "="))
+		if err != nil {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if !transport.IsDNSMessage(r.Header.Get("Content-Type")) {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err = io.ReadAll(io.LimitReader(r.Body, transport.MaxMessageLength+1))
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if len(data) < dnsmessage.HeaderLength || len(data) > transport.MaxMessageLength {
+		http.Error(w, "invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	client := s.clientAddr(r)
+	log.Info("Received a %s message (%d bytes) from %s", s.Net, len(data), client.String())
+
+	p, err := parser.NewParser(data)
+	if err == nil {
+		err = p.ParseMessage()
+	}
+	if err != nil || !p.Message.IsQuery() {
+		http.Error(w, "invalid DNS query", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), defaultTimeout)
+	defer cancel()
+
+	resp := handleQuery(ctx, p.Message, data, s.UDPConn, client, s.errChan)
+	if resp == nil {
+		http.Error(w, "failed to process query", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", transport.DNSMessageContentType)
+	if maxAge, ok := minTTL(resp); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge))
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp)))
+	_, _ = w.Write(resp)
+}
+
+// clientAddr identifies the client. Requests from trusted proxies are
+// attributed to the last address in X-Forwarded-For that is not a proxy.
+func (s *HTTPServer) clientAddr(r *http.Request) net.Addr {
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	if !s.trusted(remote.Addr()) {
+		return net.TCPAddrFromAddrPort(remote)
+	}
+
+	hops := []string{}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for hop := range strings.SplitSeq(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	// the right most entries are appended by the proxies closest to us
+	for _, hop := range slices.Backward(hops) {
+		addr, err := netip.ParseAddr(hop)
+		if err != nil {
+			break
+		}
+		addr = addr.Unmap()
+		if !s.trusted(addr) {
+			return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, 0))
+		}
+	}
+	return net.TCPAddrFromAddrPort(remote)
+}
+
+func (s *HTTPServer) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range s.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// minTTL returns the smallest TTL in the answer section. Negative answers
+// are cached for as long as the SOA in the authority section says (RFC 2308).
+func minTTL(resp []byte) (uint32, bool) {
+	p, err := parser.NewParser(resp)
+	if err != nil {
+		return 0, false
+	}
+	if err := p.ParseMessage(); err != nil {
+		return 0, false
+	}
+
+	ttls := []uint32{}
+	for _, rr := range p.Message.Answers {
+		ttls = append(ttls, rr.TTL)
+	}
+	if len(ttls) == 0 {
+		for _, rr := range p.Message.AuthorityRecords {
+			if rr.Type != dnsmessage.TypeSOA {
+				continue
+			}
+			if soa, err := dnsmessage.UnpackSOA(rr.RData); err == nil {
+				ttls = append(ttls, min(rr.TTL, soa.Minimum))
+			}
+		}
+	}
+
+	if len(ttls) == 0 {
+		return 0, false
+	}
+	return slices.Min(ttls), true
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/parser"
+	"server/pkg/transport"
+	"server/pkg/upstream"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startHTTPTestServer(t *testing.T, srv *HTTPServer) chan error {
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 16)
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		assert.NoError(t, srv.Start(ctx, errCh))
+	})
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	return errCh
+}
+
+// answerWithTTLs answers the query with one A record per TTL.
+func answerWithTTLs(ttls ...uint32) func([]byte) []byte {
+	return func(query []byte) []byte {
+		p, err := parser.NewParser(query)
+		if err != nil || p.ParseMessage() != nil {
+			return nil
+		}
+		m := p.Message
+		m.Header.QR = 1
+		for i, ttl := range ttls {
+			m.Answers = append(m.Answers, &dnsmessage.ResourceRecord{
+				Name:  m.Question.QName,
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassIN,
+				TTL:   ttl,
+				RData: []byte{192, 0, 2, byte(i + 1)},
+			})
+		}
+		resp, err := m.Pack()
+		if err != nil {
+			return nil
+		}
+		return resp
+	}
+}
+
+func TestHTTPSServer(t *testing.T) {
+	fake := newFakeUpstream(t, respond(dnsmessage.RCodeNoError))
+	udpSrv, _ := startTestServer(t, &upstream.Config{Addrs: []string{fake.Addr()}})
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert := writeTestCert(t, certFile, keyFile)
+
+	srv, err := NewHTTPServer(&HTTPSConfig{
+		Addr:     "127.0.0.1",
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}, udpSrv.Conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "https", srv.GetNet())
+	errCh := startHTTPTestServer(t, srv)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			c, err := transport.NewDoHClient(transport.DoHConfig{
+				URL:     "https://" + srv.Listener.Addr().String() + defaultDoHPath,
+				Method:  method,
+				RootCAs: roots,
+			})
+			assert.NoError(t, err)
+
+			m := exchangeQuery(t, c)
+			assert.Equal(t, uint32(0x45dc), m.Header.ID)
+			assert.Equal(t, dnsmessage.RCodeNoError, m.Header.RCode)
+		})
+	}
+	assert.Equal(t, int32(2), fake.queries.Load())
+	assert.Empty(t, errCh)
+}
+
+const testQuery = "45dc010000010000000000000377777707796f757475626503636f6d0000010001"
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	assert.NoError(t, err)
+	return b
+}
+
+func TestHTTPServer(t *testing.T) {
+	fake := newFakeUpstream(t, answerWithTTLs(120, 60, 300))
+	udpSrv, _ := startTestServer(t, &upstream.Config{Addrs: []string{fake.Addr()}})
+
+	srv, err := NewHTTPServer(&HTTPSConfig{Addr: "127.0.0.1"}, udpSrv.Conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "http", srv.GetNet())
+	errCh := startHTTPTestServer(t, srv)
+
+	url := "http://" + srv.Listener.Addr().String() + defaultDoHPath
+	query := mustDecodeHex(t, testQuery)
+
+	get, err := http.NewRequest(http.MethodGet, url+"?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+	assert.NoError(t, err)
+	post, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(query))
+	assert.NoError(t, err)
+	post.Header.Set("Content-Type", transport.DNSMessageContentType)
+
+	for _, req := range []*http.Request{get, post} {
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode, req.Method)
+		assert.Equal(t, transport.DNSMessageContentType, resp.Header.Get("Content-Type"))
+		assert.Equal(t, "max-age=60", resp.Header.Get("Cache-Control"))
+
+		p, err := parser.NewParser(body)
+		assert.NoError(t, err)
+		assert.NoError(t, p.ParseMessage())
+		assert.Equal(t, uint32(0x45dc), p.Message.Header.ID)
+		assert.Len(t, p.Message.Answers, 3)
+	}
+	assert.Equal(t, int32(2), fake.queries.Load())
+	assert.Empty(t, errCh)
+}
+
+func TestHTTPServerRejectsBadRequests(t *testing.T) {
+	udpSrv, _ := startTestServer(t, &upstream.Config{Addrs: []string{"127.0.0.1:1"}})
+
+	srv, err := NewHTTPServer(&HTTPSConfig{Addr: "127.0.0.1"}, udpSrv.Conn)
+	assert.NoError(t, err)
+	startHTTPTestServer(t, srv)
+
+	url := "http://" + srv.Listener.Addr().String() + defaultDoHPath
+	response := mustDecodeHex(t, "45dc810000010000000000000377777707796f757475626503636f6d0000010001")
+
+	tests := []struct {
+		method      string
+		query       string
+		contentType string
+		body        []byte
+		status      int
+	}{
+		{method: http.MethodGet, query: "?dns=not*base64", status: http.StatusBadRequest},
+		{method: http.MethodGet, status: http.StatusBadRequest},
+		{method: http.MethodGet, query: "?dns=" + base64.RawURLEncoding.EncodeToString(response), status: http.StatusBadRequest},
+		{method: http.MethodPost, contentType: "text/plain", body: response, status: http.StatusUnsupportedMediaType},
+		{method: http.MethodPost, contentType: transport.DNSMessageContentType, body: []byte{1, 2, 3}, status: http.StatusBadRequest},
+		{method: http.MethodPost, contentType: transport.DNSMessageContentType + "; charset=utf-8", body: []byte{1, 2, 3}, status: http.StatusBadRequest},
+		{method: http.MethodPut, status: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, url+tt.query, bytes.NewReader(tt.body))
+		assert.NoError(t, err)
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, tt.status, resp.StatusCode, "%s %s", tt.method, tt.query)
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	srv, err := NewHTTPServer(&HTTPSConfig{
+		Addr:           "127.0.0.1",
+		TrustedProxies: []string{"10.0.0.0/8", "2001:db8::1"},
+	}, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = srv.Listener.Close() })
+
+	tests := []struct {
+		remote string
+		xff    []string
+		exp    string
+	}{
+		// untrusted peers can't choose their address
+		{remote: "192.0.2.1:5000", xff: []string{"198.51.100.1"}, exp: "192.0.2.1:5000"},
+		{remote: "10.0.0.1:5000", exp: "10.0.0.1:5000"},
+		{remote: "10.0.0.1:5000", xff: []string{"198.51.100.1"}, exp: "198.51.100.1:0"},
+		// only the hops appended by trusted proxies count
+		{remote: "10.0.0.1:5000", xff: []string{"203.0.113.9, 198.51.100.1, 10.1.1.1"}, exp: "198.51.100.1:0"},
+		{remote: "10.0.0.1:5000", xff: []string{"203.0.113.9", "198.51.100.1"}, exp: "198.51.100.1:0"},
+		{remote: "[2001:db8::1]:443", xff: []string{"2001:db8::2"}, exp: "[2001:db8::2]:0"},
+		{remote: "10.0.0.1:5000", xff: []string{"garbage"}, exp: "10.0.0.1:5000"},
+	}
+	for _, tt := range tests {
+		r, err := http.NewRequest(http.MethodGet, "/", nil)
+		assert.NoError(t, err)
+		r.RemoteAddr = tt.remote
+		for _, v := range tt.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		assert.Equal(t, tt.exp, srv.clientAddr(r).String(), "%s %v", tt.remote, tt.xff)
+	}
+
+	_, err = NewHTTPServer(&HTTPSConfig{Addr: "127.0.0.1", TrustedProxies: []string{"not-an-ip"}}, nil)
+	assert.Error(t, err)
+}
@@ -13,6 +13,9 @@ var TransactionTable *TransationsTable
 type Addr struct {
 	Addr      string
 	Timestamp time.Time
+	// replies from upstream are handed over to the goroutine
+	// waiting on the forwarded query
+	Reply chan Reply
 }
 
 type TransationsTable struct {
@@ -44,6 +47,23 @@ func (tt *TransationsTable) Store(key int, value Addr) {
 	tt.m[key] = value
 }
 
+// LoadOrStore stores the value only if the key is not present yet.
+// It returns the existing value and true otherwise.
+func (tt *TransationsTable) LoadOrStore(key int, value Addr) (Addr, bool) {
+	if tt == nil || tt.m == nil {
+		log.Fatal("TransactionsTable is not initialized")
+		return Addr{}, false
+	}
+
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if val, ok := tt.m[key]; ok {
+		return val, true
+	}
+	tt.m[key] = value
+	return value, false
+}
+
 func (tt *TransationsTable) Delete(key int) {
 	if tt == nil || tt.m == nil {
 		log.Fatal("TransactionsTable is not initialized")
@@ -64,6 +84,9 @@ func (tt *TransationsTable) String() string {
 		log.Fatal("TransactionsTable is not initialized")
 		return ""
 	}
+
+	tt.mu.RLock()
+	defer tt.mu.RUnlock()
 	var sb strings.Builder
 	for k, v := range tt.m {
 		sb.WriteString(fmt.Sprintf("ID: %d, %v", k, v))
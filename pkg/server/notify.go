@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/log"
+	"server/pkg/tsig"
+	"server/pkg/zone"
+)
+
+// notifySecondaries tells the secondaries of the zone about its new
+// version in the background (RFC 1996), signed with the key of the zone.
+func notifySecondaries(z *zone.Zone) {
+	key := TSIGKeys.Get(z.Key)
+	for _, addr := range z.Notify {
+		go func() {
+			addr := withDefaultPort(addr)
+			if err := zone.Notify(context.Background(), addr, z, key); err != nil {
+				log.Warn("failed to notify %s about zone %s: %v", addr, dnsmessage.DomainNameToString(z.Origin), err)
+				return
+			}
+			log.Debug("notified %s about serial %d of zone %s", addr, z.Serial(), dnsmessage.DomainNameToString(z.Origin))
+		}()
+	}
+}
+
+func isNotify(m *dnsmessage.DNSMessage) bool {
+	return m.Header.OpCode == dnsmessage.OpCodeNotify
+}
+
+// answerNotify acknowledges a NOTIFY from a primary of one of our
+// secondary zones, which is refreshed right away. NOTIFY from anybody
+// else is refused (RFC 1996, section 3.10), as is NOTIFY not signed with
+// the key of the zone if it has one.
+func answerNotify(m *dnsmessage.DNSMessage, client net.Addr, key *tsig.Key) ([]byte, error) {
+	if m.Question == nil {
+		return dnsmessage.NewErrorResponse(m, dnsmessage.RCodeFormatError), nil
+	}
+	s := secondaryOf(m.Question.QName)
+	if s == nil || !s.fromPrimary(client) || (s.key != nil && key != s.key) {
+		log.Warn("refusing NOTIFY for %s from %s", dnsmessage.DomainNameToString(m.Question.QName), client.String())
+		return dnsmessage.NewErrorResponse(m, dnsmessage.RCodeRefused), nil
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+		// a refresh is pending already
+	}
+	log.Info("got NOTIFY for zone %s from %s", s.cfg.Origin, client.String())
+
+	h := authoritativeHeader(m)
+	resp := dnsmessage.DNSMessage{Header: &h, Question: m.Question}
+	return resp.Pack()
+}
+
+// secondaryOf returns the secondary for the zone with the origin.
+func secondaryOf(origin dnsmessage.DomainName) *secondary {
+	for _, s := range secondaries {
+		if dnsmessage.EqualNames(s.origin, origin) {
+			return s
+		}
+	}
+	return nil
+}
+
+// fromPrimary reports whether the client is one of the primaries.
+func (s *secondary) fromPrimary(client net.Addr) bool {
+	addr, err := netip.ParseAddrPort(client.String())
+	if err != nil {
+		return false
+	}
+	for _, primary := range s.primaries {
+		host, _, err := net.SplitHostPort(primary)
+		if err != nil {
+			continue
+		}
+		if ip, err := netip.ParseAddr(host); err == nil && ip.Unmap() == addr.Addr().Unmap() {
+			return true
+		}
+	}
+	return false
+}
+
+// withDefaultPort adds the DNS port to addresses without one.
+func withDefaultPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(addr, "53")
+	}
+	return addr
+}
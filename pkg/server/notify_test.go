@@ -0,0 +1,121 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/parser"
+	"server/pkg/zone"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func notifyQuery(t *testing.T, origin string) []byte {
+	m := dnsmessage.DNSMessage{
+		Header:   &dnsmessage.Header{ID: 0x4e4e, OpCode: dnsmessage.OpCodeNotify, AA: 1},
+		Question: &dnsmessage.Question{QName: dnsmessage.ParseDomainName(origin), QType: dnsmessage.TypeSOA, QClass: dnsmessage.ClassIN},
+	}
+	data, err := m.Pack()
+	require.NoError(t, err)
+	return data
+}
+
+func parseMessage(t *testing.T, data []byte) *dnsmessage.DNSMessage {
+	p, err := parser.NewParser(data)
+	require.NoError(t, err)
+	require.NoError(t, p.ParseMessage())
+	return p.Message
+}
+
+func TestNotifyReceived(t *testing.T) {
+	store := zone.NewStore()
+	fromUs, err := newSecondary(zone.Config{Origin: "example.", Primaries: []string{"127.0.0.1"}}, store)
+	require.NoError(t, err)
+	fromOthers, err := newSecondary(zone.Config{Origin: "other.", Primaries: []string{"192.0.2.1:5353"}}, store)
+	require.NoError(t, err)
+	secondaries = []*secondary{fromUs, fromOthers}
+	t.Cleanup(func() { secondaries = nil })
+
+	srv, errCh := serveUDP(t)
+	client, err := NewUDPClient(srv.Conn.LocalAddr().String(), time.Second)
+	require.NoError(t, err)
+	defer client.Close()
+
+	data, err := client.SendAndReceive(notifyQuery(t, "example"), 512)
+	require.NoError(t, err)
+	resp := parseMessage(t, data)
+	assert.Equal(t, uint32(0x4e4e), resp.Header.ID)
+	assert.Equal(t, uint64(1), resp.Header.QR)
+	assert.Equal(t, uint64(dnsmessage.OpCodeNotify), resp.Header.OpCode)
+	assert.Equal(t, uint64(1), resp.Header.AA)
+	assert.Equal(t, dnsmessage.RCodeNoError, resp.Header.RCode)
+	assert.Len(t, fromUs.notify, 1)
+
+	// another one while the refresh is pending
+	_, err = client.SendAndReceive(notifyQuery(t, "example"), 512)
+	require.NoError(t, err)
+	assert.Len(t, fromUs.notify, 1)
+
+	// not from the primary and for a zone we aren't a secondary for
+	for _, origin := range []string{"other", "unknown"} {
+		data, err := client.SendAndReceive(notifyQuery(t, origin), 512)
+		require.NoError(t, err)
+		assert.Equal(t, dnsmessage.RCodeRefused, parseMessage(t, data).Header.RCode, origin)
+	}
+	assert.Empty(t, fromOthers.notify)
+	assert.Empty(t, errCh)
+}
+
+func TestNotifySent(t *testing.T) {
+	secondary, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer secondary.Close()
+
+	dir := t.TempDir()
+	cfg := writeTransferZone(t, dir, 1)
+	cfg.Notify = []string{secondary.LocalAddr().String()}
+	require.NoError(t, InitZones([]zone.Config{cfg}))
+	t.Cleanup(func() { Zones = nil })
+
+	read := func(wait time.Duration) (*dnsmessage.DNSMessage, net.Addr) {
+		buf := make([]byte, 512)
+		require.NoError(t, secondary.SetReadDeadline(time.Now().Add(wait)))
+		n, from, err := secondary.ReadFrom(buf)
+		if err != nil {
+			return nil, nil
+		}
+		return parseMessage(t, buf[:n]), from
+	}
+
+	cfg = writeTransferZone(t, dir, 2)
+	cfg.Notify = []string{secondary.LocalAddr().String()}
+	require.NoError(t, ReloadZones([]zone.Config{cfg}))
+
+	m, from := read(5 * time.Second)
+	require.NotNil(t, m)
+	assert.Equal(t, uint64(dnsmessage.OpCodeNotify), m.Header.OpCode)
+	assert.Equal(t, uint64(1), m.Header.AA)
+	assert.True(t, m.IsQuery())
+	assert.Equal(t, "example", dnsmessage.DomainNameToString(m.Question.QName))
+	assert.Equal(t, dnsmessage.TypeSOA, m.Question.QType)
+	require.Len(t, m.Answers, 1)
+	soa, err := dnsmessage.UnpackSOA(m.Answers[0].RData)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), soa.Serial)
+
+	h := *m.Header
+	h.QR = 1
+	ack := dnsmessage.DNSMessage{Header: &h, Question: m.Question}
+	data, err := ack.Pack()
+	require.NoError(t, err)
+	_, err = secondary.WriteTo(data, from)
+	require.NoError(t, err)
+
+	// nothing changed, nobody is notified
+	require.NoError(t, ReloadZones([]zone.Config{cfg}))
+	m, _ = read(300 * time.Millisecond)
+	assert.Nil(t, m)
+}
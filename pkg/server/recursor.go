@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/resolver"
+)
+
+// Recursor resolves queries iteratively from the root. It is nil
+// unless recursion is enabled, then queries are only forwarded
+// if a forwarding rule matches.
+var Recursor *resolver.Resolver
+
+func InitRecursor(cfg *resolver.Config) error {
+	Recursor = nil
+	if !cfg.Enabled {
+		return nil
+	}
+
+	r, err := resolver.NewResolver(cfg, Infra)
+	if err != nil {
+		return err
+	}
+	Recursor = r
+	return nil
+}
+
+// recurse resolves the query and packs the response to it.
+func recurse(ctx context.Context, m *dnsmessage.DNSMessage) ([]byte, error) {
+	result, err := Recursor.Resolve(ctx, m.Question)
+	if err != nil {
+		return nil, err
+	}
+
+	h := *m.Header
+	h.QR = 1
+	h.AA = 0
+	h.TC = 0
+	h.RA = 1
+	h.Z = 0
+	h.RCode = result.Header.RCode
+
+	resp := dnsmessage.DNSMessage{
+		Header:           &h,
+		Question:         m.Question,
+		Answers:          result.Answers,
+		AuthorityRecords: result.AuthorityRecords,
+	}
+	return resp.Pack()
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/resolver"
+	"server/pkg/upstream"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecursion(t *testing.T) {
+	// the root server answers everything itself
+	root := newFakeUpstream(t, answerWithTTLs(60))
+	forwarded := newFakeUpstream(t, respond(dnsmessage.RCodeNoError))
+
+	InitTransactionsTable()
+	assert.NoError(t, InitUpstreams(
+		&upstream.Config{Addrs: []string{"127.0.0.1:1"}, Timeout: 100 * time.Millisecond},
+		map[string]upstream.Config{"corp": {Addrs: []string{forwarded.Addr()}}},
+		[]upstream.Rule{{Suffix: "corp.test", Group: "corp"}},
+	))
+	assert.NoError(t, InitRecursor(&resolver.Config{
+		Enabled:   true,
+		RootHints: []string{"127.0.0.1"},
+		Port:      root.conn.LocalAddr().(*net.UDPAddr).Port,
+	}))
+	t.Cleanup(func() { Recursor = nil })
+	srv, errCh := serveUDP(t)
+
+	m := sendQuery(t, srv)
+	assert.Equal(t, uint32(0x45dc), m.Header.ID)
+	assert.Equal(t, uint64(1), m.Header.RA)
+	assert.Equal(t, dnsmessage.RCodeNoError, m.Header.RCode)
+	assert.Len(t, m.Answers, 1)
+	assert.Equal(t, int32(1), root.queries.Load())
+	assert.Empty(t, errCh)
+
+	// forwarding rules still apply
+	client, err := NewUDPClient(srv.Conn.LocalAddr().String(), 5*time.Second)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	query := dnsmessage.DNSMessage{
+		Header:   &dnsmessage.Header{ID: 7, RD: 1},
+		Question: &dnsmessage.Question{QName: dnsmessage.ParseDomainName("host.corp.test"), QType: dnsmessage.TypeA, QClass: dnsmessage.ClassIN},
+	}
+	data, err := query.Pack()
+	assert.NoError(t, err)
+	_, err = client.SendAndReceive(data, 512)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), forwarded.queries.Load())
+	assert.Equal(t, int32(1), root.queries.Load())
+}
+
+func TestRecursionTruncatesOverUDP(t *testing.T) {
+	ttls := make([]uint32, 40)
+	for i := range ttls {
+		ttls[i] = 60
+	}
+	root := newFakeUpstream(t, answerWithTTLs(ttls...))
+
+	InitTransactionsTable()
+	assert.NoError(t, InitUpstreams(&upstream.Config{Addrs: []string{"127.0.0.1:1"}}, nil, nil))
+	assert.NoError(t, InitRecursor(&resolver.Config{
+		Enabled:   true,
+		RootHints: []string{"127.0.0.1"},
+		Port:      root.conn.LocalAddr().(*net.UDPAddr).Port,
+	}))
+	t.Cleanup(func() { Recursor = nil })
+	srv, _ := serveUDP(t)
+
+	m := sendQuery(t, srv)
+	assert.Equal(t, uint64(1), m.Header.TC)
+	assert.Empty(t, m.Answers)
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/zone"
+)
+
+// TTL of the PTR records of static hosts unless configured
+const defaultReverseTTL = time.Hour
+
+// ReverseConfig lets PTR queries for addresses in the LAN be answered from
+// the A and AAAA records of our zones and the static hosts, so that no
+// reverse zone has to be kept in line with them.
+type ReverseConfig struct {
+	// networks like "192.168.1.0/24" whose reverse names we answer, none if empty
+	Prefixes []string `yaml:"prefixes"`
+	// addresses of devices that are in none of our zones, by name
+	Hosts map[string][]string `yaml:"hosts"`
+	// TTL of the answers for static hosts
+	TTL time.Duration `yaml:"ttl"`
+}
+
+type reverseHosts struct {
+	prefixes []netip.Prefix
+	hosts    map[netip.Addr][]dnsmessage.DomainName
+	ttl      uint32
+}
+
+// reverse answers PTR queries for the LAN.
+// It is nil unless prefixes are configured.
+var reverse *reverseHosts
+
+func InitReverse(cfg *ReverseConfig) error {
+	reverse = nil
+	if len(cfg.Prefixes) == 0 {
+		return nil
+	}
+
+	r := &reverseHosts{hosts: make(map[netip.Addr][]dnsmessage.DomainName), ttl: uint32(defaultReverseTTL / time.Second)}
+	if cfg.TTL > 0 {
+		r.ttl = uint32(cfg.TTL / time.Second)
+	}
+	for _, p := range cfg.Prefixes {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return fmt.Errorf("invalid prefix %q: %w", p, err)
+		}
+		r.prefixes = append(r.prefixes, prefix.Masked())
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Hosts)) {
+		for _, a := range cfg.Hosts[name] {
+			addr, err := netip.ParseAddr(a)
+			if err != nil {
+				return fmt.Errorf("invalid address %q of host %s: %w", a, name, err)
+			}
+			addr = addr.WithZone("").Unmap()
+			r.hosts[addr] = append(r.hosts[addr], dnsmessage.ParseDomainName(name))
+		}
+	}
+	reverse = r
+	return nil
+}
+
+func (r *reverseHosts) covers(addr netip.Addr) bool {
+	for _, prefix := range r.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// answerReverse answers queries for names in the reverse zones of the LAN
+// prefixes, PTR queries for addresses with the names of the static hosts
+// and of the A and AAAA records in our zones. The zones are ours, so other
+// names don't exist and private addresses don't leak to the forwarders
+// (RFC 6303). A reverse zone of our own covering the name wins.
+func answerReverse(m *dnsmessage.DNSMessage) *zone.Answer {
+	q := m.Question
+	if reverse == nil || m.Header.OpCode != 0 || q.QClass != dnsmessage.ClassIN {
+		return nil
+	}
+	if Zones != nil && Zones.Find(q.QName) != nil {
+		return nil
+	}
+	prefix, ok := reversePrefix(q.QName)
+	if !ok {
+		return nil
+	}
+	covering, ok := reverse.covering(prefix)
+	if !ok {
+		return nil
+	}
+
+	negative := &zone.Answer{Authoritative: true, Authority: dnsmessage.ResourceRecords{reverse.soa(covering)}}
+	if !prefix.IsSingleIP() {
+		// the networks in between have no records of their own
+		return negative
+	}
+	ptrs := reverse.lookup(prefix.Addr(), q.QName)
+	if len(ptrs) == 0 {
+		negative.RCode = dnsmessage.RCodeNameError
+		return negative
+	}
+	if q.QType != dnsmessage.TypePTR && q.QType != dnsmessage.TypeANY {
+		return negative
+	}
+	return &zone.Answer{Authoritative: true, Answers: ptrs}
+}
+
+// covering returns the configured prefix the network is in.
+func (r *reverseHosts) covering(network netip.Prefix) (netip.Prefix, bool) {
+	for _, prefix := range r.prefixes {
+		if prefix.Bits() <= network.Bits() && prefix.Contains(network.Addr()) {
+			return prefix, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// lookup returns the PTR records of the address for the name.
+func (r *reverseHosts) lookup(addr netip.Addr, name dnsmessage.DomainName) dnsmessage.ResourceRecords {
+	var names []dnsmessage.DomainName
+	var ptrs dnsmessage.ResourceRecords
+	add := func(host dnsmessage.DomainName, ttl uint32) {
+		if slices.ContainsFunc(names, func(n dnsmessage.DomainName) bool { return dnsmessage.EqualNames(n, host) }) {
+			return
+		}
+		names = append(names, host)
+		ptrs = append(ptrs, &dnsmessage.ResourceRecord{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassIN, TTL: ttl, RData: dnsmessage.PackDomainName(host)})
+	}
+	for _, host := range r.hosts[addr] {
+		add(host, r.ttl)
+	}
+	if Zones != nil {
+		for _, rr := range Zones.Hosts(addr) {
+			add(rr.Name, rr.TTL)
+		}
+	}
+	return ptrs
+}
+
+// soa returns the SOA record of the reverse zone of the prefix for
+// negative answers, with the values of RFC 6303, section 3.
+func (r *reverseHosts) soa(prefix netip.Prefix) *dnsmessage.ResourceRecord {
+	soa := dnsmessage.SOA{
+		MName:   dnsmessage.ParseDomainName("localhost."),
+		RName:   dnsmessage.ParseDomainName("nobody.invalid."),
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   1200,
+		Expire:  604800,
+		Minimum: r.ttl,
+	}
+	return &dnsmessage.ResourceRecord{Name: reverseName(prefix), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassIN, TTL: r.ttl, RData: soa.Pack()}
+}
+
+// reverseName returns the name in in-addr.arpa or ip6.arpa of the
+// network, the one of the prefix in whole labels for other prefixes.
+func reverseName(prefix netip.Prefix) dnsmessage.DomainName {
+	ip := prefix.Addr().AsSlice()
+	var labels []string
+	if prefix.Addr().Is4() {
+		for _, b := range ip[:prefix.Bits()/8] {
+			labels = append([]string{strconv.Itoa(int(b))}, labels...)
+		}
+		return dnsmessage.Domain(append(labels, "in-addr", "arpa")...)
+	}
+	for i := range prefix.Bits() / 4 {
+		nibble := ip[i/2] >> (4 * (1 - i%2)) & 0x0F
+		labels = append([]string{strconv.FormatUint(uint64(nibble), 16)}, labels...)
+	}
+	return dnsmessage.Domain(append(labels, "ip6", "arpa")...)
+}
+
+// reversePrefix returns the network a name in in-addr.arpa or ip6.arpa
+// stands for, a single address for a full name (RFC 1035, section 3.5
+// and RFC 3596, section 2.5).
+func reversePrefix(name dnsmessage.DomainName) (netip.Prefix, bool) {
+	n := len(name) - 2
+	switch {
+	case n >= 0 && n <= 4 && isLabel(name[n], "in-addr") && isLabel(name[n+1], "arpa"):
+		var ip [4]byte
+		for i := range n {
+			b, err := strconv.ParseUint(string(name[n-1-i]), 10, 8)
+			if err != nil {
+				return netip.Prefix{}, false
+			}
+			ip[i] = byte(b)
+		}
+		return netip.PrefixFrom(netip.AddrFrom4(ip), 8*n), true
+	case n >= 0 && n <= 32 && isLabel(name[n], "ip6") && isLabel(name[n+1], "arpa"):
+		var ip [16]byte
+		for i := range n {
+			label := name[n-1-i]
+			if len(label) != 1 {
+				return netip.Prefix{}, false
+			}
+			nibble, err := strconv.ParseUint(string(label), 16, 4)
+			if err != nil {
+				return netip.Prefix{}, false
+			}
+			ip[i/2] |= byte(nibble) << (4 * (1 - i%2))
+		}
+		return netip.PrefixFrom(netip.AddrFrom16(ip), 4*n), true
+	}
+	return netip.Prefix{}, false
+}
+
+func isLabel(label []byte, s string) bool {
+	return strings.EqualFold(string(label), s)
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/parser"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReversePrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+	}{
+		{name: "80.2.0.192.in-addr.arpa", prefix: "192.0.2.80/32"},
+		{name: "80.2.0.192.IN-ADDR.ARPA", prefix: "192.0.2.80/32"},
+		{name: "2.0.192.in-addr.arpa", prefix: "192.0.2.0/24"},
+		{name: "in-addr.arpa", prefix: "0.0.0.0/0"},
+		{name: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", prefix: "2001:db8::1/128"},
+		{name: "A.B.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", prefix: "2001:db8::ba/128"},
+		{name: "8.b.d.0.1.0.0.2.ip6.arpa", prefix: "2001:db8::/32"},
+		{name: "256.2.0.192.in-addr.arpa"},
+		{name: "x.2.0.192.in-addr.arpa"},
+		{name: "1.80.2.0.192.in-addr.arpa"},
+		{name: "10.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+		{name: "www.example"},
+		{name: "arpa"},
+	}
+	for _, tt := range tests {
+		prefix, ok := reversePrefix(dnsmessage.ParseDomainName(tt.name))
+		if tt.prefix == "" {
+			assert.False(t, ok, tt.name)
+			continue
+		}
+		assert.True(t, ok, tt.name)
+		assert.Equal(t, netip.MustParsePrefix(tt.prefix), prefix, tt.name)
+		// and back
+		if prefix.Bits()%8 == 0 {
+			assert.True(t, dnsmessage.EqualNames(dnsmessage.ParseDomainName(tt.name), reverseName(prefix)), tt.name)
+		}
+	}
+	assert.Equal(t, "1.168.192.in-addr.arpa", dnsmessage.DomainNameToString(reverseName(netip.MustParsePrefix("192.168.1.0/24"))))
+	assert.Equal(t, "168.192.in-addr.arpa", dnsmessage.DomainNameToString(reverseName(netip.MustParsePrefix("192.168.16.0/20"))))
+	assert.Equal(t, "0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", dnsmessage.DomainNameToString(reverseName(netip.MustParsePrefix("2001:db8::/48"))))
+}
+
+func TestAnswerReverse(t *testing.T) {
+	initTestZones(t)
+	require.NoError(t, InitReverse(&ReverseConfig{
+		Prefixes: []string{"192.0.2.0/24", "2001:db8::/64"},
+		Hosts: map[string][]string{
+			"printer.lan.": {"192.0.2.9", "2001:db8::9"},
+			"www.example.": {"192.0.2.80"},
+		},
+		TTL: time.Minute,
+	}))
+	t.Cleanup(func() { reverse = nil })
+
+	query := func(name string, qtype dnsmessage.RRType) *dnsmessage.DNSMessage {
+		return &dnsmessage.DNSMessage{
+			Header:   &dnsmessage.Header{ID: 0x4321, RD: 1},
+			Question: &dnsmessage.Question{QName: dnsmessage.ParseDomainName(name), QType: qtype, QClass: dnsmessage.ClassIN},
+		}
+	}
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     dnsmessage.RRType
+		forwarded bool
+		rcode     dnsmessage.RCode
+		ptrs      []string
+		ttl       uint32
+		soa       string
+	}{
+		{name: "static host", qname: "9.2.0.192.in-addr.arpa", qtype: dnsmessage.TypePTR, ptrs: []string{"printer.lan."}, ttl: 60},
+		{name: "static host over IPv6", qname: "9.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", qtype: dnsmessage.TypePTR, ptrs: []string{"printer.lan."}, ttl: 60},
+		{name: "zone host", qname: "53.2.0.192.in-addr.arpa", qtype: dnsmessage.TypeANY, ptrs: []string{"ns1.example."}, ttl: 3600},
+		// named by both, once
+		{name: "static and zone host", qname: "80.2.0.192.in-addr.arpa", qtype: dnsmessage.TypePTR, ptrs: []string{"www.example."}, ttl: 60},
+		{name: "unknown address", qname: "10.2.0.192.in-addr.arpa", qtype: dnsmessage.TypePTR, rcode: dnsmessage.RCodeNameError, soa: "2.0.192.in-addr.arpa"},
+		{name: "unknown IPv6 address", qname: "a.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", qtype: dnsmessage.TypePTR, rcode: dnsmessage.RCodeNameError, soa: "0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+		{name: "other type", qname: "9.2.0.192.in-addr.arpa", qtype: dnsmessage.TypeTXT, soa: "2.0.192.in-addr.arpa"},
+		{name: "network", qname: "2.0.192.in-addr.arpa", qtype: dnsmessage.TypePTR, soa: "2.0.192.in-addr.arpa"},
+		{name: "outside the LAN", qname: "9.100.51.198.in-addr.arpa", qtype: dnsmessage.TypePTR, forwarded: true},
+		{name: "wider than the LAN", qname: "0.192.in-addr.arpa", qtype: dnsmessage.TypePTR, forwarded: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := answerReverse(query(tt.qname, tt.qtype))
+			if tt.forwarded {
+				assert.Nil(t, a)
+				return
+			}
+			require.NotNil(t, a)
+			assert.True(t, a.Authoritative)
+			assert.Equal(t, tt.rcode, a.RCode)
+			var names []string
+			for _, rr := range a.Answers {
+				assert.Equal(t, dnsmessage.TypePTR, rr.Type)
+				assert.Equal(t, tt.ttl, rr.TTL)
+				names = append(names, rr.RDataString())
+			}
+			assert.Equal(t, tt.ptrs, names)
+			if tt.soa != "" {
+				require.Len(t, a.Authority, 1)
+				assert.Equal(t, dnsmessage.TypeSOA, a.Authority[0].Type)
+				assert.Equal(t, tt.soa, dnsmessage.DomainNameToString(a.Authority[0].Name))
+			}
+		})
+	}
+
+	errCh := make(chan error, 1)
+	answer := func(name string) *dnsmessage.DNSMessage {
+		data := answerQuery(context.Background(), query(name, dnsmessage.TypePTR), nil, nil, nil, nil, errCh)
+		p, err := parser.NewParser(data)
+		require.NoError(t, err)
+		require.NoError(t, p.ParseMessage())
+		return p.Message
+	}
+	m := answer("9.2.0.192.in-addr.arpa")
+	assert.Equal(t, uint32(0x4321), m.Header.ID)
+	assert.Equal(t, uint64(1), m.Header.AA)
+	assert.Len(t, m.Answers, 1)
+	// unknown hosts in the LAN are not forwarded
+	m = answer("10.2.0.192.in-addr.arpa")
+	assert.Equal(t, dnsmessage.RCodeNameError, m.Header.RCode)
+	assert.Equal(t, uint64(1), m.Header.AA)
+	assert.Len(t, m.AuthorityRecords, 1)
+	assert.Empty(t, errCh)
+}
+
+func TestInitReverseErrors(t *testing.T) {
+	t.Cleanup(func() { reverse = nil })
+	for _, cfg := range []ReverseConfig{
+		{Prefixes: []string{"192.0.2.0/33"}},
+		{Prefixes: []string{"192.0.2.0/24"}, Hosts: map[string][]string{"printer.lan.": {"192.0.2"}}},
+	} {
+		assert.Error(t, InitReverse(&cfg))
+	}
+	require.NoError(t, InitReverse(&ReverseConfig{}))
+	assert.Nil(t, reverse)
+}
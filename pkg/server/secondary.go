@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/log"
+	"server/pkg/tsig"
+	"server/pkg/zone"
+)
+
+const (
+	// how often a secondary without a zone asks its primaries
+	defaultRetry = time.Minute
+	// the timers of an SOA are never shorter than this
+	minRefresh = time.Second
+)
+
+// secondaries keeps the zones we transfer from a primary, see StartSecondaries.
+var secondaries []*secondary
+
+// secondary keeps a zone transferred from its primaries up to date
+// (RFC 1034, section 4.3.5) and stops serving it once it expires.
+type secondary struct {
+	cfg       zone.Config
+	origin    dnsmessage.DomainName
+	primaries []string
+	acl       zone.ACL
+	key       *tsig.Key // signs the transfers, nil for none
+	store     *zone.Store
+	// makes run refresh at once, see answerNotify
+	notify    chan struct{}
+	refreshed time.Time // when the primaries last confirmed the zone
+}
+
+func newSecondary(cfg zone.Config, store *zone.Store) (*secondary, error) {
+	if cfg.DNSSEC != nil {
+		return nil, errors.New("secondary zones are signed by their primary")
+	}
+	acl, err := zone.ParseACL(cfg.AllowTransfer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allow_transfer: %w", err)
+	}
+	s := &secondary{
+		cfg:    cfg,
+		origin: dnsmessage.ParseDomainName(cfg.Origin),
+		acl:    acl,
+		key:    TSIGKeys.Get(cfg.Key),
+		store:  store,
+		notify: make(chan struct{}, 1),
+	}
+	for _, addr := range cfg.Primaries {
+		s.primaries = append(s.primaries, withDefaultPort(addr))
+	}
+	s.loadCopy()
+	return s, nil
+}
+
+// loadCopy serves the copy of the zone saved by an earlier
+// run unless it expired in the meantime.
+func (s *secondary) loadCopy() {
+	if s.cfg.File == "" {
+		return
+	}
+	info, err := os.Stat(s.cfg.File)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Warn("failed to read the copy of zone %s: %v", s.cfg.Origin, err)
+		}
+		return
+	}
+	z, err := zone.Load(&zone.Config{Origin: s.cfg.Origin, File: s.cfg.File})
+	if err != nil {
+		log.Warn("ignoring the copy of zone %s: %v", s.cfg.Origin, err)
+		return
+	}
+	if time.Since(info.ModTime()) >= timersOf(z).expire {
+		log.Info("the copy of zone %s has expired", s.cfg.Origin)
+		return
+	}
+	s.configure(z)
+	s.store.Add(z)
+	s.refreshed = info.ModTime()
+	log.Info("loaded the copy of zone %s with serial %d", s.cfg.Origin, z.Serial())
+}
+
+// configure gives a copy of the zone the settings of the secondary.
+func (s *secondary) configure(z *zone.Zone) {
+	z.AllowTransfer = s.acl
+	z.Notify = s.cfg.Notify
+	z.TransferKeys = s.cfg.TransferKeys
+	z.Key = s.cfg.Key
+}
+
+// run refreshes the zone whenever its SOA says so until ctx is done.
+func (s *secondary) run(ctx context.Context) {
+	for {
+		timer := time.NewTimer(s.refresh(ctx))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-s.notify:
+			timer.Stop()
+		}
+	}
+}
+
+// refresh asks the primaries for a newer version of the zone and
+// returns when to ask again. The zone is removed once it expires.
+func (s *secondary) refresh(ctx context.Context) time.Duration {
+	current := s.store.Get(s.origin)
+	for _, addr := range s.primaries {
+		z, err := zone.Transfer(ctx, addr, s.origin, current, s.key)
+		if err != nil {
+			log.Warn("failed to transfer zone %s from %s: %v", s.cfg.Origin, addr, err)
+			continue
+		}
+
+		s.refreshed = time.Now()
+		if z == current {
+			s.touch()
+		} else {
+			s.configure(z)
+			s.store.Add(z)
+			log.Info("transferred zone %s with serial %d from %s", s.cfg.Origin, z.Serial(), addr)
+			s.save(z)
+			notifySecondaries(z)
+		}
+		return timersOf(z).refresh
+	}
+
+	if current == nil {
+		return defaultRetry
+	}
+	t := timersOf(current)
+	left := time.Until(s.refreshed.Add(t.expire))
+	if left <= 0 {
+		log.Warn("zone %s expired, the primaries haven't answered for %s", s.cfg.Origin, t.expire)
+		s.store.Remove(s.origin)
+		return t.retry
+	}
+	return min(t.retry, left)
+}
+
+// save keeps a copy of the zone for the next start.
+func (s *secondary) save(z *zone.Zone) {
+	if s.cfg.File == "" {
+		return
+	}
+	if err := z.Save(s.cfg.File); err != nil {
+		log.Warn("failed to save zone %s: %v", s.cfg.Origin, err)
+	}
+}
+
+// touch marks the copy of the zone as confirmed by the primaries.
+func (s *secondary) touch() {
+	if s.cfg.File == "" {
+		return
+	}
+	now := time.Now()
+	if err := os.Chtimes(s.cfg.File, now, now); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Warn("failed to touch the copy of zone %s: %v", s.cfg.Origin, err)
+	}
+}
+
+type soaTimers struct {
+	refresh, retry, expire time.Duration
+}
+
+func timersOf(z *zone.Zone) soaTimers {
+	soa, err := dnsmessage.UnpackSOA(z.SOA().RData)
+	if err != nil {
+		return soaTimers{refresh: defaultRetry, retry: defaultRetry, expire: defaultRetry}
+	}
+	seconds := func(v uint32) time.Duration {
+		return max(time.Duration(v)*time.Second, minRefresh)
+	}
+	return soaTimers{refresh: seconds(soa.Refresh), retry: seconds(soa.Retry), expire: seconds(soa.Expire)}
+}
+
+// StartSecondaries keeps the secondary zones up to date until ctx is done.
+func StartSecondaries(ctx context.Context) {
+	for _, s := range secondaries {
+		go s.run(ctx)
+	}
+}
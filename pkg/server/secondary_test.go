@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/zone"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecondary(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, InitZones([]zone.Config{writeTransferZone(t, dir, 1, "127.0.0.1")}))
+	t.Cleanup(func() { Zones = nil })
+	primary := startTransferServer(t)
+
+	www := &dnsmessage.Question{QName: dnsmessage.ParseDomainName("www.example"), QType: dnsmessage.TypeA, QClass: dnsmessage.ClassIN}
+	copyFile := filepath.Join(t.TempDir(), "example.zone")
+	cfg := zone.Config{Origin: "example.", File: copyFile, Primaries: []string{primary.Listener.Addr().String()}}
+	store := zone.NewStore()
+	s, err := newSecondary(cfg, store)
+	require.NoError(t, err)
+	assert.Nil(t, store.Get(s.origin))
+
+	ctx := context.Background()
+	assert.Equal(t, 7200*time.Second, s.refresh(ctx))
+	require.NotNil(t, store.Get(s.origin))
+	assert.Equal(t, uint32(1), store.Get(s.origin).Serial())
+	assert.Equal(t, []byte{192, 0, 2, 1}, store.Answer(www, false).Answers[0].RData)
+
+	// the changes on the primary come over incrementally
+	require.NoError(t, ReloadZones([]zone.Config{writeTransferZone(t, dir, 2, "127.0.0.1")}))
+	s.refresh(ctx)
+	assert.Equal(t, uint32(2), store.Get(s.origin).Serial())
+	assert.Equal(t, []byte{192, 0, 2, 2}, store.Answer(www, false).Answers[0].RData)
+	assert.ElementsMatch(t, recordLines(Zones.Get(s.origin).Records()), recordLines(store.Get(s.origin).Records()))
+
+	// nothing new
+	before := store.Get(s.origin)
+	s.refresh(ctx)
+	assert.Same(t, before, store.Get(s.origin))
+
+	// the copy is served after a restart while the primary is away
+	cfg.Primaries = []string{"127.0.0.1:1"}
+	restarted := zone.NewStore()
+	s, err = newSecondary(cfg, restarted)
+	require.NoError(t, err)
+	require.NotNil(t, restarted.Get(s.origin))
+	assert.Equal(t, uint32(2), restarted.Get(s.origin).Serial())
+
+	// until it expires
+	assert.Equal(t, 1800*time.Second, s.refresh(ctx))
+	assert.NotNil(t, restarted.Get(s.origin))
+	s.refreshed = time.Now().Add(-1209600 * time.Second)
+	s.refresh(ctx)
+	assert.Nil(t, restarted.Get(s.origin))
+
+	// an expired copy isn't loaded at all
+	old := time.Now().Add(-1209600 * time.Second)
+	require.NoError(t, os.Chtimes(copyFile, old, old))
+	expired := zone.NewStore()
+	_, err = newSecondary(cfg, expired)
+	require.NoError(t, err)
+	assert.Nil(t, expired.Get(s.origin))
+}
+
+func TestSecondaryTransferRefused(t *testing.T) {
+	require.NoError(t, InitZones([]zone.Config{writeTransferZone(t, t.TempDir(), 1)}))
+	t.Cleanup(func() { Zones = nil })
+	primary := startTransferServer(t)
+
+	store := zone.NewStore()
+	s, err := newSecondary(zone.Config{Origin: "example.", Primaries: []string{primary.Listener.Addr().String()}}, store)
+	require.NoError(t, err)
+	assert.Equal(t, defaultRetry, s.refresh(context.Background()))
+	assert.Nil(t, store.Get(s.origin))
+}
+
+func TestInitZonesSecondary(t *testing.T) {
+	require.NoError(t, InitZones([]zone.Config{{Origin: "example.", Primaries: []string{"192.0.2.1"}}}))
+	t.Cleanup(func() { Zones = nil; secondaries = nil })
+	require.Len(t, secondaries, 1)
+	assert.Equal(t, []string{"192.0.2.1:53"}, secondaries[0].primaries)
+	assert.NotNil(t, Zones)
+	assert.Nil(t, Zones.Find(dnsmessage.ParseDomainName("www.example")))
+}
+
+func recordLines(records dnsmessage.ResourceRecords) []string {
+	var lines []string
+	for _, rr := range records {
+		lines = append(lines, fmt.Sprintf("%s %d %s %s", dnsmessage.DomainNameToString(rr.Name), rr.TTL, rr.Type, rr.RDataString()))
+	}
+	return lines
+}
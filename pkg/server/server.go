@@ -5,36 +5,90 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
+	"server/pkg/dnsmessage"
+	"server/pkg/dnssec"
 	"server/pkg/log"
 	"server/pkg/parser"
+	"server/pkg/resolver"
+	"server/pkg/tsig"
+	"server/pkg/upstream"
+	"server/pkg/zone"
 )
 
+// default time budget for processing a single query
+const defaultTimeout = 5 * time.Second
+
+// largest response sent over UDP (RFC 1035, section 4.2.1)
+const maxUDPResponseLength = 512
+
 type ServerConfig struct {
-	UDPCfg  UDPConfig
-	TCPCfg  TCPConfig
-	Timeout time.Duration
+	UDPCfg   UDPConfig       `yaml:"udp"`
+	TCPCfg   TCPConfig       `yaml:"tcp"`
+	TLSCfg   TLSConfig       `yaml:"tls"`
+	HTTPSCfg HTTPSConfig     `yaml:"https"`
+	Timeout  time.Duration   `yaml:"timeout"`
+	Upstream upstream.Config `yaml:"upstream"`
+	// named upstream groups that forwarding rules can refer to
+	UpstreamGroups map[string]upstream.Config `yaml:"upstream_groups"`
+	ForwardRules   []upstream.Rule            `yaml:"forward_rules"`
+	// resolve from the root servers instead of forwarding to Upstream
+	Recursion resolver.Config `yaml:"recursion"`
+	// validate forwarded answers
+	DNSSEC dnssec.Config `yaml:"dnssec"`
+	// zones answered authoritatively ahead of forwarding
+	Zones []zone.Config `yaml:"zones"`
+	// keys for TSIG, named by the zones
+	TSIGKeys []tsig.Config `yaml:"tsig_keys"`
+	// PTR answers for the LAN from the addresses of our hosts
+	Reverse ReverseConfig `yaml:"reverse"`
 }
 
 type UDPConfig struct {
-	Addr          string
-	Port          int
-	MaxBufferSize int
-	Timeout       time.Duration
+	Addr          string        `yaml:"addr"`
+	Port          int           `yaml:"port"`
+	MaxBufferSize int           `yaml:"max_buffer_size"`
+	Timeout       time.Duration `yaml:"timeout"`
 }
 
 type TCPConfig struct {
-	Addr    string
-	Port    int
-	Timeout time.Duration
+	Addr    string        `yaml:"addr"`
+	Port    int           `yaml:"port"`
+	Timeout time.Duration `yaml:"timeout"` // idle timeout of connections
+}
+
+// TLSConfig configures the DNS over TLS listener,
+// it is only started if a certificate is given.
+type TLSConfig struct {
+	TCPConfig `yaml:",inline"`
+	CertFile  string `yaml:"cert_file"`
+	KeyFile   string `yaml:"key_file"`
+}
+
+// HTTPSConfig configures the DNS over HTTPS listener. Without a
+// certificate it serves plain HTTP for use behind a reverse proxy.
+type HTTPSConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Addr     string        `yaml:"addr"`
+	Port     int           `yaml:"port"`
+	Path     string        `yaml:"path"`
+	Timeout  time.Duration `yaml:"timeout"` // idle timeout of connections
+	CertFile string        `yaml:"cert_file"`
+	KeyFile  string        `yaml:"key_file"`
+	// addresses or CIDRs of proxies whose X-Forwarded-For header is trusted
+	TrustedProxies []string `yaml:"trusted_proxies"`
 }
 
 type Server struct {
 	Cfg       *ServerConfig
 	servers   []NetworkServer
 	UDPServer *UDPServer
-	// TCPServer *TCPServer
+	TCPServer *TCPServer
+	TLSServer *TCPServer
+	// DoH listener, serves HTTP or HTTPS
+	HTTPServer *HTTPServer
 }
 
 type NetworkServer interface {
@@ -43,16 +97,13 @@ type NetworkServer interface {
 	GetNet() string
 }
 
-func NewServer() (*Server, error) {
-	srvCfg := ServerConfig{
-		UDPCfg: UDPConfig{
-			Addr:          "",
-			Port:          8085,
-			MaxBufferSize: 512,
-		},
-		Timeout: 5 * time.Second,
-	}
+// Reloader is implemented by servers that can pick up
+// changed files (e.g. certificates) without a restart.
+type Reloader interface {
+	Reload() error
+}
 
+func NewServer(srvCfg *ServerConfig) (*Server, error) {
 	servers := []NetworkServer{}
 	udpSrv, err := NewUDPServer(&srvCfg.UDPCfg)
 	if err != nil {
@@ -61,24 +112,65 @@ func NewServer() (*Server, error) {
 	servers = append(servers, udpSrv)
 
 	srv := Server{
-		Cfg:     &srvCfg,
-		servers: servers,
+		Cfg:       srvCfg,
+		UDPServer: udpSrv,
+	}
+
+	if srvCfg.TCPCfg.Port != 0 {
+		tcpSrv, err := NewTCPServer(&srvCfg.TCPCfg, udpSrv.Conn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create TCP server: %w", err)
+		}
+		servers = append(servers, tcpSrv)
+		srv.TCPServer = tcpSrv
+	}
+
+	if srvCfg.TLSCfg.CertFile != "" {
+		tlsSrv, err := NewTLSServer(&srvCfg.TLSCfg, udpSrv.Conn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create TLS server: %w", err)
+		}
+		servers = append(servers, tlsSrv)
+		srv.TLSServer = tlsSrv
 	}
+
+	if srvCfg.HTTPSCfg.Enabled {
+		httpSrv, err := NewHTTPServer(&srvCfg.HTTPSCfg, udpSrv.Conn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create DoH server: %w", err)
+		}
+		servers = append(servers, httpSrv)
+		srv.HTTPServer = httpSrv
+	}
+
+	srv.servers = servers
 	return &srv, nil
 }
 
+// Reload makes the listeners pick up changed certificates.
+func (s *Server) Reload() error {
+	for _, server := range s.servers {
+		if r, ok := server.(Reloader); ok {
+			if err := r.Reload(); err != nil {
+				return fmt.Errorf("reload %s listener failed: %w", server.GetNet(), err)
+			}
+		}
+	}
+	return nil
+}
+
 func (s *Server) Start(ctx context.Context, errChan chan error, procErrChan chan error) {
 	log.Info("starting server...")
 
-	go func() {
-		for _, server := range s.servers {
+	// Start blocks for as long as the listener is running
+	for _, server := range s.servers {
+		go func() {
 			log.Info("starting %s server...", server.GetNet())
 			if err := server.Start(ctx, procErrChan); err != nil {
 				errChan <- fmt.Errorf("start %s listener failed: %w", server.GetNet(), err)
-				return
 			}
-		}
-	}()
+		}()
+	}
 }
 
 // Stop stops the server
@@ -137,6 +229,10 @@ func (s *UDPServer) Start(ctx context.Context, errChan chan error) error {
 		_ = s.Conn.Close()
 	}()
 
+	// let the queries in flight finish before returning
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
 	for {
 		buf := make([]byte, s.Config.MaxBufferSize*3)
 		n, addr, err := s.Conn.ReadFromUDP(buf[0:])
@@ -168,13 +264,18 @@ func (s *UDPServer) Start(ctx context.Context, errChan chan error) error {
 		}
 		log.Info("Received a packet (%d bytes) from %s", n, addr.String())
 
-		// TODO: set a timeout for the session
-		go func(data []byte, addr *net.UDPAddr) {
-			timeoutCtx, cancel := context.WithTimeout(ctx, s.Config.Timeout)
+		timeout := s.Config.Timeout
+		if timeout <= 0 {
+			timeout = defaultTimeout
+		}
+
+		data := buf[:n]
+		wg.Go(func() {
+			timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
 			defer cancel()
 
 			DNSProcess(data, addr, s.Conn, timeoutCtx, errChan)
-		}(buf[:n], addr)
+		})
 	}
 }
 
@@ -207,44 +308,155 @@ func DNSProcess(data []byte, addr *net.UDPAddr, conn *net.UDPConn, ctx context.C
 	m := p.Message
 
 	if m.IsQuery() {
-		// handle dns query
-		log.Info("Processing DNS query")
-
-		TransactionTable.Store(int(m.Header.ID), Addr{Addr: addr.String(), Timestamp: time.Now()})
-		log.Debug("stored new transaction: %s", TransactionTable.String())
+		resp := handleQuery(ctx, m, data, conn, addr, errChan)
+		if resp == nil {
+			return
+		}
+		if len(resp) > udpResponseLimit(m) {
+			resp = truncate(m, resp)
+		}
 
-		// TODO: make upstream NS configurable
-		w, err := NewResponseWriter(conn, "1.1.1.1:53")
+		w, err := NewResponseWriter(conn, addr.String())
 		if err != nil {
 			errChan <- fmt.Errorf("failed to create a response writer: %w", err)
 			return
 		}
-
-		// we skip serialization to wire for now and
-		// instead reuse the original datagram
-		w.Write(data)
+		w.Write(resp)
 
 	} else {
 		// handle dns response
 		log.Info("Processing DNS response")
 
-		clientAddr, ok := TransactionTable.Load(int(m.Header.ID))
-		log.Debug("loaded client address %s for transaction ID %d", clientAddr, m.Header.ID)
+		entry, ok := TransactionTable.Load(int(m.Header.ID))
 		if !ok {
+			RejectedReplies.UnknownID.Add(1)
 			errChan <- fmt.Errorf("failed to find ID %d in transactions table to forward response to", m.Header.ID)
 			return
 		}
-		w, err := NewResponseWriter(conn, clientAddr.Addr)
-		if err != nil {
-			errChan <- fmt.Errorf("failed to create a response writer: %w", err)
-			return
+		log.Debug("loaded client address %s for transaction ID %d", entry.Addr, m.Header.ID)
+
+		select {
+		case entry.Reply <- Reply{Msg: m, Data: data, From: addr.String()}:
+		default:
+			log.Debug("dropping reply for transaction ID %d: nobody is waiting for it", m.Header.ID)
 		}
-		w.Write(data)
-		TransactionTable.Delete(int(m.Header.ID))
-		log.Debug("deleted entry for transaction ID %d", m.Header.ID)
-		log.Debug(TransactionTable.String())
 	}
 
 	// Here you would parse the DNS message and respond accordingly
 	log.Info("Finished processing DNS data from %s", addr.String())
 }
+
+// handleQuery answers a parsed query regardless of the listener it came in
+// on. Queries to UDP upstreams are sent over conn. It returns nil if there
+// is nothing to send back. Responses to signed queries are signed.
+func handleQuery(ctx context.Context, m *dnsmessage.DNSMessage, data []byte, conn *net.UDPConn, client net.Addr, errChan chan error) []byte {
+	session, resp := verifyTSIG(m, data)
+	if resp != nil {
+		return resp
+	}
+	if session != nil {
+		// the signature is ours, not the upstreams'
+		data = tsig.Unsigned(data)
+	}
+	resp = answerQuery(ctx, m, data, conn, client, session.Key(), errChan)
+	if resp != nil && session != nil {
+		resp = session.Sign(resp, time.Now())
+	}
+	return resp
+}
+
+// answerQuery answers a query signed with key, nil if it is unsigned.
+func answerQuery(ctx context.Context, m *dnsmessage.DNSMessage, data []byte, conn *net.UDPConn, client net.Addr, key *tsig.Key, errChan chan error) []byte {
+	log.Info("Processing DNS query")
+
+	if isNotify(m) {
+		resp, err := answerNotify(m, client, key)
+		if err != nil {
+			errChan <- fmt.Errorf("failed to answer NOTIFY %d: %w", m.Header.ID, err)
+			resp = dnsmessage.NewErrorResponse(m, dnsmessage.RCodeServerFailure)
+		}
+		return resp
+	}
+
+	if isUpdate(m) {
+		resp, err := answerUpdate(m, client, key)
+		if err != nil {
+			errChan <- fmt.Errorf("failed to answer update %d: %w", m.Header.ID, err)
+			resp = dnsmessage.NewErrorResponse(m, dnsmessage.RCodeServerFailure)
+		}
+		return resp
+	}
+
+	if isTransfer(m) {
+		resp, err := transferOverDatagram(m, client, key)
+		if err != nil {
+			errChan <- fmt.Errorf("failed to answer transfer query %d: %w", m.Header.ID, err)
+			resp = dnsmessage.NewErrorResponse(m, dnsmessage.RCodeServerFailure)
+		}
+		return resp
+	}
+
+	if a := answerReverse(m); a != nil {
+		resp, err := authoritativeResponse(m, a)
+		if err != nil {
+			errChan <- fmt.Errorf("failed to answer reverse query %d: %w", m.Header.ID, err)
+			resp = dnsmessage.NewErrorResponse(m, dnsmessage.RCodeServerFailure)
+		}
+		return resp
+	}
+
+	if authoritative(m) {
+		resp, err := answerAuthoritative(m)
+		if err != nil {
+			errChan <- fmt.Errorf("failed to answer query %d: %w", m.Header.ID, err)
+			resp = dnsmessage.NewErrorResponse(m, dnsmessage.RCodeServerFailure)
+		}
+		return resp
+	}
+
+	if Upstreams == nil {
+		errChan <- errors.New("upstreams are not initialized")
+		return nil
+	}
+
+	pool := Upstreams.Route(m.Question.QName)
+	if Recursor != nil && pool == Upstreams.Default {
+		resp, err := recurse(ctx, m)
+		if err != nil {
+			errChan <- fmt.Errorf("failed to resolve query %d: %w", m.Header.ID, err)
+			resp = dnsmessage.NewErrorResponse(m, dnsmessage.RCodeServerFailure)
+		}
+		return resp
+	}
+
+	var resp []byte
+	var err error
+	if Validator != nil {
+		resp, err = forwardValidated(ctx, pool, conn, client, m)
+	} else {
+		resp, err = forward(ctx, pool, conn, client, m, data)
+	}
+	if err != nil {
+		errChan <- fmt.Errorf("failed to forward query %d: %w", m.Header.ID, err)
+		resp = dnsmessage.NewErrorResponse(m, dnsmessage.RCodeServerFailure)
+	}
+	return resp
+}
+
+// udpResponseLimit returns the largest response the client takes over
+// UDP, clients with EDNS advertise their own limit (RFC 6891, section 6.2.5).
+func udpResponseLimit(m *dnsmessage.DNSMessage) int {
+	opt := m.OPT()
+	if opt == nil {
+		return maxUDPResponseLength
+	}
+	return min(max(int(opt.Class), maxUDPResponseLength), ednsUDPSize)
+}
+
+// truncate replaces a response too large for UDP by its header and
+// question with the TC bit set so that the client retries over TCP.
+func truncate(m *dnsmessage.DNSMessage, resp []byte) []byte {
+	t := dnsmessage.NewErrorResponse(m, dnsmessage.RCode(resp[3]&0x0F))
+	t[2] |= 0x02
+	return t
+}
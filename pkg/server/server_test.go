@@ -8,7 +8,9 @@ import (
 	"testing"
 	"time"
 
+	"server/pkg/dnsmessage"
 	"server/pkg/log"
+	"server/pkg/upstream"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -16,7 +18,7 @@ import (
 var TestUDPCfg = UDPConfig{
 	Addr:          "127.0.0.1",
 	Port:          0, // random available port
-	MaxBufferSize: 512,
+	MaxBufferSize: ednsUDPSize,
 }
 
 func TestUDPServerCreation(t *testing.T) {
@@ -37,7 +39,7 @@ func TestUDPServerLifecycleViaShutdown(t *testing.T) {
 
 	var wg sync.WaitGroup
 	wg.Go(func() {
-		err := udpSrv.Start(ctx)
+		err := udpSrv.Start(ctx, make(chan error, 1))
 		assert.NoError(t, err)
 	})
 
@@ -63,7 +65,7 @@ func TestUDPServerLifecycleViaContext(t *testing.T) {
 	defer cancel()
 
 	wg.Go(func() {
-		err = udpSrv.Start(ctx)
+		err = udpSrv.Start(ctx, make(chan error, 1))
 		assert.NoError(t, err)
 	})
 
@@ -77,6 +79,9 @@ func TestUDPMessage(t *testing.T) {
 	udpSrv, err := NewUDPServer(&TestUDPCfg)
 	InitTransactionsTable()
 
+	fake := newFakeUpstream(t, respond(dnsmessage.RCodeNoError))
+	assert.NoError(t, InitUpstreams(&upstream.Config{Addrs: []string{fake.Addr()}}, nil, nil))
+
 	assert.NoError(t, err)
 	assert.NotNil(t, udpSrv)
 
@@ -84,9 +89,9 @@ func TestUDPMessage(t *testing.T) {
 
 	errCh := make(chan error, 1)
 
-	var wg sync.WaitGroup
-	wg.Go(func() {
-		err = udpSrv.Start(ctx, errCh)
+	var srvWg sync.WaitGroup
+	srvWg.Go(func() {
+		err := udpSrv.Start(ctx, errCh)
 		assert.NoError(t, err)
 	})
 
@@ -95,7 +100,7 @@ func TestUDPMessage(t *testing.T) {
 
 	clients := make([]*UDPClient, 0)
 	for i := range 5 {
-		client, err := NewUDPClient(udpSrv.Conn.LocalAddr().String())
+		client, err := NewUDPClient(udpSrv.Conn.LocalAddr().String(), time.Second*5)
 		fmt.Printf("launching client %d\n", i)
 		assert.NoError(t, err)
 		assert.NotNil(t, client)
@@ -108,6 +113,7 @@ func TestUDPMessage(t *testing.T) {
 	assert.NoError(t, err)
 
 	fmt.Println("we are here")
+	var wg sync.WaitGroup
 	for _, client := range clients {
 		wg.Go(func() {
 			resp, err := client.SendAndReceive(query, 512)
@@ -123,6 +129,7 @@ func TestUDPMessage(t *testing.T) {
 
 	wg.Wait()
 	cancel()
+	srvWg.Wait()
 	fmt.Println("we are here")
 	assert.Empty(t, errCh)
 }
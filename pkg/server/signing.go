@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/log"
+)
+
+// how often the signatures of the signed zones are checked
+const resignInterval = time.Minute
+
+// signedZones are the origins of the zones we sign, see StartSigning.
+var signedZones []dnsmessage.DomainName
+
+// resignZones replaces the signatures of the signed zones that are due.
+func resignZones(now time.Time) {
+	zonesMu.Lock()
+	defer zonesMu.Unlock()
+
+	for _, origin := range signedZones {
+		z := Zones.Get(origin)
+		if z == nil {
+			continue
+		}
+		next, err := z.Resign(now)
+		if err != nil {
+			log.Warn("failed to re-sign zone %s: %v", dnsmessage.DomainNameToString(origin), err)
+			continue
+		}
+		if next != z {
+			Zones.Add(next)
+			log.Info("re-signed zone %s with serial %d", dnsmessage.DomainNameToString(origin), next.Serial())
+			notifySecondaries(next)
+		}
+	}
+}
+
+// StartSigning keeps the signatures of the signed zones fresh until ctx is
+// done. Zones may become signed by a reload, so it runs without them too.
+func StartSigning(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(resignInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				resignZones(now)
+			}
+		}
+	}()
+}
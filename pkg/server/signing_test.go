@@ -0,0 +1,108 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/parser"
+	"server/pkg/zone"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func initSignedTestZones(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "example.zone")
+	require.NoError(t, os.WriteFile(path, []byte(testZoneFile), 0o644))
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+	key := filepath.Join(dir, "example.pem")
+	require.NoError(t, os.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+
+	require.NoError(t, InitZones([]zone.Config{{
+		Origin: "example.",
+		File:   path,
+		DNSSEC: &zone.SigningConfig{KSK: key, Validity: 10 * time.Hour, Refresh: 2 * time.Hour},
+	}}))
+	t.Cleanup(func() { Zones = nil; signedZones = nil })
+}
+
+func answerSigned(t *testing.T, name string, opt *dnsmessage.ResourceRecord) *dnsmessage.DNSMessage {
+	m := &dnsmessage.DNSMessage{
+		Header:   &dnsmessage.Header{ID: 0x4321},
+		Question: &dnsmessage.Question{QName: dnsmessage.ParseDomainName(name), QType: dnsmessage.TypeA, QClass: dnsmessage.ClassIN},
+	}
+	if opt != nil {
+		m.AdditonalRecords = dnsmessage.ResourceRecords{opt}
+	}
+	data, err := answerAuthoritative(m)
+	require.NoError(t, err)
+	p, err := parser.NewParser(data)
+	require.NoError(t, err)
+	require.NoError(t, p.ParseMessage())
+	return p.Message
+}
+
+func countType(records dnsmessage.ResourceRecords, typ dnsmessage.RRType) int {
+	n := 0
+	for _, rr := range records {
+		if rr.Type == typ {
+			n++
+		}
+	}
+	return n
+}
+
+func TestAnswerSigned(t *testing.T) {
+	initSignedTestZones(t)
+
+	tests := []struct {
+		name   string
+		qname  string
+		opt    *dnsmessage.ResourceRecord
+		rcode  dnsmessage.RCode
+		sigs   int
+		nsecs  int
+		withDO bool
+	}{
+		{name: "without EDNS", qname: "www.example"},
+		{name: "without DO", qname: "www.example", opt: dnsmessage.NewOPT(1232, false)},
+		{name: "with DO", qname: "www.example", opt: dnsmessage.NewOPT(1232, true), sigs: 1, withDO: true},
+		// the NSEC of the apex covers both the name and the wildcard
+		{name: "name error", qname: "missing.example", opt: dnsmessage.NewOPT(1232, true), rcode: dnsmessage.RCodeNameError, sigs: 2, nsecs: 1, withDO: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := answerSigned(t, tt.qname, tt.opt)
+			assert.Equal(t, tt.rcode, resp.Header.RCode)
+			assert.Equal(t, tt.sigs, countType(resp.Answers, dnsmessage.TypeRRSIG)+countType(resp.AuthorityRecords, dnsmessage.TypeRRSIG))
+			assert.Equal(t, tt.nsecs, countType(resp.AuthorityRecords, dnsmessage.TypeNSEC))
+			assert.Equal(t, tt.withDO, resp.DO())
+		})
+	}
+}
+
+func TestResignZones(t *testing.T) {
+	initSignedTestZones(t)
+	z := Zones.Get(dnsmessage.ParseDomainName("example"))
+
+	resignZones(time.Now())
+	assert.Same(t, z, Zones.Get(z.Origin))
+
+	resignZones(z.ResignAt())
+	next := Zones.Get(z.Origin)
+	assert.Equal(t, z.Serial()+1, next.Serial())
+	assert.True(t, next.ResignAt().After(z.ResignAt()))
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/log"
+	"server/pkg/parser"
+	"server/pkg/transport"
+	"server/pkg/tsig"
+)
+
+// how long an open connection may stay without a query (RFC 7766, section 6.2.3)
+const defaultIdleTimeout = 10 * time.Second
+
+// TCPServer serves DNS over TCP (RFC 7766) or, with a TLS listener,
+// DNS over TLS (RFC 7858). Queries on a connection are processed
+// concurrently and answered in the order they complete.
+type TCPServer struct {
+	Config   *TCPConfig
+	Listener net.Listener
+	Net      string
+	// queries to UDP upstreams go out over the socket of the UDP listener
+	// so that the replies find their way back through DNSProcess
+	UDPConn *net.UDPConn
+	Certs   *CertStore // only set for TLS
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func NewTCPServer(cfg *TCPConfig, udpConn *net.UDPConn) (*TCPServer, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(cfg.Addr, strconv.Itoa(cfg.Port)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TCP listener: %w", err)
+	}
+
+	srv := TCPServer{
+		Config:   cfg,
+		Listener: l,
+		Net:      "tcp",
+		UDPConn:  udpConn,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	return &srv, nil
+}
+
+// NewTLSServer creates a DNS over TLS server. The certificate
+// can be replaced at runtime with Reload.
+func NewTLSServer(cfg *TLSConfig, udpConn *net.UDPConn) (*TCPServer, error) {
+	certs, err := NewCertStore(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	srv, err := NewTCPServer(&cfg.TCPConfig, udpConn)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.Listener = tls.NewListener(srv.Listener, &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"dot"},
+	})
+	srv.Net = "tls"
+	srv.Certs = certs
+	return srv, nil
+}
+
+func (s *TCPServer) GetNet() string {
+	return s.Net
+}
+
+// Reload reads the certificate and key files again.
+func (s *TCPServer) Reload() error {
+	if s.Certs == nil {
+		return nil
+	}
+	return s.Certs.Reload()
+}
+
+func (s *TCPServer) Start(ctx context.Context, errChan chan error) error {
+	log.Info("starting %s server on %s...", s.Net, s.Listener.Addr().String())
+
+	go func() {
+		<-ctx.Done()
+		log.Debug("context done, closing %s listener...", s.Net)
+		_ = s.Listener.Close()
+	}()
+
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Info("%s listener closed, exiting accept loop", s.Net)
+				return nil
+			}
+
+			select {
+			case <-ctx.Done():
+				log.Info("%s server shutting down", s.Net)
+				return nil
+			default:
+				log.Warn("error accepting %s connection: %v", s.Net, err)
+				continue
+			}
+		}
+		log.Debug("accepted %s connection from %s", s.Net, conn.RemoteAddr().String())
+
+		go s.serveConn(ctx, conn, errChan)
+	}
+}
+
+func (s *TCPServer) serveConn(ctx context.Context, conn net.Conn, errChan chan error) {
+	s.track(conn, true)
+	defer s.track(conn, false)
+	defer conn.Close()
+
+	idleTimeout := s.Config.Timeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+
+	var (
+		writeMu sync.Mutex
+		wg      sync.WaitGroup
+	)
+	// let the queries in flight finish before closing the connection
+	defer wg.Wait()
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		data, err := transport.ReadMessage(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Debug("closing %s connection from %s: %v", s.Net, conn.RemoteAddr().String(), err)
+			}
+			return
+		}
+		log.Info("Received a %s message (%d bytes) from %s", s.Net, len(data), conn.RemoteAddr().String())
+
+		wg.Go(func() {
+			timeoutCtx, cancel := context.WithTimeout(ctx, defaultTimeout)
+			defer cancel()
+
+			msgs := s.process(timeoutCtx, data, conn.RemoteAddr(), errChan)
+
+			// the messages of a zone transfer go out back to back
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			for _, msg := range msgs {
+				_ = conn.SetWriteDeadline(time.Now().Add(idleTimeout))
+				if err := transport.WriteMessage(conn, msg); err != nil {
+					errChan <- fmt.Errorf("failed to write response to %s: %w", conn.RemoteAddr().String(), err)
+					return
+				}
+			}
+		})
+	}
+}
+
+// process answers a query with the messages to send back,
+// more than one only for zone transfers.
+func (s *TCPServer) process(ctx context.Context, data []byte, client net.Addr, errChan chan error) [][]byte {
+	p, err := parser.NewParser(data)
+	if err != nil {
+		errChan <- fmt.Errorf("failed to create DNS parser: %w", err)
+		return nil
+	}
+	if err := p.ParseMessage(); err != nil {
+		errChan <- fmt.Errorf("failed to parse DNS message: %v", err)
+		return nil
+	}
+
+	if !p.Message.IsQuery() {
+		log.Warn("ignoring a response received over %s from %s", s.Net, client.String())
+		return nil
+	}
+	if isTransfer(p.Message) {
+		session, resp := verifyTSIG(p.Message, data)
+		if resp != nil {
+			return [][]byte{resp}
+		}
+		msgs, err := transfer(p.Message, client, session.Key())
+		if err != nil {
+			errChan <- err
+			msgs = [][]byte{dnsmessage.NewErrorResponse(p.Message, dnsmessage.RCodeServerFailure)}
+		}
+		return signAll(session, msgs)
+	}
+
+	resp := handleQuery(ctx, p.Message, data, s.UDPConn, client, errChan)
+	if resp == nil {
+		return nil
+	}
+	return [][]byte{resp}
+}
+
+// signAll signs the messages in the order they are sent.
+func signAll(session *tsig.Session, msgs [][]byte) [][]byte {
+	if session == nil {
+		return msgs
+	}
+	now := time.Now()
+	for i := range msgs {
+		msgs[i] = session.Sign(msgs[i], now)
+	}
+	return msgs
+}
+
+func (s *TCPServer) track(conn net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		s.conns[conn] = struct{}{}
+	} else {
+		delete(s.conns, conn)
+	}
+}
+
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	log.Info("shutting down %s server...", s.Net)
+	if err := s.Listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("failed to close %s listener: %w", s.Net, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	return nil
+}
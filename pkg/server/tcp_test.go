@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/parser"
+	"server/pkg/transport"
+	"server/pkg/upstream"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCert writes a self-signed certificate for dns.test and 127.0.0.1 and its key.
+func writeTestCert(t *testing.T, certFile, keyFile string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		DNSNames:     []string{"dns.test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert
+}
+
+func startTCPTestServer(t *testing.T, srv *TCPServer) chan error {
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 16)
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		assert.NoError(t, srv.Start(ctx, errCh))
+	})
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	return errCh
+}
+
+func dotClient(t *testing.T, srv *TCPServer, cert *x509.Certificate) *transport.DoTClient {
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	c, err := transport.NewDoTClient(transport.DoTConfig{
+		Addr:       srv.Listener.Addr().String(),
+		ServerName: "dns.test",
+		SPKIPins:   []string{transport.SPKIPin(cert)},
+		RootCAs:    roots,
+	})
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func exchangeQuery(t *testing.T, c upstream.Exchanger) *dnsmessage.DNSMessage {
+	query, err := hex.DecodeString("45dc010000010000000000000377777707796f757475626503636f6d0000010001")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := c.Exchange(ctx, query)
+	assert.NoError(t, err)
+
+	p, err := parser.NewParser(resp)
+	assert.NoError(t, err)
+	assert.NoError(t, p.ParseMessage())
+	return p.Message
+}
+
+func TestTLSServer(t *testing.T) {
+	fake := newFakeUpstream(t, respond(dnsmessage.RCodeNoError))
+	udpSrv, _ := startTestServer(t, &upstream.Config{Addrs: []string{fake.Addr()}})
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert := writeTestCert(t, certFile, keyFile)
+
+	srv, err := NewTLSServer(&TLSConfig{
+		TCPConfig: TCPConfig{Addr: "127.0.0.1", Port: 0},
+		CertFile:  certFile,
+		KeyFile:   keyFile,
+	}, udpSrv.Conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "tls", srv.GetNet())
+	errCh := startTCPTestServer(t, srv)
+
+	// several queries pipelined over the same connection
+	c := dotClient(t, srv, cert)
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Go(func() {
+			m := exchangeQuery(t, c)
+			assert.Equal(t, uint32(0x45dc), m.Header.ID)
+			assert.Equal(t, uint64(1), m.Header.QR)
+			assert.Equal(t, dnsmessage.RCodeNoError, m.Header.RCode)
+		})
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(5), fake.queries.Load())
+	assert.Empty(t, errCh)
+}
+
+func TestTLSServerReloadsCertificate(t *testing.T) {
+	fake := newFakeUpstream(t, respond(dnsmessage.RCodeNoError))
+	udpSrv, _ := startTestServer(t, &upstream.Config{Addrs: []string{fake.Addr()}})
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	oldCert := writeTestCert(t, certFile, keyFile)
+
+	srv, err := NewTLSServer(&TLSConfig{
+		TCPConfig: TCPConfig{Addr: "127.0.0.1", Port: 0},
+		CertFile:  certFile,
+		KeyFile:   keyFile,
+	}, udpSrv.Conn)
+	assert.NoError(t, err)
+	startTCPTestServer(t, srv)
+
+	exchangeQuery(t, dotClient(t, srv, oldCert))
+
+	newCert := writeTestCert(t, certFile, keyFile)
+	assert.NoError(t, srv.Reload())
+
+	exchangeQuery(t, dotClient(t, srv, newCert))
+
+	// a broken file keeps the current certificate
+	assert.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0o600))
+	assert.Error(t, srv.Reload())
+	exchangeQuery(t, dotClient(t, srv, newCert))
+}
+
+// tcpClient sends queries over plain TCP, one connection per query.
+type tcpClient struct {
+	addr string
+}
+
+func (c tcpClient) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := transport.WriteMessage(conn, query); err != nil {
+		return nil, err
+	}
+	return transport.ReadMessage(conn)
+}
+
+func TestTCPServer(t *testing.T) {
+	fake := newFakeUpstream(t, respond(dnsmessage.RCodeNoError))
+	udpSrv, _ := startTestServer(t, &upstream.Config{Addrs: []string{fake.Addr()}})
+
+	srv, err := NewTCPServer(&TCPConfig{Addr: "127.0.0.1", Port: 0}, udpSrv.Conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp", srv.GetNet())
+	errCh := startTCPTestServer(t, srv)
+
+	m := exchangeQuery(t, tcpClient{addr: srv.Listener.Addr().String()})
+	assert.Equal(t, dnsmessage.RCodeNoError, m.Header.RCode)
+	assert.Empty(t, errCh)
+
+	assert.NoError(t, srv.Shutdown(context.Background()))
+}
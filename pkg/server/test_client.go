@@ -24,7 +24,8 @@ func NewUDPClient(serverAddr string, timeout time.Duration) (*UDPClient, error)
 	}
 
 	client := UDPClient{
-		Conn: conn,
+		Conn:    conn,
+		Timeout: timeout,
 	}
 
 	return &client, nil
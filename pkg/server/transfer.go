@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/log"
+	"server/pkg/tsig"
+	"server/pkg/zone"
+)
+
+// messages of a zone transfer are filled up to this size, well below the
+// limit of TCP so that a large RRset still fits
+const maxTransferMessage = 16 * 1024
+
+// isTransfer reports whether the query asks for a zone transfer.
+func isTransfer(m *dnsmessage.DNSMessage) bool {
+	return Zones != nil && m.Header.OpCode == 0 && m.Question != nil &&
+		(m.Question.QType == dnsmessage.TypeAXFR || m.Question.QType == dnsmessage.TypeIXFR)
+}
+
+// transferZone returns the zone the client may transfer or the response
+// code refusing it. The query has to be signed with one of the transfer
+// keys of the zone or come from an address it allows.
+func transferZone(m *dnsmessage.DNSMessage, client net.Addr, key *tsig.Key) (*zone.Zone, dnsmessage.RCode) {
+	z := Zones.Get(m.Question.QName)
+	if z == nil || m.Question.QClass != z.Class {
+		return nil, dnsmessage.RCodeRefused
+	}
+	if keyAllowed(z.TransferKeys, key) {
+		return z, dnsmessage.RCodeNoError
+	}
+	addr, err := netip.ParseAddrPort(client.String())
+	if err != nil || !z.AllowTransfer.Allows(addr.Addr()) {
+		log.Warn("refusing transfer of %s to %s", dnsmessage.DomainNameToString(m.Question.QName), client.String())
+		return nil, dnsmessage.RCodeRefused
+	}
+	return z, dnsmessage.RCodeNoError
+}
+
+// transfer answers an AXFR or IXFR query over TCP with as many messages
+// as the zone takes (RFC 5936, section 2.2 and RFC 1995, section 4).
+func transfer(m *dnsmessage.DNSMessage, client net.Addr, key *tsig.Key) ([][]byte, error) {
+	z, rcode := transferZone(m, client, key)
+	if z == nil {
+		return [][]byte{dnsmessage.NewErrorResponse(m, rcode)}, nil
+	}
+
+	records := z.AXFR()
+	if m.Question.QType == dnsmessage.TypeIXFR {
+		from, ok := ixfrSerial(m)
+		if !ok {
+			return [][]byte{dnsmessage.NewErrorResponse(m, dnsmessage.RCodeFormatError)}, nil
+		}
+		records = z.IXFR(from)
+	}
+	log.Info("transferring %s (%s, %d records) to %s", dnsmessage.DomainNameToString(z.Origin), m.Question.QType, len(records), client.String())
+
+	var msgs [][]byte
+	for len(records) > 0 {
+		n, size := 0, 0
+		for n < len(records) {
+			// without compression, the messages only get smaller
+			size += len(dnsmessage.PackDomainName(records[n].Name)) + 10 + len(records[n].RData)
+			if n > 0 && size > maxTransferMessage {
+				break
+			}
+			n++
+		}
+
+		// the question may be repeated in every message (RFC 5936, section 2.2.1)
+		h := authoritativeHeader(m)
+		resp := dnsmessage.DNSMessage{Header: &h, Question: m.Question, Answers: records[:n]}
+		msg, err := resp.Pack()
+		if err != nil {
+			return nil, fmt.Errorf("failed to pack transfer of %s: %w", dnsmessage.DomainNameToString(z.Origin), err)
+		}
+		msgs = append(msgs, msg)
+		records = records[n:]
+	}
+	return msgs, nil
+}
+
+// transferOverDatagram answers transfer queries over UDP and HTTPS, which
+// carry a single message. An incremental transfer is sent if it fits,
+// otherwise the client gets the current SOA to try TCP (RFC 1995, section
+// 2). AXFR is only served over TCP (RFC 5936, section 4.2).
+func transferOverDatagram(m *dnsmessage.DNSMessage, client net.Addr, key *tsig.Key) ([]byte, error) {
+	if m.Question.QType == dnsmessage.TypeAXFR {
+		return dnsmessage.NewErrorResponse(m, dnsmessage.RCodeFormatError), nil
+	}
+	z, rcode := transferZone(m, client, key)
+	if z == nil {
+		return dnsmessage.NewErrorResponse(m, rcode), nil
+	}
+	from, ok := ixfrSerial(m)
+	if !ok {
+		return dnsmessage.NewErrorResponse(m, dnsmessage.RCodeFormatError), nil
+	}
+
+	h := authoritativeHeader(m)
+	// the diffs start with the old SOA after the current one,
+	// a whole zone has a single SOA before its last record
+	if records := z.IXFR(from); len(records) > 1 && records[1].Type == dnsmessage.TypeSOA {
+		resp := dnsmessage.DNSMessage{Header: &h, Question: m.Question, Answers: records}
+		msg, err := resp.Pack()
+		if err != nil {
+			return nil, fmt.Errorf("failed to pack transfer of %s: %w", dnsmessage.DomainNameToString(z.Origin), err)
+		}
+		if len(msg) <= udpResponseLimit(m) {
+			log.Info("transferring %s (%s, %d records) to %s", dnsmessage.DomainNameToString(z.Origin), m.Question.QType, len(records), client.String())
+			return msg, nil
+		}
+	}
+	resp := dnsmessage.DNSMessage{Header: &h, Question: m.Question, Answers: dnsmessage.ResourceRecords{z.SOA()}}
+	return resp.Pack()
+}
+
+// authoritativeHeader returns the header of a successful response to m
+// from an authoritative server.
+func authoritativeHeader(m *dnsmessage.DNSMessage) dnsmessage.Header {
+	h := *m.Header
+	h.QR = 1
+	h.AA = 1
+	h.TC = 0
+	h.RA = 0
+	h.Z = 0
+	h.RCode = dnsmessage.RCodeNoError
+	return h
+}
+
+// ixfrSerial returns the serial of the zone the client has,
+// sent as SOA in the authority section of the query.
+func ixfrSerial(m *dnsmessage.DNSMessage) (uint32, bool) {
+	for _, rr := range m.AuthorityRecords {
+		if rr.Type == dnsmessage.TypeSOA && dnsmessage.EqualNames(rr.Name, m.Question.QName) {
+			soa, err := dnsmessage.UnpackSOA(rr.RData)
+			if err != nil {
+				return 0, false
+			}
+			return soa.Serial, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/parser"
+	"server/pkg/transport"
+	"server/pkg/zone"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// transferTXTs records make the zone take several messages
+const transferTXTs = 500
+
+// writeTransferZone writes example. with the serial and returns its config.
+func writeTransferZone(t *testing.T, dir string, serial int, allow ...string) zone.Config {
+	var b strings.Builder
+	fmt.Fprintf(&b, "$ORIGIN example.\n$TTL 3600\n@ SOA ns1 hostmaster %d 7200 1800 1209600 300\n@ NS ns1\nns1 A 192.0.2.53\n", serial)
+	fmt.Fprintf(&b, "www A 192.0.2.%d\n", serial)
+	for i := range transferTXTs {
+		fmt.Fprintf(&b, "txt%d TXT \"%s\"\n", i, strings.Repeat("x", 100))
+	}
+	path := filepath.Join(dir, "example.zone")
+	require.NoError(t, os.WriteFile(path, []byte(b.String()), 0o644))
+	return zone.Config{Origin: "example.", File: path, AllowTransfer: allow}
+}
+
+func transferQuery(t *testing.T, qtype dnsmessage.RRType, serial uint32) []byte {
+	m := dnsmessage.DNSMessage{
+		Header:   &dnsmessage.Header{ID: 0x7a7a},
+		Question: &dnsmessage.Question{QName: dnsmessage.ParseDomainName("example"), QType: qtype, QClass: dnsmessage.ClassIN},
+	}
+	if qtype == dnsmessage.TypeIXFR {
+		soa := dnsmessage.SOA{MName: dnsmessage.ParseDomainName("ns1.example"), RName: dnsmessage.ParseDomainName("hostmaster.example"), Serial: serial}
+		m.AuthorityRecords = dnsmessage.ResourceRecords{{Name: m.Question.QName, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassIN, RData: soa.Pack()}}
+	}
+	data, err := m.Pack()
+	require.NoError(t, err)
+	return data
+}
+
+func changeQuery(t *testing.T, query []byte, change func(m *dnsmessage.DNSMessage)) []byte {
+	p, err := parser.NewParser(query)
+	require.NoError(t, err)
+	require.NoError(t, p.ParseMessage())
+	change(p.Message)
+	query, err = p.Message.Pack()
+	require.NoError(t, err)
+	return query
+}
+
+// readTransfer reads the messages of a transfer until the last record
+// repeats the first SOA, or the first message if it is an error.
+func readTransfer(t *testing.T, conn net.Conn) []*dnsmessage.DNSMessage {
+	var msgs []*dnsmessage.DNSMessage
+	var records dnsmessage.ResourceRecords
+	for {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		data, err := transport.ReadMessage(conn)
+		require.NoError(t, err)
+		p, err := parser.NewParser(data)
+		require.NoError(t, err)
+		require.NoError(t, p.ParseMessage())
+		msgs = append(msgs, p.Message)
+		records = append(records, p.Message.Answers...)
+
+		if p.Message.Header.RCode != dnsmessage.RCodeNoError || len(records) == 1 && len(msgs) == 1 {
+			return msgs
+		}
+		if last := records[len(records)-1]; len(records) > 1 && last.Type == dnsmessage.TypeSOA && string(last.RData) == string(records[0].RData) {
+			return msgs
+		}
+	}
+}
+
+func startTransferServer(t *testing.T) *TCPServer {
+	srv, err := NewTCPServer(&TCPConfig{Addr: "127.0.0.1"}, nil)
+	require.NoError(t, err)
+	errCh := startTCPTestServer(t, srv)
+	t.Cleanup(func() { assert.Empty(t, errCh) })
+	return srv
+}
+
+func dialTransfer(t *testing.T, srv *TCPServer, query []byte) []*dnsmessage.DNSMessage {
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, transport.WriteMessage(conn, query))
+	return readTransfer(t, conn)
+}
+
+func TestAXFR(t *testing.T) {
+	require.NoError(t, InitZones([]zone.Config{writeTransferZone(t, t.TempDir(), 1, "127.0.0.0/8")}))
+	t.Cleanup(func() { Zones = nil })
+	srv := startTransferServer(t)
+
+	msgs := dialTransfer(t, srv, transferQuery(t, dnsmessage.TypeAXFR, 0))
+	require.Greater(t, len(msgs), 1)
+	var records dnsmessage.ResourceRecords
+	for i, m := range msgs {
+		assert.Equal(t, uint32(0x7a7a), m.Header.ID)
+		assert.Equal(t, uint64(1), m.Header.AA)
+		assert.Equal(t, "example", dnsmessage.DomainNameToString(m.Question.QName), "message %d", i)
+		records = append(records, m.Answers...)
+	}
+	// SOA, NS, ns1 A, www A, the TXTs and the SOA again
+	assert.Len(t, records, 4+transferTXTs+1)
+	assert.Equal(t, dnsmessage.TypeSOA, records[0].Type)
+	assert.Equal(t, dnsmessage.TypeSOA, records[len(records)-1].Type)
+}
+
+func TestAXFRRefused(t *testing.T) {
+	require.NoError(t, InitZones([]zone.Config{writeTransferZone(t, t.TempDir(), 1, "192.0.2.0/24")}))
+	t.Cleanup(func() { Zones = nil })
+	srv := startTransferServer(t)
+
+	msgs := dialTransfer(t, srv, transferQuery(t, dnsmessage.TypeAXFR, 0))
+	require.Len(t, msgs, 1)
+	assert.Equal(t, dnsmessage.RCodeRefused, msgs[0].Header.RCode)
+	assert.Empty(t, msgs[0].Answers)
+
+	// not our zone
+	msgs = dialTransfer(t, srv, changeQuery(t, transferQuery(t, dnsmessage.TypeAXFR, 0), func(m *dnsmessage.DNSMessage) {
+		m.Question.QName = dnsmessage.ParseDomainName("www.example")
+	}))
+	assert.Equal(t, dnsmessage.RCodeRefused, msgs[0].Header.RCode)
+}
+
+func TestIXFR(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, InitZones([]zone.Config{writeTransferZone(t, dir, 1, "127.0.0.1")}))
+	t.Cleanup(func() { Zones = nil })
+	cfg := writeTransferZone(t, dir, 2, "127.0.0.1")
+	require.NoError(t, ReloadZones([]zone.Config{cfg}))
+	srv := startTransferServer(t)
+
+	msgs := dialTransfer(t, srv, transferQuery(t, dnsmessage.TypeIXFR, 1))
+	require.Len(t, msgs, 1)
+	var lines []string
+	for _, rr := range msgs[0].Answers {
+		lines = append(lines, rr.Type.String()+" "+rr.RDataString())
+	}
+	soa := func(serial int) string {
+		return fmt.Sprintf("SOA ns1.example. hostmaster.example. %d 7200 1800 1209600 300", serial)
+	}
+	assert.Equal(t, []string{soa(2), soa(1), "A 192.0.2.1", soa(2), "A 192.0.2.2", soa(2)}, lines)
+
+	// up to date
+	msgs = dialTransfer(t, srv, transferQuery(t, dnsmessage.TypeIXFR, 2))
+	require.Len(t, msgs[0].Answers, 1)
+	assert.Equal(t, soa(2), "SOA "+msgs[0].Answers[0].RDataString())
+
+	// without the serial of the client
+	msgs = dialTransfer(t, srv, changeQuery(t, transferQuery(t, dnsmessage.TypeIXFR, 1), func(m *dnsmessage.DNSMessage) {
+		m.AuthorityRecords = nil
+	}))
+	assert.Equal(t, dnsmessage.RCodeFormatError, msgs[0].Header.RCode)
+}
+
+func TestTransferOverUDP(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, InitZones([]zone.Config{writeTransferZone(t, dir, 1, "127.0.0.1")}))
+	t.Cleanup(func() { Zones = nil })
+	require.NoError(t, ReloadZones([]zone.Config{writeTransferZone(t, dir, 2, "127.0.0.1")}))
+	srv, errCh := serveUDP(t)
+
+	client, err := NewUDPClient(srv.Conn.LocalAddr().String(), 5*time.Second)
+	require.NoError(t, err)
+	defer client.Close()
+
+	exchange := func(query []byte) *dnsmessage.DNSMessage {
+		resp, err := client.SendAndReceive(query, ednsUDPSize)
+		require.NoError(t, err)
+		p, err := parser.NewParser(resp)
+		require.NoError(t, err)
+		require.NoError(t, p.ParseMessage())
+		return p.Message
+	}
+
+	// the change since serial 1 fits into the datagram
+	m := exchange(transferQuery(t, dnsmessage.TypeIXFR, 1))
+	assert.Equal(t, dnsmessage.RCodeNoError, m.Header.RCode)
+	require.Len(t, m.Answers, 6)
+	assert.Equal(t, dnsmessage.TypeSOA, m.Answers[1].Type)
+	assert.Equal(t, "192.0.2.2", m.Answers[4].RDataString())
+
+	// the whole zone doesn't, the client is told to come back over TCP
+	m = exchange(transferQuery(t, dnsmessage.TypeIXFR, 0))
+	assert.Equal(t, dnsmessage.RCodeNoError, m.Header.RCode)
+	require.Len(t, m.Answers, 1)
+	assert.Equal(t, dnsmessage.TypeSOA, m.Answers[0].Type)
+
+	// up to date
+	m = exchange(transferQuery(t, dnsmessage.TypeIXFR, 2))
+	require.Len(t, m.Answers, 1)
+	assert.Equal(t, dnsmessage.TypeSOA, m.Answers[0].Type)
+
+	m = exchange(changeQuery(t, transferQuery(t, dnsmessage.TypeIXFR, 1), func(m *dnsmessage.DNSMessage) {
+		m.AuthorityRecords = nil
+	}))
+	assert.Equal(t, dnsmessage.RCodeFormatError, m.Header.RCode)
+
+	m = exchange(transferQuery(t, dnsmessage.TypeAXFR, 0))
+	assert.Equal(t, dnsmessage.RCodeFormatError, m.Header.RCode)
+	assert.Empty(t, m.Answers)
+	assert.Empty(t, errCh)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/log"
+	"server/pkg/tsig"
+	"server/pkg/zone"
+)
+
+// TSIGKeys holds the keys shared with other servers and clients.
+var TSIGKeys tsig.Keys
+
+func InitTSIGKeys(cfgs []tsig.Config) error {
+	keys, err := tsig.NewKeys(cfgs)
+	if err != nil {
+		return fmt.Errorf("invalid TSIG keys: %w", err)
+	}
+	TSIGKeys = keys
+	return nil
+}
+
+// verifyTSIG checks the signature of a signed query and removes it from
+// the message. It returns nil for unsigned queries and the response to
+// send back instead for queries failing verification (RFC 8945, section 5.2).
+func verifyTSIG(m *dnsmessage.DNSMessage, data []byte) (*tsig.Session, []byte) {
+	s, err := TSIGKeys.Verify(data, time.Now())
+	if errors.Is(err, tsig.ErrUnsigned) {
+		return nil, nil
+	}
+	var e *tsig.Error
+	if errors.As(err, &e) {
+		log.Warn("refusing query %d: %v", m.Header.ID, err)
+		return nil, s.Sign(dnsmessage.NewErrorResponse(m, dnsmessage.RCodeNotAuth), time.Now())
+	}
+	if err != nil {
+		log.Warn("refusing query %d with a broken TSIG record: %v", m.Header.ID, err)
+		return nil, dnsmessage.NewErrorResponse(m, dnsmessage.RCodeFormatError)
+	}
+	m.AdditonalRecords = m.AdditonalRecords[:len(m.AdditonalRecords)-1]
+	return s, nil
+}
+
+// keyAllowed reports whether the key is one of the names.
+func keyAllowed(names []string, key *tsig.Key) bool {
+	return key != nil && slices.ContainsFunc(names, key.Is)
+}
+
+// checkKeys makes sure the keys the zone names are defined.
+func checkKeys(cfg *zone.Config) error {
+	names := append(slices.Clone(cfg.TransferKeys), cfg.UpdateKeys...)
+	if cfg.Key != "" {
+		names = append(names, cfg.Key)
+	}
+	for _, name := range names {
+		if TSIGKeys.Get(name) == nil {
+			return fmt.Errorf("unknown TSIG key %s", name)
+		}
+	}
+	return nil
+}
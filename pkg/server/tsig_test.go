@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/tsig"
+	"server/pkg/zone"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testTSIGKey = tsig.Config{Name: "xfr.example.", Secret: base64.StdEncoding.EncodeToString([]byte("shared by primary and secondary"))}
+
+func initTestTSIGKeys(t *testing.T) {
+	require.NoError(t, InitTSIGKeys([]tsig.Config{testTSIGKey}))
+	t.Cleanup(func() { TSIGKeys = nil })
+}
+
+func TestTSIGTransfer(t *testing.T) {
+	initTestTSIGKeys(t)
+	cfg := writeTransferZone(t, t.TempDir(), 1)
+	cfg.TransferKeys = []string{"XFR.example"}
+	require.NoError(t, InitZones([]zone.Config{cfg}))
+	t.Cleanup(func() { Zones = nil })
+	primary := startTransferServer(t)
+	addr := primary.Listener.Addr().String()
+	origin := dnsmessage.ParseDomainName("example")
+
+	// with the key from any address
+	store := zone.NewStore()
+	s, err := newSecondary(zone.Config{Origin: "example.", Primaries: []string{addr}, Key: "xfr.example"}, store)
+	require.NoError(t, err)
+	s.refresh(context.Background())
+	require.NotNil(t, store.Get(origin))
+	assert.Equal(t, uint32(1), store.Get(origin).Serial())
+
+	// not without it
+	_, err = zone.Transfer(context.Background(), addr, origin, nil, nil)
+	assert.ErrorContains(t, err, "refused")
+
+	// nor with another secret under its name
+	forged, err := tsig.NewKey(tsig.Config{Name: testTSIGKey.Name, Secret: base64.StdEncoding.EncodeToString([]byte("guessed"))})
+	require.NoError(t, err)
+	_, err = zone.Transfer(context.Background(), addr, origin, nil, forged)
+	assert.Error(t, err)
+}
+
+func TestTSIGUpdate(t *testing.T) {
+	initTestTSIGKeys(t)
+	cfg := testZoneConfig(t)
+	cfg.UpdateKeys = []string{"xfr.example"}
+	require.NoError(t, InitZones([]zone.Config{cfg}))
+	t.Cleanup(func() { Zones = nil })
+
+	host := dnsmessage.ResourceRecords{{Name: dnsmessage.ParseDomainName("host.example"), Type: dnsmessage.TypeA, Class: dnsmessage.ClassIN, TTL: 60, RData: []byte{192, 0, 2, 10}}}
+	query := updateQuery(t, "example", nil, host)
+	client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 99), Port: 5353}
+	errCh := make(chan error, 1)
+	send := func(data []byte) []byte {
+		t.Helper()
+		resp := handleQuery(context.Background(), parseMessage(t, data), data, nil, client, errCh)
+		require.NotNil(t, resp)
+		return resp
+	}
+
+	// unsigned from an address that may not update
+	assert.Equal(t, dnsmessage.RCodeRefused, parseMessage(t, send(query)).Header.RCode)
+
+	// signed, the response is signed as well
+	signed, session := TSIGKeys.Get("xfr.example").SignRequest(query, time.Now())
+	resp := send(signed)
+	assert.Equal(t, dnsmessage.RCodeNoError, parseMessage(t, resp).Header.RCode)
+	require.NoError(t, session.Verify(resp, time.Now()))
+	assert.Equal(t, uint32(2), Zones.Get(dnsmessage.ParseDomainName("example")).Serial())
+
+	// changed on the way
+	signed, session = TSIGKeys.Get("xfr.example").SignRequest(query, time.Now())
+	signed[bytes.Index(signed, []byte{192, 0, 2, 10})+3] = 11
+	resp = send(signed)
+	assert.Equal(t, dnsmessage.RCodeNotAuth, parseMessage(t, resp).Header.RCode)
+	assert.ErrorContains(t, session.Verify(resp, time.Now()), "bad signature")
+
+	// signed with a key we don't know
+	unknown, err := tsig.NewKey(tsig.Config{Name: "other.example", Secret: testTSIGKey.Secret})
+	require.NoError(t, err)
+	signed, _ = unknown.SignRequest(query, time.Now())
+	assert.Equal(t, dnsmessage.RCodeNotAuth, parseMessage(t, send(signed)).Header.RCode)
+	assert.Equal(t, uint32(2), Zones.Get(dnsmessage.ParseDomainName("example")).Serial())
+	assert.Empty(t, errCh)
+}
+
+func TestInitZonesUnknownKey(t *testing.T) {
+	initTestTSIGKeys(t)
+	cfg := testZoneConfig(t)
+	cfg.UpdateKeys = []string{"missing.example"}
+	assert.ErrorContains(t, InitZones([]zone.Config{cfg}), "missing.example")
+	t.Cleanup(func() { Zones = nil })
+}
+
+func TestTSIGNotify(t *testing.T) {
+	initTestTSIGKeys(t)
+	s, err := newSecondary(zone.Config{Origin: "example.", Primaries: []string{"127.0.0.1"}, Key: "xfr.example"}, zone.NewStore())
+	require.NoError(t, err)
+	secondaries = []*secondary{s}
+	t.Cleanup(func() { secondaries = nil })
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	errCh := make(chan error, 1)
+
+	// the primary has to sign it
+	query := notifyQuery(t, "example")
+	resp := handleQuery(context.Background(), parseMessage(t, query), query, nil, client, errCh)
+	assert.Equal(t, dnsmessage.RCodeRefused, parseMessage(t, resp).Header.RCode)
+	assert.Empty(t, s.notify)
+
+	signed, session := TSIGKeys.Get("xfr.example").SignRequest(query, time.Now())
+	resp = handleQuery(context.Background(), parseMessage(t, signed), signed, nil, client, errCh)
+	assert.Equal(t, dnsmessage.RCodeNoError, parseMessage(t, resp).Header.RCode)
+	assert.NoError(t, session.Verify(resp, time.Now()))
+	assert.Len(t, s.notify, 1)
+	assert.Empty(t, errCh)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/log"
+	"server/pkg/tsig"
+)
+
+func isUpdate(m *dnsmessage.DNSMessage) bool {
+	return m.Header.OpCode == dnsmessage.OpCodeUpdate
+}
+
+// answerUpdate applies a dynamic update to one of our zones (RFC 2136).
+// The zone section is the question, the prerequisites and the updates
+// are the answer and authority sections. Only clients in the allow_update
+// list of the zone or signing with one of its update keys may update it,
+// and only zones we are the primary for.
+func answerUpdate(m *dnsmessage.DNSMessage, client net.Addr, key *tsig.Key) ([]byte, error) {
+	if m.Question == nil || m.Question.QType != dnsmessage.TypeSOA {
+		return dnsmessage.NewErrorResponse(m, dnsmessage.RCodeFormatError), nil
+	}
+	name := dnsmessage.DomainNameToString(m.Question.QName)
+	if Zones == nil {
+		return dnsmessage.NewErrorResponse(m, dnsmessage.RCodeNotAuth), nil
+	}
+
+	zonesMu.Lock()
+	defer zonesMu.Unlock()
+
+	z := Zones.Get(m.Question.QName)
+	if z == nil || m.Question.QClass != z.Class {
+		return dnsmessage.NewErrorResponse(m, dnsmessage.RCodeNotAuth), nil
+	}
+	if secondaryOf(z.Origin) != nil {
+		log.Warn("refusing update of %s from %s, we are a secondary for it", name, client.String())
+		return dnsmessage.NewErrorResponse(m, dnsmessage.RCodeRefused), nil
+	}
+	addr, err := netip.ParseAddrPort(client.String())
+	if !keyAllowed(z.UpdateKeys, key) && (err != nil || !z.AllowUpdate.Allows(addr.Addr())) {
+		log.Warn("refusing update of %s from %s", name, client.String())
+		return dnsmessage.NewErrorResponse(m, dnsmessage.RCodeRefused), nil
+	}
+
+	next, rcode, err := z.Update(m.Answers, m.AuthorityRecords)
+	if err != nil {
+		return nil, err
+	}
+	if rcode != dnsmessage.RCodeNoError {
+		log.Info("update of %s from %s failed: %s", name, client.String(), rcode)
+		return dnsmessage.NewErrorResponse(m, rcode), nil
+	}
+	if next != z {
+		Zones.Add(next)
+		log.Info("updated zone %s to serial %d for %s", name, next.Serial(), client.String())
+		notifySecondaries(next)
+	}
+
+	h := authoritativeHeader(m)
+	resp := dnsmessage.DNSMessage{Header: &h, Question: m.Question}
+	return resp.Pack()
+}
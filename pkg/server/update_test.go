@@ -0,0 +1,116 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/zone"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testZoneConfig(t *testing.T, allowUpdate ...string) zone.Config {
+	path := filepath.Join(t.TempDir(), "example.zone")
+	require.NoError(t, os.WriteFile(path, []byte(testZoneFile), 0o644))
+	return zone.Config{Origin: "example.", File: path, AllowUpdate: allowUpdate}
+}
+
+func updateQuery(t *testing.T, origin string, prereqs, updates dnsmessage.ResourceRecords) []byte {
+	m := dnsmessage.DNSMessage{
+		Header:           &dnsmessage.Header{ID: 0x5a5a, OpCode: dnsmessage.OpCodeUpdate},
+		Question:         &dnsmessage.Question{QName: dnsmessage.ParseDomainName(origin), QType: dnsmessage.TypeSOA, QClass: dnsmessage.ClassIN},
+		Answers:          prereqs,
+		AuthorityRecords: updates,
+	}
+	data, err := m.Pack()
+	require.NoError(t, err)
+	return data
+}
+
+func sendUpdate(t *testing.T, srv *UDPServer, query []byte) *dnsmessage.DNSMessage {
+	client, err := NewUDPClient(srv.Conn.LocalAddr().String(), time.Second*5)
+	require.NoError(t, err)
+	defer client.Close()
+	data, err := client.SendAndReceive(query, ednsUDPSize)
+	require.NoError(t, err)
+	return parseMessage(t, data)
+}
+
+func TestUpdate(t *testing.T) {
+	cfg := testZoneConfig(t, "127.0.0.1")
+	require.NoError(t, InitZones([]zone.Config{cfg}))
+	t.Cleanup(func() { Zones = nil })
+	srv, errCh := serveUDP(t)
+
+	host := dnsmessage.ParseDomainName("host.example")
+	addHost := dnsmessage.ResourceRecords{{Name: host, Type: dnsmessage.TypeA, Class: dnsmessage.ClassIN, TTL: 60, RData: []byte{192, 0, 2, 10}}}
+	// only if the name is new
+	unused := dnsmessage.ResourceRecords{{Name: host, Type: dnsmessage.TypeANY, Class: dnsmessage.ClassNONE}}
+
+	resp := sendUpdate(t, srv, updateQuery(t, "example", unused, addHost))
+	assert.Equal(t, dnsmessage.RCodeNoError, resp.Header.RCode)
+	assert.Equal(t, uint64(1), resp.Header.QR)
+	assert.Equal(t, uint64(dnsmessage.OpCodeUpdate), resp.Header.OpCode)
+	assert.Equal(t, uint32(2), Zones.Get(dnsmessage.ParseDomainName("example")).Serial())
+
+	answer := sendAuthoritativeQuery(t, srv, "host.example", 0)
+	require.Len(t, answer.Answers, 1)
+	assert.Equal(t, []byte{192, 0, 2, 10}, answer.Answers[0].RData)
+
+	// the name is in use now
+	resp = sendUpdate(t, srv, updateQuery(t, "example", unused, addHost))
+	assert.Equal(t, dnsmessage.RCodeYXDomain, resp.Header.RCode)
+	// not our zone
+	resp = sendUpdate(t, srv, updateQuery(t, "other", nil, nil))
+	assert.Equal(t, dnsmessage.RCodeNotAuth, resp.Header.RCode)
+	// outside of the zone
+	resp = sendUpdate(t, srv, updateQuery(t, "example", nil, dnsmessage.ResourceRecords{{Name: dnsmessage.ParseDomainName("www.other"), Type: dnsmessage.TypeA, Class: dnsmessage.ClassIN, RData: []byte{192, 0, 2, 1}}}))
+	assert.Equal(t, dnsmessage.RCodeNotZone, resp.Header.RCode)
+
+	// the update outlives a reload and a restart
+	require.NoError(t, ReloadZones([]zone.Config{cfg}))
+	assert.Len(t, sendAuthoritativeQuery(t, srv, "host.example", 0).Answers, 1)
+	z, err := zone.Load(&cfg)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), z.Serial())
+	assert.Len(t, z.Lookup(&dnsmessage.Question{QName: host, QType: dnsmessage.TypeA, QClass: dnsmessage.ClassIN}).Answers, 1)
+	assert.Empty(t, errCh)
+}
+
+func TestUpdateRefused(t *testing.T) {
+	host := dnsmessage.ResourceRecords{{Name: dnsmessage.ParseDomainName("host.example"), Type: dnsmessage.TypeA, Class: dnsmessage.ClassIN, TTL: 60, RData: []byte{192, 0, 2, 10}}}
+	query := parseMessage(t, updateQuery(t, "example", nil, host))
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	rcode := func() dnsmessage.RCode {
+		t.Helper()
+		resp, err := answerUpdate(query, client, nil)
+		require.NoError(t, err)
+		return parseMessage(t, resp).Header.RCode
+	}
+	t.Cleanup(func() { Zones = nil; secondaries = nil })
+
+	// nobody may update the zone
+	require.NoError(t, InitZones([]zone.Config{testZoneConfig(t)}))
+	assert.Equal(t, dnsmessage.RCodeRefused, rcode())
+
+	// somebody else may
+	require.NoError(t, InitZones([]zone.Config{testZoneConfig(t, "192.0.2.0/24")}))
+	assert.Equal(t, dnsmessage.RCodeRefused, rcode())
+
+	// we are a secondary for the zone
+	require.NoError(t, InitZones([]zone.Config{testZoneConfig(t, "127.0.0.1")}))
+	s, err := newSecondary(zone.Config{Origin: "example.", Primaries: []string{"192.0.2.1"}}, Zones)
+	require.NoError(t, err)
+	secondaries = []*secondary{s}
+	assert.Equal(t, dnsmessage.RCodeRefused, rcode())
+	assert.Equal(t, uint32(1), Zones.Get(dnsmessage.ParseDomainName("example")).Serial())
+
+	secondaries = nil
+	assert.Equal(t, dnsmessage.RCodeNoError, rcode())
+	assert.Equal(t, uint32(2), Zones.Get(dnsmessage.ParseDomainName("example")).Serial())
+}
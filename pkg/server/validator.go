@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/dnssec"
+	"server/pkg/log"
+	"server/pkg/parser"
+	"server/pkg/upstream"
+)
+
+// UDP payload size advertised to upstreams and clients, small enough to
+// avoid fragmentation (DNS flag day 2020)
+const ednsUDPSize = 1232
+
+// Validator checks the DNSSEC signatures of forwarded answers.
+// It is nil unless validation is enabled.
+var Validator *dnssec.Validator
+
+func InitValidator(cfg *dnssec.Config) error {
+	Validator = nil
+	if !cfg.Enabled {
+		return nil
+	}
+
+	v, err := dnssec.NewValidator(cfg)
+	if err != nil {
+		return err
+	}
+	Validator = v
+	return nil
+}
+
+// forwardValidated forwards the query asking for DNSSEC records and
+// validates the reply, names proven not to exist by earlier replies are
+// answered right away. Bogus answers become SERVFAIL unless the client
+// set the CD bit, secure ones get the AD bit if the client understands it.
+func forwardValidated(ctx context.Context, pool *upstream.Pool, conn *net.UDPConn, client net.Addr, m *dnsmessage.DNSMessage) ([]byte, error) {
+	if resp := Validator.Synthesize(m.Question); resp != nil {
+		log.Debug("answering %s %s from cached NSEC records", dnsmessage.DomainNameToString(m.Question.QName), m.Question.QType)
+		resp.Header.ID = m.Header.ID
+		resp.Header.OpCode = m.Header.OpCode
+		resp.Header.RD = m.Header.RD
+		return clientResponse(m, resp, true)
+	}
+
+	resp, err := exchangeDO(ctx, pool, conn, client, m.Header, m.Question)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.TC == 1 {
+		// the client retries over TCP and gets validated data then
+		return clientResponse(m, resp, false)
+	}
+
+	lookup := func(ctx context.Context, name dnsmessage.DomainName, qtype dnsmessage.RRType) (*dnsmessage.DNSMessage, error) {
+		h := &dnsmessage.Header{RD: 1}
+		q := &dnsmessage.Question{QName: name, QType: qtype, QClass: dnsmessage.ClassIN}
+		return exchangeDO(ctx, Upstreams.Route(name), conn, client, h, q)
+	}
+
+	status, err := Validator.Validate(ctx, lookup, resp)
+	question := fmt.Sprintf("%s %s", dnsmessage.DomainNameToString(m.Question.QName), m.Question.QType)
+	log.Debug("answer to %s is %s", question, status)
+	if status == dnssec.Bogus {
+		log.Warn("bogus answer to %s: %v", question, err)
+		if !m.Header.CD() {
+			h := *resp.Header
+			h.RCode = dnsmessage.RCodeServerFailure
+			return clientResponse(m, &dnsmessage.DNSMessage{Header: &h}, false)
+		}
+	}
+	return clientResponse(m, resp, status == dnssec.Secure)
+}
+
+// exchangeDO forwards a query with the DO and CD bits set so that the
+// upstreams send the signatures along, even for data they consider bogus.
+func exchangeDO(ctx context.Context, pool *upstream.Pool, conn *net.UDPConn, client net.Addr, h *dnsmessage.Header, q *dnsmessage.Question) (*dnsmessage.DNSMessage, error) {
+	header := *h
+	header.Z |= dnsmessage.ZCheckingDisabled
+	query := &dnsmessage.DNSMessage{
+		Header:           &header,
+		Question:         q,
+		AdditonalRecords: dnsmessage.ResourceRecords{dnsmessage.NewOPT(ednsUDPSize, true)},
+	}
+	data, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack query: %w", err)
+	}
+
+	reply, err := forward(ctx, pool, conn, client, query, data)
+	if err != nil {
+		return nil, err
+	}
+	p, err := parser.NewParser(reply)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.ParseMessage(); err != nil {
+		return nil, fmt.Errorf("failed to parse reply: %w", err)
+	}
+	return p.Message, nil
+}
+
+// clientResponse packs the validated reply for the client. DNSSEC records
+// are only passed on if the client asked for them with the DO bit.
+func clientResponse(m *dnsmessage.DNSMessage, resp *dnsmessage.DNSMessage, secure bool) ([]byte, error) {
+	h := *resp.Header
+	h.Z &^= dnsmessage.ZAuthenticData | dnsmessage.ZCheckingDisabled
+	if secure && (m.DO() || m.Header.AD()) {
+		h.Z |= dnsmessage.ZAuthenticData
+	}
+	h.Z |= m.Header.Z & dnsmessage.ZCheckingDisabled
+
+	do := m.DO()
+	strip := func(records dnsmessage.ResourceRecords) dnsmessage.ResourceRecords {
+		kept := dnsmessage.ResourceRecords{}
+		for _, rr := range records {
+			switch rr.Type {
+			case dnsmessage.TypeOPT:
+				continue
+			case dnsmessage.TypeRRSIG, dnsmessage.TypeNSEC, dnsmessage.TypeNSEC3:
+				if !do && rr.Type != m.Question.QType {
+					continue
+				}
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+
+	out := dnsmessage.DNSMessage{
+		Header:           &h,
+		Question:         m.Question,
+		Answers:          strip(resp.Answers),
+		AuthorityRecords: strip(resp.AuthorityRecords),
+		AdditonalRecords: strip(resp.AdditonalRecords),
+	}
+	if m.OPT() != nil {
+		out.AdditonalRecords = append(out.AdditonalRecords, dnsmessage.NewOPT(ednsUDPSize, do))
+	}
+	return out.Pack()
+}
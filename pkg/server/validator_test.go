@@ -0,0 +1,184 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/dnssec"
+	"server/pkg/parser"
+	"server/pkg/upstream"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signedZone answers for example. with records signed by its key,
+// the A record of bad.example. carries a signature of other data.
+func signedZone(t *testing.T) (func([]byte) []byte, string) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := dnssec.NewDNSKEY(dnsmessage.DNSKEYFlagZone|dnsmessage.DNSKEYFlagSEP, priv.Public())
+	require.NoError(t, err)
+	ds, err := dnssec.NewDS(dnsmessage.Domain("example"), key, dnssec.DigestSHA256)
+	require.NoError(t, err)
+
+	sign := func(rrset dnsmessage.ResourceRecords) dnsmessage.ResourceRecords {
+		sig, err := dnssec.Sign(rrset, dnsmessage.Domain("example"), key, priv, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+		assert.NoError(t, err)
+		return append(rrset, &dnsmessage.ResourceRecord{Name: rrset[0].Name, Type: dnsmessage.TypeRRSIG, Class: dnsmessage.ClassIN, TTL: 300, RData: sig.Pack()})
+	}
+
+	handler := func(query []byte) []byte {
+		p, err := parser.NewParser(query)
+		assert.NoError(t, err)
+		assert.NoError(t, p.ParseMessage())
+		q := p.Message
+
+		h := *q.Header
+		h.QR = 1
+		resp := &dnsmessage.DNSMessage{Header: &h, Question: q.Question}
+		rr := &dnsmessage.ResourceRecord{Name: q.Question.QName, Type: q.Question.QType, Class: dnsmessage.ClassIN, TTL: 300}
+
+		switch name := dnsmessage.DomainNameToString(q.Question.QName); {
+		case q.Question.QType == dnsmessage.TypeDNSKEY:
+			rr.RData = key.Pack()
+			resp.Answers = sign(dnsmessage.ResourceRecords{rr})
+		case q.Question.QType == dnsmessage.TypeA && dnsmessage.EqualNames(q.Question.QName, dnsmessage.Domain("www", "example")):
+			rr.RData = []byte{192, 0, 2, 1}
+			resp.Answers = sign(dnsmessage.ResourceRecords{rr})
+		case q.Question.QType == dnsmessage.TypeA && dnsmessage.EqualNames(q.Question.QName, dnsmessage.Domain("bad", "example")):
+			rr.RData = []byte{192, 0, 2, 1}
+			resp.Answers = sign(dnsmessage.ResourceRecords{rr})
+			resp.Answers[0].RData = []byte{203, 0, 113, 1}
+		case q.Question.QType == dnsmessage.TypeA:
+			// every other name in the zone doesn't exist
+			h.RCode = dnsmessage.RCodeNameError
+			soa := &dnsmessage.SOA{MName: dnsmessage.Domain("ns", "example"), RName: dnsmessage.Domain("admin", "example"), Serial: 1, Minimum: 300}
+			resp.AuthorityRecords = sign(dnsmessage.ResourceRecords{{Name: dnsmessage.Domain("example"), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassIN, TTL: 300, RData: soa.Pack()}})
+			chain := []dnsmessage.DomainName{dnsmessage.Domain("example"), dnsmessage.Domain("bad", "example"), dnsmessage.Domain("www", "example")}
+			for i, owner := range chain {
+				types := []dnsmessage.RRType{dnsmessage.TypeA, dnsmessage.TypeRRSIG, dnsmessage.TypeNSEC}
+				if i == 0 {
+					types = []dnsmessage.RRType{dnsmessage.TypeSOA, dnsmessage.TypeRRSIG, dnsmessage.TypeNSEC, dnsmessage.TypeDNSKEY}
+				}
+				nsec := &dnsmessage.NSEC{NextDomain: chain[(i+1)%len(chain)], Types: types}
+				resp.AuthorityRecords = append(resp.AuthorityRecords, sign(dnsmessage.ResourceRecords{
+					{Name: owner, Type: dnsmessage.TypeNSEC, Class: dnsmessage.ClassIN, TTL: 300, RData: nsec.Pack()},
+				})...)
+			}
+		default:
+			t.Errorf("unexpected query for %s %s", name, q.Question.QType)
+			h.RCode = dnsmessage.RCodeServerFailure
+		}
+
+		data, err := resp.Pack()
+		assert.NoError(t, err)
+		return data
+	}
+	return handler, fmt.Sprintf("example. IN DS %s", ds)
+}
+
+func sendValidatedQuery(t *testing.T, srv *UDPServer, name string, z uint64, opt *dnsmessage.ResourceRecord) *dnsmessage.DNSMessage {
+	client, err := NewUDPClient(srv.Conn.LocalAddr().String(), time.Second*5)
+	require.NoError(t, err)
+	defer client.Close()
+
+	query := &dnsmessage.DNSMessage{
+		Header:   &dnsmessage.Header{ID: 0x1234, RD: 1, Z: z},
+		Question: &dnsmessage.Question{QName: dnsmessage.ParseDomainName(name), QType: dnsmessage.TypeA, QClass: dnsmessage.ClassIN},
+	}
+	if opt != nil {
+		query.AdditonalRecords = dnsmessage.ResourceRecords{opt}
+	}
+	data, err := query.Pack()
+	require.NoError(t, err)
+
+	resp, err := client.SendAndReceive(data, ednsUDPSize)
+	require.NoError(t, err)
+	p, err := parser.NewParser(resp)
+	require.NoError(t, err)
+	require.NoError(t, p.ParseMessage())
+	return p.Message
+}
+
+func hasRRSIG(m *dnsmessage.DNSMessage) bool {
+	for _, rr := range m.Answers {
+		if rr.Type == dnsmessage.TypeRRSIG {
+			return true
+		}
+	}
+	return false
+}
+
+func TestForwardValidated(t *testing.T) {
+	handler, anchor := signedZone(t)
+	zone := newFakeUpstream(t, handler)
+
+	require.NoError(t, InitValidator(&dnssec.Config{Enabled: true, TrustAnchors: []string{anchor}}))
+	t.Cleanup(func() { Validator = nil })
+	srv, errCh := startTestServer(t, &upstream.Config{Addrs: []string{zone.Addr()}})
+
+	tests := []struct {
+		name    string
+		qname   string
+		z       uint64
+		opt     *dnsmessage.ResourceRecord
+		rcode   dnsmessage.RCode
+		ad      bool
+		answers int
+		rrsig   bool
+	}{
+		{name: "secure with DO", qname: "www.example", opt: dnsmessage.NewOPT(1232, true), ad: true, answers: 2, rrsig: true},
+		{name: "secure with AD", qname: "www.example", z: dnsmessage.ZAuthenticData, ad: true, answers: 1},
+		{name: "secure without EDNS", qname: "www.example", answers: 1},
+		{name: "bogus", qname: "bad.example", opt: dnsmessage.NewOPT(1232, true), rcode: dnsmessage.RCodeServerFailure},
+		{name: "bogus with CD", qname: "bad.example", z: dnsmessage.ZCheckingDisabled, answers: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := sendValidatedQuery(t, srv, tt.qname, tt.z, tt.opt)
+			assert.Equal(t, uint32(0x1234), m.Header.ID)
+			assert.Equal(t, tt.rcode, m.Header.RCode)
+			assert.Equal(t, tt.ad, m.Header.AD())
+			assert.Len(t, m.Answers, tt.answers)
+			assert.Equal(t, tt.rrsig, hasRRSIG(m))
+			assert.Equal(t, tt.opt != nil, m.OPT() != nil)
+		})
+	}
+	assert.Empty(t, errCh)
+}
+
+func TestForwardSynthesizesFromNSEC(t *testing.T) {
+	handler, anchor := signedZone(t)
+	zone := newFakeUpstream(t, handler)
+
+	require.NoError(t, InitValidator(&dnssec.Config{Enabled: true, TrustAnchors: []string{anchor}, AggressiveNSEC: true}))
+	t.Cleanup(func() { Validator = nil })
+	srv, errCh := startTestServer(t, &upstream.Config{Addrs: []string{zone.Addr()}})
+
+	m := sendValidatedQuery(t, srv, "nx.example", 0, dnsmessage.NewOPT(1232, true))
+	assert.Equal(t, dnsmessage.RCodeNameError, m.Header.RCode)
+	assert.True(t, m.Header.AD())
+	queries := zone.queries.Load()
+
+	// names in the ranges of the NSEC records are answered without asking
+	for _, name := range []string{"other.example", "a.example", "x.www.example"} {
+		m = sendValidatedQuery(t, srv, name, 0, dnsmessage.NewOPT(1232, true))
+		assert.Equal(t, uint32(0x1234), m.Header.ID)
+		assert.Equal(t, dnsmessage.RCodeNameError, m.Header.RCode)
+		assert.True(t, m.Header.AD())
+		assert.NotEmpty(t, m.AuthorityRecords)
+	}
+	m = sendValidatedQuery(t, srv, "nx2.example", 0, nil)
+	assert.Equal(t, dnsmessage.RCodeNameError, m.Header.RCode)
+	assert.Len(t, m.AuthorityRecords, 1, "only the SOA without DO")
+	assert.Equal(t, queries, zone.queries.Load())
+
+	m = sendValidatedQuery(t, srv, "www.example", 0, nil)
+	assert.Equal(t, dnsmessage.RCodeNoError, m.Header.RCode)
+	assert.Empty(t, errCh)
+}
@@ -0,0 +1,308 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/log"
+	"server/pkg/parser"
+)
+
+const (
+	DNSMessageContentType = "application/dns-message"
+	defaultIdleTimeout    = 90 * time.Second
+	// replies kept in the DoH cache, and how many of them an insert
+	// into the full cache looks at to make room
+	maxDoHCacheEntries = 1024
+	dohEvictionScan    = 8
+)
+
+type DoHConfig struct {
+	URL     string         // URI template without variables, e.g. https://dns.example/dns-query
+	Method  string         // http.MethodPost (default) or http.MethodGet
+	RootCAs *x509.CertPool // system roots if nil
+}
+
+// DoHClient forwards queries over DNS over HTTPS (RFC 8484). Connections
+// are kept alive and reused by the HTTP/2 transport. Replies are cached
+// for as long as the Cache-Control header of the response allows.
+type DoHClient struct {
+	cfg    DoHConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]dohCacheEntry
+}
+
+type dohCacheEntry struct {
+	data    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func NewDoHClient(cfg DoHConfig) (*DoHClient, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid DoH URL %q", cfg.URL)
+	}
+
+	switch cfg.Method {
+	case "":
+		cfg.Method = http.MethodPost
+	case http.MethodPost, http.MethodGet:
+	default:
+		return nil, fmt.Errorf("unsupported DoH method %q", cfg.Method)
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs:    cfg.RootCAs,
+			MinVersion: tls.VersionTLS12,
+		},
+		// a custom TLS config disables HTTP/2 unless asked for explicitly
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   defaultIdleTimeout,
+	}
+
+	return &DoHClient{
+		cfg:    cfg,
+		client: &http.Client{Transport: transport},
+		cache:  make(map[string]dohCacheEntry),
+	}, nil
+}
+
+// Exchange sends the query and returns the reply carrying the ID of the query.
+func (c *DoHClient) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < dnsmessage.HeaderLength {
+		return nil, fmt.Errorf("query of %d bytes is too short", len(query))
+	}
+	id := binary.BigEndian.Uint16(query)
+
+	// the ID is always 0 to make the requests cache friendly (RFC 8484, section 4.1)
+	msg := slices.Clone(query)
+	binary.BigEndian.PutUint16(msg, 0)
+
+	key, q := cacheKey(msg)
+	if resp, ok := c.cached(key, q); ok {
+		log.Debug("answering from DoH cache for %s", c.cfg.URL)
+		binary.BigEndian.PutUint16(resp, id)
+		return resp, nil
+	}
+
+	req, err := c.newRequest(ctx, msg, base64.RawURLEncoding.EncodeToString(msg))
+	if err != nil {
+		return nil, err
+	}
+
+	httpResp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("DoH request to %s failed: %w", c.cfg.URL, err)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server %s responded with status %s", c.cfg.URL, httpResp.Status)
+	}
+	if ct := httpResp.Header.Get("Content-Type"); !IsDNSMessage(ct) {
+		return nil, fmt.Errorf("DoH server %s responded with content type %q", c.cfg.URL, ct)
+	}
+
+	resp, err := io.ReadAll(io.LimitReader(httpResp.Body, MaxMessageLength+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DoH response: %w", err)
+	}
+	if len(resp) < dnsmessage.HeaderLength || len(resp) > MaxMessageLength {
+		return nil, fmt.Errorf("DoH response of %d bytes is invalid", len(resp))
+	}
+
+	if maxAge, ok := freshness(httpResp.Header); ok && key != "" {
+		c.store(key, resp, maxAge)
+	}
+
+	resp = slices.Clone(resp)
+	binary.BigEndian.PutUint16(resp, id)
+	return resp, nil
+}
+
+// IsDNSMessage reports whether the Content-Type header value is
+// application/dns-message, parameters like charset are ignored.
+func IsDNSMessage(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == DNSMessageContentType
+}
+
+// cacheKey identifies the question of the query along with the DO and CD
+// bits that change the reply. Queries differing only in the case of the
+// name or in EDNS options like padding share it. The key is empty for
+// queries that can't be parsed, their replies are not cached.
+func cacheKey(query []byte) (string, *dnsmessage.Question) {
+	p, err := parser.NewParser(slices.Clone(query))
+	if err != nil {
+		return "", nil
+	}
+	if err := p.ParseMessage(); err != nil || p.Message.Question == nil {
+		return "", nil
+	}
+	m := p.Message
+
+	key := dnsmessage.PackDomainName(m.Question.QName)
+	for i, c := range key {
+		if c >= 'A' && c <= 'Z' {
+			key[i] = c + 'a' - 'A'
+		}
+	}
+	key = binary.BigEndian.AppendUint16(key, uint16(m.Question.QType))
+	key = binary.BigEndian.AppendUint16(key, uint16(m.Question.QClass))
+	var flags byte
+	if m.DO() {
+		flags |= 1
+	}
+	if m.Header.CD() {
+		flags |= 2
+	}
+	return string(append(key, flags)), m.Question
+}
+
+func (c *DoHClient) newRequest(ctx context.Context, msg []byte, encoded string) (*http.Request, error) {
+	var (
+		req *http.Request
+		err error
+	)
+	if c.cfg.Method == http.MethodGet {
+		u, _ := url.Parse(c.cfg.URL)
+		q := u.Query()
+		q.Set("dns", encoded)
+		u.RawQuery = q.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.URL, bytes.NewReader(msg))
+		if req != nil {
+			req.Header.Set("Content-Type", DNSMessageContentType)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DoH request: %w", err)
+	}
+	req.Header.Set("Accept", DNSMessageContentType)
+	return req, nil
+}
+
+// freshness returns how long a response may be reused
+// according to its Cache-Control and Age headers.
+func freshness(h http.Header) (time.Duration, bool) {
+	maxAge := -1
+	for directive := range strings.SplitSeq(h.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store" || directive == "no-cache" || directive == "private":
+			return 0, false
+		case strings.HasPrefix(directive, "max-age="):
+			v, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err != nil {
+				return 0, false
+			}
+			maxAge = v
+		}
+	}
+	if age, err := strconv.Atoi(h.Get("Age")); err == nil {
+		maxAge -= age
+	}
+	if maxAge <= 0 {
+		return 0, false
+	}
+	return time.Duration(maxAge) * time.Second, true
+}
+
+func (c *DoHClient) store(key string, resp []byte, maxAge time.Duration) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.cache[key]; !ok && len(c.cache) >= maxDoHCacheEntries {
+		c.evict(now)
+	}
+	c.cache[key] = dohCacheEntry{data: slices.Clone(resp), stored: now, expires: now.Add(maxAge)}
+}
+
+// evict makes room in the full cache without going through all of it.
+// Maps are iterated from a random entry, so a few entries are looked at:
+// the expired ones are dropped, or else the one expiring first.
+func (c *DoHClient) evict(now time.Time) {
+	var victim string
+	var victimExpires time.Time
+	dropped := false
+	n := 0
+	for k, entry := range c.cache {
+		if now.After(entry.expires) {
+			delete(c.cache, k)
+			dropped = true
+		} else if victim == "" || entry.expires.Before(victimExpires) {
+			victim, victimExpires = k, entry.expires
+		}
+		if n++; n == dohEvictionScan {
+			break
+		}
+	}
+	if !dropped {
+		delete(c.cache, victim)
+	}
+}
+
+// cached returns a cached reply with the TTLs reduced by the time it
+// spent in the cache (RFC 8484, section 5.1). The reply carries the
+// question as it was asked, the case of the name may differ.
+func (c *DoHClient) cached(key string, q *dnsmessage.Question) ([]byte, bool) {
+	if key == "" {
+		return nil, false
+	}
+	c.mu.Lock()
+	entry, ok := c.cache[key]
+	c.mu.Unlock()
+
+	now := time.Now()
+	if !ok || now.After(entry.expires) {
+		return nil, false
+	}
+
+	p, err := parser.NewParser(slices.Clone(entry.data))
+	if err != nil {
+		return nil, false
+	}
+	if err := p.ParseMessage(); err != nil {
+		// we can't adjust the TTLs of what we can't parse
+		return nil, false
+	}
+
+	p.Message.Question = q
+	age := uint32(now.Sub(entry.stored).Seconds())
+	for _, section := range []dnsmessage.ResourceRecords{p.Message.Answers, p.Message.AuthorityRecords, p.Message.AdditonalRecords} {
+		for _, rr := range section {
+			// the TTL of these holds flags and the extended RCODE
+			if rr.Type == dnsmessage.TypeOPT || rr.Type == dnsmessage.TypeTSIG {
+				continue
+			}
+			rr.TTL = max(rr.TTL, age) - age
+		}
+	}
+
+	resp, err := p.Message.Pack()
+	if err != nil {
+		return nil, false
+	}
+	return resp, true
+}
@@ -0,0 +1,356 @@
+package transport
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/parser"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// dohStandIn answers every query with a single A record
+// and records what the requests looked like
+type dohStandIn struct {
+	server       *httptest.Server
+	requests     atomic.Int32
+	cacheControl string
+	contentType  string // of the replies, DNSMessageContentType if empty
+	lastMethod   atomic.Value
+	lastProto    atomic.Int32
+}
+
+func newDoHStandIn(t *testing.T, cacheControl string) *dohStandIn {
+	s := &dohStandIn{cacheControl: cacheControl}
+	s.server = httptest.NewUnstartedServer(http.HandlerFunc(s.serveHTTP))
+	s.server.EnableHTTP2 = true
+	s.server.StartTLS()
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *dohStandIn) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests.Add(1)
+	s.lastMethod.Store(r.Method)
+	s.lastProto.Store(int32(r.ProtoMajor))
+
+	var (
+		query []byte
+		err   error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != DNSMessageContentType {
+			http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+		query, err = io.ReadAll(r.Body)
+	}
+	if err != nil || len(query) < dnsmessage.HeaderLength || binary.BigEndian.Uint16(query) != 0 {
+		http.Error(w, "bad query", http.StatusBadRequest)
+		return
+	}
+
+	p, err := parser.NewParser(query)
+	if err == nil {
+		err = p.ParseMessage()
+	}
+	if err != nil {
+		http.Error(w, "bad query", http.StatusBadRequest)
+		return
+	}
+
+	m := p.Message
+	m.Header.QR = 1
+	m.Header.RA = 1
+	m.Answers = dnsmessage.ResourceRecords{{
+		Name:  m.Question.QName,
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassIN,
+		TTL:   300,
+		RData: []byte{192, 0, 2, 1},
+	}}
+	resp, err := m.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	contentType := DNSMessageContentType
+	if s.contentType != "" {
+		contentType = s.contentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	if s.cacheControl != "" {
+		w.Header().Set("Cache-Control", s.cacheControl)
+	}
+	_, _ = w.Write(resp)
+}
+
+func (s *dohStandIn) client(t *testing.T, method string) *DoHClient {
+	roots := x509.NewCertPool()
+	roots.AddCert(s.server.Certificate())
+
+	c, err := NewDoHClient(DoHConfig{URL: s.server.URL + "/dns-query", Method: method, RootCAs: roots})
+	assert.NoError(t, err)
+	return c
+}
+
+func parseReply(t *testing.T, data []byte) *dnsmessage.DNSMessage {
+	p, err := parser.NewParser(data)
+	assert.NoError(t, err)
+	assert.NoError(t, p.ParseMessage())
+	return p.Message
+}
+
+func TestDoHExchange(t *testing.T) {
+	for _, method := range []string{http.MethodPost, http.MethodGet} {
+		t.Run(method, func(t *testing.T) {
+			s := newDoHStandIn(t, "")
+			c := s.client(t, method)
+
+			for i := range 3 {
+				resp, err := c.Exchange(context.Background(), queryWithID(t, uint16(100+i)))
+				assert.NoError(t, err)
+
+				m := parseReply(t, resp)
+				assert.Equal(t, uint32(100+i), m.Header.ID)
+				assert.Len(t, m.Answers, 1)
+				assert.Equal(t, "192.0.2.1", m.Answers[0].RDataString())
+			}
+
+			assert.Equal(t, int32(3), s.requests.Load())
+			assert.Equal(t, method, s.lastMethod.Load())
+			assert.Equal(t, int32(2), s.lastProto.Load())
+		})
+	}
+}
+
+func TestDoHHonorsMaxAge(t *testing.T) {
+	s := newDoHStandIn(t, "max-age=300")
+	c := s.client(t, http.MethodGet)
+
+	resp, err := c.Exchange(context.Background(), queryWithID(t, 1))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(300), parseReply(t, resp).Answers[0].TTL)
+
+	// pretend the reply has been in the cache for a while
+	c.mu.Lock()
+	for k, entry := range c.cache {
+		entry.stored = entry.stored.Add(-100 * time.Second)
+		c.cache[k] = entry
+	}
+	c.mu.Unlock()
+
+	resp, err = c.Exchange(context.Background(), queryWithID(t, 2))
+	assert.NoError(t, err)
+	m := parseReply(t, resp)
+	assert.Equal(t, uint32(2), m.Header.ID)
+	assert.Equal(t, uint32(200), m.Answers[0].TTL)
+	assert.Equal(t, int32(1), s.requests.Load())
+
+	// expired entries are not used anymore
+	c.mu.Lock()
+	for k, entry := range c.cache {
+		entry.expires = time.Now().Add(-time.Second)
+		c.cache[k] = entry
+	}
+	c.mu.Unlock()
+
+	_, err = c.Exchange(context.Background(), queryWithID(t, 3))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), s.requests.Load())
+}
+
+func TestDoHCachedOPT(t *testing.T) {
+	s := newDoHStandIn(t, "max-age=300")
+	c := s.client(t, http.MethodPost)
+
+	query := func(id uint32) []byte {
+		m := parseReply(t, queryWithID(t, uint16(id)))
+		m.AdditonalRecords = dnsmessage.ResourceRecords{dnsmessage.NewOPT(1232, true)}
+		data, err := m.Pack()
+		assert.NoError(t, err)
+		return data
+	}
+	resp, err := c.Exchange(context.Background(), query(1))
+	assert.NoError(t, err)
+	assert.True(t, parseReply(t, resp).DO())
+
+	c.mu.Lock()
+	for k, entry := range c.cache {
+		entry.stored = entry.stored.Add(-100 * time.Second)
+		c.cache[k] = entry
+	}
+	c.mu.Unlock()
+
+	resp, err = c.Exchange(context.Background(), query(2))
+	assert.NoError(t, err)
+	m := parseReply(t, resp)
+	assert.Equal(t, int32(1), s.requests.Load())
+	assert.Equal(t, uint32(200), m.Answers[0].TTL)
+	// the flags in the TTL of the OPT record are left alone
+	assert.Equal(t, dnsmessage.NewOPT(1232, true).TTL, m.OPT().TTL)
+}
+
+func TestDoHCacheLimit(t *testing.T) {
+	s := newDoHStandIn(t, "max-age=300")
+	c := s.client(t, http.MethodPost)
+
+	now := time.Now()
+	for i := range maxDoHCacheEntries {
+		c.store(strconv.Itoa(i), []byte{1}, time.Duration(i+1)*time.Second)
+	}
+	assert.Len(t, c.cache, maxDoHCacheEntries)
+
+	// a full cache stays full but not fuller
+	c.store("new", []byte{1}, time.Minute)
+	assert.Len(t, c.cache, maxDoHCacheEntries)
+	assert.Contains(t, c.cache, "new")
+
+	// expired entries make room first
+	for k, entry := range c.cache {
+		entry.expires = now.Add(-time.Second)
+		c.cache[k] = entry
+	}
+	c.store("newer", []byte{1}, time.Minute)
+	assert.Less(t, len(c.cache), maxDoHCacheEntries)
+	assert.Contains(t, c.cache, "newer")
+
+	// replacing an entry evicts nothing
+	n := len(c.cache)
+	c.store("newer", []byte{2}, time.Minute)
+	assert.Len(t, c.cache, n)
+}
+
+func TestDoHNoCache(t *testing.T) {
+	s := newDoHStandIn(t, "no-store, max-age=300")
+	c := s.client(t, http.MethodPost)
+
+	for i := range 2 {
+		_, err := c.Exchange(context.Background(), queryWithID(t, uint16(i)))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int32(2), s.requests.Load())
+}
+
+func TestFreshness(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		age          string
+		exp          time.Duration
+		ok           bool
+	}{
+		{cacheControl: "max-age=60", exp: time.Minute, ok: true},
+		{cacheControl: "public, Max-Age=60", age: "20", exp: 40 * time.Second, ok: true},
+		{cacheControl: "max-age=60", age: "60"},
+		{cacheControl: "no-cache"},
+		{cacheControl: "max-age=abc"},
+		{},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		h.Set("Cache-Control", tt.cacheControl)
+		if tt.age != "" {
+			h.Set("Age", tt.age)
+		}
+		maxAge, ok := freshness(h)
+		assert.Equal(t, tt.ok, ok, tt.cacheControl)
+		assert.Equal(t, tt.exp, maxAge, tt.cacheControl)
+	}
+}
+
+func TestDoHCacheKey(t *testing.T) {
+	s := newDoHStandIn(t, "max-age=300")
+	c := s.client(t, http.MethodPost)
+
+	query := func(name string, z uint64, opt *dnsmessage.ResourceRecord) []byte {
+		m := &dnsmessage.DNSMessage{
+			Header:   &dnsmessage.Header{ID: 7, RD: 1, Z: z},
+			Question: &dnsmessage.Question{QName: dnsmessage.ParseDomainName(name), QType: dnsmessage.TypeA, QClass: dnsmessage.ClassIN},
+		}
+		if opt != nil {
+			m.AdditonalRecords = dnsmessage.ResourceRecords{opt}
+		}
+		data, err := m.Pack()
+		assert.NoError(t, err)
+		return data
+	}
+	padded := dnsmessage.NewOPT(1232, false)
+	padded.RData = []byte{0, 12, 0, 4, 0, 0, 0, 0} // padding option (RFC 7830)
+	padded.RdLength = uint32(len(padded.RData))
+
+	tests := []struct {
+		name     string
+		query    []byte
+		requests int32
+	}{
+		{name: "first", query: query("www.example", 0, nil), requests: 1},
+		{name: "0x20 case", query: query("wWw.ExAmple", 0, nil), requests: 1},
+		{name: "padding", query: query("www.example", 0, padded), requests: 1},
+		{name: "DO", query: query("www.example", 0, dnsmessage.NewOPT(1232, true)), requests: 2},
+		{name: "CD", query: query("www.example", dnsmessage.ZCheckingDisabled, nil), requests: 3},
+		{name: "other name", query: query("mail.example", 0, nil), requests: 4},
+	}
+	for _, tt := range tests {
+		resp, err := c.Exchange(context.Background(), tt.query)
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.requests, s.requests.Load(), tt.name)
+
+		// the reply echoes the name as it was asked
+		m := parseReply(t, resp)
+		assert.Equal(t, parseReply(t, tt.query).Question.QName, m.Question.QName, tt.name)
+	}
+}
+
+func TestDoHContentTypeParameters(t *testing.T) {
+	for contentType, ok := range map[string]bool{
+		"application/dns-message; charset=utf-8": true,
+		"Application/DNS-Message":                true,
+		"text/html":                              false,
+		"application/dns-message; =":             false,
+	} {
+		s := &dohStandIn{contentType: contentType}
+		s.server = httptest.NewUnstartedServer(http.HandlerFunc(s.serveHTTP))
+		s.server.EnableHTTP2 = true
+		s.server.StartTLS()
+		t.Cleanup(s.server.Close)
+
+		_, err := s.client(t, http.MethodPost).Exchange(context.Background(), queryWithID(t, 1))
+		if ok {
+			assert.NoError(t, err, contentType)
+		} else {
+			assert.ErrorContains(t, err, "content type", contentType)
+		}
+	}
+}
+
+func TestDoHErrors(t *testing.T) {
+	_, err := NewDoHClient(DoHConfig{URL: "http://dns.example/dns-query"})
+	assert.Error(t, err)
+
+	_, err = NewDoHClient(DoHConfig{URL: "https://dns.example/dns-query", Method: "PUT"})
+	assert.Error(t, err)
+
+	s := newDoHStandIn(t, "")
+	roots := x509.NewCertPool()
+	roots.AddCert(s.server.Certificate())
+	c, err := NewDoHClient(DoHConfig{URL: s.server.URL + "/dns-query", RootCAs: roots})
+	assert.NoError(t, err)
+
+	// the stand in rejects queries it can't parse
+	_, err = c.Exchange(context.Background(), []byte{0, 1, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0, 5})
+	assert.ErrorContains(t, err, "400")
+}
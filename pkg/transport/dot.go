@@ -0,0 +1,293 @@
+package transport
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/log"
+)
+
+const defaultDialTimeout = 5 * time.Second
+
+var errConnClosed = errors.New("connection closed")
+
+type DoTConfig struct {
+	Addr       string // host:port of the upstream
+	ServerName string // name to verify the certificate against
+	// base64 encoded SHA-256 digests of the SubjectPublicKeyInfo, at least one
+	// certificate of a verified chain has to match if set (RFC 7858, section 4.2)
+	SPKIPins    []string
+	RootCAs     *x509.CertPool // system roots if nil
+	DialTimeout time.Duration
+}
+
+// DoTClient forwards queries over DNS over TLS (RFC 7858). It keeps a
+// single TLS connection open and pipelines queries over it, so replies
+// may arrive out of order and are matched to the queries by ID.
+type DoTClient struct {
+	cfg       DoTConfig
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	conn *dotConn
+}
+
+type dotConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]chan []byte
+	nextID  uint16
+
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+}
+
+func NewDoTClient(cfg DoTConfig) (*DoTClient, error) {
+	host, _, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DoT upstream address %q: %w", cfg.Addr, err)
+	}
+
+	serverName := cfg.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+
+	pins := make([][]byte, 0, len(cfg.SPKIPins))
+	for _, pin := range cfg.SPKIPins {
+		digest, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q: expected a base64 encoded SHA-256 digest", pin)
+		}
+		pins = append(pins, digest)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+		RootCAs:    cfg.RootCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(pins) > 0 {
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs.VerifiedChains, pins)
+		}
+	}
+
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = defaultDialTimeout
+	}
+
+	return &DoTClient{cfg: cfg, tlsConfig: tlsConfig}, nil
+}
+
+// verifyPins looks for the pins in the chains built by certificate
+// verification. The certificates the peer sent may include any
+// certificate that is not part of its chain, so they are not checked.
+func verifyPins(chains [][]*x509.Certificate, pins [][]byte) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if slices.Equal(digest[:], pin) {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("no certificate matches the configured SPKI pins")
+}
+
+// SPKIPin returns the pin of a certificate in the format expected by DoTConfig.
+func SPKIPin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// Exchange sends the query and waits for the matching reply. The reply
+// carries the ID of the query that was passed in.
+func (c *DoTClient) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < dnsmessage.HeaderLength {
+		return nil, fmt.Errorf("query of %d bytes is too short", len(query))
+	}
+
+	dc, reused, err := c.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := dc.exchange(ctx, query)
+	if errors.Is(err, errConnClosed) && reused {
+		// the server may close idle connections at any time (RFC 7766, section 6.2.3)
+		// so give it one more try on a fresh connection
+		log.Debug("DoT connection to %s was closed, reconnecting", c.cfg.Addr)
+		dc, _, err = c.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = dc.exchange(ctx, query)
+	}
+	return resp, err
+}
+
+// getConn returns the open connection or dials a new one.
+// The flag reports whether the connection was reused.
+func (c *DoTClient) getConn(ctx context.Context) (*dotConn, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil && !c.conn.closed() {
+		return c.conn, true, nil
+	}
+
+	dialer := tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: c.cfg.DialTimeout},
+		Config:    c.tlsConfig,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", c.cfg.Addr)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to connect to DoT upstream %s: %w", c.cfg.Addr, err)
+	}
+	log.Debug("opened DoT connection to %s", c.cfg.Addr)
+
+	dc := &dotConn{
+		conn:    conn,
+		pending: make(map[uint16]chan []byte),
+		done:    make(chan struct{}),
+	}
+	go dc.readLoop()
+
+	c.conn = dc
+	return dc, false, nil
+}
+
+// Close closes the open connection, if any.
+func (c *DoTClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil {
+		c.conn.close(errConnClosed)
+		c.conn = nil
+	}
+	return nil
+}
+
+func (dc *dotConn) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	origID := binary.BigEndian.Uint16(query)
+
+	id, replies, err := dc.register()
+	if err != nil {
+		return nil, err
+	}
+	defer dc.unregister(id)
+
+	msg := slices.Clone(query)
+	binary.BigEndian.PutUint16(msg, id)
+
+	dc.writeMu.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = dc.conn.SetWriteDeadline(deadline)
+	}
+	err = WriteMessage(dc.conn, msg)
+	dc.writeMu.Unlock()
+	if err != nil {
+		dc.close(err)
+		return nil, fmt.Errorf("failed to send query: %w", errConnClosed)
+	}
+
+	select {
+	case resp := <-replies:
+		binary.BigEndian.PutUint16(resp, origID)
+		return resp, nil
+	case <-dc.done:
+		return nil, fmt.Errorf("%w: %v", errConnClosed, dc.err)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// register reserves an ID which is unique among the queries in flight.
+func (dc *dotConn) register() (uint16, chan []byte, error) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if dc.closed() {
+		return 0, nil, errConnClosed
+	}
+	if len(dc.pending) >= 0xFFFF {
+		return 0, nil, errors.New("too many queries in flight")
+	}
+
+	for {
+		dc.nextID++
+		if _, ok := dc.pending[dc.nextID]; !ok {
+			break
+		}
+	}
+	replies := make(chan []byte, 1)
+	dc.pending[dc.nextID] = replies
+	return dc.nextID, replies, nil
+}
+
+func (dc *dotConn) unregister(id uint16) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	delete(dc.pending, id)
+}
+
+func (dc *dotConn) readLoop() {
+	for {
+		msg, err := ReadMessage(dc.conn)
+		if err != nil {
+			dc.close(err)
+			return
+		}
+		if len(msg) < dnsmessage.HeaderLength {
+			dc.close(fmt.Errorf("received a message of %d bytes", len(msg)))
+			return
+		}
+
+		id := binary.BigEndian.Uint16(msg)
+		dc.mu.Lock()
+		replies, ok := dc.pending[id]
+		delete(dc.pending, id)
+		dc.mu.Unlock()
+
+		if !ok {
+			log.Debug("dropping DoT reply with unknown ID %d", id)
+			continue
+		}
+		replies <- msg
+	}
+}
+
+func (dc *dotConn) close(err error) {
+	dc.closeOnce.Do(func() {
+		dc.err = err
+		close(dc.done)
+		_ = dc.conn.Close()
+	})
+}
+
+func (dc *dotConn) closed() bool {
+	select {
+	case <-dc.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,221 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testQuery = "45dc010000010000000000000377777707796f757475626503636f6d0000010001"
+
+func newTestCert(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		DNSNames:     []string{"dns.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+// dotStandIn is a DoT upstream on loopback. It collects batch queries
+// from a connection before answering them in reverse order.
+type dotStandIn struct {
+	listener net.Listener
+	cert     *x509.Certificate
+	batch    int
+	conns    atomic.Int32
+}
+
+func newDoTStandIn(t *testing.T, batch int) *dotStandIn {
+	tlsCert, cert := newTestCert(t)
+	return newDoTStandInWithCert(t, batch, tlsCert, cert)
+}
+
+// newDoTStandInWithCert serves the certificate chain, cert is trusted by the clients.
+func newDoTStandInWithCert(t *testing.T, batch int, tlsCert tls.Certificate, cert *x509.Certificate) *dotStandIn {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{tlsCert}})
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	s := &dotStandIn{listener: l, cert: cert, batch: batch}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *dotStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		queries := [][]byte{}
+		for len(queries) < s.batch {
+			msg, err := ReadMessage(conn)
+			if err != nil {
+				return
+			}
+			queries = append(queries, msg)
+		}
+		for i := len(queries) - 1; i >= 0; i-- {
+			resp := queries[i]
+			resp[2] |= 0x80
+			if err := WriteMessage(conn, resp); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *dotStandIn) client(t *testing.T, pins ...string) *DoTClient {
+	roots := x509.NewCertPool()
+	roots.AddCert(s.cert)
+
+	c, err := NewDoTClient(DoTConfig{
+		Addr:       s.listener.Addr().String(),
+		ServerName: "dns.test",
+		SPKIPins:   pins,
+		RootCAs:    roots,
+	})
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func queryWithID(t *testing.T, id uint16) []byte {
+	query, err := hex.DecodeString(testQuery)
+	assert.NoError(t, err)
+	binary.BigEndian.PutUint16(query, id)
+	return query
+}
+
+func TestDoTExchangePipelined(t *testing.T) {
+	s := newDoTStandIn(t, 4)
+	c := s.client(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// replies to the batch come back in reverse order
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Go(func() {
+			// all clients use the same ID on purpose
+			resp, err := c.Exchange(ctx, queryWithID(t, 42))
+			assert.NoError(t, err)
+			assert.Equal(t, uint16(42), binary.BigEndian.Uint16(resp))
+			assert.Equal(t, byte(0x81), resp[2], "query %d", i)
+		})
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), s.conns.Load())
+}
+
+func TestDoTExchangeReusesConnection(t *testing.T) {
+	s := newDoTStandIn(t, 1)
+	c := s.client(t)
+
+	for i := range 3 {
+		resp, err := c.Exchange(context.Background(), queryWithID(t, uint16(i)))
+		assert.NoError(t, err)
+		assert.Equal(t, uint16(i), binary.BigEndian.Uint16(resp))
+	}
+	assert.Equal(t, int32(1), s.conns.Load())
+}
+
+func TestDoTExchangeReconnects(t *testing.T) {
+	s := newDoTStandIn(t, 1)
+	c := s.client(t)
+
+	_, err := c.Exchange(context.Background(), queryWithID(t, 1))
+	assert.NoError(t, err)
+
+	// simulate the server closing the idle connection
+	c.mu.Lock()
+	_ = c.conn.conn.Close()
+	c.mu.Unlock()
+
+	_, err = c.Exchange(context.Background(), queryWithID(t, 2))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), s.conns.Load())
+}
+
+func TestDoTSPKIPinning(t *testing.T) {
+	s := newDoTStandIn(t, 1)
+
+	c := s.client(t, SPKIPin(s.cert))
+	_, err := c.Exchange(context.Background(), queryWithID(t, 1))
+	assert.NoError(t, err)
+
+	_, other := newTestCert(t)
+	c = s.client(t, SPKIPin(other))
+	_, err = c.Exchange(context.Background(), queryWithID(t, 1))
+	assert.ErrorContains(t, err, "SPKI pins")
+
+	_, err = NewDoTClient(DoTConfig{Addr: "127.0.0.1:853", SPKIPins: []string{"not a pin"}})
+	assert.Error(t, err)
+}
+
+func TestDoTServerNameMismatch(t *testing.T) {
+	s := newDoTStandIn(t, 1)
+	roots := x509.NewCertPool()
+	roots.AddCert(s.cert)
+
+	c, err := NewDoTClient(DoTConfig{
+		Addr:       s.listener.Addr().String(),
+		ServerName: "other.test",
+		RootCAs:    roots,
+	})
+	assert.NoError(t, err)
+
+	_, err = c.Exchange(context.Background(), queryWithID(t, 1))
+	assert.Error(t, err)
+}
+
+func TestDoTSPKIPinOutsideVerifiedChain(t *testing.T) {
+	tlsCert, cert := newTestCert(t)
+	pinnedTLS, pinned := newTestCert(t)
+	// the pinned certificate is sent after the leaf but nothing chains to it
+	tlsCert.Certificate = append(tlsCert.Certificate, pinnedTLS.Certificate[0])
+	s := newDoTStandInWithCert(t, 1, tlsCert, cert)
+
+	c := s.client(t, SPKIPin(pinned))
+	_, err := c.Exchange(context.Background(), queryWithID(t, 1))
+	assert.ErrorContains(t, err, "SPKI pins")
+
+	c = s.client(t, SPKIPin(cert))
+	_, err = c.Exchange(context.Background(), queryWithID(t, 1))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DNS over TCP (and TLS on top of it) prefixes every message
+// with its length as a 2 byte integer (RFC 1035, section 4.2.2)
+
+const MaxMessageLength = 65535
+
+// ReadMessage reads a single length-prefixed message.
+func ReadMessage(r io.Reader) ([]byte, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint16(prefix[:])
+	if length == 0 {
+		return nil, errors.New("received a message of length 0")
+	}
+
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("failed to read message of %d bytes: %w", length, err)
+	}
+	return msg, nil
+}
+
+// WriteMessage writes the message with its length prefix in a single write.
+func WriteMessage(w io.Writer, msg []byte) error {
+	if len(msg) > MaxMessageLength {
+		return fmt.Errorf("message of %d bytes exceeds max length %d", len(msg), MaxMessageLength)
+	}
+
+	buf := make([]byte, 2, len(msg)+2)
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	buf = append(buf, msg...)
+
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,301 @@
+// Package tsig signs and verifies DNS messages with shared secrets
+// (transaction signatures, RFC 8945).
+package tsig
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"slices"
+	"strings"
+	"time"
+
+	"server/pkg/dnsmessage"
+)
+
+// seconds the clocks of both sides may differ (RFC 8945, section 10)
+const defaultFudge = 300
+
+// Config is a key shared with another server or a client.
+type Config struct {
+	Name string `yaml:"name"`
+	// hmac-sha256 (the default) or hmac-sha512
+	Algorithm string `yaml:"algorithm"`
+	Secret    string `yaml:"secret"` // base64
+}
+
+// the algorithms we sign with (RFC 8945, section 6)
+var algorithms = map[string]func() hash.Hash{
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+// Key is a secret shared under a name.
+type Key struct {
+	name      dnsmessage.DomainName
+	algorithm dnsmessage.DomainName
+	hash      func() hash.Hash
+	secret    []byte
+}
+
+func NewKey(cfg Config) (*Key, error) {
+	alg := strings.ToLower(strings.TrimSuffix(cfg.Algorithm, "."))
+	if alg == "" {
+		alg = "hmac-sha256"
+	}
+	h, ok := algorithms[alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", cfg.Algorithm)
+	}
+	secret, err := base64.StdEncoding.DecodeString(cfg.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret: %w", err)
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret")
+	}
+	return &Key{
+		name:      dnsmessage.ParseDomainName(cfg.Name),
+		algorithm: dnsmessage.ParseDomainName(alg),
+		hash:      h,
+		secret:    secret,
+	}, nil
+}
+
+// Name returns the name of the key in lower case without the final dot.
+func (k *Key) Name() string {
+	return strings.ToLower(dnsmessage.DomainNameToString(k.name))
+}
+
+// Is reports whether the key has the name.
+func (k *Key) Is(name string) bool {
+	return dnsmessage.EqualNames(k.name, dnsmessage.ParseDomainName(name))
+}
+
+// Keys holds the keys by their name.
+type Keys map[string]*Key
+
+func NewKeys(cfgs []Config) (Keys, error) {
+	keys := make(Keys, len(cfgs))
+	for _, cfg := range cfgs {
+		k, err := NewKey(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", cfg.Name, err)
+		}
+		if keys[k.Name()] != nil {
+			return nil, fmt.Errorf("key %s is defined twice", cfg.Name)
+		}
+		keys[k.Name()] = k
+	}
+	return keys, nil
+}
+
+// Get returns the key with the name, nil if there is none.
+func (ks Keys) Get(name string) *Key {
+	return ks[strings.ToLower(strings.TrimSuffix(name, "."))]
+}
+
+// ErrUnsigned is returned for messages without a TSIG record.
+var ErrUnsigned = errors.New("message is not signed")
+
+// Error is a failed verification. The response to a request that failed
+// carries the code in its TSIG record.
+type Error struct {
+	Code dnsmessage.RCode
+}
+
+func (e *Error) Error() string {
+	return "TSIG verification failed: " + e.Code.String()
+}
+
+// Session chains the signatures of the messages exchanged with a key:
+// a response is signed over the MAC of the request, every further
+// message of a TCP stream over the MAC of the one before (RFC 8945,
+// section 5.3).
+type Session struct {
+	key      *Key
+	mac      []byte // of the message before
+	messages int    // signed or verified after the request
+	// a request that failed verification with its key and algorithm
+	err       dnsmessage.RCode
+	keyName   dnsmessage.DomainName
+	algorithm dnsmessage.DomainName
+}
+
+// Key returns the key of the session, nil for no session.
+func (s *Session) Key() *Key {
+	if s == nil {
+		return nil
+	}
+	return s.key
+}
+
+// SignRequest signs the request and returns the session to verify
+// the responses with.
+func (k *Key) SignRequest(msg []byte, now time.Time) ([]byte, *Session) {
+	s := &Session{key: k}
+	signed, mac := s.sign(msg, nil, true, now)
+	s.mac = mac
+	return signed, s
+}
+
+// Verify checks the signature of the request with the key it names. If
+// it fails with an *Error, the session signs the error response.
+func (ks Keys) Verify(msg []byte, now time.Time) (*Session, error) {
+	start, name, sig, err := signature(msg)
+	if err != nil {
+		return nil, err
+	}
+	k := ks[strings.ToLower(dnsmessage.DomainNameToString(name))]
+	if k == nil || !dnsmessage.EqualNames(k.algorithm, sig.Algorithm) {
+		return &Session{err: dnsmessage.RCodeBadKey, keyName: name, algorithm: sig.Algorithm}, &Error{dnsmessage.RCodeBadKey}
+	}
+	s := &Session{key: k, mac: sig.MAC}
+	if code := s.check(msg[:start], sig, nil, true, now); code != dnsmessage.RCodeNoError {
+		if code == dnsmessage.RCodeBadSig {
+			s.key = nil
+			s.keyName, s.algorithm = name, sig.Algorithm
+		}
+		s.err = code
+		return s, &Error{code}
+	}
+	return s, nil
+}
+
+// Unsigned returns the message without its TSIG record,
+// the message itself if it has none.
+func Unsigned(msg []byte) []byte {
+	start, _, _, err := signature(msg)
+	if err != nil {
+		return msg
+	}
+	b := slices.Clone(msg[:start])
+	binary.BigEndian.PutUint16(b[10:], binary.BigEndian.Uint16(b[10:])-1)
+	return b
+}
+
+// Verify checks the signature of the next response.
+func (s *Session) Verify(msg []byte, now time.Time) error {
+	start, name, sig, err := signature(msg)
+	if err != nil {
+		return err
+	}
+	if !dnsmessage.EqualNames(name, s.key.name) || !dnsmessage.EqualNames(sig.Algorithm, s.key.algorithm) {
+		return &Error{dnsmessage.RCodeBadKey}
+	}
+	if sig.Error != dnsmessage.RCodeNoError {
+		return fmt.Errorf("the other side failed to verify our signature: %s", sig.Error)
+	}
+	if code := s.check(msg[:start], sig, s.mac, s.messages == 0, now); code != dnsmessage.RCodeNoError {
+		return &Error{code}
+	}
+	s.mac = sig.MAC
+	s.messages++
+	return nil
+}
+
+// Sign signs the next response. The response to a request that failed
+// verification carries the error, unsigned unless it was the time
+// (RFC 8945, section 5.3.2).
+func (s *Session) Sign(msg []byte, now time.Time) []byte {
+	if s.key == nil {
+		sig := &dnsmessage.TSIG{
+			Algorithm:  s.algorithm,
+			TimeSigned: uint64(now.Unix()),
+			Fudge:      defaultFudge,
+			OriginalID: binary.BigEndian.Uint16(msg),
+			Error:      s.err,
+		}
+		return appendTSIG(msg, s.keyName, sig)
+	}
+	signed, mac := s.sign(msg, s.mac, s.messages == 0, now)
+	s.mac = mac
+	s.messages++
+	return signed
+}
+
+// sign appends the TSIG record with the MAC over the prior MAC, the
+// message and the TSIG variables, only the timers of them after the
+// first message of a stream.
+func (s *Session) sign(msg, prior []byte, full bool, now time.Time) ([]byte, []byte) {
+	sig := &dnsmessage.TSIG{
+		Algorithm:  s.key.algorithm,
+		TimeSigned: uint64(now.Unix()),
+		Fudge:      defaultFudge,
+		OriginalID: binary.BigEndian.Uint16(msg),
+		Error:      s.err,
+	}
+	if s.err == dnsmessage.RCodeBadTime {
+		// our time for the client to see how far off it is
+		sig.OtherData = binary.BigEndian.AppendUint16(nil, uint16(sig.TimeSigned>>32))
+		sig.OtherData = binary.BigEndian.AppendUint32(sig.OtherData, uint32(sig.TimeSigned))
+	}
+	sig.MAC = s.key.mac(prior, msg, s.key.name, sig, full)
+	return appendTSIG(msg, s.key.name, sig), sig.MAC
+}
+
+// check verifies the MAC of the signature over the message without the
+// TSIG record and then its time.
+func (s *Session) check(msg []byte, sig *dnsmessage.TSIG, prior []byte, full bool, now time.Time) dnsmessage.RCode {
+	unsigned := slices.Clone(msg)
+	binary.BigEndian.PutUint16(unsigned, sig.OriginalID)
+	binary.BigEndian.PutUint16(unsigned[10:], binary.BigEndian.Uint16(unsigned[10:])-1)
+	if !hmac.Equal(sig.MAC, s.key.mac(prior, unsigned, s.key.name, sig, full)) {
+		return dnsmessage.RCodeBadSig
+	}
+	if diff := now.Unix() - int64(sig.TimeSigned); diff > int64(sig.Fudge) || -diff > int64(sig.Fudge) {
+		return dnsmessage.RCodeBadTime
+	}
+	return dnsmessage.RCodeNoError
+}
+
+// mac computes the MAC of the message (RFC 8945, section 4.3).
+func (k *Key) mac(prior, msg []byte, name dnsmessage.DomainName, sig *dnsmessage.TSIG, full bool) []byte {
+	h := hmac.New(k.hash, k.secret)
+	if len(prior) > 0 {
+		h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(prior))))
+		h.Write(prior)
+	}
+	h.Write(msg)
+
+	var vars []byte
+	if full {
+		vars = append(vars, canonicalName(name)...)
+		vars = binary.BigEndian.AppendUint16(vars, uint16(dnsmessage.ClassANY))
+		vars = binary.BigEndian.AppendUint32(vars, 0) // TTL
+		vars = append(vars, canonicalName(sig.Algorithm)...)
+	}
+	vars = binary.BigEndian.AppendUint16(vars, uint16(sig.TimeSigned>>32))
+	vars = binary.BigEndian.AppendUint32(vars, uint32(sig.TimeSigned))
+	vars = binary.BigEndian.AppendUint16(vars, sig.Fudge)
+	if full {
+		vars = binary.BigEndian.AppendUint16(vars, uint16(sig.Error))
+		vars = binary.BigEndian.AppendUint16(vars, uint16(len(sig.OtherData)))
+		vars = append(vars, sig.OtherData...)
+	}
+	h.Write(vars)
+	return h.Sum(nil)
+}
+
+func canonicalName(name dnsmessage.DomainName) []byte {
+	return bytes.ToLower(dnsmessage.PackDomainName(name))
+}
+
+// appendTSIG adds the TSIG record to the end of the message.
+func appendTSIG(msg []byte, name dnsmessage.DomainName, sig *dnsmessage.TSIG) []byte {
+	rdata := sig.Pack()
+	b := slices.Clone(msg)
+	binary.BigEndian.PutUint16(b[10:], binary.BigEndian.Uint16(b[10:])+1)
+	b = append(b, dnsmessage.PackDomainName(name)...)
+	b = binary.BigEndian.AppendUint16(b, uint16(dnsmessage.TypeTSIG))
+	b = binary.BigEndian.AppendUint16(b, uint16(dnsmessage.ClassANY))
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+	return append(b, rdata...)
+}
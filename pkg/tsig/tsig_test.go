@@ -0,0 +1,153 @@
+package tsig
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"server/pkg/dnsmessage"
+	dnsparser "server/pkg/parser"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testSecret = base64.StdEncoding.EncodeToString([]byte("a secret of the two servers"))
+
+func testKeys(t *testing.T, algorithm string) Keys {
+	keys, err := NewKeys([]Config{{Name: "transfer.example.", Algorithm: algorithm, Secret: testSecret}})
+	require.NoError(t, err)
+	return keys
+}
+
+func testMessage(t *testing.T, id uint32, qr uint64) []byte {
+	m := dnsmessage.DNSMessage{
+		Header:   &dnsmessage.Header{ID: id, QR: qr},
+		Question: &dnsmessage.Question{QName: dnsmessage.ParseDomainName("example"), QType: dnsmessage.TypeAXFR, QClass: dnsmessage.ClassIN},
+	}
+	if qr == 1 {
+		m.Answers = dnsmessage.ResourceRecords{{Name: dnsmessage.ParseDomainName("www.example"), Type: dnsmessage.TypeA, Class: dnsmessage.ClassIN, TTL: 60, RData: []byte{192, 0, 2, 1}}}
+	}
+	data, err := m.Pack()
+	require.NoError(t, err)
+	return data
+}
+
+func TestNewKeys(t *testing.T) {
+	keys := testKeys(t, "")
+	k := keys.Get("Transfer.Example.")
+	require.NotNil(t, k)
+	assert.Equal(t, "transfer.example", k.Name())
+	assert.True(t, k.Is("TRANSFER.example."))
+	assert.False(t, k.Is("other.example"))
+
+	for _, cfg := range []Config{
+		{Name: "k", Algorithm: "hmac-md5", Secret: testSecret},
+		{Name: "k", Secret: "not base64!"},
+		{Name: "k"},
+	} {
+		_, err := NewKey(cfg)
+		assert.Error(t, err, cfg)
+	}
+	_, err := NewKeys([]Config{{Name: "k", Secret: testSecret}, {Name: "K.", Secret: testSecret}})
+	assert.Error(t, err)
+}
+
+func TestSignAndVerify(t *testing.T) {
+	for _, alg := range []string{"hmac-sha256", "hmac-sha512"} {
+		t.Run(alg, func(t *testing.T) {
+			keys := testKeys(t, alg)
+			now := time.Unix(1_700_000_000, 0)
+
+			request, client := keys.Get("transfer.example").SignRequest(testMessage(t, 7, 0), now)
+			// the parser takes the signed message
+			p, err := dnsparser.NewParser(request)
+			require.NoError(t, err)
+			require.NoError(t, p.ParseMessage())
+			require.Len(t, p.Message.AdditonalRecords, 1)
+			assert.Equal(t, dnsmessage.TypeTSIG, p.Message.AdditonalRecords[0].Type)
+
+			server, err := keys.Verify(request, now.Add(time.Minute))
+			require.NoError(t, err)
+			assert.Same(t, keys.Get("transfer.example"), server.Key())
+
+			// a stream of responses, each chained to the one before
+			for range 3 {
+				response := server.Sign(testMessage(t, 7, 1), now)
+				require.NoError(t, client.Verify(response, now))
+			}
+		})
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	keys := testKeys(t, "")
+	now := time.Unix(1_700_000_000, 0)
+	request, _ := keys.Get("transfer.example").SignRequest(testMessage(t, 7, 0), now)
+
+	_, err := keys.Verify(testMessage(t, 7, 0), now)
+	assert.ErrorIs(t, err, ErrUnsigned)
+
+	verify := func(msg []byte, now time.Time) (*Session, dnsmessage.RCode) {
+		t.Helper()
+		s, err := keys.Verify(msg, now)
+		var e *Error
+		require.ErrorAs(t, err, &e)
+		return s, e.Code
+	}
+	errorOf := func(response []byte) dnsmessage.RCode {
+		t.Helper()
+		_, _, sig, err := signature(response)
+		require.NoError(t, err)
+		return sig.Error
+	}
+
+	// changed after signing
+	tampered := append([]byte(nil), request...)
+	tampered[2] ^= 1
+	s, code := verify(tampered, now)
+	assert.Equal(t, dnsmessage.RCodeBadSig, code)
+	assert.Nil(t, s.Key())
+	assert.Equal(t, dnsmessage.RCodeBadSig, errorOf(s.Sign(testMessage(t, 7, 1), now)))
+
+	// a key we don't know
+	other, err := NewKey(Config{Name: "other.example", Secret: testSecret})
+	require.NoError(t, err)
+	unknown, _ := other.SignRequest(testMessage(t, 7, 0), now)
+	s, code = verify(unknown, now)
+	assert.Equal(t, dnsmessage.RCodeBadKey, code)
+	assert.Equal(t, dnsmessage.RCodeBadKey, errorOf(s.Sign(testMessage(t, 7, 1), now)))
+
+	// a clock too far off, the response is signed though
+	_, client := keys.Get("transfer.example").SignRequest(testMessage(t, 7, 0), now)
+	s, code = verify(request, now.Add(time.Hour))
+	assert.Equal(t, dnsmessage.RCodeBadTime, code)
+	assert.NotNil(t, s.Key())
+	response := s.Sign(testMessage(t, 7, 1), now.Add(time.Hour))
+	assert.Equal(t, dnsmessage.RCodeBadTime, errorOf(response))
+	assert.ErrorContains(t, client.Verify(response, now), "bad time")
+}
+
+func TestVerifyResponseErrors(t *testing.T) {
+	keys := testKeys(t, "")
+	now := time.Unix(1_700_000_000, 0)
+	request, client := keys.Get("transfer.example").SignRequest(testMessage(t, 7, 0), now)
+	server, err := keys.Verify(request, now)
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, client.Verify(testMessage(t, 7, 1), now), ErrUnsigned)
+
+	response := server.Sign(testMessage(t, 7, 1), now)
+	response[len(response)-1] ^= 1
+	assert.Error(t, client.Verify(response, now))
+
+	// the responses have to come in order
+	request, client = keys.Get("transfer.example").SignRequest(testMessage(t, 8, 0), now)
+	server, err = keys.Verify(request, now)
+	require.NoError(t, err)
+	server.Sign(testMessage(t, 8, 1), now)
+	second := server.Sign(testMessage(t, 8, 1), now)
+	var e *Error
+	require.ErrorAs(t, client.Verify(second, now), &e)
+	assert.Equal(t, dnsmessage.RCodeBadSig, e.Code)
+}
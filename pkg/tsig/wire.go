@@ -0,0 +1,82 @@
+package tsig
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"server/pkg/dnsmessage"
+)
+
+// signature returns where the TSIG record at the end of the message
+// starts, the name of its key and its RDATA. Messages without one
+// return ErrUnsigned.
+func signature(msg []byte) (int, dnsmessage.DomainName, *dnsmessage.TSIG, error) {
+	if len(msg) < 12 {
+		return 0, nil, nil, errors.New("message is too short")
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	records := 0
+	for _, i := range []int{6, 8, 10} {
+		records += int(binary.BigEndian.Uint16(msg[i:]))
+	}
+
+	off := 12
+	var err error
+	for range questions {
+		if off, err = skipName(msg, off); err != nil {
+			return 0, nil, nil, err
+		}
+		off += 4
+	}
+	start := -1
+	for i := range records {
+		rr := off
+		if off, err = skipName(msg, off); err != nil {
+			return 0, nil, nil, err
+		}
+		if off+10 > len(msg) {
+			return 0, nil, nil, errors.New("record is cut off")
+		}
+		typ := dnsmessage.RRType(binary.BigEndian.Uint16(msg[off:]))
+		off += 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+		if typ == dnsmessage.TypeTSIG {
+			if i != records-1 || binary.BigEndian.Uint16(msg[10:]) == 0 {
+				return 0, nil, nil, errors.New("TSIG record is not the last one")
+			}
+			start = rr
+		}
+	}
+	if off != len(msg) {
+		return 0, nil, nil, errors.New("message has the wrong length")
+	}
+	if start < 0 {
+		return 0, nil, nil, ErrUnsigned
+	}
+
+	// the name of the key is never compressed
+	name, n, err := dnsmessage.UnpackDomainName(msg[start:])
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid key name: %w", err)
+	}
+	sig, err := dnsmessage.UnpackTSIG(msg[start+n+10:])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return start, name, sig, nil
+}
+
+// skipName returns the offset after the name at off.
+func skipName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		switch l := int(msg[off]); {
+		case l == 0:
+			return off + 1, nil
+		case l&0xC0 == 0xC0:
+			return off + 2, nil
+		default:
+			off += 1 + l
+		}
+	}
+	return 0, errors.New("name is cut off")
+}
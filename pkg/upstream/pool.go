@@ -0,0 +1,182 @@
+package upstream
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"server/pkg/infra"
+)
+
+type Strategy string
+
+const (
+	// try upstreams one after another in the configured order
+	StrategySequential Strategy = "sequential"
+	// try upstreams in a random order
+	StrategyRandom Strategy = "random"
+	// start with the next upstream on every query
+	StrategyRoundRobin Strategy = "round-robin"
+	// try the upstream with the lowest smoothed RTT first
+	StrategyLowestLatency Strategy = "lowest-latency"
+	// query all upstreams at once and take the first reply
+	StrategyParallel Strategy = "parallel"
+)
+
+const (
+	DefaultTimeout     = 2 * time.Second
+	DefaultMaxFails    = 3
+	DefaultFailTimeout = 30 * time.Second
+	// longest an upstream is backed off for after repeated failures
+	DefaultMaxFailTimeout = 5 * time.Minute
+)
+
+type Config struct {
+	Addrs          []string      `yaml:"addrs"`
+	Strategy       Strategy      `yaml:"strategy"`
+	Timeout        time.Duration `yaml:"timeout"`          // per attempt
+	MaxFails       int           `yaml:"max_fails"`        // consecutive failures before an upstream is marked down
+	FailTimeout    time.Duration `yaml:"fail_timeout"`     // how long an upstream stays down, doubled on every further failure
+	MaxFailTimeout time.Duration `yaml:"max_fail_timeout"` // upper bound for the doubled fail timeout
+	TLS            TLSConfig     `yaml:"tls"`
+	DoHMethod      string        `yaml:"doh_method"` // GET or POST (default)
+}
+
+type Pool struct {
+	Upstreams []*Upstream
+	Strategy  Strategy
+	Timeout   time.Duration
+
+	next atomic.Uint64
+}
+
+// NewPool creates the upstreams of a group. Their health is tracked in
+// table which may be shared with other pools, nil means a table of its own.
+func NewPool(cfg *Config, table *infra.Table) (*Pool, error) {
+	if len(cfg.Addrs) == 0 {
+		return nil, errors.New("at least one upstream address is required")
+	}
+
+	strategy := cfg.Strategy
+	if strategy == "" {
+		strategy = StrategySequential
+	}
+	switch strategy {
+	case StrategySequential, StrategyRandom, StrategyRoundRobin, StrategyLowestLatency, StrategyParallel:
+	default:
+		return nil, fmt.Errorf("unknown upstream strategy %q", strategy)
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	maxFails := cfg.MaxFails
+	if maxFails <= 0 {
+		maxFails = DefaultMaxFails
+	}
+	failTimeout := cfg.FailTimeout
+	if failTimeout <= 0 {
+		failTimeout = DefaultFailTimeout
+	}
+	maxFailTimeout := cfg.MaxFailTimeout
+	if maxFailTimeout <= 0 {
+		maxFailTimeout = DefaultMaxFailTimeout
+	}
+	if table == nil {
+		table = infra.NewTable()
+	}
+
+	upstreams := make([]*Upstream, 0, len(cfg.Addrs))
+	for _, addr := range cfg.Addrs {
+		u, err := newUpstream(addr, &cfg.TLS, cfg.DoHMethod)
+		if err != nil {
+			return nil, err
+		}
+		u.infra = table
+		u.policy = infra.Policy{MaxFails: maxFails, Backoff: failTimeout, MaxBackoff: maxFailTimeout, Timeout: timeout}
+		upstreams = append(upstreams, u)
+	}
+
+	return &Pool{
+		Upstreams: upstreams,
+		Strategy:  strategy,
+		Timeout:   timeout,
+	}, nil
+}
+
+// Plan returns the order in which the upstreams should be tried for a
+// single query. Every element is one attempt; all upstreams within an
+// attempt are queried at the same time. Upstreams that are marked down
+// are moved to the end so that they are still tried as a last resort.
+func (p *Pool) Plan() [][]*Upstream {
+	ordered := slices.Clone(p.Upstreams)
+
+	switch p.Strategy {
+	case StrategyRandom:
+		rand.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	case StrategyRoundRobin:
+		n := int((p.next.Add(1) - 1) % uint64(len(ordered)))
+		ordered = append(ordered[n:], ordered[:n]...)
+	case StrategyLowestLatency:
+		// upstreams without measurements sort first so that they get probed
+		slices.SortStableFunc(ordered, func(a, b *Upstream) int {
+			return cmp.Compare(a.RTT(), b.RTT())
+		})
+	}
+
+	now := time.Now()
+	healthy := make([]*Upstream, 0, len(ordered))
+	down := make([]*Upstream, 0)
+	for _, u := range ordered {
+		if u.Healthy(now) {
+			healthy = append(healthy, u)
+		} else {
+			down = append(down, u)
+		}
+	}
+
+	if p.Strategy == StrategyParallel {
+		plan := [][]*Upstream{}
+		if len(healthy) > 0 {
+			plan = append(plan, healthy)
+		}
+		if len(down) > 0 {
+			plan = append(plan, down)
+		}
+		return plan
+	}
+
+	plan := make([][]*Upstream, 0, len(ordered))
+	for _, u := range append(healthy, down...) {
+		plan = append(plan, []*Upstream{u})
+	}
+	return plan
+}
+
+// Get returns the upstream with the given address if it belongs to the pool.
+func (p *Pool) Get(addr string) (*Upstream, bool) {
+	for _, u := range p.Upstreams {
+		if u.Addr == addr {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+func (p *Pool) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("strategy: %s", p.Strategy))
+	for _, u := range p.Upstreams {
+		sb.WriteString("\n  ")
+		sb.WriteString(u.String())
+	}
+	return sb.String()
+}
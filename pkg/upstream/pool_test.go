@@ -0,0 +1,199 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+
+	"server/pkg/infra"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testAddrs = []string{"127.0.0.1:5301", "127.0.0.1:5302", "127.0.0.1:5303"}
+
+func planAddrs(plan [][]*Upstream) [][]string {
+	addrs := [][]string{}
+	for _, attempt := range plan {
+		a := []string{}
+		for _, u := range attempt {
+			a = append(a, u.Addr)
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs
+}
+
+func TestNewPool(t *testing.T) {
+	p, err := NewPool(&Config{Addrs: []string{"9.9.9.9", "[2606:4700::1111]:53"}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, StrategySequential, p.Strategy)
+	assert.Equal(t, DefaultTimeout, p.Timeout)
+	assert.Equal(t, "9.9.9.9:53", p.Upstreams[0].Addr)
+	assert.Equal(t, "[2606:4700::1111]:53", p.Upstreams[1].Addr)
+
+	_, err = NewPool(&Config{}, nil)
+	assert.Error(t, err)
+
+	_, err = NewPool(&Config{Addrs: testAddrs, Strategy: "fastest"}, nil)
+	assert.Error(t, err)
+}
+
+func TestPlan(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy Strategy
+		exp      [][][]string // expected plans for consecutive calls
+	}{
+		{
+			name:     "sequential",
+			strategy: StrategySequential,
+			exp: [][][]string{
+				{{testAddrs[0]}, {testAddrs[1]}, {testAddrs[2]}},
+				{{testAddrs[0]}, {testAddrs[1]}, {testAddrs[2]}},
+			},
+		},
+		{
+			name:     "round robin",
+			strategy: StrategyRoundRobin,
+			exp: [][][]string{
+				{{testAddrs[0]}, {testAddrs[1]}, {testAddrs[2]}},
+				{{testAddrs[1]}, {testAddrs[2]}, {testAddrs[0]}},
+				{{testAddrs[2]}, {testAddrs[0]}, {testAddrs[1]}},
+			},
+		},
+		{
+			name:     "parallel",
+			strategy: StrategyParallel,
+			exp: [][][]string{
+				{testAddrs},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPool(&Config{Addrs: testAddrs, Strategy: tt.strategy}, nil)
+			assert.NoError(t, err)
+
+			for _, exp := range tt.exp {
+				assert.Equal(t, exp, planAddrs(p.Plan()))
+			}
+		})
+	}
+}
+
+func TestPlanRandom(t *testing.T) {
+	p, err := NewPool(&Config{Addrs: testAddrs, Strategy: StrategyRandom}, nil)
+	assert.NoError(t, err)
+
+	plan := planAddrs(p.Plan())
+	assert.Len(t, plan, len(testAddrs))
+	for _, addr := range testAddrs {
+		assert.Contains(t, plan, []string{addr})
+	}
+}
+
+func TestPlanLowestLatency(t *testing.T) {
+	p, err := NewPool(&Config{Addrs: testAddrs, Strategy: StrategyLowestLatency}, nil)
+	assert.NoError(t, err)
+
+	p.Upstreams[0].ReportSuccess(30 * time.Millisecond)
+	p.Upstreams[1].ReportSuccess(10 * time.Millisecond)
+	p.Upstreams[2].ReportSuccess(20 * time.Millisecond)
+
+	assert.Equal(t, [][]string{{testAddrs[1]}, {testAddrs[2]}, {testAddrs[0]}}, planAddrs(p.Plan()))
+}
+
+func TestPlanLowestLatencyNeverAnswered(t *testing.T) {
+	p, err := NewPool(&Config{Addrs: testAddrs[:2], Strategy: StrategyLowestLatency}, nil)
+	assert.NoError(t, err)
+
+	// the first upstream times out before it ever answered
+	p.Upstreams[0].ReportFailure()
+	p.Upstreams[1].ReportSuccess(30 * time.Millisecond)
+	assert.True(t, p.Upstreams[0].Healthy(time.Now()))
+	assert.Equal(t, [][]string{{testAddrs[1]}, {testAddrs[0]}}, planAddrs(p.Plan()))
+}
+
+func TestPlanMovesDownUpstreamsLast(t *testing.T) {
+	p, err := NewPool(&Config{Addrs: testAddrs, MaxFails: 2}, nil)
+	assert.NoError(t, err)
+
+	p.Upstreams[0].ReportFailure()
+	assert.True(t, p.Upstreams[0].Healthy(time.Now()))
+	assert.Equal(t, [][]string{{testAddrs[0]}, {testAddrs[1]}, {testAddrs[2]}}, planAddrs(p.Plan()))
+
+	p.Upstreams[0].ReportFailure()
+	assert.False(t, p.Upstreams[0].Healthy(time.Now()))
+	assert.True(t, p.Upstreams[0].Healthy(time.Now().Add(DefaultFailTimeout)))
+	assert.Equal(t, [][]string{{testAddrs[1]}, {testAddrs[2]}, {testAddrs[0]}}, planAddrs(p.Plan()))
+
+	p.Strategy = StrategyParallel
+	assert.Equal(t, [][]string{{testAddrs[1], testAddrs[2]}, {testAddrs[0]}}, planAddrs(p.Plan()))
+
+	// every further failure doubles the time the upstream is down
+	p.Upstreams[0].ReportFailure()
+	assert.False(t, p.Upstreams[0].Healthy(time.Now().Add(DefaultFailTimeout)))
+	assert.True(t, p.Upstreams[0].Healthy(time.Now().Add(2*DefaultFailTimeout)))
+
+	// a single success brings the upstream back
+	p.Upstreams[0].ReportSuccess(time.Millisecond)
+	assert.True(t, p.Upstreams[0].Healthy(time.Now()))
+}
+
+func TestPoolsShareInfraTable(t *testing.T) {
+	table := infra.NewTable()
+	a, err := NewPool(&Config{Addrs: testAddrs[:1], MaxFails: 1}, table)
+	assert.NoError(t, err)
+	b, err := NewPool(&Config{Addrs: testAddrs[:2]}, table)
+	assert.NoError(t, err)
+
+	a.Upstreams[0].ReportFailure()
+	assert.False(t, b.Upstreams[0].Healthy(time.Now()))
+	assert.Equal(t, [][]string{{testAddrs[1]}, {testAddrs[0]}}, planAddrs(b.Plan()))
+
+	b.Upstreams[1].ReportSuccess(5 * time.Millisecond)
+	assert.Equal(t, 5*time.Millisecond, table.RTT(testAddrs[1]))
+}
+
+func TestReportSuccessSmoothsRTT(t *testing.T) {
+	p, err := NewPool(&Config{Addrs: []string{"127.0.0.1"}}, nil)
+	assert.NoError(t, err)
+	u := p.Upstreams[0]
+
+	u.ReportSuccess(80 * time.Millisecond)
+	assert.Equal(t, 80*time.Millisecond, u.RTT())
+
+	u.ReportSuccess(0)
+	assert.Equal(t, 70*time.Millisecond, u.RTT())
+}
+
+func TestNewEncryptedUpstreams(t *testing.T) {
+	p, err := NewPool(&Config{
+		Addrs: []string{"tls://1.1.1.1#cloudflare-dns.com", "tls://9.9.9.9:8853", "8.8.8.8", "https://dns.google/dns-query"},
+		TLS:   TLSConfig{ServerName: "dns.quad9.net"},
+	}, nil)
+	assert.NoError(t, err)
+
+	assert.Equal(t, ProtocolTLS, p.Upstreams[0].Protocol)
+	assert.Equal(t, "1.1.1.1:853", p.Upstreams[0].Addr)
+	assert.NotNil(t, p.Upstreams[0].Client)
+
+	assert.Equal(t, ProtocolTLS, p.Upstreams[1].Protocol)
+	assert.Equal(t, "9.9.9.9:8853", p.Upstreams[1].Addr)
+
+	assert.Equal(t, ProtocolUDP, p.Upstreams[2].Protocol)
+	assert.Nil(t, p.Upstreams[2].Client)
+
+	assert.Equal(t, ProtocolHTTPS, p.Upstreams[3].Protocol)
+	assert.Equal(t, "https://dns.google/dns-query", p.Upstreams[3].Addr)
+	assert.NotNil(t, p.Upstreams[3].Client)
+
+	_, err = NewPool(&Config{Addrs: []string{"https://dns.google/dns-query"}, DoHMethod: "PUT"}, nil)
+	assert.Error(t, err)
+
+	_, err = NewPool(&Config{
+		Addrs: []string{"tls://1.1.1.1"},
+		TLS:   TLSConfig{CAFile: "/does/not/exist.pem"},
+	}, nil)
+	assert.Error(t, err)
+}
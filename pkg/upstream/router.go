@@ -0,0 +1,72 @@
+package upstream
+
+import (
+	"fmt"
+	"strings"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/infra"
+	"server/pkg/nametree"
+)
+
+// Rule sends queries for names at or below Suffix to the upstream group Group.
+type Rule struct {
+	Suffix string `yaml:"suffix"`
+	Group  string `yaml:"group"`
+}
+
+// Router selects the upstream pool for a query by the longest
+// matching suffix rule and falls back to the default pool.
+type Router struct {
+	Default *Pool
+	Groups  map[string]*Pool
+	routes  *nametree.Tree[*Pool]
+}
+
+// NewRouter creates the pools of all groups. The health of their
+// upstreams is tracked in table, see NewPool.
+func NewRouter(def *Config, groups map[string]Config, rules []Rule, table *infra.Table) (*Router, error) {
+	if table == nil {
+		table = infra.NewTable()
+	}
+
+	defPool, err := NewPool(def, table)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default upstream group: %w", err)
+	}
+
+	r := Router{
+		Default: defPool,
+		Groups:  make(map[string]*Pool, len(groups)),
+		routes:  nametree.New[*Pool](),
+	}
+	for name, cfg := range groups {
+		pool, err := NewPool(&cfg, table)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream group %q: %w", name, err)
+		}
+		r.Groups[name] = pool
+	}
+
+	for _, rule := range rules {
+		pool, ok := r.Groups[rule.Group]
+		if !ok {
+			return nil, fmt.Errorf("forwarding rule for %q refers to unknown upstream group %q", rule.Suffix, rule.Group)
+		}
+		suffix := dnsmessage.ParseDomainName(strings.TrimPrefix(rule.Suffix, "."))
+		if _, ok := r.routes.Get(suffix); !ok {
+			// the first rule for a suffix wins
+			r.routes.Insert(suffix, pool)
+		}
+	}
+
+	return &r, nil
+}
+
+// Route returns the pool responsible for the given name.
+func (r *Router) Route(name dnsmessage.DomainName) *Pool {
+	if pool, ok := r.routes.Match(name); ok {
+		return pool
+	}
+	return r.Default
+}
@@ -0,0 +1,60 @@
+package upstream
+
+import (
+	"testing"
+
+	"server/pkg/dnsmessage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoute(t *testing.T) {
+	r, err := NewRouter(
+		&Config{Addrs: []string{"1.1.1.1"}},
+		map[string]Config{
+			"office":  {Addrs: []string{"10.0.0.53"}},
+			"router":  {Addrs: []string{"192.168.2.1"}},
+			"reverse": {Addrs: []string{"10.0.0.54"}},
+			"lab":     {Addrs: []string{"10.1.0.53"}},
+		},
+		[]Rule{
+			{Suffix: ".corp.internal", Group: "office"},
+			{Suffix: "lab.corp.internal.", Group: "lab"},
+			{Suffix: "lan", Group: "router"},
+			{Suffix: "10.in-addr.arpa", Group: "reverse"},
+		},
+		nil,
+	)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name string
+		exp  string
+	}{
+		{name: "wiki.corp.internal", exp: "10.0.0.53:53"},
+		{name: "corp.internal", exp: "10.0.0.53:53"},
+		{name: "WIKI.Corp.Internal", exp: "10.0.0.53:53"},
+		{name: "printer.lab.corp.internal", exp: "10.1.0.53:53"},
+		{name: "nas.lan", exp: "192.168.2.1:53"},
+		{name: "4.3.2.10.in-addr.arpa", exp: "10.0.0.54:53"},
+		{name: "4.3.2.11.in-addr.arpa", exp: "1.1.1.1:53"},
+		{name: "notcorp.internal", exp: "1.1.1.1:53"},
+		{name: "kristina.pianykh.xyz", exp: "1.1.1.1:53"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := r.Route(dnsmessage.ParseDomainName(tt.name))
+			assert.Equal(t, tt.exp, pool.Upstreams[0].Addr)
+		})
+	}
+}
+
+func TestNewRouterUnknownGroup(t *testing.T) {
+	_, err := NewRouter(
+		&Config{Addrs: []string{"1.1.1.1"}},
+		nil,
+		[]Rule{{Suffix: "lan", Group: "router"}},
+		nil,
+	)
+	assert.Error(t, err)
+}
@@ -0,0 +1,200 @@
+package upstream
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"server/pkg/infra"
+	"server/pkg/log"
+	"server/pkg/transport"
+)
+
+const (
+	ProtocolUDP   = "udp"
+	ProtocolTLS   = "tls"
+	ProtocolHTTPS = "https"
+)
+
+const (
+	defaultPort    = "53"
+	defaultTLSPort = "853"
+)
+
+// Exchanger sends a query over its own connection and returns the reply.
+// Upstreams reached over plain UDP don't have one, their replies
+// arrive on the listener socket instead.
+type Exchanger interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// TLSConfig holds the defaults for upstreams of a group reached over TLS or HTTPS.
+type TLSConfig struct {
+	ServerName string   `yaml:"server_name"`
+	SPKIPins   []string `yaml:"spki_pins"`
+	CAFile     string   `yaml:"ca_file"` // PEM bundle to use instead of the system roots
+}
+
+// Upstream is a single resolver queries are forwarded to
+// together with the health state we keep for it.
+type Upstream struct {
+	Addr     string
+	Protocol string
+	Client   Exchanger
+
+	infra  *infra.Table
+	policy infra.Policy
+}
+
+// newUpstream parses an upstream address. Plain addresses are reached over
+// UDP, "tls://host[:port][#name]" over DNS over TLS where the optional name
+// is the one to verify the certificate against and "https://..." URLs
+// over DNS over HTTPS.
+func newUpstream(addr string, tlsCfg *TLSConfig, dohMethod string) (*Upstream, error) {
+	if rest, ok := strings.CutPrefix(addr, "tls://"); ok {
+		return newTLSUpstream(rest, tlsCfg)
+	}
+	if strings.HasPrefix(addr, "https://") {
+		return newHTTPSUpstream(addr, tlsCfg, dohMethod)
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, defaultPort)
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream address %q: %w", addr, err)
+	}
+
+	return &Upstream{
+		// keep the resolved form so that it can be compared
+		// against the source address of replies
+		Addr:     udpAddr.String(),
+		Protocol: ProtocolUDP,
+	}, nil
+}
+
+func newTLSUpstream(addr string, tlsCfg *TLSConfig) (*Upstream, error) {
+	addr, serverName, _ := strings.Cut(addr, "#")
+	if serverName == "" {
+		serverName = tlsCfg.ServerName
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, defaultTLSPort)
+	}
+
+	roots, err := loadRoots(tlsCfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := transport.NewDoTClient(transport.DoTConfig{
+		Addr:       addr,
+		ServerName: serverName,
+		SPKIPins:   tlsCfg.SPKIPins,
+		RootCAs:    roots,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Upstream{
+		Addr:     addr,
+		Protocol: ProtocolTLS,
+		Client:   client,
+	}, nil
+}
+
+func newHTTPSUpstream(addr string, tlsCfg *TLSConfig, method string) (*Upstream, error) {
+	roots, err := loadRoots(tlsCfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := transport.NewDoHClient(transport.DoHConfig{
+		URL:     addr,
+		Method:  strings.ToUpper(method),
+		RootCAs: roots,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Upstream{
+		Addr:     addr,
+		Protocol: ProtocolHTTPS,
+		Client:   client,
+	}, nil
+}
+
+// loadRoots reads a PEM bundle, no file means the system roots.
+func loadRoots(caFile string) (*x509.CertPool, error) {
+	if caFile == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+	}
+	return roots, nil
+}
+
+// Healthy reports whether the upstream is not backed off.
+func (u *Upstream) Healthy(now time.Time) bool {
+	return u.infra.Healthy(u.Addr, now)
+}
+
+// RTT returns the smoothed round trip time measured so far
+// or 0 if the upstream has never answered.
+func (u *Upstream) RTT() time.Duration {
+	return u.infra.RTT(u.Addr)
+}
+
+// ReportSuccess resets the failure counter and folds the measured
+// round trip time into the smoothed value.
+func (u *Upstream) ReportSuccess(rtt time.Duration) {
+	u.infra.Success(u.Addr, rtt)
+}
+
+// ReportFailure counts a timeout or a SERVFAIL. After maxFails consecutive
+// failures the upstream is considered down for failTimeout, which doubles
+// with every further failure.
+func (u *Upstream) ReportFailure() {
+	u.infra.Failure(u.Addr, u.policy)
+}
+
+// RandomizeCase reports whether the case of the question name in queries
+// to the upstream should be randomized. It is only done over plain UDP,
+// encryption already protects the other protocols against spoofing.
+func (u *Upstream) RandomizeCase() bool {
+	return u.Protocol == ProtocolUDP && u.infra.RandomizeCase(u.Addr)
+}
+
+// ReportCase records whether a reply echoed the randomized question name
+// with exactly the same case.
+func (u *Upstream) ReportCase(preserved bool) {
+	if preserved {
+		u.infra.CasePreserved(u.Addr)
+		return
+	}
+	if u.infra.CaseMismatch(u.Addr) {
+		log.Warn("upstream %s doesn't preserve the case of question names, no longer randomizing it", u.Addr)
+	}
+}
+
+func (u *Upstream) String() string {
+	s := u.infra.Stats(u.Addr)
+	if u.Protocol == ProtocolHTTPS {
+		return fmt.Sprintf("%s (failures: %d, rtt: %s)", u.Addr, s.Consecutive, s.SRTT)
+	}
+	return fmt.Sprintf("%s://%s (failures: %d, rtt: %s)", u.Protocol, u.Addr, s.Consecutive, s.SRTT)
+}
@@ -0,0 +1,37 @@
+package zone
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// ACL lists the networks of the clients allowed to do something with a zone.
+type ACL []netip.Prefix
+
+// ParseACL reads addresses and CIDRs like "192.0.2.1" or "2001:db8::/32".
+func ParseACL(entries []string) (ACL, error) {
+	acl := make(ACL, 0, len(entries))
+	for _, e := range entries {
+		prefix, err := netip.ParsePrefix(e)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(e)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid address or network %q: %w", e, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		acl = append(acl, prefix.Masked())
+	}
+	return acl, nil
+}
+
+// Allows reports whether the address is in one of the networks.
+func (a ACL) Allows(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range a {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,263 @@
+package zone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"time"
+
+	"server/pkg/dnsmessage"
+	dnsparser "server/pkg/parser"
+	"server/pkg/transport"
+	"server/pkg/tsig"
+)
+
+const (
+	// time allowed for a whole transfer if the context has no deadline
+	transferTimeout = time.Minute
+	// a NOTIFY is sent again if the secondary doesn't answer in time
+	// (RFC 1996, section 3.6)
+	notifyTimeout  = 2 * time.Second
+	notifyAttempts = 5
+)
+
+// Transfer fetches the zone with the origin from the primary at addr over
+// TCP. With the current version of the zone it asks for the changes since
+// (IXFR) and otherwise for the whole zone (AXFR). It returns current if the
+// primary has nothing newer. With a key, the query and every message of
+// the answer are signed.
+func Transfer(ctx context.Context, addr string, origin dnsmessage.DomainName, current *Zone, key *tsig.Key) (*Zone, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, transferTimeout)
+		defer cancel()
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	query := dnsmessage.DNSMessage{
+		Header:   &dnsmessage.Header{ID: uint32(rand.N(0x10000))},
+		Question: &dnsmessage.Question{QName: origin, QType: dnsmessage.TypeAXFR, QClass: dnsmessage.ClassIN},
+	}
+	if current != nil {
+		query.Question.QType = dnsmessage.TypeIXFR
+		query.Question.QClass = current.Class
+		query.AuthorityRecords = dnsmessage.ResourceRecords{current.SOA()}
+	}
+	data, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	var session *tsig.Session
+	if key != nil {
+		data, session = key.SignRequest(data, time.Now())
+	}
+	if err := transport.WriteMessage(conn, data); err != nil {
+		return nil, err
+	}
+
+	var records dnsmessage.ResourceRecords
+	for !transferComplete(records, current) {
+		data, err := transport.ReadMessage(conn)
+		if err != nil {
+			return nil, fmt.Errorf("transfer ended early: %w", err)
+		}
+		if session != nil {
+			if err := session.Verify(data, time.Now()); err != nil {
+				return nil, err
+			}
+		}
+		p, err := dnsparser.NewParser(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.ParseMessage(); err != nil {
+			return nil, err
+		}
+		m := p.Message
+		if m.Header.ID != query.Header.ID || m.IsQuery() {
+			return nil, errors.New("the reply doesn't match the query")
+		}
+		if m.Header.RCode != dnsmessage.RCodeNoError {
+			return nil, fmt.Errorf("the primary answered %s", m.Header.RCode)
+		}
+		if len(m.Answers) == 0 {
+			return nil, errors.New("the primary sent no records")
+		}
+		for _, rr := range m.Answers {
+			if rr.Type != dnsmessage.TypeSOA {
+				continue
+			}
+			// serial() relies on it
+			if _, err := dnsmessage.UnpackSOA(rr.RData); err != nil {
+				return nil, fmt.Errorf("invalid SOA record: %w", err)
+			}
+		}
+		records = append(records, m.Answers...)
+		if records[0].Type != dnsmessage.TypeSOA || !dnsmessage.EqualNames(records[0].Name, origin) {
+			return nil, errors.New("the transfer doesn't start with the SOA of the zone")
+		}
+	}
+	return transferred(origin, records, current)
+}
+
+// transferComplete reports whether the records make up a whole transfer.
+// It ends with the SOA it starts with (RFC 5936, section 2.2), in an
+// incremental transfer at the place the next change would start
+// (RFC 1995, section 4).
+func transferComplete(records dnsmessage.ResourceRecords, current *Zone) bool {
+	if len(records) == 0 {
+		return false
+	}
+	if current != nil && !serialLess(current.Serial(), serial(records[0])) {
+		// nothing newer
+		return true
+	}
+	if len(records) < 2 {
+		return false
+	}
+	last := records[len(records)-1]
+	if last.Type != dnsmessage.TypeSOA || serial(last) != serial(records[0]) {
+		return false
+	}
+	if records[1].Type != dnsmessage.TypeSOA {
+		return true
+	}
+	// the SOA records of the changes come in pairs before the last one
+	soas := 0
+	for _, rr := range records[1:] {
+		if rr.Type == dnsmessage.TypeSOA {
+			soas++
+		}
+	}
+	return soas%2 == 1
+}
+
+// transferred builds the zone from the records of a complete transfer.
+func transferred(origin dnsmessage.DomainName, records dnsmessage.ResourceRecords, current *Zone) (*Zone, error) {
+	if current != nil && !serialLess(current.Serial(), serial(records[0])) {
+		return current, nil
+	}
+	if records[1].Type != dnsmessage.TypeSOA || current == nil {
+		// the whole zone
+		return New(origin, records[:len(records)-1])
+	}
+
+	diffs, err := splitDiffs(records[1 : len(records)-1])
+	if err != nil {
+		return nil, err
+	}
+	z := current
+	for _, d := range diffs {
+		next, err := z.apply(d)
+		if err != nil {
+			return nil, err
+		}
+		z = next
+	}
+	return z, nil
+}
+
+// apply returns the zone with the changes of the diff,
+// which has to start at the serial of the zone.
+func (z *Zone) apply(d *Diff) (*Zone, error) {
+	if serial(d.OldSOA) != z.Serial() {
+		return nil, fmt.Errorf("change from serial %d doesn't apply to serial %d", serial(d.OldSOA), z.Serial())
+	}
+	// the TTL doesn't tell records apart
+	key := func(rr *dnsmessage.ResourceRecord) string {
+		return fmt.Sprintf("%s/%d/%x", nameKey(rr.Name), rr.Type, rr.RData)
+	}
+	deleted := make(map[string]bool, len(d.Deleted))
+	for _, rr := range d.Deleted {
+		deleted[key(rr)] = true
+	}
+
+	records := dnsmessage.ResourceRecords{d.NewSOA}
+	for _, rr := range z.records[1:] {
+		if !deleted[key(rr)] {
+			records = append(records, rr)
+		}
+	}
+	return z.derive(append(records, d.Added...))
+}
+
+// Notify tells the secondary at addr that the zone changed (RFC 1996).
+// It returns once the secondary acknowledged it. With a key, the NOTIFY is
+// signed and so has to be the acknowledgement.
+func Notify(ctx context.Context, addr string, z *Zone, key *tsig.Key) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	query := dnsmessage.DNSMessage{
+		Header:   &dnsmessage.Header{ID: uint32(rand.N(0x10000)), OpCode: dnsmessage.OpCodeNotify, AA: 1},
+		Question: &dnsmessage.Question{QName: z.Origin, QType: dnsmessage.TypeSOA, QClass: z.Class},
+		Answers:  dnsmessage.ResourceRecords{z.SOA()},
+	}
+	data, err := query.Pack()
+	if err != nil {
+		return err
+	}
+	var session *tsig.Session
+	if key != nil {
+		data, session = key.SignRequest(data, time.Now())
+	}
+
+	buf := make([]byte, dnsmessage.MaxMessageLength)
+	for range notifyAttempts {
+		if _, err := conn.Write(data); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(notifyTimeout)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		_ = conn.SetReadDeadline(deadline)
+
+		for {
+			n, err := conn.Read(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			p, err := dnsparser.NewParser(buf[:n])
+			if err != nil || p.ParseMessage() != nil {
+				continue
+			}
+			m := p.Message
+			if m.Header.ID != query.Header.ID || m.IsQuery() || m.Header.OpCode != dnsmessage.OpCodeNotify {
+				continue
+			}
+			if session != nil {
+				if err := session.Verify(buf[:n], time.Now()); err != nil {
+					return err
+				}
+			}
+			if m.Header.RCode != dnsmessage.RCodeNoError {
+				return fmt.Errorf("the secondary answered %s", m.Header.RCode)
+			}
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return errors.New("the secondary didn't answer")
+}
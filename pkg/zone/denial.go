@@ -0,0 +1,205 @@
+package zone
+
+import (
+	"bytes"
+	"encoding/base32"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/dnssec"
+)
+
+// hashedRecord is an NSEC3 record with the hash its owner name encodes.
+type hashedRecord struct {
+	hash  []byte
+	nsec3 *dnsmessage.NSEC3
+	rr    *dnsmessage.ResourceRecord
+}
+
+// indexDenial sorts the NSEC and NSEC3 records of the zone for
+// the proofs of nonexistence, see nsecFor and nsec3For.
+func (z *Zone) indexDenial() error {
+	for _, rr := range z.records {
+		switch rr.Type {
+		case dnsmessage.TypeNSEC:
+			z.nsecs = append(z.nsecs, rr)
+		case dnsmessage.TypeNSEC3:
+			if len(rr.Name) != len(z.Origin)+1 {
+				continue
+			}
+			nsec3, err := dnsmessage.UnpackNSEC3(rr.RData)
+			if err != nil {
+				return fmt.Errorf("invalid NSEC3 record %s: %w", nameString(rr.Name), err)
+			}
+			hash, err := base32.HexEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(string(rr.Name[0])))
+			if err != nil {
+				return fmt.Errorf("invalid NSEC3 owner %s: %w", nameString(rr.Name), err)
+			}
+			z.nsec3s = append(z.nsec3s, hashedRecord{hash: hash, nsec3: nsec3, rr: rr})
+		}
+	}
+	slices.SortFunc(z.nsecs, func(a, b *dnsmessage.ResourceRecord) int { return dnssec.CompareNames(a.Name, b.Name) })
+	slices.SortFunc(z.nsec3s, func(a, b hashedRecord) int { return bytes.Compare(a.hash, b.hash) })
+	return nil
+}
+
+// signatures returns the RRSIG records covering the RRset of the name.
+func (z *Zone) signatures(name dnsmessage.DomainName, typ dnsmessage.RRType) dnsmessage.ResourceRecords {
+	n := z.lookup(name)
+	if n == nil {
+		return nil
+	}
+	var sigs dnsmessage.ResourceRecords
+	for _, rr := range n.rrsets[dnsmessage.TypeRRSIG] {
+		if len(rr.RData) >= 2 && dnsmessage.RRType(uint16(rr.RData[0])<<8|uint16(rr.RData[1])) == typ {
+			sigs = append(sigs, rr)
+		}
+	}
+	return sigs
+}
+
+// signed returns the records with their signatures.
+func (z *Zone) signed(rrset dnsmessage.ResourceRecords) dnsmessage.ResourceRecords {
+	if len(rrset) == 0 {
+		return nil
+	}
+	return append(slices.Clone(rrset), z.signatures(rrset[0].Name, rrset[0].Type)...)
+}
+
+// nsecFor returns the NSEC record of the name or the one covering it.
+// The apex comes first in canonical order, so there always is one.
+func (z *Zone) nsecFor(name dnsmessage.DomainName) *dnsmessage.ResourceRecord {
+	i := sort.Search(len(z.nsecs), func(i int) bool { return dnssec.CompareNames(z.nsecs[i].Name, name) > 0 })
+	return z.nsecs[max(i-1, 0)]
+}
+
+// nsec3For returns the NSEC3 record matching the hash of the name or
+// covering it, and whether it matches. The last record covers the hashes
+// before the first one.
+func (z *Zone) nsec3For(name dnsmessage.DomainName) (*dnsmessage.ResourceRecord, bool) {
+	param := z.nsec3s[0].nsec3
+	hash := dnssec.HashName(name, param.Salt, param.Iterations)
+	i := sort.Search(len(z.nsec3s), func(i int) bool { return bytes.Compare(z.nsec3s[i].hash, hash) > 0 })
+	if i == 0 {
+		i = len(z.nsec3s)
+	}
+	h := z.nsec3s[i-1]
+	return h.rr, bytes.Equal(h.hash, hash)
+}
+
+// closestEncloser returns the longest name above the name that exists.
+func (z *Zone) closestEncloser(name dnsmessage.DomainName) dnsmessage.DomainName {
+	for i := 1; i < len(name)-len(z.Origin); i++ {
+		if z.lookup(name[i:]) != nil {
+			return name[i:]
+		}
+	}
+	return z.Origin
+}
+
+// nextCloser is the name one label longer than the closest encloser.
+func nextCloser(name, encloser dnsmessage.DomainName) dnsmessage.DomainName {
+	return name[len(name)-len(encloser)-1:]
+}
+
+func wildcardOf(name dnsmessage.DomainName) dnsmessage.DomainName {
+	return append(dnsmessage.Domain("*"), name...)
+}
+
+// proof returns the NSEC or NSEC3 records with their signatures,
+// each record once.
+func (z *Zone) proof(records ...*dnsmessage.ResourceRecord) dnsmessage.ResourceRecords {
+	var proof dnsmessage.ResourceRecords
+	for _, rr := range records {
+		if !slices.Contains(proof, rr) {
+			proof = append(proof, z.signed(dnsmessage.ResourceRecords{rr})...)
+		}
+	}
+	return proof
+}
+
+// closestEncloserProof proves the closest encloser of the name and that
+// the next closer name doesn't exist (RFC 5155, section 7.2.1).
+func (z *Zone) closestEncloserProof(name dnsmessage.DomainName) (dnsmessage.DomainName, []*dnsmessage.ResourceRecord) {
+	encloser := z.closestEncloser(name)
+	// a name left out with opt-out has no record of its own
+	for len(encloser) > len(z.Origin) {
+		if _, ok := z.nsec3For(encloser); ok {
+			break
+		}
+		encloser = encloser[1:]
+	}
+	match, _ := z.nsec3For(encloser)
+	cover, _ := z.nsec3For(nextCloser(name, encloser))
+	return encloser, []*dnsmessage.ResourceRecord{match, cover}
+}
+
+// noName proves that the name doesn't exist and no wildcard
+// matches it (RFC 4035, section 3.1.3.2 and RFC 5155, section 7.2.2).
+func (z *Zone) noName(name dnsmessage.DomainName) dnsmessage.ResourceRecords {
+	switch {
+	case len(z.nsec3s) > 0:
+		encloser, records := z.closestEncloserProof(name)
+		wildcard, _ := z.nsec3For(wildcardOf(encloser))
+		return z.proof(append(records, wildcard)...)
+	case len(z.nsecs) > 0:
+		return z.proof(z.nsecFor(name), z.nsecFor(wildcardOf(z.closestEncloser(name))))
+	}
+	return nil
+}
+
+// noData proves that the name has no records of the type, the name
+// matched by the node if it is a wildcard (RFC 4035, section 3.1.3.1
+// and 3.1.3.4, RFC 5155, section 7.2.3 to 7.2.5).
+func (z *Zone) noData(n *node, name dnsmessage.DomainName) dnsmessage.ResourceRecords {
+	wildcard := !dnsmessage.EqualNames(n.name, name)
+	switch {
+	case len(z.nsec3s) > 0:
+		if wildcard {
+			_, records := z.closestEncloserProof(name)
+			match, _ := z.nsec3For(n.name)
+			return z.proof(append(records, match)...)
+		}
+		if match, ok := z.nsec3For(name); ok {
+			return z.proof(match)
+		}
+		// a delegation left out with opt-out
+		_, records := z.closestEncloserProof(name)
+		return z.proof(records...)
+	case len(z.nsecs) > 0:
+		if wildcard {
+			return z.proof(z.nsecFor(name), z.nsecFor(n.name))
+		}
+		return z.proof(z.nsecFor(name))
+	}
+	return nil
+}
+
+// expanded proves that no closer name than the wildcard of the node
+// matches the name of an answer synthesized from it (RFC 4035, section
+// 3.1.3.3 and RFC 5155, section 7.2.6).
+func (z *Zone) expanded(n *node, name dnsmessage.DomainName) dnsmessage.ResourceRecords {
+	if dnsmessage.EqualNames(n.name, name) {
+		return nil
+	}
+	switch {
+	case len(z.nsec3s) > 0:
+		cover, _ := z.nsec3For(nextCloser(name, n.name[1:]))
+		return z.proof(cover)
+	case len(z.nsecs) > 0:
+		return z.proof(z.nsecFor(name))
+	}
+	return nil
+}
+
+// delegation returns the DS records of a referral or the proof that
+// there are none, the child zone is unsigned then (RFC 4035, section 3.1.4).
+func (z *Zone) delegation(cut *node) dnsmessage.ResourceRecords {
+	if ds := cut.rrsets[dnsmessage.TypeDS]; len(ds) > 0 {
+		return z.signed(ds)
+	}
+	return z.noData(cut, cut.name)
+}
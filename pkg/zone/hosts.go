@@ -0,0 +1,35 @@
+package zone
+
+import (
+	"net/netip"
+
+	"server/pkg/dnsmessage"
+)
+
+// indexHosts maps the addresses of the A and AAAA records to the records
+// for reverse lookups. Glue and wildcards don't name a host of the zone.
+func (z *Zone) indexHosts() {
+	z.hosts = make(map[netip.Addr]dnsmessage.ResourceRecords)
+	for _, rr := range z.records {
+		if rr.Type != dnsmessage.TypeA && rr.Type != dnsmessage.TypeAAAA {
+			continue
+		}
+		if len(rr.Name) > len(z.Origin) && string(rr.Name[0]) == "*" {
+			continue
+		}
+		if z.zoneCut(rr.Name, rr.Type) != nil {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(rr.RData)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+		z.hosts[addr] = append(z.hosts[addr], rr)
+	}
+}
+
+// Hosts returns the A and AAAA records of the zone with the address.
+func (z *Zone) Hosts(addr netip.Addr) dnsmessage.ResourceRecords {
+	return z.hosts[addr.Unmap()]
+}
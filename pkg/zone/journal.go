@@ -0,0 +1,134 @@
+package zone
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"server/pkg/dnsmessage"
+)
+
+// journalPath returns the file next to the master file
+// that keeps the updates of the zone.
+func journalPath(file string) string {
+	return file + ".jnl"
+}
+
+func masterPath(journal string) string {
+	return strings.TrimSuffix(journal, ".jnl")
+}
+
+// appendJournal adds the change to the journal at path. The journal holds
+// the changes as records in master file format, each one like in an
+// incremental transfer: the old SOA, the deleted records, the new SOA and
+// the added records.
+func appendJournal(path string, d *Diff) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := writeDiffs(f, []*Diff{d}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rewriteJournal replaces the journal at path by one with the changes.
+// The new journal is written next to it first, so that a crash leaves
+// either of them.
+func rewriteJournal(path string, diffs []*Diff) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if err := writeDiffs(f, diffs); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func writeDiffs(f *os.File, diffs []*Diff) error {
+	bw := bufio.NewWriter(f)
+	for _, d := range diffs {
+		writeDiff(bw, d)
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func writeDiff(w io.Writer, d *Diff) {
+	records := append(append(append(dnsmessage.ResourceRecords{d.OldSOA}, d.Deleted...), d.NewSOA), d.Added...)
+	for _, rr := range records {
+		fmt.Fprintln(w, recordLine(rr))
+	}
+}
+
+// readJournal returns the changes in the journal at path, none if
+// there is no journal.
+func readJournal(path string) ([]*Diff, error) {
+	records, err := ParseFile(path, nil)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return splitDiffs(records)
+}
+
+// compactJournal keeps the journal from growing with every change. The
+// last maxJournal changes are kept for incremental transfers, the older
+// ones are folded into a single change from the zone in the master file,
+// which a restart starts out from.
+func (z *Zone) compactJournal() error {
+	diffs, err := readJournal(z.journalFile)
+	if err != nil {
+		return err
+	}
+	if len(diffs) <= maxJournal {
+		return nil
+	}
+	records, err := ParseFile(masterPath(z.journalFile), z.Origin)
+	if err != nil {
+		return err
+	}
+	// replayed without signing like in Load, the signatures are in the changes
+	base, err := New(z.Origin, records)
+	if err != nil {
+		return err
+	}
+
+	// changes to an older serial than the master file's are gone for good
+	folded := base
+	old, kept := diffs[:len(diffs)-maxJournal], diffs[len(diffs)-maxJournal:]
+	for _, d := range old {
+		if serial(d.OldSOA) != folded.Serial() {
+			continue
+		}
+		if folded, err = folded.apply(d); err != nil {
+			return err
+		}
+	}
+	if folded != base {
+		kept = append([]*Diff{NewDiff(base, folded)}, kept...)
+	}
+	return rewriteJournal(z.journalFile, kept)
+}
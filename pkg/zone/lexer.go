@@ -0,0 +1,151 @@
+package zone
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+type token struct {
+	text   string // escapes are kept, they are decoded with the field
+	quoted bool
+}
+
+// entry is a directive or a record, possibly spread over several
+// lines by parentheses.
+type entry struct {
+	line     int // where the entry starts
+	tokens   []token
+	indented bool // starts with white space, the owner is the previous one
+}
+
+// lexer splits a zone file into entries (RFC 1035, section 5.1).
+type lexer struct {
+	r    *bufio.Reader
+	line int
+}
+
+func newLexer(r io.Reader) *lexer {
+	return &lexer{r: bufio.NewReader(r), line: 1}
+}
+
+// lexError is an error at a line, the parser adds the file name.
+type lexError struct {
+	line int
+	err  error
+}
+
+func (e *lexError) Error() string {
+	return e.err.Error()
+}
+
+// next returns the next entry or io.EOF after the last one.
+func (l *lexer) next() (*entry, error) {
+	e := &entry{line: l.line}
+	var text strings.Builder
+	inToken, quoted, inQuote := false, false, false
+	parens := 0
+	lineStart := true
+
+	endToken := func() {
+		if inToken {
+			e.tokens = append(e.tokens, token{text: text.String(), quoted: quoted})
+		}
+		text.Reset()
+		inToken, quoted = false, false
+	}
+	fail := func(msg string) (*entry, error) {
+		return nil, &lexError{line: l.line, err: errors.New(msg)}
+	}
+
+	for {
+		c, err := l.r.ReadByte()
+		if err == io.EOF {
+			if inQuote {
+				return fail("unterminated quoted string")
+			}
+			if parens > 0 {
+				return nil, &lexError{line: e.line, err: errors.New("unbalanced parentheses")}
+			}
+			endToken()
+			if len(e.tokens) == 0 {
+				return nil, io.EOF
+			}
+			return e, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if lineStart && len(e.tokens) == 0 && !inToken {
+			e.line = l.line
+			e.indented = c == ' ' || c == '\t'
+		}
+		lineStart = false
+
+		switch {
+		case c == '\\':
+			// the escaped character is taken as it is, even a newline
+			next, err := l.r.ReadByte()
+			if err != nil {
+				return fail("escape at the end of the file")
+			}
+			if next == '\n' {
+				l.line++
+			}
+			text.WriteByte(c)
+			text.WriteByte(next)
+			inToken = true
+
+		case inQuote && c == '"':
+			inQuote = false
+			endToken()
+
+		case inQuote && c == '\n':
+			return fail("unterminated quoted string")
+
+		case inQuote:
+			text.WriteByte(c)
+
+		case c == '"':
+			endToken()
+			inQuote, inToken, quoted = true, true, true
+
+		case c == ';':
+			endToken()
+			if _, err := l.r.ReadString('\n'); err == nil {
+				_ = l.r.UnreadByte()
+			}
+
+		case c == '(':
+			endToken()
+			parens++
+
+		case c == ')':
+			endToken()
+			if parens == 0 {
+				return fail("unbalanced parentheses")
+			}
+			parens--
+
+		case c == '\n':
+			endToken()
+			l.line++
+			lineStart = true
+			if parens == 0 && len(e.tokens) > 0 {
+				return e, nil
+			}
+			if parens == 0 {
+				e.indented = false
+			}
+
+		case c == ' ' || c == '\t' || c == '\r':
+			endToken()
+
+		default:
+			text.WriteByte(c)
+			inToken = true
+		}
+	}
+}
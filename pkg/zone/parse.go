@@ -0,0 +1,389 @@
+package zone
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"server/pkg/dnsmessage"
+)
+
+// $INCLUDE nesting allowed, it stops include loops
+const maxIncludeDepth = 8
+
+// ParseError tells where in which file parsing failed.
+type ParseError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+type parser struct {
+	file   string
+	origin dnsmessage.DomainName // nil if there is none yet
+	owner  dnsmessage.DomainName // of the previous record
+	class  dnsmessage.RRClass
+
+	defaultTTL    uint32 // from $TTL
+	hasDefaultTTL bool
+	lastTTL       uint32 // of the previous record
+	hasLastTTL    bool
+
+	depth   int
+	records dnsmessage.ResourceRecords
+}
+
+// ParseFile reads the master file at path (RFC 1035, section 5). Relative
+// names are completed with origin until a $ORIGIN directive changes it,
+// origin may be nil if the file sets it itself.
+func ParseFile(path string, origin dnsmessage.DomainName) (dnsmessage.ResourceRecords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f, path, origin)
+}
+
+// Parse reads a master file from r. The name of the file is used in
+// errors and files in $INCLUDE directives are relative to it.
+func Parse(r io.Reader, file string, origin dnsmessage.DomainName) (dnsmessage.ResourceRecords, error) {
+	p := &parser{file: file, origin: origin}
+	if err := p.parse(r); err != nil {
+		return nil, err
+	}
+	return p.records, nil
+}
+
+func (p *parser) parse(r io.Reader) error {
+	l := newLexer(r)
+	for {
+		e, err := l.next()
+		if err == io.EOF {
+			return nil
+		}
+		var lexErr *lexError
+		if errors.As(err, &lexErr) {
+			return &ParseError{File: p.file, Line: lexErr.line, Err: lexErr.err}
+		}
+		if err != nil {
+			return &ParseError{File: p.file, Line: l.line, Err: err}
+		}
+
+		if err := p.entry(e); err != nil {
+			var parseErr *ParseError
+			if errors.As(err, &parseErr) {
+				// from an included file
+				return err
+			}
+			return &ParseError{File: p.file, Line: e.line, Err: err}
+		}
+	}
+}
+
+func (p *parser) entry(e *entry) error {
+	tokens := e.tokens
+	if !e.indented && !tokens[0].quoted && strings.HasPrefix(tokens[0].text, "$") {
+		return p.directive(tokens)
+	}
+
+	rr := &dnsmessage.ResourceRecord{}
+	if e.indented {
+		if p.owner == nil {
+			return errors.New("no owner name for the record")
+		}
+		rr.Name = p.owner
+	} else {
+		name, err := p.name(tokens[0])
+		if err != nil {
+			return fmt.Errorf("invalid owner name: %w", err)
+		}
+		rr.Name = name
+		tokens = tokens[1:]
+	}
+
+	// the TTL and the class come in any order before the type
+	hasTTL, hasClass := false, false
+	for len(tokens) > 0 {
+		t := tokens[0].text
+		if ttl, err := parseTTL(t); err == nil && !hasTTL && !tokens[0].quoted {
+			rr.TTL, hasTTL = ttl, true
+		} else if class, ok := dnsmessage.ParseRRClass(t); ok && !hasClass && !tokens[0].quoted {
+			rr.Class, hasClass = class, true
+		} else {
+			break
+		}
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return errors.New("missing record type")
+	}
+	typ, ok := dnsmessage.ParseRRType(tokens[0].text)
+	if !ok || tokens[0].quoted {
+		return fmt.Errorf("unknown record type %q", tokens[0].text)
+	}
+	if typ == dnsmessage.TypeOPT {
+		return errors.New("OPT is not a record of a zone")
+	}
+	rr.Type = typ
+
+	rdata, err := p.rdata(typ, tokens[1:])
+	if err != nil {
+		return fmt.Errorf("invalid %s record: %w", typ, err)
+	}
+	rr.RData = rdata
+	rr.RdLength = uint32(len(rdata))
+
+	switch {
+	case hasClass && p.class != 0 && rr.Class != p.class:
+		return fmt.Errorf("class %s differs from %s of the previous records", rr.Class, p.class)
+	case !hasClass && p.class != 0:
+		rr.Class = p.class
+	case !hasClass:
+		rr.Class = dnsmessage.ClassIN
+	}
+	p.class = rr.Class
+
+	if !hasTTL {
+		switch {
+		case p.hasDefaultTTL:
+			rr.TTL = p.defaultTTL
+		case p.hasLastTTL:
+			rr.TTL = p.lastTTL
+		case typ == dnsmessage.TypeSOA:
+			// the minimum of the SOA served as the default before $TTL (RFC 2308, section 4)
+			soa, _ := dnsmessage.UnpackSOA(rdata)
+			rr.TTL = soa.Minimum
+		default:
+			return errors.New("no TTL for the record and no $TTL before it")
+		}
+	}
+	p.lastTTL, p.hasLastTTL = rr.TTL, true
+	p.owner = rr.Name
+
+	p.records = append(p.records, rr)
+	return nil
+}
+
+func (p *parser) directive(tokens []token) error {
+	args := tokens[1:]
+	switch strings.ToUpper(tokens[0].text) {
+	case "$ORIGIN":
+		if len(args) != 1 {
+			return errors.New("$ORIGIN takes a domain name")
+		}
+		origin, err := p.name(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid $ORIGIN: %w", err)
+		}
+		p.origin = origin
+
+	case "$TTL":
+		if len(args) != 1 {
+			return errors.New("$TTL takes a TTL")
+		}
+		ttl, err := parseTTL(args[0].text)
+		if err != nil {
+			return fmt.Errorf("invalid $TTL: %w", err)
+		}
+		p.defaultTTL, p.hasDefaultTTL = ttl, true
+
+	case "$INCLUDE":
+		if len(args) < 1 || len(args) > 2 {
+			return errors.New("$INCLUDE takes a file name and an optional origin")
+		}
+		if p.depth >= maxIncludeDepth {
+			return errors.New("$INCLUDE nested too deeply")
+		}
+		path := decodeText(args[0].text)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(p.file), path)
+		}
+		origin := p.origin
+		if len(args) == 2 {
+			var err error
+			if origin, err = p.name(args[1]); err != nil {
+				return fmt.Errorf("invalid origin of $INCLUDE: %w", err)
+			}
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		// the origin and the owner of the including file stay as they were
+		// (RFC 1035, section 5.1), the included file may set its own $TTL
+		included := *p
+		included.file, included.origin, included.depth = path, origin, p.depth+1
+		if err := included.parse(f); err != nil {
+			return err
+		}
+		p.records = included.records
+		p.class = included.class
+		p.lastTTL, p.hasLastTTL = included.lastTTL, included.hasLastTTL
+
+	default:
+		return fmt.Errorf("unknown directive %s", tokens[0].text)
+	}
+	return nil
+}
+
+// name parses a domain name, names without a trailing dot are relative
+// to the origin and @ is the origin itself.
+func (p *parser) name(t token) (dnsmessage.DomainName, error) {
+	if t.text == "@" && !t.quoted {
+		if p.origin == nil {
+			return nil, errors.New("@ without an origin")
+		}
+		return p.origin, nil
+	}
+	if t.text == "." {
+		return dnsmessage.DomainName{}, nil
+	}
+
+	name := dnsmessage.DomainName{}
+	var label []byte
+	absolute := false
+	s := t.text
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\':
+			b, n, err := decodeEscape(s[i:])
+			if err != nil {
+				return nil, err
+			}
+			label = append(label, b)
+			i += n - 1
+		case c == '.':
+			if len(label) == 0 {
+				return nil, fmt.Errorf("empty label in %q", s)
+			}
+			name = append(name, label)
+			label = nil
+			absolute = i == len(s)-1
+		default:
+			label = append(label, c)
+		}
+	}
+	if len(label) > 0 {
+		name = append(name, label)
+	}
+
+	if !absolute {
+		if p.origin == nil {
+			return nil, fmt.Errorf("relative name %q without an origin", s)
+		}
+		name = append(name, p.origin...)
+	}
+
+	length := 1
+	for _, label := range name {
+		if len(label) > 63 {
+			return nil, fmt.Errorf("label %q is longer than 63 bytes", label)
+		}
+		length += 1 + len(label)
+	}
+	if length > 255 {
+		return nil, fmt.Errorf("name %q is longer than 255 bytes", s)
+	}
+	return name, nil
+}
+
+// decodeEscape decodes \X or \DDD at the start of s and returns
+// the byte and the length of the escape.
+func decodeEscape(s string) (byte, int, error) {
+	if len(s) < 2 {
+		return 0, 0, errors.New("incomplete escape")
+	}
+	if s[1] < '0' || s[1] > '9' {
+		return s[1], 2, nil
+	}
+	if len(s) < 4 {
+		return 0, 0, fmt.Errorf("invalid escape %q", s)
+	}
+	v, err := strconv.ParseUint(s[1:4], 10, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid escape %q", s[:4])
+	}
+	return byte(v), 4, nil
+}
+
+// decodeText decodes the escapes of a character string or a file name.
+func decodeText(s string) string {
+	b, _ := decodeString(s)
+	return string(b)
+}
+
+func decodeString(s string) ([]byte, error) {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		c, n, err := decodeEscape(s[i:])
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, c)
+		i += n - 1
+	}
+	return b, nil
+}
+
+// parseTTL parses a TTL in seconds or with units like 1h30m as BIND does.
+func parseTTL(s string) (uint32, error) {
+	if s == "" || !unicode.IsDigit(rune(s[0])) {
+		return 0, fmt.Errorf("invalid TTL %q", s)
+	}
+	if v, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return checkTTL(v)
+	}
+
+	var total, n uint64
+	digits := false
+	for _, c := range strings.ToLower(s) {
+		if c >= '0' && c <= '9' {
+			n = n*10 + uint64(c-'0')
+			digits = true
+			if n > 1<<31 {
+				return 0, fmt.Errorf("TTL %q is too large", s)
+			}
+			continue
+		}
+		unit, ok := map[rune]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}[c]
+		if !ok || !digits {
+			return 0, fmt.Errorf("invalid TTL %q", s)
+		}
+		total += n * unit
+		n, digits = 0, false
+	}
+	if digits {
+		return 0, fmt.Errorf("invalid TTL %q: number without a unit", s)
+	}
+	return checkTTL(total)
+}
+
+// checkTTL rejects TTLs with the most significant bit set (RFC 2181, section 8).
+func checkTTL(v uint64) (uint32, error) {
+	if v >= 1<<31 {
+		return 0, fmt.Errorf("TTL %d is too large", v)
+	}
+	return uint32(v), nil
+}
@@ -0,0 +1,169 @@
+package zone
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"server/pkg/dnsmessage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testZone = `; zone of the README
+$ORIGIN pianykh.xyz.
+$TTL 1h
+@	IN	SOA	ns1 hostmaster (
+		2024010101 ; serial
+		2h         ; refresh
+		30m        ; retry
+		2w         ; expire
+		300 )      ; minimum
+	IN	NS	ns1
+	NS	ns2.example.com.
+	MX	10 mail
+ns1	A	192.0.2.53
+www	300 IN	A	192.0.2.80
+	IN 600	AAAA	2001:db8::80
+mail	A	192.0.2.25
+txt	TXT	"v=spf1 -all" "second \"quoted\"" plain
+	HINFO	"PC" "Linux"
+alias	CNAME	www
+_dns.sub	PTR	host\.with\.dots
+sub	DS	12345 13 2 ( 3B8F0A6E 7C1E8A1D
+		0D1A2B3C4D5E6F708192A3B4C5D6E7F8091A2B3C4D5E6F708192A3B4 )
+@	DNSKEY	257 3 13 AQID
+	RRSIG	A 13 2 3600 20240201000000 20240101000000 12345 pianykh.xyz. AQID
+	NSEC	www A NS SOA MX RRSIG NSEC DNSKEY
+	NSEC3PARAM	1 0 0 -
+abc	NSEC3	1 1 10 AABB 1MTIO A RRSIG
+generic	TYPE731	\# 3 abcdef
+empty	NULL	\# 0
+wks	WKS	192.0.2.1 TCP smtp 80
+info	MINFO	admin errors
+$ORIGIN other.
+x	CH	TXT	"chaos"
+`
+
+func TestParse(t *testing.T) {
+	records, err := Parse(strings.NewReader(strings.ReplaceAll(testZone, "x\tCH", "x\tIN")), "pianykh.xyz.zone", nil)
+	require.NoError(t, err)
+
+	exp := []string{
+		"pianykh.xyz 3600 IN SOA ns1.pianykh.xyz. hostmaster.pianykh.xyz. 2024010101 7200 1800 1209600 300",
+		"pianykh.xyz 3600 IN NS ns1.pianykh.xyz.",
+		"pianykh.xyz 3600 IN NS ns2.example.com.",
+		"pianykh.xyz 3600 IN MX 10 mail.pianykh.xyz.",
+		"ns1.pianykh.xyz 3600 IN A 192.0.2.53",
+		"www.pianykh.xyz 300 IN A 192.0.2.80",
+		"www.pianykh.xyz 600 IN AAAA 2001:db8::80",
+		"mail.pianykh.xyz 3600 IN A 192.0.2.25",
+		`txt.pianykh.xyz 3600 IN TXT "v=spf1 -all" "second \"quoted\"" "plain"`,
+		`txt.pianykh.xyz 3600 IN HINFO "PC" "Linux"`,
+		"alias.pianykh.xyz 3600 IN CNAME www.pianykh.xyz.",
+		"_dns.sub.pianykh.xyz 3600 IN PTR host.with.dots.pianykh.xyz.",
+		"sub.pianykh.xyz 3600 IN DS 12345 13 2 3B8F0A6E7C1E8A1D0D1A2B3C4D5E6F708192A3B4C5D6E7F8091A2B3C4D5E6F708192A3B4",
+		"pianykh.xyz 3600 IN DNSKEY 257 3 13 AQID",
+		"pianykh.xyz 3600 IN RRSIG A 13 2 3600 20240201000000 20240101000000 12345 pianykh.xyz. AQID",
+		"pianykh.xyz 3600 IN NSEC www.pianykh.xyz. A NS SOA MX RRSIG NSEC DNSKEY",
+		"pianykh.xyz 3600 IN NSEC3PARAM 1 0 0 -",
+		"abc.pianykh.xyz 3600 IN NSEC3 1 1 10 AABB 1MTIO A RRSIG",
+		`generic.pianykh.xyz 3600 IN UNKNOWN(731) \# 3 abcdef`,
+		`empty.pianykh.xyz 3600 IN NULL \# 0 `,
+		`wks.pianykh.xyz 3600 IN WKS \# 16 c0000201060000004000000000000080`,
+		"info.pianykh.xyz 3600 IN MINFO admin.pianykh.xyz. errors.pianykh.xyz.",
+		`x.other 3600 IN TXT "chaos"`,
+	}
+	got := make([]string, len(records))
+	for i, rr := range records {
+		got[i] = strings.Join([]string{dnsmessage.DomainNameToString(rr.Name), strconv.FormatUint(uint64(rr.TTL), 10), rr.Class.String(), rr.Type.String(), rr.RDataString()}, " ")
+		assert.Equal(t, uint32(len(rr.RData)), rr.RdLength)
+	}
+	assert.Equal(t, exp, got)
+
+	// the escaped dots stay in the label
+	assert.Equal(t, []byte("host.with.dots"), records[11].RData[1:15])
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		zone string
+		line int
+		err  string
+	}{
+		{name: "class change", zone: testZone, line: 33, err: "class CH differs"},
+		{name: "no TTL", zone: "$ORIGIN example.\nwww A 192.0.2.1\n", line: 2, err: "no TTL"},
+		{name: "no origin", zone: "$TTL 60\nwww A 192.0.2.1\n", line: 2, err: "without an origin"},
+		{name: "no owner", zone: "$TTL 60\n  A 192.0.2.1\n", line: 2, err: "no owner"},
+		{name: "bad address", zone: "$TTL 60\nwww.example. A 2001:db8::1\n", line: 2, err: "invalid address"},
+		{name: "unknown type", zone: "$TTL 60\n\n\nwww.example. BOGUS x\n", line: 4, err: "unknown record type"},
+		{name: "trailing data", zone: "$TTL 60\nwww.example. CNAME a.example. b.example.\n", line: 2, err: "unexpected"},
+		{name: "unbalanced", zone: "$TTL 60\nwww.example. TXT ( \"a\"\n", line: 2, err: "unbalanced"},
+		{name: "unterminated", zone: "$TTL 60\nwww.example. TXT \"a\n", line: 2, err: "unterminated"},
+		{name: "long label", zone: "$TTL 60\n" + strings.Repeat("a", 64) + ".example. A 192.0.2.1\n", line: 2, err: "longer than 63"},
+		{name: "bad TTL", zone: "$TTL 1x\n", line: 1, err: "invalid $TTL"},
+		{name: "huge TTL", zone: "$TTL 4294967295\n", line: 1, err: "too large"},
+		{name: "generic length", zone: "$TTL 60\nx.example. TYPE999 \\# 2 abcdef\n", line: 2, err: "not 2"},
+		{name: "directive", zone: "$GENERATE 1-2 a A 192.0.2.1\n", line: 1, err: "unknown directive"},
+		{name: "OPT", zone: "$TTL 60\nexample. OPT \\# 0\n", line: 2, err: "OPT"},
+		{name: "multi-line entry", zone: "$TTL 60\nexample. SOA ns.example. host.example. (\n1 2 3\n4 x )\n", line: 2, err: "invalid minimum"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.zone), "test.zone", nil)
+			var parseErr *ParseError
+			require.True(t, errors.As(err, &parseErr), "error: %v", err)
+			assert.Equal(t, "test.zone", parseErr.File)
+			assert.Equal(t, tt.line, parseErr.Line)
+			assert.ErrorContains(t, err, tt.err)
+			assert.True(t, strings.HasPrefix(err.Error(), "test.zone:"))
+		})
+	}
+}
+
+func TestParseInclude(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+	write("hosts.zone", "$TTL 60\nwww A 192.0.2.1\nbroken A x\n")
+	write("mail.zone", "mx A 192.0.2.25\n")
+	main := write("main.zone", "$ORIGIN example.\n$TTL 300\n@ NS ns\n$INCLUDE mail.zone\n$INCLUDE mail.zone sub.example.\n  A 192.0.2.2\n")
+
+	records, err := ParseFile(main, nil)
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	assert.Equal(t, "mx.example", dnsmessage.DomainNameToString(records[1].Name))
+	assert.Equal(t, "mx.sub.example", dnsmessage.DomainNameToString(records[2].Name))
+	// the owner of the including file stays the current one
+	assert.Equal(t, "example", dnsmessage.DomainNameToString(records[3].Name))
+	assert.Equal(t, uint32(300), records[3].TTL)
+
+	// errors point into the included file
+	broken := write("broken.zone", "$ORIGIN example.\n\n$INCLUDE hosts.zone\n")
+	_, err = ParseFile(broken, nil)
+	assert.EqualError(t, err, filepath.Join(dir, "hosts.zone")+`:3: invalid A record: invalid address "x"`)
+
+	loop := write("loop.zone", "$INCLUDE loop.zone\n")
+	_, err = ParseFile(loop, nil)
+	assert.ErrorContains(t, err, "nested too deeply")
+}
+
+func TestParseTTL(t *testing.T) {
+	for s, exp := range map[string]uint32{"0": 0, "3600": 3600, "1h30m": 5400, "1W2D": 777600, "2147483647": 1<<31 - 1} {
+		v, err := parseTTL(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, exp, v, s)
+	}
+	for _, s := range []string{"", "h", "1h30", "1y", "2147483648", "-1"} {
+		_, err := parseTTL(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -0,0 +1,478 @@
+package zone
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/pkg/dnsmessage"
+)
+
+// well-known services that WKS records may name instead of giving the port
+var services = map[string]int{
+	"ftp": 21, "ssh": 22, "telnet": 23, "smtp": 25, "domain": 53, "http": 80,
+	"pop3": 110, "ntp": 123, "imap": 143, "snmp": 161, "https": 443,
+}
+
+// fields hands out the RDATA tokens of a record one by one.
+type fields struct {
+	tokens []token
+}
+
+func (f *fields) next(what string) (token, error) {
+	if len(f.tokens) == 0 {
+		return token{}, fmt.Errorf("missing %s", what)
+	}
+	t := f.tokens[0]
+	f.tokens = f.tokens[1:]
+	return t, nil
+}
+
+// rest joins the remaining tokens, base64 and hex may be split by white space.
+func (f *fields) rest(what string) (string, error) {
+	if len(f.tokens) == 0 {
+		return "", fmt.Errorf("missing %s", what)
+	}
+	var sb strings.Builder
+	for _, t := range f.tokens {
+		sb.WriteString(t.text)
+	}
+	f.tokens = nil
+	return sb.String(), nil
+}
+
+func (f *fields) uint(what string, bits int) (uint64, error) {
+	t, err := f.next(what)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseUint(t.text, 10, bits)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", what, t.text)
+	}
+	return v, nil
+}
+
+func (f *fields) done() error {
+	if len(f.tokens) > 0 {
+		return fmt.Errorf("unexpected %q after the data", f.tokens[0].text)
+	}
+	return nil
+}
+
+// rdata converts the presentation format of the RDATA into its wire format.
+func (p *parser) rdata(typ dnsmessage.RRType, tokens []token) ([]byte, error) {
+	f := &fields{tokens: tokens}
+	if len(tokens) > 0 && tokens[0].text == `\#` && !tokens[0].quoted {
+		return genericRData(f)
+	}
+
+	name := func(what string) ([]byte, error) {
+		t, err := f.next(what)
+		if err != nil {
+			return nil, err
+		}
+		n, err := p.name(t)
+		if err != nil {
+			return nil, err
+		}
+		return dnsmessage.PackDomainName(n), nil
+	}
+
+	var rdata []byte
+	switch typ {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		t, err := f.next("address")
+		if err != nil {
+			return nil, err
+		}
+		addr, err := netip.ParseAddr(t.text)
+		if err != nil || addr.Is4() != (typ == dnsmessage.TypeA) || addr.Zone() != "" {
+			return nil, fmt.Errorf("invalid address %q", t.text)
+		}
+		rdata = addr.AsSlice()
+
+	case dnsmessage.TypeNS, dnsmessage.TypeMD, dnsmessage.TypeMF, dnsmessage.TypeCNAME,
+		dnsmessage.TypeMB, dnsmessage.TypeMG, dnsmessage.TypeMR, dnsmessage.TypePTR:
+		n, err := name("domain name")
+		if err != nil {
+			return nil, err
+		}
+		rdata = n
+
+	case dnsmessage.TypeMINFO:
+		for _, what := range []string{"RMAILBX", "EMAILBX"} {
+			n, err := name(what)
+			if err != nil {
+				return nil, err
+			}
+			rdata = append(rdata, n...)
+		}
+
+	case dnsmessage.TypeSOA:
+		mname, err := name("MNAME")
+		if err != nil {
+			return nil, err
+		}
+		rname, err := name("RNAME")
+		if err != nil {
+			return nil, err
+		}
+		rdata = append(mname, rname...)
+		for _, what := range []string{"serial", "refresh", "retry", "expire", "minimum"} {
+			t, err := f.next(what)
+			if err != nil {
+				return nil, err
+			}
+			// all but the serial are times, units are fine there
+			v, err := strconv.ParseUint(t.text, 10, 32)
+			if err != nil && what != "serial" {
+				var ttl uint32
+				ttl, err = parseTTL(t.text)
+				v = uint64(ttl)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", what, t.text)
+			}
+			rdata = binary.BigEndian.AppendUint32(rdata, uint32(v))
+		}
+
+	case dnsmessage.TypeMX:
+		pref, err := f.uint("preference", 16)
+		if err != nil {
+			return nil, err
+		}
+		exchange, err := name("exchange")
+		if err != nil {
+			return nil, err
+		}
+		rdata = append(binary.BigEndian.AppendUint16(nil, uint16(pref)), exchange...)
+
+	case dnsmessage.TypeHINFO, dnsmessage.TypeTXT:
+		if len(f.tokens) == 0 {
+			return nil, errors.New("missing character string")
+		}
+		if typ == dnsmessage.TypeHINFO && len(f.tokens) != 2 {
+			return nil, errors.New("HINFO takes the CPU and the OS")
+		}
+		for _, t := range f.tokens {
+			s, err := decodeString(t.text)
+			if err != nil {
+				return nil, err
+			}
+			if len(s) > 255 {
+				return nil, fmt.Errorf("character string %q is longer than 255 bytes", t.text)
+			}
+			rdata = append(append(rdata, byte(len(s))), s...)
+		}
+		f.tokens = nil
+
+	case dnsmessage.TypeWKS:
+		return p.wks(f)
+
+	case dnsmessage.TypeDS, dnsmessage.TypeCDS:
+		return ds(f)
+
+	case dnsmessage.TypeDNSKEY, dnsmessage.TypeCDNSKEY:
+		return dnskey(f)
+
+	case dnsmessage.TypeRRSIG:
+		return p.rrsig(f)
+
+	case dnsmessage.TypeNSEC:
+		next, err := f.next("next domain name")
+		if err != nil {
+			return nil, err
+		}
+		n, err := p.name(next)
+		if err != nil {
+			return nil, err
+		}
+		types, err := typeList(f)
+		if err != nil {
+			return nil, err
+		}
+		return (&dnsmessage.NSEC{NextDomain: n, Types: types}).Pack(), nil
+
+	case dnsmessage.TypeNSEC3:
+		return nsec3(f)
+
+	case dnsmessage.TypeNSEC3PARAM:
+		alg, flags, iterations, salt, err := nsec3Params(f)
+		if err != nil {
+			return nil, err
+		}
+		return (&dnsmessage.NSEC3PARAM{HashAlgorithm: alg, Flags: flags, Iterations: iterations, Salt: salt}).Pack(), f.done()
+
+	default:
+		return nil, fmt.Errorf("RDATA of %s can only be given in the generic format", typ)
+	}
+	return rdata, f.done()
+}
+
+// genericRData parses \# <length> <hex> (RFC 3597, section 5).
+func genericRData(f *fields) ([]byte, error) {
+	f.tokens = f.tokens[1:]
+	length, err := f.uint("RDATA length", 16)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return []byte{}, f.done()
+	}
+	s, err := f.rest("RDATA")
+	if err != nil {
+		return nil, err
+	}
+	rdata, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RDATA: %w", err)
+	}
+	if len(rdata) != int(length) {
+		return nil, fmt.Errorf("RDATA has %d bytes, not %d", len(rdata), length)
+	}
+	return rdata, nil
+}
+
+// wks parses the address, the protocol and the services (RFC 1035, section 3.4.2).
+func (p *parser) wks(f *fields) ([]byte, error) {
+	t, err := f.next("address")
+	if err != nil {
+		return nil, err
+	}
+	addr, err := netip.ParseAddr(t.text)
+	if err != nil || !addr.Is4() {
+		return nil, fmt.Errorf("invalid address %q", t.text)
+	}
+
+	t, err = f.next("protocol")
+	if err != nil {
+		return nil, err
+	}
+	var protocol uint64
+	switch strings.ToLower(t.text) {
+	case "tcp":
+		protocol = 6
+	case "udp":
+		protocol = 17
+	default:
+		if protocol, err = strconv.ParseUint(t.text, 10, 8); err != nil {
+			return nil, fmt.Errorf("invalid protocol %q", t.text)
+		}
+	}
+
+	var bitmap []byte
+	for _, t := range f.tokens {
+		port, ok := services[strings.ToLower(t.text)]
+		if !ok {
+			v, err := strconv.ParseUint(t.text, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("unknown service %q", t.text)
+			}
+			port = int(v)
+		}
+		for len(bitmap) <= port/8 {
+			bitmap = append(bitmap, 0)
+		}
+		bitmap[port/8] |= 0x80 >> (port % 8)
+	}
+	rdata := append(addr.AsSlice(), byte(protocol))
+	return append(rdata, bitmap...), nil
+}
+
+func ds(f *fields) ([]byte, error) {
+	tag, err := f.uint("key tag", 16)
+	if err != nil {
+		return nil, err
+	}
+	alg, err := f.uint("algorithm", 8)
+	if err != nil {
+		return nil, err
+	}
+	digestType, err := f.uint("digest type", 8)
+	if err != nil {
+		return nil, err
+	}
+	s, err := f.rest("digest")
+	if err != nil {
+		return nil, err
+	}
+	digest, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest: %w", err)
+	}
+	return (&dnsmessage.DS{KeyTag: uint16(tag), Algorithm: uint8(alg), DigestType: uint8(digestType), Digest: digest}).Pack(), nil
+}
+
+func dnskey(f *fields) ([]byte, error) {
+	flags, err := f.uint("flags", 16)
+	if err != nil {
+		return nil, err
+	}
+	protocol, err := f.uint("protocol", 8)
+	if err != nil {
+		return nil, err
+	}
+	alg, err := f.uint("algorithm", 8)
+	if err != nil {
+		return nil, err
+	}
+	s, err := f.rest("public key")
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	return (&dnsmessage.DNSKEY{Flags: uint16(flags), Protocol: uint8(protocol), Algorithm: uint8(alg), PublicKey: key}).Pack(), nil
+}
+
+func (p *parser) rrsig(f *fields) ([]byte, error) {
+	t, err := f.next("type covered")
+	if err != nil {
+		return nil, err
+	}
+	covered, ok := dnsmessage.ParseRRType(t.text)
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q", t.text)
+	}
+	alg, err := f.uint("algorithm", 8)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := f.uint("labels", 8)
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := f.uint("original TTL", 32)
+	if err != nil {
+		return nil, err
+	}
+	var times [2]uint32
+	for i, what := range []string{"expiration", "inception"} {
+		t, err := f.next(what)
+		if err != nil {
+			return nil, err
+		}
+		if times[i], err = parseSigTime(t.text); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", what, err)
+		}
+	}
+	tag, err := f.uint("key tag", 16)
+	if err != nil {
+		return nil, err
+	}
+	t, err = f.next("signer's name")
+	if err != nil {
+		return nil, err
+	}
+	signer, err := p.name(t)
+	if err != nil {
+		return nil, err
+	}
+	s, err := f.rest("signature")
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	return (&dnsmessage.RRSIG{
+		TypeCovered: covered,
+		Algorithm:   uint8(alg),
+		Labels:      uint8(labels),
+		OriginalTTL: uint32(ttl),
+		Expiration:  times[0],
+		Inception:   times[1],
+		KeyTag:      uint16(tag),
+		SignerName:  signer,
+		Signature:   signature,
+	}).Pack(), nil
+}
+
+// parseSigTime parses YYYYMMDDHHmmSS in UTC or seconds since the epoch
+// (RFC 4034, section 3.2).
+func parseSigTime(s string) (uint32, error) {
+	if len(s) == 14 {
+		t, err := time.Parse("20060102150405", s)
+		if err != nil {
+			return 0, err
+		}
+		return uint32(t.Unix()), nil
+	}
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return uint32(v), nil
+}
+
+func nsec3Params(f *fields) (alg, flags uint8, iterations uint16, salt []byte, err error) {
+	var v [3]uint64
+	for i, what := range []string{"hash algorithm", "flags", "iterations"} {
+		bits := 8
+		if i == 2 {
+			bits = 16
+		}
+		if v[i], err = f.uint(what, bits); err != nil {
+			return
+		}
+	}
+	t, err := f.next("salt")
+	if err != nil {
+		return
+	}
+	salt = []byte{}
+	if t.text != "-" {
+		if salt, err = hex.DecodeString(t.text); err != nil || len(salt) > 255 {
+			err = fmt.Errorf("invalid salt %q", t.text)
+			return
+		}
+	}
+	return uint8(v[0]), uint8(v[1]), uint16(v[2]), salt, nil
+}
+
+func nsec3(f *fields) ([]byte, error) {
+	alg, flags, iterations, salt, err := nsec3Params(f)
+	if err != nil {
+		return nil, err
+	}
+	t, err := f.next("next hashed owner name")
+	if err != nil {
+		return nil, err
+	}
+	next, err := base32.HexEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(t.text))
+	if err != nil || len(next) == 0 {
+		return nil, fmt.Errorf("invalid next hashed owner name %q", t.text)
+	}
+	types, err := typeList(f)
+	if err != nil {
+		return nil, err
+	}
+	return (&dnsmessage.NSEC3{
+		HashAlgorithm: alg, Flags: flags, Iterations: iterations, Salt: salt, NextHashed: next, Types: types,
+	}).Pack(), nil
+}
+
+func typeList(f *fields) ([]dnsmessage.RRType, error) {
+	types := []dnsmessage.RRType{}
+	for _, t := range f.tokens {
+		typ, ok := dnsmessage.ParseRRType(t.text)
+		if !ok {
+			return nil, fmt.Errorf("unknown type %q", t.text)
+		}
+		types = append(types, typ)
+	}
+	f.tokens = nil
+	return types, nil
+}
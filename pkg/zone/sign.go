@@ -0,0 +1,400 @@
+package zone
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/dnssec"
+)
+
+const (
+	defaultValidity = 14 * 24 * time.Hour
+	defaultRefresh  = 3 * 24 * time.Hour
+	// signatures are valid a little before they are made
+	// for resolvers with clocks running behind
+	inceptionSkew = time.Hour
+	// SHA-1, the only hash of NSEC3 (RFC 5155, section 11)
+	nsec3SHA1 = 1
+)
+
+// SigningConfig makes us sign the zone (RFC 4035, section 2). The keys
+// are PEM files with a PKCS #8 private key. Without a ZSK, the KSK signs
+// all RRsets, otherwise just the DNSKEY RRset.
+type SigningConfig struct {
+	KSK string `yaml:"ksk"`
+	ZSK string `yaml:"zsk"`
+	// NSEC3 instead of NSEC records (RFC 5155), the salt in hex
+	NSEC3      bool   `yaml:"nsec3"`
+	Salt       string `yaml:"salt"`
+	Iterations uint16 `yaml:"iterations"`
+	// leave delegations without DS out of the NSEC3 chain
+	OptOut bool `yaml:"opt_out"`
+	// how long signatures are valid and how long
+	// before they expire they are replaced
+	Validity time.Duration `yaml:"validity"`
+	Refresh  time.Duration `yaml:"refresh"`
+}
+
+type signingKey struct {
+	dnskey *dnsmessage.DNSKEY
+	tag    uint16
+	priv   crypto.Signer
+}
+
+// signer signs a zone whenever it is built, see derive.
+type signer struct {
+	ksk, zsk signingKey             // the same key without a ZSK
+	nsec3    *dnsmessage.NSEC3PARAM // nil for NSEC
+	optOut   bool
+	validity time.Duration
+	refresh  time.Duration
+}
+
+func newSigner(cfg *SigningConfig) (*signer, error) {
+	if cfg.KSK == "" {
+		return nil, errors.New("no KSK")
+	}
+	ksk, err := loadSigningKey(cfg.KSK, dnsmessage.DNSKEYFlagZone|dnsmessage.DNSKEYFlagSEP)
+	if err != nil {
+		return nil, fmt.Errorf("KSK: %w", err)
+	}
+	s := &signer{ksk: ksk, zsk: ksk, optOut: cfg.OptOut, validity: cfg.Validity, refresh: cfg.Refresh}
+	if cfg.ZSK != "" {
+		if s.zsk, err = loadSigningKey(cfg.ZSK, dnsmessage.DNSKEYFlagZone); err != nil {
+			return nil, fmt.Errorf("ZSK: %w", err)
+		}
+	}
+	if s.validity == 0 {
+		s.validity = defaultValidity
+	}
+	if s.refresh == 0 {
+		s.refresh = min(defaultRefresh, s.validity/2)
+	}
+	if s.refresh >= s.validity {
+		return nil, errors.New("signatures have to be refreshed before they expire")
+	}
+
+	if !cfg.NSEC3 {
+		if cfg.OptOut {
+			return nil, errors.New("opt-out needs NSEC3")
+		}
+		return s, nil
+	}
+	salt, err := hex.DecodeString(cfg.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %w", err)
+	}
+	s.nsec3 = &dnsmessage.NSEC3PARAM{HashAlgorithm: nsec3SHA1, Iterations: cfg.Iterations, Salt: salt}
+	return s, nil
+}
+
+func loadSigningKey(path string, flags uint16) (signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return signingKey{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return signingKey{}, fmt.Errorf("%s has no PEM data", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return signingKey{}, fmt.Errorf("invalid key in %s: %w", path, err)
+	}
+	priv, ok := key.(crypto.Signer)
+	if !ok {
+		return signingKey{}, fmt.Errorf("%s holds no signing key", path)
+	}
+	dnskey, err := dnssec.NewDNSKEY(flags, priv.Public())
+	if err != nil {
+		return signingKey{}, err
+	}
+	return signingKey{dnskey: dnskey, tag: dnssec.KeyTag(dnskey), priv: priv}, nil
+}
+
+// generated reports whether the signer makes the records of the type.
+func generated(typ dnsmessage.RRType) bool {
+	switch typ {
+	case dnsmessage.TypeDNSKEY, dnsmessage.TypeRRSIG, dnsmessage.TypeNSEC, dnsmessage.TypeNSEC3, dnsmessage.TypeNSEC3PARAM:
+		return true
+	}
+	return false
+}
+
+// sign replaces the DNSKEY RRset, the NSEC or NSEC3 chain and the
+// signatures among the records with new ones and returns when they have
+// to be refreshed. Signatures of prev for the same RRsets are kept unless
+// they are due.
+func (s *signer) sign(origin dnsmessage.DomainName, records dnsmessage.ResourceRecords, prev *Zone, now time.Time) (dnsmessage.ResourceRecords, time.Time, error) {
+	var data dnsmessage.ResourceRecords
+	for _, rr := range records {
+		if !generated(rr.Type) {
+			data = append(data, rr)
+		}
+	}
+	z, err := New(origin, data)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	apex := func(typ dnsmessage.RRType, ttl uint32, rdata []byte) *dnsmessage.ResourceRecord {
+		return &dnsmessage.ResourceRecord{Name: origin, Type: typ, Class: z.Class, TTL: ttl, RData: rdata}
+	}
+	data = append(data, apex(dnsmessage.TypeDNSKEY, z.SOA().TTL, s.ksk.dnskey.Pack()))
+	if s.zsk.tag != s.ksk.tag {
+		data = append(data, apex(dnsmessage.TypeDNSKEY, z.SOA().TTL, s.zsk.dnskey.Pack()))
+	}
+	if s.nsec3 != nil {
+		data = append(data, apex(dnsmessage.TypeNSEC3PARAM, 0, s.nsec3.Pack()))
+	}
+	if z, err = New(origin, data); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var chain dnsmessage.ResourceRecords
+	if s.nsec3 != nil {
+		chain = s.nsec3Chain(z)
+	} else {
+		chain = nsecChain(z)
+	}
+	rrsets := make([]dnsmessage.ResourceRecords, 0, len(z.nodes)+len(chain))
+	for _, n := range z.nodes {
+		cut := z.delegates(n)
+		if z.zoneCut(n.name, dnsmessage.TypeDS) != nil {
+			// below a delegation, glue isn't signed
+			continue
+		}
+		for typ, rrset := range n.rrsets {
+			if !cut || typ == dnsmessage.TypeDS {
+				rrsets = append(rrsets, rrset)
+			}
+		}
+	}
+	for _, rr := range chain {
+		rrsets = append(rrsets, dnsmessage.ResourceRecords{rr})
+	}
+
+	refresh := now.Add(s.validity)
+	signed := append(data, chain...)
+	for _, rrset := range rrsets {
+		key := s.zsk
+		if rrset[0].Type == dnsmessage.TypeDNSKEY {
+			key = s.ksk
+		}
+		sig, expiration, err := s.signature(rrset, origin, key, prev, now)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("failed to sign %s/%s: %w", nameString(rrset[0].Name), rrset[0].Type, err)
+		}
+		signed = append(signed, sig)
+		if due := expiration.Add(-s.refresh); due.Before(refresh) {
+			refresh = due
+		}
+	}
+	return signed, refresh, nil
+}
+
+// signature signs the RRset unless prev has a signature of the same
+// RRset by the key that isn't due yet, and returns when it expires.
+func (s *signer) signature(rrset dnsmessage.ResourceRecords, origin dnsmessage.DomainName, key signingKey, prev *Zone, now time.Time) (*dnsmessage.ResourceRecord, time.Time, error) {
+	name, typ := rrset[0].Name, rrset[0].Type
+	if n := prev.lookup(name); n != nil && sameRRset(n.rrsets[typ], rrset) {
+		for _, rr := range n.rrsets[dnsmessage.TypeRRSIG] {
+			sig, err := dnsmessage.UnpackRRSIG(rr.RData)
+			if err != nil || sig.TypeCovered != typ || sig.KeyTag != key.tag || sig.Algorithm != key.dnskey.Algorithm {
+				continue
+			}
+			if expiration := time.Unix(int64(sig.Expiration), 0); expiration.After(now.Add(s.refresh)) {
+				return rr, expiration, nil
+			}
+		}
+	}
+
+	expiration := now.Add(s.validity)
+	sig, err := dnssec.Sign(rrset, origin, key.dnskey, key.priv, now.Add(-inceptionSkew), expiration)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	rr := &dnsmessage.ResourceRecord{Name: name, Type: dnsmessage.TypeRRSIG, Class: rrset[0].Class, TTL: rrset[0].TTL, RData: sig.Pack()}
+	return rr, time.Unix(int64(sig.Expiration), 0), nil
+}
+
+// sameRRset reports whether the RRsets have the same records and TTL.
+func sameRRset(a, b dnsmessage.ResourceRecords) bool {
+	return len(a) == len(b) && len(a) > 0 && a[0].TTL == b[0].TTL && sameRData(a, b) && sameRData(b, a)
+}
+
+// delegates reports whether the node is a zone cut.
+func (z *Zone) delegates(n *node) bool {
+	return len(n.rrsets[dnsmessage.TypeNS]) > 0 && !dnsmessage.EqualNames(n.name, z.Origin)
+}
+
+// chainNodes returns the nodes the NSEC or NSEC3 chain has to cover:
+// everything but the names below delegations.
+func (z *Zone) chainNodes() []*node {
+	var nodes []*node
+	for _, n := range z.nodes {
+		if z.zoneCut(n.name, dnsmessage.TypeDS) == nil {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// chainTypes returns the types of the node the NSEC or NSEC3 record
+// lists, at a delegation only those of the parent side. Whether the node
+// has signatures of its own is reported as well.
+func (z *Zone) chainTypes(n *node) ([]dnsmessage.RRType, bool) {
+	var types []dnsmessage.RRType
+	signed := false
+	for typ := range n.rrsets {
+		if z.delegates(n) && typ != dnsmessage.TypeNS && typ != dnsmessage.TypeDS {
+			continue
+		}
+		types = append(types, typ)
+		signed = signed || !z.delegates(n) || typ == dnsmessage.TypeDS
+	}
+	return types, signed
+}
+
+// negativeTTL is the TTL of NSEC and NSEC3 records (RFC 9077).
+func (z *Zone) negativeTTL() uint32 {
+	return z.negative()[0].TTL
+}
+
+// nsecChain links the names of the zone in canonical order (RFC 4034,
+// section 4). Empty non-terminals have no NSEC record.
+func nsecChain(z *Zone) dnsmessage.ResourceRecords {
+	var nodes []*node
+	for _, n := range z.chainNodes() {
+		if len(n.rrsets) > 0 {
+			nodes = append(nodes, n)
+		}
+	}
+	slices.SortFunc(nodes, func(a, b *node) int { return dnssec.CompareNames(a.name, b.name) })
+
+	chain := make(dnsmessage.ResourceRecords, len(nodes))
+	for i, n := range nodes {
+		// the NSEC record is signed itself
+		types, _ := z.chainTypes(n)
+		nsec := dnsmessage.NSEC{
+			NextDomain: nodes[(i+1)%len(nodes)].name,
+			Types:      append(types, dnsmessage.TypeNSEC, dnsmessage.TypeRRSIG),
+		}
+		slices.Sort(nsec.Types)
+		chain[i] = &dnsmessage.ResourceRecord{Name: n.name, Type: dnsmessage.TypeNSEC, Class: z.Class, TTL: z.negativeTTL(), RData: nsec.Pack()}
+	}
+	return chain
+}
+
+// nsec3Chain links the hashes of the names of the zone (RFC 5155,
+// section 7.1). With opt-out, delegations without DS are left out.
+func (s *signer) nsec3Chain(z *Zone) dnsmessage.ResourceRecords {
+	type hashed struct {
+		hash []byte
+		n    *node
+	}
+	var nodes []hashed
+	for _, n := range z.chainNodes() {
+		if s.optOut && z.delegates(n) && len(n.rrsets[dnsmessage.TypeDS]) == 0 {
+			continue
+		}
+		nodes = append(nodes, hashed{dnssec.HashName(n.name, s.nsec3.Salt, s.nsec3.Iterations), n})
+	}
+	slices.SortFunc(nodes, func(a, b hashed) int { return strings.Compare(string(a.hash), string(b.hash)) })
+
+	var flags uint8
+	if s.optOut {
+		flags = dnsmessage.NSEC3FlagOptOut
+	}
+	chain := make(dnsmessage.ResourceRecords, len(nodes))
+	for i, h := range nodes {
+		types, signed := z.chainTypes(h.n)
+		if signed {
+			types = append(types, dnsmessage.TypeRRSIG)
+		}
+		nsec3 := dnsmessage.NSEC3{
+			HashAlgorithm: s.nsec3.HashAlgorithm,
+			Flags:         flags,
+			Iterations:    s.nsec3.Iterations,
+			Salt:          s.nsec3.Salt,
+			NextHashed:    nodes[(i+1)%len(nodes)].hash,
+			Types:         types,
+		}
+		slices.Sort(nsec3.Types)
+		chain[i] = &dnsmessage.ResourceRecord{Name: hashedName(h.hash, z.Origin), Type: dnsmessage.TypeNSEC3, Class: z.Class, TTL: z.negativeTTL(), RData: nsec3.Pack()}
+	}
+	return chain
+}
+
+// hashedName is the owner name of the NSEC3 record for the hash.
+func hashedName(hash []byte, origin dnsmessage.DomainName) dnsmessage.DomainName {
+	label := strings.ToLower(base32.HexEncoding.WithPadding(base32.NoPadding).EncodeToString(hash))
+	return append(dnsmessage.Domain(label), origin...)
+}
+
+// ResignAt returns when the first signatures of the zone are due
+// for a refresh, the zero time for zones we don't sign.
+func (z *Zone) ResignAt() time.Time {
+	return z.resignAt
+}
+
+// signLoaded signs the zone read from the master file and the journal.
+// The signatures in the journal are kept while they are valid. If the
+// zone changes anyway, like when it is signed for the first time or has
+// been down for a while, the serial goes up for the secondaries to notice
+// and the change is added to the journal like an update.
+func (z *Zone) signLoaded(now time.Time) (*Zone, error) {
+	signed, err := z.deriveAt(z.records, now)
+	if err != nil {
+		return nil, err
+	}
+	if d := NewDiff(z, signed); len(d.Deleted) == 0 && len(d.Added) == 0 {
+		return signed, nil
+	}
+	records := slices.Clone(z.records)
+	soa, err := z.nextSOA(records[0])
+	if err != nil {
+		return nil, err
+	}
+	records[0] = soa
+	next, err := signed.deriveAt(records, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := z.writeJournal(next); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// Resign returns the zone with fresh signatures once some are due, the
+// zone itself before. The serial goes up for the secondaries to notice
+// and the change is added to the journal like an update.
+func (z *Zone) Resign(now time.Time) (*Zone, error) {
+	if z.signer == nil || now.Before(z.resignAt) {
+		return z, nil
+	}
+	records := slices.Clone(z.records)
+	soa, err := z.nextSOA(records[0])
+	if err != nil {
+		return nil, err
+	}
+	records[0] = soa
+	next, err := z.deriveAt(records, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := z.writeJournal(next); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
@@ -0,0 +1,276 @@
+package zone
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/dnssec"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const signedZoneFile = `$ORIGIN example.
+$TTL 3600
+@ SOA ns1 hostmaster 1 7200 1800 1209600 300
+@ NS ns1
+ns1 A 192.0.2.53
+www A 192.0.2.1
+*.wild TXT "wildcard"
+a.b.c TXT "below empty non-terminals"
+secure NS ns.secure
+secure DS 12345 13 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF
+ns.secure A 192.0.2.54
+insecure NS ns.other.
+`
+
+func writeSigningKey(t *testing.T, dir, name string) string {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+	path := filepath.Join(dir, name+".pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+	return path
+}
+
+func signedZoneConfig(t *testing.T, signing SigningConfig) *Config {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "example.zone")
+	require.NoError(t, os.WriteFile(path, []byte(signedZoneFile), 0o644))
+	signing.KSK = writeSigningKey(t, dir, "ksk")
+	signing.ZSK = writeSigningKey(t, dir, "zsk")
+	return &Config{Origin: "example.", File: path, DNSSEC: &signing}
+}
+
+func loadSignedZone(t *testing.T, signing SigningConfig) *Zone {
+	z, err := Load(signedZoneConfig(t, signing))
+	require.NoError(t, err)
+	return z
+}
+
+// validator trusts the KSK of the zone.
+func validator(t *testing.T, z *Zone) *dnssec.Validator {
+	var ksk *dnsmessage.DNSKEY
+	for _, rr := range z.lookup(z.Origin).rrsets[dnsmessage.TypeDNSKEY] {
+		k, err := dnsmessage.UnpackDNSKEY(rr.RData)
+		require.NoError(t, err)
+		if k.Flags&dnsmessage.DNSKEYFlagSEP != 0 {
+			ksk = k
+		}
+	}
+	require.NotNil(t, ksk)
+	ds, err := dnssec.NewDS(z.Origin, ksk, dnssec.DigestSHA256)
+	require.NoError(t, err)
+	v, err := dnssec.NewValidator(&dnssec.Config{TrustAnchors: []string{fmt.Sprintf("example. IN DS %s", ds)}})
+	require.NoError(t, err)
+	return v
+}
+
+func answerMessage(q *dnsmessage.Question, a *Answer) *dnsmessage.DNSMessage {
+	return &dnsmessage.DNSMessage{
+		Header:           &dnsmessage.Header{QR: 1, AA: 1, RCode: a.RCode},
+		Question:         q,
+		Answers:          a.Answers,
+		AuthorityRecords: a.Authority,
+		AdditonalRecords: a.Additional,
+	}
+}
+
+// validate answers the question from the zone and validates the answer.
+func validate(t *testing.T, z *Zone, v *dnssec.Validator, name string, qtype dnsmessage.RRType) (*Answer, dnssec.Status) {
+	t.Helper()
+	lookup := func(ctx context.Context, name dnsmessage.DomainName, qtype dnsmessage.RRType) (*dnsmessage.DNSMessage, error) {
+		q := &dnsmessage.Question{QName: name, QType: qtype, QClass: dnsmessage.ClassIN}
+		return answerMessage(q, z.LookupDNSSEC(q)), nil
+	}
+	q := &dnsmessage.Question{QName: dnsmessage.ParseDomainName(name), QType: qtype, QClass: dnsmessage.ClassIN}
+	a := z.LookupDNSSEC(q)
+	status, err := v.Validate(context.Background(), lookup, answerMessage(q, a))
+	if status == dnssec.Bogus {
+		t.Errorf("%s/%s is bogus: %v", name, qtype, err)
+	}
+	return a, status
+}
+
+func hasType(records dnsmessage.ResourceRecords, typ dnsmessage.RRType) bool {
+	for _, rr := range records {
+		if rr.Type == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSignedZone(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		signing SigningConfig
+		proof   dnsmessage.RRType
+	}{
+		{"NSEC", SigningConfig{}, dnsmessage.TypeNSEC},
+		{"NSEC3", SigningConfig{NSEC3: true, Salt: "aabbccdd", Iterations: 1}, dnsmessage.TypeNSEC3},
+		{"NSEC3 opt-out", SigningConfig{NSEC3: true, OptOut: true}, dnsmessage.TypeNSEC3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			z := loadSignedZone(t, tc.signing)
+			v := validator(t, z)
+
+			a, status := validate(t, z, v, "www.example", dnsmessage.TypeA)
+			assert.Equal(t, dnssec.Secure, status)
+			assert.True(t, hasType(a.Answers, dnsmessage.TypeRRSIG))
+			// only with DO
+			assert.False(t, hasType(z.Lookup(&dnsmessage.Question{QName: dnsmessage.ParseDomainName("www.example"), QType: dnsmessage.TypeA, QClass: dnsmessage.ClassIN}).Answers, dnsmessage.TypeRRSIG))
+
+			for _, q := range []struct {
+				name  string
+				qtype dnsmessage.RRType
+				rcode dnsmessage.RCode
+			}{
+				{"missing.example", dnsmessage.TypeA, dnsmessage.RCodeNameError},
+				{"x.www.example", dnsmessage.TypeA, dnsmessage.RCodeNameError},
+				{"www.example", dnsmessage.TypeAAAA, dnsmessage.RCodeNoError},
+				// an empty non-terminal
+				{"b.c.example", dnsmessage.TypeTXT, dnsmessage.RCodeNoError},
+				{"any.wild.example", dnsmessage.TypeTXT, dnsmessage.RCodeNoError},
+				{"any.wild.example", dnsmessage.TypeA, dnsmessage.RCodeNoError},
+			} {
+				a, status := validate(t, z, v, q.name, q.qtype)
+				assert.Equal(t, q.rcode, a.RCode, q.name)
+				// opt-out only proves that no signed delegation matches
+				if !tc.signing.OptOut {
+					assert.Equal(t, dnssec.Secure, status, "%s/%s", q.name, q.qtype)
+				}
+				if len(a.Answers) == 0 {
+					assert.True(t, hasType(a.Authority, tc.proof), q.name)
+				}
+			}
+
+			// the DS of a signed delegation comes with the referral
+			a = z.LookupDNSSEC(&dnsmessage.Question{QName: dnsmessage.ParseDomainName("www.secure.example"), QType: dnsmessage.TypeA, QClass: dnsmessage.ClassIN})
+			assert.False(t, a.Authoritative)
+			assert.True(t, hasType(a.Authority, dnsmessage.TypeDS))
+			assert.True(t, hasType(a.Authority, dnsmessage.TypeRRSIG))
+			// an unsigned delegation is proven to have none
+			a, status = validate(t, z, v, "insecure.example", dnsmessage.TypeDS)
+			assert.False(t, hasType(a.Answers, dnsmessage.TypeDS))
+			assert.NotEqual(t, dnssec.Bogus, status)
+		})
+	}
+}
+
+func TestSignedZoneOptOut(t *testing.T) {
+	z := loadSignedZone(t, SigningConfig{NSEC3: true, OptOut: true})
+	param := &dnsmessage.NSEC3PARAM{HashAlgorithm: nsec3SHA1}
+	for _, name := range []string{"example", "www.example", "secure.example", "b.c.example"} {
+		_, ok := z.nsec3For(dnsmessage.ParseDomainName(name))
+		assert.True(t, ok, name)
+	}
+	_, ok := z.nsec3For(dnsmessage.ParseDomainName("insecure.example"))
+	assert.False(t, ok)
+	assert.NotNil(t, z.lookup(hashedName(dnssec.HashName(dnsmessage.ParseDomainName("www.example"), param.Salt, param.Iterations), z.Origin)))
+}
+
+func TestSignedZoneUpdate(t *testing.T) {
+	z := loadSignedZone(t, SigningConfig{})
+	sigOf := func(z *Zone, name string, typ dnsmessage.RRType) string {
+		sigs := z.signatures(dnsmessage.ParseDomainName(name), typ)
+		require.Len(t, sigs, 1, "%s/%s", name, typ)
+		return string(sigs[0].RData)
+	}
+
+	host := dnsmessage.ResourceRecords{{Name: dnsmessage.ParseDomainName("host.example"), Type: dnsmessage.TypeA, Class: dnsmessage.ClassIN, TTL: 60, RData: []byte{192, 0, 2, 10}}}
+	next, rcode, err := z.Update(nil, host)
+	require.NoError(t, err)
+	require.Equal(t, dnsmessage.RCodeNoError, rcode)
+
+	// the new records are signed and the chain takes them in
+	validate(t, next, validator(t, next), "host.example", dnsmessage.TypeA)
+	validate(t, next, validator(t, next), "hosts.example", dnsmessage.TypeA)
+	// unchanged RRsets keep their signatures, the SOA changed
+	assert.Equal(t, sigOf(z, "www.example", dnsmessage.TypeA), sigOf(next, "www.example", dnsmessage.TypeA))
+	assert.Equal(t, sigOf(z, "example", dnsmessage.TypeDNSKEY), sigOf(next, "example", dnsmessage.TypeDNSKEY))
+	assert.NotEqual(t, sigOf(z, "example", dnsmessage.TypeSOA), sigOf(next, "example", dnsmessage.TypeSOA))
+}
+
+func TestResign(t *testing.T) {
+	z := loadSignedZone(t, SigningConfig{Validity: 10 * time.Hour, Refresh: 2 * time.Hour})
+	resignAt := z.ResignAt()
+	assert.WithinDuration(t, time.Now().Add(8*time.Hour), resignAt, time.Minute)
+
+	same, err := z.Resign(resignAt.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Same(t, z, same)
+
+	next, err := z.Resign(resignAt)
+	require.NoError(t, err)
+	assert.Equal(t, z.Serial()+1, next.Serial())
+	assert.True(t, next.ResignAt().After(resignAt))
+	for _, rr := range next.Records() {
+		if rr.Type != dnsmessage.TypeRRSIG {
+			continue
+		}
+		sig, err := dnsmessage.UnpackRRSIG(rr.RData)
+		require.NoError(t, err)
+		assert.Greater(t, int64(sig.Expiration), resignAt.Add(2*time.Hour).Unix())
+	}
+
+	// a restart serves the new serial from the journal
+	unsigned, err := Load(&Config{Origin: "example.", File: z.journalFile[:len(z.journalFile)-len(".jnl")]})
+	require.NoError(t, err)
+	assert.Equal(t, next.Serial(), unsigned.Serial())
+}
+
+func TestSignedZoneRestart(t *testing.T) {
+	cfg := signedZoneConfig(t, SigningConfig{})
+	// signing changes the zone in the master file
+	z, err := Load(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), z.Serial())
+
+	// a restart serves the same signatures with the same serial
+	loaded, err := Load(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, z.Serial(), loaded.Serial())
+	assert.ElementsMatch(t, section(z.Records()), section(loaded.Records()))
+
+	// a restart after the signatures are due changes the serial
+	unsigned, err := Load(&Config{Origin: cfg.Origin, File: cfg.File})
+	require.NoError(t, err)
+	unsigned.signer = z.signer
+	later, err := unsigned.signLoaded(z.ResignAt())
+	require.NoError(t, err)
+	assert.Equal(t, z.Serial()+1, later.Serial())
+	loaded, err = Load(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, later.Serial(), loaded.Serial())
+}
+
+func TestSigningConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	ksk := writeSigningKey(t, dir, "ksk")
+	notPEM := filepath.Join(dir, "key.txt")
+	require.NoError(t, os.WriteFile(notPEM, []byte("secret"), 0o600))
+
+	for _, cfg := range []SigningConfig{
+		{},
+		{KSK: filepath.Join(dir, "missing.pem")},
+		{KSK: notPEM},
+		{KSK: ksk, OptOut: true},
+		{KSK: ksk, NSEC3: true, Salt: "xyz"},
+		{KSK: ksk, Validity: time.Hour, Refresh: 2 * time.Hour},
+	} {
+		_, err := newSigner(&cfg)
+		assert.Error(t, err, cfg)
+	}
+}
@@ -0,0 +1,79 @@
+package zone
+
+import (
+	"net/netip"
+	"sync"
+
+	"server/pkg/dnsmessage"
+	"server/pkg/nametree"
+)
+
+// Store holds the zones we are authoritative for. Zones are replaced as
+// a whole so that lookups never see a zone that is changed halfway.
+type Store struct {
+	mu    sync.RWMutex
+	zones *nametree.Tree[*Zone]
+}
+
+func NewStore() *Store {
+	return &Store{zones: nametree.New[*Zone]()}
+}
+
+// Add adds the zone to the store, replacing a zone with the same origin.
+// A replaced zone with a lower serial leaves its changes to the new zone
+// for incremental transfers, so the zone must not be in use yet.
+func (s *Store) Add(z *Zone) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.zones.Get(z.Origin); ok {
+		z.succeed(old)
+	}
+	s.zones.Insert(z.Origin, z)
+}
+
+// Remove stops serving the zone with the origin.
+func (s *Store) Remove(origin dnsmessage.DomainName) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.zones.Delete(origin)
+}
+
+// Get returns the zone with the origin or nil.
+func (s *Store) Get(origin dnsmessage.DomainName) *Zone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	z, _ := s.zones.Get(origin)
+	return z
+}
+
+// Find returns the closest zone the name is in or nil.
+func (s *Store) Find(name dnsmessage.DomainName) *Zone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	z, _ := s.zones.Match(name)
+	return z
+}
+
+// Hosts returns the A and AAAA records with the address from all zones.
+func (s *Store) Hosts(addr netip.Addr) dnsmessage.ResourceRecords {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var records dnsmessage.ResourceRecords
+	for _, z := range s.zones.Values() {
+		records = append(records, z.Hosts(addr)...)
+	}
+	return records
+}
+
+// Answer answers the question from the closest zone, with the DNSSEC
+// records if asked for. Questions for names outside of all zones are refused.
+func (s *Store) Answer(q *dnsmessage.Question, dnssec bool) *Answer {
+	z := s.Find(q.QName)
+	if z == nil || q.QClass != z.Class {
+		return &Answer{RCode: dnsmessage.RCodeRefused}
+	}
+	if dnssec {
+		return z.LookupDNSSEC(q)
+	}
+	return z.Lookup(q)
+}
@@ -0,0 +1,128 @@
+package zone
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"server/pkg/dnsmessage"
+)
+
+// changes of a zone kept for incremental transfers
+const maxJournal = 64
+
+// Diff is the change from one version of a zone to the next
+// in the form of an incremental transfer (RFC 1995, section 4).
+type Diff struct {
+	OldSOA  *dnsmessage.ResourceRecord
+	Deleted dnsmessage.ResourceRecords
+	NewSOA  *dnsmessage.ResourceRecord
+	Added   dnsmessage.ResourceRecords
+}
+
+// NewDiff returns the records deleted from and added to the old zone,
+// the SOA records aside.
+func NewDiff(old, new *Zone) *Diff {
+	d := &Diff{OldSOA: old.SOA(), NewSOA: new.SOA()}
+	in := func(z *Zone, rr *dnsmessage.ResourceRecord) bool {
+		n := z.lookup(rr.Name)
+		if n == nil {
+			return false
+		}
+		for _, other := range n.rrsets[rr.Type] {
+			if other.TTL == rr.TTL && bytes.Equal(other.RData, rr.RData) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rr := range old.records[1:] {
+		if !in(new, rr) {
+			d.Deleted = append(d.Deleted, rr)
+		}
+	}
+	for _, rr := range new.records[1:] {
+		if !in(old, rr) {
+			d.Added = append(d.Added, rr)
+		}
+	}
+	return d
+}
+
+// succeed makes the zone the next version of old. The changes since old
+// are added to its journal if the serial went up, a zone with the same or
+// a lower serial can't be transferred incrementally.
+func (z *Zone) succeed(old *Zone) {
+	if z == old || !serialLess(old.Serial(), z.Serial()) {
+		return
+	}
+	journal := old.journal
+	if len(journal) >= maxJournal {
+		journal = journal[len(journal)-maxJournal+1:]
+	}
+	z.journal = append(append([]*Diff(nil), journal...), NewDiff(old, z))
+}
+
+// AXFR returns the records of a full zone transfer: the SOA, all
+// other records and the SOA again (RFC 5936, section 2.2).
+func (z *Zone) AXFR() dnsmessage.ResourceRecords {
+	return append(append(dnsmessage.ResourceRecords(nil), z.records...), z.SOA())
+}
+
+// IXFR returns the records of an incremental transfer to a secondary with
+// the serial (RFC 1995, section 4). A secondary that is up to date gets
+// the SOA alone and one with a version the journal doesn't go back to
+// gets the whole zone.
+func (z *Zone) IXFR(from uint32) dnsmessage.ResourceRecords {
+	if !serialLess(from, z.Serial()) {
+		return dnsmessage.ResourceRecords{z.SOA()}
+	}
+	for i, d := range z.journal {
+		if serial(d.OldSOA) != from {
+			continue
+		}
+		records := dnsmessage.ResourceRecords{z.SOA()}
+		for _, d := range z.journal[i:] {
+			records = append(records, d.OldSOA)
+			records = append(records, d.Deleted...)
+			records = append(records, d.NewSOA)
+			records = append(records, d.Added...)
+		}
+		return append(records, z.SOA())
+	}
+	return z.AXFR()
+}
+
+// serial returns the serial number of a valid SOA record.
+func serial(soa *dnsmessage.ResourceRecord) uint32 {
+	return binary.BigEndian.Uint32(soa.RData[len(soa.RData)-20:])
+}
+
+// serialLess compares serial numbers in sequence space (RFC 1982, section 3.2).
+func serialLess(a, b uint32) bool {
+	return a != b && int32(b-a) > 0
+}
+
+// splitDiffs splits the changes of an incremental transfer without
+// the SOA records around them into diffs.
+func splitDiffs(records dnsmessage.ResourceRecords) ([]*Diff, error) {
+	var diffs []*Diff
+	for i := 0; i < len(records); {
+		if records[i].Type != dnsmessage.TypeSOA {
+			return nil, errors.New("change doesn't start with an SOA record")
+		}
+		d := &Diff{OldSOA: records[i]}
+		for i++; i < len(records) && records[i].Type != dnsmessage.TypeSOA; i++ {
+			d.Deleted = append(d.Deleted, records[i])
+		}
+		if i == len(records) {
+			return nil, errors.New("incomplete change")
+		}
+		d.NewSOA = records[i]
+		for i++; i < len(records) && records[i].Type != dnsmessage.TypeSOA; i++ {
+			d.Added = append(d.Added, records[i])
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs, nil
+}
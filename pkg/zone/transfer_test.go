@@ -0,0 +1,143 @@
+package zone
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"server/pkg/dnsmessage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// versionOf builds example. with the serial and the records.
+func versionOf(t *testing.T, serial uint32, records string) *Zone {
+	text := fmt.Sprintf("$ORIGIN example.\n$TTL 60\n@ SOA ns1 host %d 2 3 4 5\n@ NS ns1\nns1 A 192.0.2.53\n%s", serial, records)
+	rrs, err := Parse(strings.NewReader(text), "example.zone", nil)
+	require.NoError(t, err)
+	z, err := New(dnsmessage.ParseDomainName("example."), rrs)
+	require.NoError(t, err)
+	return z
+}
+
+func TestAXFR(t *testing.T) {
+	z := versionOf(t, 1, "www A 192.0.2.80\n")
+	assert.Equal(t, []string{
+		"example SOA ns1.example. host.example. 1 2 3 4 5",
+		"example NS ns1.example.",
+		"ns1.example A 192.0.2.53",
+		"www.example A 192.0.2.80",
+		"example SOA ns1.example. host.example. 1 2 3 4 5",
+	}, section(z.AXFR()))
+}
+
+func TestIXFR(t *testing.T) {
+	s := NewStore()
+	v1 := versionOf(t, 1, "www A 192.0.2.80\nold A 192.0.2.1\n")
+	v2 := versionOf(t, 2, "www A 192.0.2.81\nold A 192.0.2.1\n")
+	v3 := versionOf(t, 3, "www A 192.0.2.81\nnew A 192.0.2.2\n")
+	for _, z := range []*Zone{v1, v2, v3} {
+		s.Add(z)
+	}
+
+	soa := func(serial int) string {
+		return fmt.Sprintf("example SOA ns1.example. host.example. %d 2 3 4 5", serial)
+	}
+	assert.Equal(t, []string{
+		soa(3),
+		soa(1), "www.example A 192.0.2.80", soa(2), "www.example A 192.0.2.81",
+		soa(2), "old.example A 192.0.2.1", soa(3), "new.example A 192.0.2.2",
+		soa(3),
+	}, section(v3.IXFR(1)))
+	assert.Equal(t, []string{soa(3), soa(2), "old.example A 192.0.2.1", soa(3), "new.example A 192.0.2.2", soa(3)}, section(v3.IXFR(2)))
+	// up to date or ahead
+	assert.Equal(t, []string{soa(3)}, section(v3.IXFR(3)))
+	assert.Equal(t, []string{soa(3)}, section(v3.IXFR(4)))
+	// a version the journal doesn't know
+	assert.Equal(t, section(v3.AXFR()), section(v3.IXFR(0)))
+
+	// a lower serial starts over
+	v0 := versionOf(t, 0, "")
+	s.Add(v0)
+	assert.Empty(t, v0.journal)
+	assert.Same(t, v0, s.Get(v0.Origin))
+}
+
+func TestIXFRJournalLimit(t *testing.T) {
+	s := NewStore()
+	var z *Zone
+	for serial := range uint32(maxJournal + 10) {
+		z = versionOf(t, serial, fmt.Sprintf("www A 192.0.2.%d\n", serial))
+		s.Add(z)
+	}
+	assert.Len(t, z.journal, maxJournal)
+	assert.Equal(t, section(z.AXFR()), section(z.IXFR(5)))
+	assert.NotEqual(t, section(z.AXFR()), section(z.IXFR(10)))
+}
+
+func TestSerialLess(t *testing.T) {
+	assert.True(t, serialLess(1, 2))
+	assert.False(t, serialLess(2, 1))
+	assert.False(t, serialLess(2, 2))
+	// the serial wraps around
+	assert.True(t, serialLess(0xFFFFFFFF, 1))
+	assert.False(t, serialLess(1, 0xFFFFFFFF))
+}
+
+func TestACL(t *testing.T) {
+	acl, err := ParseACL([]string{"192.0.2.1", "10.0.0.0/8", "2001:db8::/32"})
+	require.NoError(t, err)
+
+	for addr, exp := range map[string]bool{
+		"192.0.2.1":          true,
+		"192.0.2.2":          false,
+		"10.1.2.3":           true,
+		"::ffff:10.1.2.3":    true,
+		"2001:db8::53":       true,
+		"2001:db9::53":       false,
+		"fe80::1":            false,
+		"::ffff:192.0.2.100": false,
+	} {
+		assert.Equal(t, exp, acl.Allows(netip.MustParseAddr(addr)), addr)
+	}
+	assert.False(t, ACL(nil).Allows(netip.MustParseAddr("127.0.0.1")))
+
+	_, err = ParseACL([]string{"not-an-ip"})
+	assert.Error(t, err)
+}
+
+func TestTransferred(t *testing.T) {
+	s := NewStore()
+	v1 := versionOf(t, 1, "www A 192.0.2.80\nold A 192.0.2.1\n")
+	v2 := versionOf(t, 2, "www A 192.0.2.81\nold A 192.0.2.1\n")
+	v3 := versionOf(t, 3, "www A 192.0.2.81\nnew A 192.0.2.2\n")
+	for _, z := range []*Zone{v1, v2, v3} {
+		s.Add(z)
+	}
+
+	records := v3.IXFR(1)
+	require.True(t, transferComplete(records, v1))
+	for i := 1; i < len(records)-1; i++ {
+		assert.False(t, transferComplete(records[:i], v1), "%d records", i)
+	}
+	z, err := transferred(v1.Origin, records, v1)
+	require.NoError(t, err)
+	assert.Equal(t, section(v3.AXFR()), section(z.AXFR()))
+
+	// a whole zone instead of the changes
+	z, err = transferred(v1.Origin, v3.AXFR(), v1)
+	require.NoError(t, err)
+	assert.Equal(t, section(v3.AXFR()), section(z.AXFR()))
+
+	// nothing newer
+	assert.True(t, transferComplete(v3.IXFR(3), v3))
+	z, err = transferred(v3.Origin, v3.IXFR(3), v3)
+	require.NoError(t, err)
+	assert.Same(t, v3, z)
+
+	// changes that don't start at our version
+	_, err = transferred(v2.Origin, v3.IXFR(1), v2)
+	assert.Error(t, err)
+}
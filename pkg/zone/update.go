@@ -0,0 +1,267 @@
+package zone
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+
+	"server/pkg/dnsmessage"
+)
+
+// Update returns the zone with the updates of a dynamic update (RFC 2136)
+// applied if the prerequisites hold, or the response code saying why not.
+// Unless the updates raise the serial themselves, it goes up by one. The
+// change is added to the journal of the zone before it is returned, the
+// zone itself is returned if nothing changed.
+func (z *Zone) Update(prereqs, updates dnsmessage.ResourceRecords) (*Zone, dnsmessage.RCode, error) {
+	if rcode := z.checkPrerequisites(prereqs); rcode != dnsmessage.RCodeNoError {
+		return nil, rcode, nil
+	}
+	if rcode := z.checkUpdates(updates); rcode != dnsmessage.RCodeNoError {
+		return nil, rcode, nil
+	}
+
+	records := slices.Clone(z.records)
+	changed := false
+	for _, u := range updates {
+		var ok bool
+		records, ok = z.applyUpdate(records, u)
+		changed = changed || ok
+	}
+	if !changed {
+		return z, dnsmessage.RCodeNoError, nil
+	}
+	if !serialLess(z.Serial(), serial(records[0])) {
+		bumped, err := z.nextSOA(records[0])
+		if err != nil {
+			return nil, dnsmessage.RCodeServerFailure, err
+		}
+		records[0] = bumped
+	}
+
+	next, err := z.derive(records)
+	if err != nil {
+		return nil, dnsmessage.RCodeServerFailure, err
+	}
+	if err := z.writeJournal(next); err != nil {
+		return nil, dnsmessage.RCodeServerFailure, err
+	}
+	return next, dnsmessage.RCodeNoError, nil
+}
+
+// nextSOA returns the SOA record with the serial after the one of the zone.
+func (z *Zone) nextSOA(rr *dnsmessage.ResourceRecord) (*dnsmessage.ResourceRecord, error) {
+	soa, err := dnsmessage.UnpackSOA(rr.RData)
+	if err != nil {
+		return nil, err
+	}
+	soa.Serial = z.Serial() + 1
+	bumped := *rr
+	bumped.RData = soa.Pack()
+	return &bumped, nil
+}
+
+// writeJournal adds the change to the next version to the journal. A
+// journal with twice the changes kept for incremental transfers is
+// compacted first.
+func (z *Zone) writeJournal(next *Zone) error {
+	if z.journalFile == "" {
+		return nil
+	}
+	n := z.journalLen
+	if n >= 2*maxJournal {
+		if err := z.compactJournal(); err != nil {
+			return fmt.Errorf("failed to compact the journal: %w", err)
+		}
+		n = maxJournal + 1
+	}
+	if err := appendJournal(z.journalFile, NewDiff(z, next)); err != nil {
+		return fmt.Errorf("failed to write the journal: %w", err)
+	}
+	next.journalLen = n + 1
+	return nil
+}
+
+// checkPrerequisites checks the prerequisite section of an update
+// against the zone (RFC 2136, section 3.2).
+func (z *Zone) checkPrerequisites(prereqs dnsmessage.ResourceRecords) dnsmessage.RCode {
+	// RRsets that have to exist with exactly these records
+	var rrsets []dnsmessage.ResourceRecords
+	for _, rr := range prereqs {
+		if rr.TTL != 0 {
+			return dnsmessage.RCodeFormatError
+		}
+		if !dnsmessage.IsSubdomain(rr.Name, z.Origin) {
+			return dnsmessage.RCodeNotZone
+		}
+		n := z.lookup(rr.Name)
+		inUse := n != nil && len(n.rrsets) > 0
+		exists := n != nil && len(n.rrsets[rr.Type]) > 0
+
+		switch rr.Class {
+		case dnsmessage.ClassANY:
+			if len(rr.RData) != 0 {
+				return dnsmessage.RCodeFormatError
+			}
+			if rr.Type == dnsmessage.TypeANY && !inUse {
+				return dnsmessage.RCodeNameError
+			}
+			if rr.Type != dnsmessage.TypeANY && !exists {
+				return dnsmessage.RCodeNXRRSet
+			}
+		case dnsmessage.ClassNONE:
+			if len(rr.RData) != 0 {
+				return dnsmessage.RCodeFormatError
+			}
+			if rr.Type == dnsmessage.TypeANY && inUse {
+				return dnsmessage.RCodeYXDomain
+			}
+			if rr.Type != dnsmessage.TypeANY && exists {
+				return dnsmessage.RCodeYXRRSet
+			}
+		case z.Class:
+			i := slices.IndexFunc(rrsets, func(rrset dnsmessage.ResourceRecords) bool {
+				return rrset[0].Type == rr.Type && dnsmessage.EqualNames(rrset[0].Name, rr.Name)
+			})
+			if i < 0 {
+				rrsets = append(rrsets, dnsmessage.ResourceRecords{rr})
+			} else {
+				rrsets[i] = append(rrsets[i], rr)
+			}
+		default:
+			return dnsmessage.RCodeFormatError
+		}
+	}
+
+	for _, rrset := range rrsets {
+		var existing dnsmessage.ResourceRecords
+		if n := z.lookup(rrset[0].Name); n != nil {
+			existing = n.rrsets[rrset[0].Type]
+		}
+		if !sameRData(rrset, existing) || !sameRData(existing, rrset) {
+			return dnsmessage.RCodeNXRRSet
+		}
+	}
+	return dnsmessage.RCodeNoError
+}
+
+// sameRData reports whether every record of a has the RDATA of one in b.
+func sameRData(a, b dnsmessage.ResourceRecords) bool {
+	for _, rr := range a {
+		if !slices.ContainsFunc(b, func(other *dnsmessage.ResourceRecord) bool { return bytes.Equal(other.RData, rr.RData) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkUpdates checks the update section before anything
+// is changed (RFC 2136, section 3.4.1).
+func (z *Zone) checkUpdates(updates dnsmessage.ResourceRecords) dnsmessage.RCode {
+	for _, rr := range updates {
+		if !dnsmessage.IsSubdomain(rr.Name, z.Origin) {
+			return dnsmessage.RCodeNotZone
+		}
+		switch rr.Class {
+		case z.Class:
+			if metaType(rr.Type) {
+				return dnsmessage.RCodeFormatError
+			}
+		case dnsmessage.ClassANY:
+			if rr.TTL != 0 || len(rr.RData) != 0 || (metaType(rr.Type) && rr.Type != dnsmessage.TypeANY) {
+				return dnsmessage.RCodeFormatError
+			}
+		case dnsmessage.ClassNONE:
+			if rr.TTL != 0 || metaType(rr.Type) {
+				return dnsmessage.RCodeFormatError
+			}
+		default:
+			return dnsmessage.RCodeFormatError
+		}
+	}
+	return dnsmessage.RCodeNoError
+}
+
+// metaType reports whether the type is only found in questions or
+// carries data about a message instead of records (RFC 6895, section 3.1).
+func metaType(typ dnsmessage.RRType) bool {
+	return typ == dnsmessage.TypeOPT || (typ >= 128 && typ <= 255)
+}
+
+// applyUpdate applies a single update to the records, the SOA of which
+// comes first (RFC 2136, section 3.4.2). It reports whether they changed.
+func (z *Zone) applyUpdate(records dnsmessage.ResourceRecords, u *dnsmessage.ResourceRecord) (dnsmessage.ResourceRecords, bool) {
+	atApex := dnsmessage.EqualNames(u.Name, z.Origin)
+	at := func(rr *dnsmessage.ResourceRecord) bool { return dnsmessage.EqualNames(rr.Name, u.Name) }
+	deleted := func(del func(rr *dnsmessage.ResourceRecord) bool) (dnsmessage.ResourceRecords, bool) {
+		n := len(records)
+		records = slices.DeleteFunc(records, del)
+		return records, len(records) != n
+	}
+
+	switch u.Class {
+	case dnsmessage.ClassANY:
+		if u.Type == dnsmessage.TypeANY {
+			return deleted(func(rr *dnsmessage.ResourceRecord) bool {
+				return at(rr) && !(atApex && (rr.Type == dnsmessage.TypeSOA || rr.Type == dnsmessage.TypeNS))
+			})
+		}
+		if atApex && (u.Type == dnsmessage.TypeSOA || u.Type == dnsmessage.TypeNS) {
+			return records, false
+		}
+		return deleted(func(rr *dnsmessage.ResourceRecord) bool { return at(rr) && rr.Type == u.Type })
+
+	case dnsmessage.ClassNONE:
+		if u.Type == dnsmessage.TypeSOA {
+			return records, false
+		}
+		if atApex && u.Type == dnsmessage.TypeNS {
+			// the last NS record stays
+			others := slices.ContainsFunc(records, func(rr *dnsmessage.ResourceRecord) bool {
+				return at(rr) && rr.Type == dnsmessage.TypeNS && !bytes.Equal(rr.RData, u.RData)
+			})
+			if !others {
+				return records, false
+			}
+		}
+		return deleted(func(rr *dnsmessage.ResourceRecord) bool {
+			return at(rr) && rr.Type == u.Type && bytes.Equal(rr.RData, u.RData)
+		})
+	}
+
+	switch u.Type {
+	case dnsmessage.TypeSOA:
+		if !atApex || !serialLess(serial(records[0]), serial(u)) {
+			return records, false
+		}
+		records[0] = u
+		return records, true
+	case dnsmessage.TypeCNAME:
+		if slices.ContainsFunc(records, func(rr *dnsmessage.ResourceRecord) bool { return at(rr) && !cnameCompatible(rr.Type) }) {
+			return records, false
+		}
+		// replaces the CNAME the name may have
+		i := slices.IndexFunc(records, func(rr *dnsmessage.ResourceRecord) bool { return at(rr) && rr.Type == dnsmessage.TypeCNAME })
+		if i < 0 {
+			return append(records, u), true
+		}
+		if records[i].TTL == u.TTL && bytes.Equal(records[i].RData, u.RData) {
+			return records, false
+		}
+		records[i] = u
+		return records, true
+	}
+	if !cnameCompatible(u.Type) && slices.ContainsFunc(records, func(rr *dnsmessage.ResourceRecord) bool { return at(rr) && rr.Type == dnsmessage.TypeCNAME }) {
+		return records, false
+	}
+	for i, rr := range records {
+		if at(rr) && rr.Type == u.Type && bytes.Equal(rr.RData, u.RData) {
+			if rr.TTL == u.TTL {
+				return records, false
+			}
+			records[i] = u
+			return records, true
+		}
+	}
+	return append(records, u), true
+}
@@ -0,0 +1,247 @@
+package zone
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"server/pkg/dnsmessage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rr parses a record with an absolute name.
+func rr(t *testing.T, line string) *dnsmessage.ResourceRecord {
+	records, err := Parse(strings.NewReader(line), "", nil)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	return records[0]
+}
+
+// none turns the record into a prerequisite or deletion of its RDATA.
+func none(rr *dnsmessage.ResourceRecord) *dnsmessage.ResourceRecord {
+	c := *rr
+	c.Class = dnsmessage.ClassNONE
+	c.TTL = 0
+	return &c
+}
+
+// anyOf stands for the RRset of the name and type, or all of them.
+func anyOf(name string, typ dnsmessage.RRType) *dnsmessage.ResourceRecord {
+	return &dnsmessage.ResourceRecord{Name: dnsmessage.ParseDomainName(name), Type: typ, Class: dnsmessage.ClassANY}
+}
+
+func lookupLines(z *Zone, name string, typ dnsmessage.RRType) []string {
+	return section(z.Lookup(&dnsmessage.Question{QName: dnsmessage.ParseDomainName(name), QType: typ, QClass: dnsmessage.ClassIN}).Answers)
+}
+
+func TestUpdatePrerequisites(t *testing.T) {
+	z := loadExample(t)
+	value := func(line string) *dnsmessage.ResourceRecord {
+		r := rr(t, line)
+		r.TTL = 0
+		return r
+	}
+	tests := []struct {
+		name    string
+		prereqs dnsmessage.ResourceRecords
+		rcode   dnsmessage.RCode
+	}{
+		{"none", nil, dnsmessage.RCodeNoError},
+		{"RRset exists", dnsmessage.ResourceRecords{anyOf("www.example", dnsmessage.TypeA)}, dnsmessage.RCodeNoError},
+		{"RRset missing", dnsmessage.ResourceRecords{anyOf("www.example", dnsmessage.TypeAAAA)}, dnsmessage.RCodeNXRRSet},
+		{"name in use", dnsmessage.ResourceRecords{anyOf("www.example", dnsmessage.TypeANY)}, dnsmessage.RCodeNoError},
+		{"name not in use", dnsmessage.ResourceRecords{anyOf("host.example", dnsmessage.TypeANY)}, dnsmessage.RCodeNameError},
+		{"empty non-terminal", dnsmessage.ResourceRecords{anyOf("b.c.example", dnsmessage.TypeANY)}, dnsmessage.RCodeNameError},
+		{"RRset doesn't exist", dnsmessage.ResourceRecords{none(anyOf("www.example", dnsmessage.TypeAAAA))}, dnsmessage.RCodeNoError},
+		{"RRset exists after all", dnsmessage.ResourceRecords{none(anyOf("www.example", dnsmessage.TypeA))}, dnsmessage.RCodeYXRRSet},
+		{"name not in use after all", dnsmessage.ResourceRecords{none(anyOf("www.example", dnsmessage.TypeANY))}, dnsmessage.RCodeYXDomain},
+		{"name unused", dnsmessage.ResourceRecords{none(anyOf("host.example", dnsmessage.TypeANY))}, dnsmessage.RCodeNoError},
+		{"RRset with the value", dnsmessage.ResourceRecords{value("www.example. 0 IN A 192.0.2.80")}, dnsmessage.RCodeNoError},
+		{"RRset with another value", dnsmessage.ResourceRecords{value("www.example. 0 IN A 192.0.2.81")}, dnsmessage.RCodeNXRRSet},
+		{"whole RRset", dnsmessage.ResourceRecords{
+			value("example. 0 IN NS ns1.example."), value("example. 0 IN NS ns.other."),
+		}, dnsmessage.RCodeNoError},
+		{"part of the RRset", dnsmessage.ResourceRecords{value("example. 0 IN NS ns1.example.")}, dnsmessage.RCodeNXRRSet},
+		{"TTL", dnsmessage.ResourceRecords{rr(t, "www.example. 60 IN A 192.0.2.80")}, dnsmessage.RCodeFormatError},
+		{"outside of the zone", dnsmessage.ResourceRecords{anyOf("www.other", dnsmessage.TypeA)}, dnsmessage.RCodeNotZone},
+		{"class", dnsmessage.ResourceRecords{{Name: dnsmessage.ParseDomainName("www.example"), Type: dnsmessage.TypeA, Class: dnsmessage.ClassCH}}, dnsmessage.RCodeFormatError},
+		{"RDATA", dnsmessage.ResourceRecords{{Name: dnsmessage.ParseDomainName("www.example"), Type: dnsmessage.TypeA, Class: dnsmessage.ClassANY, RData: []byte{1, 2, 3, 4}}}, dnsmessage.RCodeFormatError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next, rcode, err := z.Update(tt.prereqs, nil)
+			require.NoError(t, err)
+			assert.Equal(t, tt.rcode, rcode)
+			if rcode == dnsmessage.RCodeNoError {
+				assert.Same(t, z, next)
+			} else {
+				assert.Nil(t, next)
+			}
+		})
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	z := loadExample(t)
+	update := func(z *Zone, updates ...*dnsmessage.ResourceRecord) *Zone {
+		t.Helper()
+		next, rcode, err := z.Update(nil, updates)
+		require.NoError(t, err)
+		require.Equal(t, dnsmessage.RCodeNoError, rcode)
+		return next
+	}
+
+	next := update(z,
+		rr(t, "host.example. 60 IN A 192.0.2.10"),
+		rr(t, "host.example. 60 IN AAAA 2001:db8::10"),
+		anyOf("www.example", dnsmessage.TypeA),
+		none(rr(t, "ns1.example. 0 IN AAAA 2001:db8::53")),
+	)
+	assert.Equal(t, uint32(2), next.Serial())
+	assert.Equal(t, []string{"host.example A 192.0.2.10"}, lookupLines(next, "host.example", dnsmessage.TypeA))
+	assert.Equal(t, []string{"host.example AAAA 2001:db8::10"}, lookupLines(next, "host.example", dnsmessage.TypeAAAA))
+	assert.Empty(t, lookupLines(next, "www.example", dnsmessage.TypeA))
+	assert.Empty(t, lookupLines(next, "ns1.example", dnsmessage.TypeAAAA))
+	assert.Len(t, lookupLines(next, "ns1.example", dnsmessage.TypeA), 1)
+	// the original is left alone
+	assert.Equal(t, uint32(1), z.Serial())
+	assert.Len(t, lookupLines(z, "www.example", dnsmessage.TypeA), 1)
+
+	// a new TTL replaces the record
+	next = update(z, rr(t, "www.example. 60 IN A 192.0.2.80"))
+	assert.Equal(t, uint32(60), next.Lookup(&dnsmessage.Question{QName: dnsmessage.ParseDomainName("www.example"), QType: dnsmessage.TypeA, QClass: dnsmessage.ClassIN}).Answers[0].TTL)
+
+	// the serial set by the update
+	next = update(z, rr(t, "example. 60 IN SOA ns1.example. hostmaster.example. 10 7200 1800 1209600 300"), rr(t, "host.example. 60 IN A 192.0.2.10"))
+	assert.Equal(t, uint32(10), next.Serial())
+	// but not a lower one
+	next = update(next, rr(t, "example. 60 IN SOA ns1.example. hostmaster.example. 5 7200 1800 1209600 300"), rr(t, "host.example. 60 IN A 192.0.2.11"))
+	assert.Equal(t, uint32(11), next.Serial())
+
+	// the apex keeps its SOA and NS records
+	next = update(z, anyOf("example", dnsmessage.TypeANY))
+	assert.Empty(t, lookupLines(next, "example", dnsmessage.TypeMX))
+	assert.Len(t, lookupLines(next, "example", dnsmessage.TypeNS), 2)
+	next = update(z, none(rr(t, "example. 0 IN NS ns1.example.")), none(rr(t, "example. 0 IN NS ns.other.")))
+	assert.Equal(t, []string{"example NS ns.other."}, lookupLines(next, "example", dnsmessage.TypeNS))
+
+	// a CNAME replaces a CNAME but nothing else
+	next = update(z, rr(t, "alias.example. 60 IN CNAME mail.example."))
+	assert.Equal(t, "alias.example CNAME mail.example.", lookupLines(next, "alias.example", dnsmessage.TypeCNAME)[0])
+	for _, u := range []*dnsmessage.ResourceRecord{
+		rr(t, "www.example. 60 IN CNAME mail.example."),
+		rr(t, "alias.example. 60 IN A 192.0.2.1"),
+		anyOf("example", dnsmessage.TypeSOA),
+		anyOf("example", dnsmessage.TypeNS),
+		none(rr(t, "example. 0 IN SOA ns1.example. hostmaster.example. 1 7200 1800 1209600 300")),
+		rr(t, "www.example. 3600 IN A 192.0.2.80"),
+		anyOf("host.example", dnsmessage.TypeANY),
+	} {
+		assert.Same(t, z, update(z, u), "%s %s", dnsmessage.DomainNameToString(u.Name), u.Type)
+	}
+}
+
+func TestUpdateErrors(t *testing.T) {
+	z := loadExample(t)
+	ttl := anyOf("www.example", dnsmessage.TypeA)
+	ttl.TTL = 60
+	for _, tt := range []struct {
+		update *dnsmessage.ResourceRecord
+		rcode  dnsmessage.RCode
+	}{
+		{rr(t, "www.other. 60 IN A 192.0.2.1"), dnsmessage.RCodeNotZone},
+		{&dnsmessage.ResourceRecord{Name: dnsmessage.ParseDomainName("www.example"), Type: dnsmessage.TypeA, Class: dnsmessage.ClassCH, RData: []byte{1, 2, 3, 4}}, dnsmessage.RCodeFormatError},
+		{&dnsmessage.ResourceRecord{Name: dnsmessage.ParseDomainName("www.example"), Type: dnsmessage.TypeANY, Class: dnsmessage.ClassIN}, dnsmessage.RCodeFormatError},
+		{anyOf("www.example", dnsmessage.TypeAXFR), dnsmessage.RCodeFormatError},
+		{ttl, dnsmessage.RCodeFormatError},
+		{rr(t, "www.example. 60 CLASS254 A 192.0.2.80"), dnsmessage.RCodeFormatError},
+	} {
+		// a valid update first, nothing is changed
+		next, rcode, err := z.Update(nil, dnsmessage.ResourceRecords{rr(t, "host.example. 60 IN A 192.0.2.10"), tt.update})
+		require.NoError(t, err)
+		assert.Equal(t, tt.rcode, rcode)
+		assert.Nil(t, next)
+	}
+}
+
+func TestUpdateJournal(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{Origin: "example.", File: filepath.Join(dir, "example.zone")}
+	require.NoError(t, os.WriteFile(cfg.File, []byte(exampleZone), 0o644))
+	z, err := Load(cfg)
+	require.NoError(t, err)
+
+	z, _, err = z.Update(nil, dnsmessage.ResourceRecords{rr(t, "host.example. 60 IN A 192.0.2.10")})
+	require.NoError(t, err)
+	z, _, err = z.Update(nil, dnsmessage.ResourceRecords{anyOf("www.example", dnsmessage.TypeA), rr(t, "host.example. 60 IN TXT \"a host\"")})
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), z.Serial())
+
+	// the updates survive a restart
+	loaded, err := Load(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), loaded.Serial())
+	assert.ElementsMatch(t, section(z.Records()), section(loaded.Records()))
+
+	// the file was edited since
+	edited := strings.Replace(exampleZone, "hostmaster 1", "hostmaster 5", 1)
+	require.NoError(t, os.WriteFile(cfg.File, []byte(edited), 0o644))
+	loaded, err = Load(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(5), loaded.Serial())
+	assert.Empty(t, lookupLines(loaded, "host.example", dnsmessage.TypeA))
+
+	// and updated again
+	_, _, err = loaded.Update(nil, dnsmessage.ResourceRecords{rr(t, "host.example. 60 IN A 192.0.2.11")})
+	require.NoError(t, err)
+	loaded, err = Load(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(6), loaded.Serial())
+	assert.Equal(t, []string{"host.example A 192.0.2.11"}, lookupLines(loaded, "host.example", dnsmessage.TypeA))
+
+	// a broken journal
+	require.NoError(t, os.WriteFile(journalPath(cfg.File), []byte("host.example. 60 IN A 192.0.2.1\n"), 0o644))
+	_, err = Load(cfg)
+	assert.Error(t, err)
+}
+
+func TestJournalCompaction(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{Origin: "example.", File: filepath.Join(dir, "example.zone")}
+	require.NoError(t, os.WriteFile(cfg.File, []byte(exampleZone), 0o644))
+	z, err := Load(cfg)
+	require.NoError(t, err)
+
+	updates := 2*maxJournal + 10
+	for i := range updates {
+		z, _, err = z.Update(nil, dnsmessage.ResourceRecords{rr(t, fmt.Sprintf("host%d.example. 60 IN A 192.0.2.%d", i, i%250))})
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint32(1+updates), z.Serial())
+
+	// the old changes are folded into one
+	diffs, err := readJournal(journalPath(cfg.File))
+	require.NoError(t, err)
+	assert.Less(t, len(diffs), 2*maxJournal)
+	assert.Equal(t, uint32(1), serial(diffs[0].OldSOA))
+	assert.Equal(t, z.Serial(), serial(diffs[len(diffs)-1].NewSOA))
+
+	loaded, err := Load(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, z.Serial(), loaded.Serial())
+	assert.ElementsMatch(t, section(z.Records()), section(loaded.Records()))
+
+	// changes to an older serial than the master file's are dropped
+	edited := strings.Replace(exampleZone, "hostmaster 1", fmt.Sprintf("hostmaster %d", 2+updates), 1)
+	require.NoError(t, os.WriteFile(cfg.File, []byte(edited), 0o644))
+	loaded, err = Load(cfg)
+	require.NoError(t, err)
+	require.NoError(t, loaded.compactJournal())
+	diffs, err = readJournal(journalPath(cfg.File))
+	require.NoError(t, err)
+	assert.Len(t, diffs, maxJournal)
+}
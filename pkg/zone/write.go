@@ -0,0 +1,84 @@
+package zone
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"server/pkg/dnsmessage"
+)
+
+// Write writes the records of the zone in master file format, the SOA
+// first. Every name is absolute so the file reads back without an origin.
+func (z *Zone) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, rr := range z.records {
+		if _, err := fmt.Fprintln(bw, recordLine(rr)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Save writes the zone to the file at path. The file is replaced at
+// once so that it never holds half a zone.
+func (z *Zone) Save(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := z.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// recordLine formats the record. RDATA whose presentation format doesn't
+// read back the same, like names with odd characters, is written in the
+// generic format (RFC 3597, section 5).
+func recordLine(rr *dnsmessage.ResourceRecord) string {
+	prefix := fmt.Sprintf("%s %d CLASS%d TYPE%d ", nameText(rr.Name), rr.TTL, rr.Class, rr.Type)
+	if typ := rr.Type.String(); !strings.HasPrefix(typ, "UNKNOWN") {
+		prefix = fmt.Sprintf("%s %d CLASS%d %s ", nameText(rr.Name), rr.TTL, rr.Class, typ)
+	}
+
+	line := prefix + rr.RDataString()
+	if back, err := Parse(strings.NewReader(line), "", nil); err == nil && len(back) == 1 && bytes.Equal(back[0].RData, rr.RData) {
+		return line
+	}
+	return prefix + fmt.Sprintf("\\# %d %x", len(rr.RData), rr.RData)
+}
+
+// nameText formats an absolute name with the characters that
+// mean something in a master file escaped.
+func nameText(name dnsmessage.DomainName) string {
+	if len(name) == 0 {
+		return "."
+	}
+	var sb strings.Builder
+	for _, label := range name {
+		for _, c := range label {
+			switch {
+			case c <= ' ' || c >= 0x7F:
+				fmt.Fprintf(&sb, "\\%03d", c)
+			case strings.IndexByte(`.\"();@$`, c) >= 0:
+				sb.WriteByte('\\')
+				sb.WriteByte(c)
+			default:
+				sb.WriteByte(c)
+			}
+		}
+		sb.WriteByte('.')
+	}
+	return sb.String()
+}
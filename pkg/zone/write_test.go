@@ -0,0 +1,52 @@
+package zone
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"server/pkg/dnsmessage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	z := loadExample(t)
+	odd := `"quoted \"text\"" "semi;colon"
+weird\.label	TXT	"a\\b"
+sp\032ace	A	192.0.2.9
+@	TYPE65534	\# 3 010203
+`
+	records, err := Parse(strings.NewReader("$ORIGIN example.\n$TTL 60\n@ TXT "+odd), "odd.zone", nil)
+	require.NoError(t, err)
+	z, err = New(z.Origin, append(z.Records(), records...))
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+	require.NoError(t, z.Write(&b))
+	back, err := Parse(&b, "written.zone", nil)
+	require.NoError(t, err)
+
+	require.Len(t, back, len(z.Records()))
+	for i, rr := range z.Records() {
+		assert.True(t, dnsmessage.EqualNames(rr.Name, back[i].Name), nameString(rr.Name))
+		assert.Equal(t, rr.Type, back[i].Type)
+		assert.Equal(t, rr.TTL, back[i].TTL)
+		assert.Equal(t, rr.RData, back[i].RData, "%s %s", nameString(rr.Name), rr.Type)
+	}
+}
+
+func TestSave(t *testing.T) {
+	z := loadExample(t)
+	path := filepath.Join(t.TempDir(), "example.zone")
+	require.NoError(t, z.Save(path))
+
+	loaded, err := Load(&Config{Origin: "example.", File: path})
+	require.NoError(t, err)
+	assert.Equal(t, section(z.AXFR()), section(loaded.AXFR()))
+	matches, err := filepath.Glob(path + ".*")
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+}
@@ -0,0 +1,479 @@
+package zone
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"server/pkg/dnsmessage"
+)
+
+// CNAMEs followed within a zone before giving up
+const maxCNAMEs = 8
+
+// Config names a zone and the master file it is loaded from.
+type Config struct {
+	Origin string `yaml:"origin"`
+	File   string `yaml:"file"`
+	// addresses or CIDRs of the secondaries that may transfer the zone
+	AllowTransfer []string `yaml:"allow_transfer"`
+	// addresses of the primaries to transfer the zone from, this makes us
+	// a secondary for the zone and File the copy kept between restarts
+	Primaries []string `yaml:"primaries"`
+	// addresses of the secondaries to notify when the zone changes
+	Notify []string `yaml:"notify"`
+	// addresses or CIDRs of the clients that may update the zone
+	AllowUpdate []string `yaml:"allow_update"`
+	// names of the TSIG keys that may transfer or update the
+	// zone, from any address
+	TransferKeys []string `yaml:"transfer_keys"`
+	UpdateKeys   []string `yaml:"update_keys"`
+	// name of the TSIG key signing our transfers from the primaries
+	// and NOTIFY in both directions
+	Key string `yaml:"key"`
+	// signs the zone, not for secondary zones
+	DNSSEC *SigningConfig `yaml:"dnssec"`
+}
+
+// Zone holds the records of a zone we are authoritative for. It is never
+// changed once built, a changed zone is a new Zone.
+type Zone struct {
+	Origin dnsmessage.DomainName
+	Class  dnsmessage.RRClass
+	// clients that may transfer the zone, nobody if empty
+	AllowTransfer ACL
+	// secondaries told about new versions of the zone
+	Notify []string
+	// clients that may update the zone, nobody if empty
+	AllowUpdate ACL
+	// names of the TSIG keys that may transfer or update the zone
+	TransferKeys []string
+	UpdateKeys   []string
+	// name of the TSIG key signing NOTIFY to the secondaries
+	Key string
+
+	records dnsmessage.ResourceRecords // the SOA first
+	nodes   map[string]*node
+	journal []*Diff // the changes leading up to the zone, oldest first
+	// file keeping the updates of the zone and the number of changes
+	// in it, see Update
+	journalFile string
+	journalLen  int
+	// nil for zones we don't sign, see Resign
+	signer   *signer
+	resignAt time.Time
+	// the NSEC and NSEC3 records of a signed zone by their owner
+	// in canonical order and by their hash
+	nsecs  dnsmessage.ResourceRecords
+	nsec3s []hashedRecord
+	// the A and AAAA records by their address, see Hosts
+	hosts map[netip.Addr]dnsmessage.ResourceRecords
+}
+
+// node holds the RRsets of a name. Empty non-terminals have a node
+// without RRsets so that they are known to exist.
+type node struct {
+	name   dnsmessage.DomainName
+	rrsets map[dnsmessage.RRType]dnsmessage.ResourceRecords
+}
+
+// Answer is the response to a question from a zone.
+type Answer struct {
+	RCode dnsmessage.RCode
+	// false for referrals to a delegated zone and for refused questions
+	Authoritative bool
+	Answers       dnsmessage.ResourceRecords
+	Authority     dnsmessage.ResourceRecords
+	Additional    dnsmessage.ResourceRecords
+}
+
+// Load reads the zone from its master file and applies the updates in
+// its journal. Updates to an older serial than the one in the master file
+// are ignored, the file was edited since. Zones we sign are signed after
+// that, see signLoaded.
+func Load(cfg *Config) (*Zone, error) {
+	acl, err := ParseACL(cfg.AllowTransfer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allow_transfer: %w", err)
+	}
+	updaters, err := ParseACL(cfg.AllowUpdate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allow_update: %w", err)
+	}
+	origin := dnsmessage.ParseDomainName(cfg.Origin)
+	records, err := ParseFile(cfg.File, origin)
+	if err != nil {
+		return nil, err
+	}
+	z, err := New(origin, records)
+	if err != nil {
+		return nil, err
+	}
+	z.AllowTransfer = acl
+	z.Notify = cfg.Notify
+	z.AllowUpdate = updaters
+	z.TransferKeys = cfg.TransferKeys
+	z.UpdateKeys = cfg.UpdateKeys
+	z.Key = cfg.Key
+	z.journalFile = journalPath(cfg.File)
+	var signer *signer
+	if cfg.DNSSEC != nil {
+		if signer, err = newSigner(cfg.DNSSEC); err != nil {
+			return nil, fmt.Errorf("invalid dnssec: %w", err)
+		}
+	}
+
+	diffs, err := readJournal(z.journalFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid journal: %w", err)
+	}
+	for _, d := range diffs {
+		if serial(d.OldSOA) != z.Serial() {
+			continue
+		}
+		if z, err = z.apply(d); err != nil {
+			return nil, fmt.Errorf("invalid journal: %w", err)
+		}
+	}
+	z.journalLen = len(diffs)
+	if signer != nil {
+		z.signer = signer
+		return z.signLoaded(time.Now())
+	}
+	return z, nil
+}
+
+// New builds the zone from its records and checks that they make up a
+// zone: a single SOA and NS records at the origin, every record within
+// the zone and no CNAME next to other data.
+func New(origin dnsmessage.DomainName, records dnsmessage.ResourceRecords) (*Zone, error) {
+	z := &Zone{Origin: origin, nodes: make(map[string]*node)}
+	z.node(origin)
+
+	for _, rr := range records {
+		if !dnsmessage.IsSubdomain(rr.Name, origin) {
+			return nil, fmt.Errorf("%s is outside of the zone %s", nameString(rr.Name), nameString(origin))
+		}
+		if z.Class == 0 {
+			z.Class = rr.Class
+		} else if rr.Class != z.Class {
+			return nil, fmt.Errorf("%s has class %s, not %s", nameString(rr.Name), rr.Class, z.Class)
+		}
+
+		n := z.node(rr.Name)
+		rrset := n.rrsets[rr.Type]
+		if slices.ContainsFunc(rrset, func(other *dnsmessage.ResourceRecord) bool { return bytes.Equal(other.RData, rr.RData) }) {
+			continue
+		}
+		n.rrsets[rr.Type] = append(rrset, rr)
+
+		if rr.Type == dnsmessage.TypeSOA {
+			if !dnsmessage.EqualNames(rr.Name, origin) {
+				return nil, fmt.Errorf("SOA record of %s is not at the origin of the zone", nameString(rr.Name))
+			}
+			if len(n.rrsets[rr.Type]) > 1 {
+				return nil, errors.New("more than one SOA record")
+			}
+			if _, err := dnsmessage.UnpackSOA(rr.RData); err != nil {
+				return nil, fmt.Errorf("invalid SOA record: %w", err)
+			}
+			z.records = append(dnsmessage.ResourceRecords{rr}, z.records...)
+			continue
+		}
+		z.records = append(z.records, rr)
+	}
+
+	apex := z.nodes[nameKey(origin)]
+	if len(apex.rrsets[dnsmessage.TypeSOA]) == 0 {
+		return nil, fmt.Errorf("no SOA record for %s", nameString(origin))
+	}
+	if len(apex.rrsets[dnsmessage.TypeNS]) == 0 {
+		return nil, fmt.Errorf("no NS records for %s", nameString(origin))
+	}
+	for _, n := range z.nodes {
+		if cname := n.rrsets[dnsmessage.TypeCNAME]; len(cname) > 0 {
+			if len(cname) > 1 {
+				return nil, fmt.Errorf("%s has more than one CNAME record", nameString(n.name))
+			}
+			for typ := range n.rrsets {
+				if !cnameCompatible(typ) {
+					return nil, fmt.Errorf("%s has a CNAME record and other data", nameString(n.name))
+				}
+			}
+		}
+	}
+	if err := z.indexDenial(); err != nil {
+		return nil, err
+	}
+	z.indexHosts()
+	return z, nil
+}
+
+// cnameCompatible reports whether records of the type may
+// exist next to a CNAME (RFC 2181, section 10.1 and RFC 4035).
+func cnameCompatible(typ dnsmessage.RRType) bool {
+	switch typ {
+	case dnsmessage.TypeCNAME, dnsmessage.TypeRRSIG, dnsmessage.TypeNSEC:
+		return true
+	}
+	return false
+}
+
+// node returns the node of the name and creates it along with
+// the empty non-terminals above it if it doesn't exist yet.
+func (z *Zone) node(name dnsmessage.DomainName) *node {
+	key := nameKey(name)
+	if n, ok := z.nodes[key]; ok {
+		return n
+	}
+	n := &node{name: name, rrsets: make(map[dnsmessage.RRType]dnsmessage.ResourceRecords)}
+	z.nodes[key] = n
+	if len(name) > len(z.Origin) {
+		z.node(name[1:])
+	}
+	return n
+}
+
+// derive builds the next version of the zone from the records,
+// signed if the zone is.
+func (z *Zone) derive(records dnsmessage.ResourceRecords) (*Zone, error) {
+	return z.deriveAt(records, time.Now())
+}
+
+func (z *Zone) deriveAt(records dnsmessage.ResourceRecords, now time.Time) (*Zone, error) {
+	var resignAt time.Time
+	if z.signer != nil {
+		var err error
+		if records, resignAt, err = z.signer.sign(z.Origin, records, z, now); err != nil {
+			return nil, err
+		}
+	}
+	next, err := New(z.Origin, records)
+	if err != nil {
+		return nil, err
+	}
+	next.signer = z.signer
+	next.resignAt = resignAt
+	next.AllowTransfer = z.AllowTransfer
+	next.Notify = z.Notify
+	next.AllowUpdate = z.AllowUpdate
+	next.TransferKeys = z.TransferKeys
+	next.UpdateKeys = z.UpdateKeys
+	next.Key = z.Key
+	next.journalFile = z.journalFile
+	next.journalLen = z.journalLen
+	return next, nil
+}
+
+func (z *Zone) lookup(name dnsmessage.DomainName) *node {
+	return z.nodes[nameKey(name)]
+}
+
+// Records returns all records of the zone, the SOA first.
+func (z *Zone) Records() dnsmessage.ResourceRecords {
+	return z.records
+}
+
+// SOA returns the SOA record of the zone.
+func (z *Zone) SOA() *dnsmessage.ResourceRecord {
+	return z.records[0]
+}
+
+// Serial returns the serial number of the SOA record.
+func (z *Zone) Serial() uint32 {
+	return serial(z.SOA())
+}
+
+// Lookup answers the question from the zone (RFC 1034, section 4.3.2).
+// The name has to be within the zone.
+func (z *Zone) Lookup(q *dnsmessage.Question) *Answer {
+	return z.answer(q, false)
+}
+
+// LookupDNSSEC answers like Lookup, with the signatures and the proofs of
+// nonexistence if the zone is signed (RFC 4035, section 3.1).
+func (z *Zone) LookupDNSSEC(q *dnsmessage.Question) *Answer {
+	return z.answer(q, true)
+}
+
+func (z *Zone) answer(q *dnsmessage.Question, dnssec bool) *Answer {
+	a := &Answer{RCode: dnsmessage.RCodeNoError, Authoritative: true}
+	name := q.QName
+
+	for range maxCNAMEs {
+		if cut := z.zoneCut(name, q.QType); cut != nil {
+			// the answers of a CNAME chain stay, the referral is for the target
+			a.Authoritative = len(a.Answers) > 0
+			a.Authority = cut.rrsets[dnsmessage.TypeNS]
+			a.Additional = z.glue(a.Authority)
+			if dnssec {
+				a.Authority = append(slices.Clone(a.Authority), z.delegation(cut)...)
+			}
+			return a
+		}
+
+		n := z.lookup(name)
+		if n == nil {
+			n = z.wildcard(name)
+		}
+		if n == nil {
+			// also at the end of a CNAME chain (RFC 6604, section 2.1)
+			a.RCode = dnsmessage.RCodeNameError
+			a.Authority = z.negative()
+			if dnssec {
+				a.Authority = append(a.Authority, z.signatures(z.Origin, dnsmessage.TypeSOA)...)
+				a.Authority = append(a.Authority, z.noName(name)...)
+			}
+			return a
+		}
+
+		if rrset := n.rrsets[q.QType]; len(rrset) > 0 {
+			a.Answers = append(a.Answers, synthesize(rrset, name)...)
+			a.Additional = z.additional(q.QType, rrset)
+			if dnssec {
+				a.Answers = append(a.Answers, synthesize(z.signatures(n.name, q.QType), name)...)
+				a.Authority = append(a.Authority, z.expanded(n, name)...)
+			}
+			return a
+		}
+
+		cname := synthesize(n.rrsets[dnsmessage.TypeCNAME], name)
+		if len(cname) == 0 {
+			// the name exists but has no records of the type
+			a.Authority = z.negative()
+			if dnssec {
+				a.Authority = append(a.Authority, z.signatures(z.Origin, dnsmessage.TypeSOA)...)
+				a.Authority = append(a.Authority, z.noData(n, name)...)
+			}
+			return a
+		}
+		a.Answers = append(a.Answers, cname...)
+		if dnssec {
+			a.Answers = append(a.Answers, synthesize(z.signatures(n.name, dnsmessage.TypeCNAME), name)...)
+			a.Authority = append(a.Authority, z.expanded(n, name)...)
+		}
+		target, _, err := dnsmessage.UnpackDomainName(cname[0].RData)
+		if err != nil || !dnsmessage.IsSubdomain(target, z.Origin) {
+			// the resolver follows names in other zones itself
+			return a
+		}
+		if slices.ContainsFunc(a.Answers, func(rr *dnsmessage.ResourceRecord) bool { return dnsmessage.EqualNames(rr.Name, target) }) {
+			// a loop, the chain is complete
+			return a
+		}
+		name = target
+	}
+	return a
+}
+
+// wildcard returns the node of the wildcard at the closest encloser of a
+// name that doesn't exist (RFC 4592, section 3.3.1). The closest encloser
+// may be an empty non-terminal, a wildcard further up doesn't match then.
+func (z *Zone) wildcard(name dnsmessage.DomainName) *node {
+	for i := 1; i <= len(name)-len(z.Origin); i++ {
+		if z.lookup(name[i:]) != nil {
+			return z.lookup(append(dnsmessage.DomainName{[]byte("*")}, name[i:]...))
+		}
+	}
+	return nil
+}
+
+// synthesize returns the records with the name as owner
+// if they come from a wildcard (RFC 4592, section 4.1).
+func synthesize(rrset dnsmessage.ResourceRecords, name dnsmessage.DomainName) dnsmessage.ResourceRecords {
+	if len(rrset) == 0 || dnsmessage.EqualNames(rrset[0].Name, name) {
+		return rrset
+	}
+	synthesized := make(dnsmessage.ResourceRecords, len(rrset))
+	for i, rr := range rrset {
+		rr := *rr
+		rr.Name = name
+		synthesized[i] = &rr
+	}
+	return synthesized
+}
+
+// zoneCut returns the node delegating the name to another zone if there is
+// one between the origin and the name. The DS records of a delegated zone
+// belong to its parent, so a DS query for the cut itself is answered here.
+func (z *Zone) zoneCut(name dnsmessage.DomainName, qtype dnsmessage.RRType) *node {
+	for i := len(name) - len(z.Origin) - 1; i >= 0; i-- {
+		if i == 0 && qtype == dnsmessage.TypeDS {
+			return nil
+		}
+		n := z.lookup(name[i:])
+		if n == nil {
+			return nil
+		}
+		if len(n.rrsets[dnsmessage.TypeNS]) > 0 {
+			return n
+		}
+	}
+	return nil
+}
+
+// negative returns the SOA for the authority section of a negative answer
+// with the TTL negative answers may be cached for (RFC 2308, section 3).
+func (z *Zone) negative() dnsmessage.ResourceRecords {
+	soa := *z.SOA()
+	if s, err := dnsmessage.UnpackSOA(soa.RData); err == nil {
+		soa.TTL = min(soa.TTL, s.Minimum)
+	}
+	return dnsmessage.ResourceRecords{&soa}
+}
+
+// additional returns the addresses of the names the answer refers to.
+func (z *Zone) additional(qtype dnsmessage.RRType, rrset dnsmessage.ResourceRecords) dnsmessage.ResourceRecords {
+	switch qtype {
+	case dnsmessage.TypeNS:
+		return z.glue(rrset)
+	case dnsmessage.TypeMX:
+		var additional dnsmessage.ResourceRecords
+		for _, rr := range rrset {
+			if len(rr.RData) > 2 {
+				additional = append(additional, z.addresses(rr.RData[2:])...)
+			}
+		}
+		return additional
+	}
+	return nil
+}
+
+// glue returns the addresses of the name servers that are within the zone.
+func (z *Zone) glue(ns dnsmessage.ResourceRecords) dnsmessage.ResourceRecords {
+	var additional dnsmessage.ResourceRecords
+	for _, rr := range ns {
+		additional = append(additional, z.addresses(rr.RData)...)
+	}
+	return additional
+}
+
+func (z *Zone) addresses(rdata []byte) dnsmessage.ResourceRecords {
+	target, _, err := dnsmessage.UnpackDomainName(rdata)
+	if err != nil {
+		return nil
+	}
+	n := z.lookup(target)
+	if n == nil {
+		return nil
+	}
+	return append(slices.Clone(n.rrsets[dnsmessage.TypeA]), n.rrsets[dnsmessage.TypeAAAA]...)
+}
+
+// nameKey is the name in wire format in lower case, labels may contain dots.
+func nameKey(name dnsmessage.DomainName) string {
+	b := dnsmessage.PackDomainName(name)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+func nameString(name dnsmessage.DomainName) string {
+	return dnsmessage.DomainNameToString(name) + "."
+}
@@ -0,0 +1,271 @@
+package zone
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"server/pkg/dnsmessage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const exampleZone = `$ORIGIN example.
+$TTL 3600
+@	SOA	ns1 hostmaster 1 7200 1800 1209600 300
+	NS	ns1
+	NS	ns.other.
+	MX	10 mail
+ns1	A	192.0.2.53
+	AAAA	2001:db8::53
+mail	A	192.0.2.25
+www	A	192.0.2.80
+alias	CNAME	www
+chain	CNAME	alias
+dangling	CNAME	nowhere
+outside	CNAME	www.other.
+toreferral	CNAME	host.sub
+a.b.c	TXT	"deep"
+sub	NS	ns.sub
+	DS	12345 13 2 3B8F0A6E
+ns.sub	A	192.0.2.54
+loop1	CNAME	loop2
+loop2	CNAME	loop1
+*.wild	A	192.0.2.1
+	MX	10 mail
+x.y.wild	A	192.0.2.2
+*.cwild	CNAME	www
+`
+
+func loadExample(t *testing.T) *Zone {
+	records, err := Parse(strings.NewReader(exampleZone), "example.zone", nil)
+	require.NoError(t, err)
+	z, err := New(dnsmessage.ParseDomainName("example."), records)
+	require.NoError(t, err)
+	return z
+}
+
+// section formats records as "name type rdata" lines.
+func section(records dnsmessage.ResourceRecords) []string {
+	var lines []string
+	for _, rr := range records {
+		lines = append(lines, dnsmessage.DomainNameToString(rr.Name)+" "+rr.Type.String()+" "+rr.RDataString())
+	}
+	return lines
+}
+
+func TestLookup(t *testing.T) {
+	z := loadExample(t)
+	soa := []string{"example SOA ns1.example. hostmaster.example. 1 7200 1800 1209600 300"}
+
+	tests := []struct {
+		name       string
+		qname      string
+		qtype      dnsmessage.RRType
+		rcode      dnsmessage.RCode
+		aa         bool
+		answers    []string
+		authority  []string
+		additional []string
+	}{
+		{
+			name: "exact", qname: "WWW.example", qtype: dnsmessage.TypeA, aa: true,
+			answers: []string{"www.example A 192.0.2.80"},
+		},
+		{
+			name: "apex NS", qname: "example", qtype: dnsmessage.TypeNS, aa: true,
+			answers:    []string{"example NS ns1.example.", "example NS ns.other."},
+			additional: []string{"ns1.example A 192.0.2.53", "ns1.example AAAA 2001:db8::53"},
+		},
+		{
+			name: "MX", qname: "example", qtype: dnsmessage.TypeMX, aa: true,
+			answers:    []string{"example MX 10 mail.example."},
+			additional: []string{"mail.example A 192.0.2.25"},
+		},
+		{
+			name: "CNAME chain", qname: "chain.example", qtype: dnsmessage.TypeA, aa: true,
+			answers: []string{"chain.example CNAME alias.example.", "alias.example CNAME www.example.", "www.example A 192.0.2.80"},
+		},
+		{
+			name: "CNAME query", qname: "alias.example", qtype: dnsmessage.TypeCNAME, aa: true,
+			answers: []string{"alias.example CNAME www.example."},
+		},
+		{
+			name: "CNAME to nothing", qname: "dangling.example", qtype: dnsmessage.TypeA, rcode: dnsmessage.RCodeNameError, aa: true,
+			answers: []string{"dangling.example CNAME nowhere.example."}, authority: soa,
+		},
+		{
+			name: "CNAME to another zone", qname: "outside.example", qtype: dnsmessage.TypeA, aa: true,
+			answers: []string{"outside.example CNAME www.other."},
+		},
+		{
+			name: "CNAME loop", qname: "loop1.example", qtype: dnsmessage.TypeA, aa: true,
+			answers: []string{"loop1.example CNAME loop2.example.", "loop2.example CNAME loop1.example."},
+		},
+		{
+			name: "NODATA", qname: "www.example", qtype: dnsmessage.TypeAAAA, aa: true,
+			authority: soa,
+		},
+		{
+			name: "empty non-terminal", qname: "b.c.example", qtype: dnsmessage.TypeA, aa: true,
+			authority: soa,
+		},
+		{
+			name: "NXDOMAIN", qname: "missing.example", qtype: dnsmessage.TypeA, rcode: dnsmessage.RCodeNameError, aa: true,
+			authority: soa,
+		},
+		{
+			name: "wildcard", qname: "host.wild.example", qtype: dnsmessage.TypeA, aa: true,
+			answers: []string{"host.wild.example A 192.0.2.1"},
+		},
+		{
+			name: "wildcard several labels down", qname: "a.b.wild.example", qtype: dnsmessage.TypeA, aa: true,
+			answers: []string{"a.b.wild.example A 192.0.2.1"},
+		},
+		{
+			name: "wildcard MX", qname: "host.wild.example", qtype: dnsmessage.TypeMX, aa: true,
+			answers:    []string{"host.wild.example MX 10 mail.example."},
+			additional: []string{"mail.example A 192.0.2.25"},
+		},
+		{
+			name: "wildcard NODATA", qname: "host.wild.example", qtype: dnsmessage.TypeAAAA, aa: true,
+			authority: soa,
+		},
+		{
+			name: "wildcard owner", qname: "*.wild.example", qtype: dnsmessage.TypeA, aa: true,
+			answers: []string{"*.wild.example A 192.0.2.1"},
+		},
+		{
+			name: "name below the wildcard", qname: "x.y.wild.example", qtype: dnsmessage.TypeA, aa: true,
+			answers: []string{"x.y.wild.example A 192.0.2.2"},
+		},
+		{
+			name: "empty non-terminal instead of the wildcard", qname: "y.wild.example", qtype: dnsmessage.TypeA, aa: true,
+			authority: soa,
+		},
+		{
+			name: "closest encloser without wildcard", qname: "z.y.wild.example", qtype: dnsmessage.TypeA, rcode: dnsmessage.RCodeNameError, aa: true,
+			authority: soa,
+		},
+		{
+			name: "wildcard CNAME", qname: "host.cwild.example", qtype: dnsmessage.TypeA, aa: true,
+			answers: []string{"host.cwild.example CNAME www.example.", "www.example A 192.0.2.80"},
+		},
+		{
+			name: "referral", qname: "www.sub.example", qtype: dnsmessage.TypeA,
+			authority:  []string{"sub.example NS ns.sub.example."},
+			additional: []string{"ns.sub.example A 192.0.2.54"},
+		},
+		{
+			name: "referral at the cut", qname: "sub.example", qtype: dnsmessage.TypeNS,
+			authority:  []string{"sub.example NS ns.sub.example."},
+			additional: []string{"ns.sub.example A 192.0.2.54"},
+		},
+		{
+			name: "DS of the child", qname: "sub.example", qtype: dnsmessage.TypeDS, aa: true,
+			answers: []string{"sub.example DS 12345 13 2 3B8F0A6E"},
+		},
+		{
+			name: "CNAME into a delegation", qname: "toreferral.example", qtype: dnsmessage.TypeA, aa: true,
+			answers:    []string{"toreferral.example CNAME host.sub.example."},
+			authority:  []string{"sub.example NS ns.sub.example."},
+			additional: []string{"ns.sub.example A 192.0.2.54"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := z.Lookup(&dnsmessage.Question{QName: dnsmessage.ParseDomainName(tt.qname), QType: tt.qtype, QClass: dnsmessage.ClassIN})
+			assert.Equal(t, tt.rcode, a.RCode)
+			assert.Equal(t, tt.aa, a.Authoritative)
+			assert.Equal(t, tt.answers, section(a.Answers))
+			assert.Equal(t, tt.authority, section(a.Authority))
+			assert.Equal(t, tt.additional, section(a.Additional))
+		})
+	}
+}
+
+func TestLookupNegativeTTL(t *testing.T) {
+	z := loadExample(t)
+	a := z.Lookup(&dnsmessage.Question{QName: dnsmessage.ParseDomainName("missing.example"), QType: dnsmessage.TypeA})
+	require.Len(t, a.Authority, 1)
+	assert.Equal(t, uint32(300), a.Authority[0].TTL)
+	// the zone itself keeps its TTL
+	assert.Equal(t, uint32(3600), z.SOA().TTL)
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := map[string]string{
+		"no SOA":          "@ NS ns1\n",
+		"no NS":           "@ SOA ns1 host 1 2 3 4 5\n",
+		"two SOAs":        "@ SOA ns1 host 1 2 3 4 5\n@ SOA ns1 host 2 2 3 4 5\n@ NS ns1\n",
+		"SOA below":       "@ SOA ns1 host 1 2 3 4 5\n@ NS ns1\nsub SOA ns1 host 1 2 3 4 5\n",
+		"outside":         "@ SOA ns1 host 1 2 3 4 5\n@ NS ns1\nwww.other. A 192.0.2.1\n",
+		"CNAME and other": "@ SOA ns1 host 1 2 3 4 5\n@ NS ns1\nwww CNAME x\nwww A 192.0.2.1\n",
+		"two CNAMEs":      "@ SOA ns1 host 1 2 3 4 5\n@ NS ns1\nwww CNAME x\nwww CNAME y\n",
+	}
+	for name, records := range tests {
+		t.Run(name, func(t *testing.T) {
+			rrs, err := Parse(strings.NewReader("$ORIGIN example.\n$TTL 60\n"+records), "test.zone", nil)
+			require.NoError(t, err)
+			_, err = New(dnsmessage.ParseDomainName("example."), rrs)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestStore(t *testing.T) {
+	s := NewStore()
+	example := loadExample(t)
+	s.Add(example)
+
+	records, err := Parse(strings.NewReader("$TTL 60\n@ SOA ns host 1 2 3 4 5\n@ NS ns\nwww A 192.0.2.1\n"), "sub.zone", dnsmessage.ParseDomainName("sub.example."))
+	require.NoError(t, err)
+	sub, err := New(dnsmessage.ParseDomainName("sub.example."), records)
+	require.NoError(t, err)
+	s.Add(sub)
+
+	assert.Same(t, sub, s.Find(dnsmessage.ParseDomainName("www.SUB.example")))
+	assert.Same(t, example, s.Find(dnsmessage.ParseDomainName("www.example")))
+	assert.Nil(t, s.Find(dnsmessage.ParseDomainName("www.other")))
+	assert.Same(t, sub, s.Get(dnsmessage.ParseDomainName("sub.example")))
+
+	a := s.Answer(&dnsmessage.Question{QName: dnsmessage.ParseDomainName("www.sub.example"), QType: dnsmessage.TypeA, QClass: dnsmessage.ClassIN}, false)
+	assert.True(t, a.Authoritative)
+	assert.Equal(t, []string{"www.sub.example A 192.0.2.1"}, section(a.Answers))
+
+	a = s.Answer(&dnsmessage.Question{QName: dnsmessage.ParseDomainName("www.other"), QType: dnsmessage.TypeA, QClass: dnsmessage.ClassIN}, false)
+	assert.Equal(t, dnsmessage.RCodeRefused, a.RCode)
+	assert.False(t, a.Authoritative)
+
+	a = s.Answer(&dnsmessage.Question{QName: dnsmessage.ParseDomainName("www.example"), QType: dnsmessage.TypeA, QClass: dnsmessage.ClassCH}, false)
+	assert.Equal(t, dnsmessage.RCodeRefused, a.RCode)
+
+	// the wildcard of example has the address too
+	assert.Equal(t, []string{"www.sub.example A 192.0.2.1"}, section(s.Hosts(netip.MustParseAddr("192.0.2.1"))))
+
+	// a zone with the same origin replaces the old one
+	s.Add(example)
+	assert.Same(t, example, s.Get(dnsmessage.ParseDomainName("example")))
+	assert.Same(t, sub, s.Get(dnsmessage.ParseDomainName("sub.example")))
+}
+
+func TestHosts(t *testing.T) {
+	z := loadExample(t)
+	tests := []struct {
+		addr  string
+		hosts []string
+	}{
+		{addr: "192.0.2.80", hosts: []string{"www.example A 192.0.2.80"}},
+		{addr: "2001:db8::53", hosts: []string{"ns1.example AAAA 2001:db8::53"}},
+		{addr: "::ffff:192.0.2.53", hosts: []string{"ns1.example A 192.0.2.53"}},
+		{addr: "192.0.2.2", hosts: []string{"x.y.wild.example A 192.0.2.2"}},
+		// wildcards and glue
+		{addr: "192.0.2.1"},
+		{addr: "192.0.2.54"},
+		{addr: "192.0.2.99"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.hosts, section(z.Hosts(netip.MustParseAddr(tt.addr))), tt.addr)
+	}
+}